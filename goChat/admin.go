@@ -0,0 +1,634 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Admin endpoints live under /api/v1/admin/ and the admin page at /admin.
+// Both use HTTP Basic auth with the credentials of a user that has
+// IsAdmin set; promote the first admin with gochat-admin promote-admin.
+
+// AdminUser is a user as shown to admins, without the password
+type AdminUser struct {
+	UserId            string `json:"userId"`
+	Email             string `json:"email,omitempty"`
+	EmailVerified     bool   `json:"emailVerified,omitempty"`
+	IsAdmin           bool   `json:"isAdmin,omitempty"`
+	IsBot             bool   `json:"isBot,omitempty"`
+	BotOwner          string `json:"botOwner,omitempty"`
+	Disabled          bool   `json:"disabled,omitempty"`
+	MustResetPassword bool   `json:"mustResetPassword,omitempty"`
+	TOTPEnabled       bool   `json:"totpEnabled,omitempty"`
+	Messages          int    `json:"messages"` // Sent or received, not counting the archive
+}
+
+// StorageStats describes the data files
+type StorageStats struct {
+	Users            int              `json:"users"`
+	Admins           int              `json:"admins"`
+	Bots             int              `json:"bots"`
+	DisabledUsers    int              `json:"disabledUsers"`
+	Messages         int              `json:"messages"`
+	ArchivedMessages int              `json:"archivedMessages"`
+	ArchiveSegments  int              `json:"archiveSegments"`
+	ScheduledPending int              `json:"scheduledPending"`
+	EncryptionKey    string           `json:"encryptionKey,omitempty"` // ID of the key encrypting new messages, if any
+	Files            map[string]int64 `json:"files"`                   // Size in bytes by file name
+	TotalBytes       int64            `json:"totalBytes"`
+}
+
+// ChangePasswordRequest struct for users changing their own password
+type ChangePasswordRequest struct {
+	UserId      string `json:"userId"`
+	Password    string `json:"password"`
+	NewPassword string `json:"newPassword"`
+}
+
+// Data files included in the storage stats, besides the archive directory
+var dataFiles = []string{
+	"users.json", "chats.json", "chats.log", "recentChats.json", "scheduled.json",
+	"conversations.json", "retention.json", "webhooks.json", "bot_tokens.json",
+	"webhook_deadletter.jsonl", "bot_audit.jsonl", "e2e_keys.json", "sessions.json",
+	"changes.jsonl", "contacts.json", "account_tokens.json",
+}
+
+// Check HTTP Basic credentials against the admin users. A temporary
+// password from a reset doesn't count, and admins with 2FA must also have a
+// session of their own from a login that passed it. Returns the admin's
+// user ID, or writes a 401 and returns false.
+func authenticateAdmin(w http.ResponseWriter, r *http.Request) (string, bool) {
+	userId, password, ok := r.BasicAuth()
+	if ok {
+		user, exists, err := findUser(userId)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "internal_error", "Error reading users.json: "+err.Error(), "")
+			return "", false
+		}
+		if exists && user.IsAdmin && !user.Disabled && !user.IsBot &&
+			subtle.ConstantTimeCompare([]byte(user.Password), []byte(password)) == 1 {
+			if user.MustResetPassword {
+				writeError(w, http.StatusUnauthorized, "password_reset_required", "Change the temporary password before using the admin API", "")
+				return "", false
+			}
+			if session, ok := requestSession(r); user.TOTPEnabled && (!ok || session.UserId != user.UserId || !session.SecondFactor) {
+				writeError(w, http.StatusUnauthorized, "second_factor_required", "Log in with your two-factor code before using the admin API", "")
+				return "", false
+			}
+			return user.UserId, true
+		}
+		fmt.Println("Admin authentication failed for:", userId)
+	}
+
+	w.Header().Set("WWW-Authenticate", `Basic realm="goChat admin", charset="UTF-8"`)
+	writeError(w, http.StatusUnauthorized, "admin_required", "Admin credentials required", "")
+	return "", false
+}
+
+// Wrap a handler so only admins can reach it
+func adminOnly(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		adminId, ok := authenticateAdmin(w, r)
+		if !ok {
+			return
+		}
+		fmt.Printf("Admin %s: %s %s\n", adminId, r.Method, r.URL.Path)
+		handler(w, r)
+	}
+}
+
+// Serve the admin page
+func serveAdmin(w http.ResponseWriter, r *http.Request) {
+	http.ServeFile(w, r, "templates/admin.html")
+}
+
+// Look up the user named in ?user= for an admin action. Admins can't act
+// on their own account so they can't lock themselves out.
+func adminTargetUser(w http.ResponseWriter, r *http.Request) (string, bool) {
+	userId := r.URL.Query().Get("user")
+	if userId == "" {
+		writeError(w, http.StatusBadRequest, "missing_parameter", "User ID is required", "user")
+		return "", false
+	}
+	if adminId, _, _ := r.BasicAuth(); adminId == userId {
+		writeError(w, http.StatusBadRequest, "invalid_field", "Admins can't do this to their own account", "user")
+		return "", false
+	}
+	if !requireUser(w, userId, "user") {
+		return "", false
+	}
+	return userId, true
+}
+
+// Apply change to one user in users.json. The whole read-modify-write
+// runs under usersMu, so change sees the latest state of the user.
+func updateUser(userId string, change func(user *User)) error {
+	usersMu.Lock()
+	defer usersMu.Unlock()
+	usersData, err := loadUsers()
+	if err != nil {
+		return err
+	}
+	for i := range usersData.Users {
+		if usersData.Users[i].UserId == userId {
+			change(&usersData.Users[i])
+			return saveUsers(usersData)
+		}
+	}
+	return fmt.Errorf("user %s does not exist", userId)
+}
+
+// Handler for listing every account
+func adminListUsers(w http.ResponseWriter, r *http.Request) {
+	usersData, err := loadUsers()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error reading users.json: "+err.Error(), "")
+		return
+	}
+	storeMu.Lock()
+	chatsData, err := loadChats()
+	storeMu.Unlock()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error reading chats.json: "+err.Error(), "")
+		return
+	}
+
+	counts := map[string]int{}
+	for _, message := range chatsData.Messages {
+		counts[message.Sender]++
+		if message.Receiver != message.Sender {
+			counts[message.Receiver]++
+		}
+	}
+
+	users := make([]AdminUser, 0, len(usersData.Users))
+	for _, user := range usersData.Users {
+		users = append(users, AdminUser{
+			UserId:            user.UserId,
+			Email:             user.Email,
+			EmailVerified:     user.EmailVerified,
+			IsAdmin:           user.IsAdmin,
+			IsBot:             user.IsBot,
+			BotOwner:          user.BotOwner,
+			Disabled:          user.Disabled,
+			MustResetPassword: user.MustResetPassword,
+			TOTPEnabled:       user.TOTPEnabled,
+			Messages:          counts[user.UserId],
+		})
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].UserId < users[j].UserId })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"users":   users,
+	})
+}
+
+// Handler for disabling an account. Disabled users can't log in or send
+// and are logged out of every device. The tokens of a disabled bot, or of
+// the bots a disabled user owns, are revoked.
+func adminDisableUser(w http.ResponseWriter, r *http.Request) {
+	setUserDisabled(w, r, true)
+}
+
+// Handler for enabling a disabled account
+func adminEnableUser(w http.ResponseWriter, r *http.Request) {
+	setUserDisabled(w, r, false)
+}
+
+func setUserDisabled(w http.ResponseWriter, r *http.Request, disabled bool) {
+	userId, ok := adminTargetUser(w, r)
+	if !ok {
+		return
+	}
+	if err := updateUser(userId, func(user *User) { user.Disabled = disabled }); err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error updating users.json: "+err.Error(), "")
+		return
+	}
+	if disabled {
+		if _, err := revokeUserSessions(map[string]bool{userId: true}); err != nil {
+			writeError(w, http.StatusInternalServerError, "internal_error", "Error writing to sessions.json: "+err.Error(), "")
+			return
+		}
+		if _, err := revokeBotTokens(map[string]bool{userId: true}); err != nil {
+			writeError(w, http.StatusInternalServerError, "internal_error", "Error writing to bot_tokens.json: "+err.Error(), "")
+			return
+		}
+	}
+
+	fmt.Printf("User %s disabled: %v\n", userId, disabled)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{"success": true})
+}
+
+// Handler for forcing a password reset. The account gets a temporary
+// password, returned once, that must be changed at the next login. Every
+// device is logged out.
+func adminResetPassword(w http.ResponseWriter, r *http.Request) {
+	userId, ok := adminTargetUser(w, r)
+	if !ok {
+		return
+	}
+
+	temporary := randomHex(6) + "A1" // Satisfies the letter-and-digit policy
+	err := updateUser(userId, func(user *User) {
+		user.Password = temporary
+		user.MustResetPassword = true
+	})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error updating users.json: "+err.Error(), "")
+		return
+	}
+	if _, err := revokeUserSessions(map[string]bool{userId: true}); err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error writing to sessions.json: "+err.Error(), "")
+		return
+	}
+
+	fmt.Println("Password reset forced for:", userId)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":           true,
+		"temporaryPassword": temporary,
+	})
+}
+
+// Handler for deleting an account with all of its messages, including
+// archived ones, and everything else that refers to it. Bots owned by the
+// account are deleted with it.
+func adminDeleteUser(w http.ResponseWriter, r *http.Request) {
+	userId, ok := adminTargetUser(w, r)
+	if !ok {
+		return
+	}
+
+	usersData, err := loadUsers()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error reading users.json: "+err.Error(), "")
+		return
+	}
+	deleted := map[string]bool{userId: true}
+	for _, user := range usersData.Users {
+		if user.IsBot && user.BotOwner == userId {
+			deleted[user.UserId] = true
+		}
+	}
+
+	// The accounts go last, so a failure part way leaves them in place and
+	// the deletion can simply be retried
+	messages, err := purgeUserData(deleted)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error deleting user data: "+err.Error(), "")
+		return
+	}
+	if err := removeUsers(deleted); err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error writing to users.json: "+err.Error(), "")
+		return
+	}
+	avatarsMu.Lock()
+	err = pruneAvatars()
+	avatarsMu.Unlock()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error removing avatars: "+err.Error(), "")
+		return
+	}
+
+	fmt.Printf("Deleted user %s (%d accounts, %d messages)\n", userId, len(deleted), messages)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":         true,
+		"deletedUsers":    len(deleted),
+		"deletedMessages": messages,
+	})
+}
+
+// Remove the given accounts from users.json
+func removeUsers(users map[string]bool) error {
+	usersMu.Lock()
+	defer usersMu.Unlock()
+	usersData, err := loadUsers()
+	if err != nil {
+		return err
+	}
+	remaining := []User{}
+	for _, user := range usersData.Users {
+		if !users[user.UserId] {
+			remaining = append(remaining, user)
+		}
+	}
+	usersData.Users = remaining
+	return saveUsers(usersData)
+}
+
+// Remove the given users' messages and settings from every data file.
+// Returns the number of messages removed.
+func purgeUserData(users map[string]bool) (int, error) {
+	involves := func(a, b string) bool { return users[a] || users[b] }
+
+	storeMu.Lock()
+	chatsData, err := loadChats()
+	if err != nil {
+		storeMu.Unlock()
+		return 0, err
+	}
+	kept := []Message{}
+	for _, message := range chatsData.Messages {
+		if !involves(message.Sender, message.Receiver) {
+			kept = append(kept, message)
+		}
+	}
+	removed := len(chatsData.Messages) - len(kept)
+	chatsData.Messages = kept
+	if err := saveChats(chatsData); err != nil {
+		storeMu.Unlock()
+		return removed, err
+	}
+
+	recentChatsData, err := currentRecentChats()
+	if err == nil {
+		chats := []RecentChat{}
+		for _, chat := range recentChatsData.Chats {
+			if !involves(chat.UserId, chat.ContactId) {
+				chats = append(chats, chat)
+			}
+		}
+		recentChatsData.Chats = chats
+		err = saveRecentChats(recentChatsData)
+	}
+	storeMu.Unlock()
+	if err != nil {
+		return removed, err
+	}
+
+	archived, err := purgeArchivedMessages(users)
+	removed += archived
+	if err != nil {
+		return removed, err
+	}
+
+	scheduledMu.Lock()
+	scheduledData, err := loadScheduled()
+	if err == nil {
+		pending := []ScheduledMessage{}
+		for _, scheduled := range scheduledData.Messages {
+			if !involves(scheduled.Sender, scheduled.Receiver) {
+				pending = append(pending, scheduled)
+			}
+		}
+		scheduledData.Messages = pending
+		err = saveScheduled(scheduledData)
+	}
+	scheduledMu.Unlock()
+	if err != nil {
+		return removed, err
+	}
+
+	conversationsMu.Lock()
+	conversationsData, err := loadConversations()
+	if err == nil {
+		conversations := []ConversationSettings{}
+		for _, settings := range conversationsData.Conversations {
+			if !involves(settings.Users[0], settings.Users[1]) {
+				conversations = append(conversations, settings)
+			}
+		}
+		conversationsData.Conversations = conversations
+		err = saveConversations(conversationsData)
+	}
+	conversationsMu.Unlock()
+	if err != nil {
+		return removed, err
+	}
+
+	retentionMu.Lock()
+	config, err := loadRetention()
+	if err == nil {
+		overrides := []UserRetention{}
+		for _, override := range config.Users {
+			if !users[override.UserId] {
+				overrides = append(overrides, override)
+			}
+		}
+		config.Users = overrides
+		err = saveRetention(config)
+	}
+	retentionMu.Unlock()
+	if err != nil {
+		return removed, err
+	}
+
+	webhooksMu.Lock()
+	webhooksData, err := loadWebhooks()
+	if err == nil {
+		hooks := []Webhook{}
+		for _, hook := range webhooksData.Webhooks {
+			if !involves(strings.TrimPrefix(hook.Owner, adminWebhookPrefix), hook.UserId) {
+				hooks = append(hooks, hook)
+			}
+		}
+		webhooksData.Webhooks = hooks
+		err = saveWebhooks(webhooksData)
+	}
+	webhooksMu.Unlock()
+	if err != nil {
+		return removed, err
+	}
+
+	botTokensMu.Lock()
+	tokensData, err := loadBotTokens()
+	if err == nil {
+		tokens := []BotToken{}
+		for _, token := range tokensData.Tokens {
+			if !involves(token.Owner, token.BotId) {
+				tokens = append(tokens, token)
+			}
+		}
+		tokensData.Tokens = tokens
+		err = saveBotTokens(tokensData)
+	}
+	botTokensMu.Unlock()
+	if err != nil {
+		return removed, err
+	}
+
+	e2eKeysMu.Lock()
+	keysData, err := loadE2EKeys()
+	if err == nil {
+		devices := []DeviceKeys{}
+		for _, device := range keysData.Devices {
+			if !users[device.UserId] {
+				devices = append(devices, device)
+			}
+		}
+		keysData.Devices = devices
+		err = saveE2EKeys(keysData)
+	}
+	e2eKeysMu.Unlock()
+	if err != nil {
+		return removed, err
+	}
+
+	if err := purgeContacts(users); err != nil {
+		return removed, err
+	}
+
+	if err := revokeAccountTokens(users, ""); err != nil {
+		return removed, err
+	}
+
+	storeMu.Lock()
+	err = purgeChangeLog(users)
+	storeMu.Unlock()
+	if err != nil {
+		return removed, err
+	}
+
+	_, err = revokeUserSessions(users)
+	return removed, err
+}
+
+// Handler for storage statistics
+func adminStats(w http.ResponseWriter, r *http.Request) {
+	stats := StorageStats{Files: map[string]int64{}, EncryptionKey: activeKeyID()}
+
+	usersData, err := loadUsers()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error reading users.json: "+err.Error(), "")
+		return
+	}
+	for _, user := range usersData.Users {
+		stats.Users++
+		if user.IsAdmin {
+			stats.Admins++
+		}
+		if user.IsBot {
+			stats.Bots++
+		}
+		if user.Disabled {
+			stats.DisabledUsers++
+		}
+	}
+
+	storeMu.Lock()
+	chatsData, err := loadChats()
+	storeMu.Unlock()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error reading chats.json: "+err.Error(), "")
+		return
+	}
+	stats.Messages = len(chatsData.Messages)
+
+	archiveMu.Lock()
+	index, err := loadArchiveIndex()
+	archiveMu.Unlock()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error reading archive index: "+err.Error(), "")
+		return
+	}
+	stats.ArchiveSegments = len(index.Segments)
+	for _, segment := range index.Segments {
+		stats.ArchivedMessages += segment.Count
+	}
+
+	scheduledMu.Lock()
+	scheduledData, err := loadScheduled()
+	scheduledMu.Unlock()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error reading scheduled.json: "+err.Error(), "")
+		return
+	}
+	stats.ScheduledPending = len(scheduledData.Messages)
+
+	for _, name := range dataFiles {
+		if info, err := os.Stat(name); err == nil {
+			stats.Files[name] = info.Size()
+			stats.TotalBytes += info.Size()
+		}
+	}
+	filepath.Walk(archiveDir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			stats.Files[archiveDir] += info.Size()
+			stats.TotalBytes += info.Size()
+		}
+		return nil
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"stats":   stats,
+	})
+}
+
+// Handler for users changing their own password, including after a
+// forced reset. Every other device of the user is logged out.
+func changePassword(w http.ResponseWriter, r *http.Request) {
+	var req ChangePasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_json", "Invalid JSON: "+err.Error(), "")
+		return
+	}
+
+	user, exists, err := findUser(req.UserId)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error reading users.json: "+err.Error(), "")
+		return
+	}
+	if !exists || user.IsBot || user.Disabled || subtle.ConstantTimeCompare([]byte(user.Password), []byte(req.Password)) != 1 {
+		writeError(w, http.StatusUnauthorized, "invalid_credentials", "Invalid username or password", "")
+		return
+	}
+
+	var errs ValidationErrors
+	validatePassword(req.NewPassword, req.UserId, &errs)
+	if req.NewPassword == req.Password {
+		errs.add("password", "The new password must be different")
+	}
+	if len(errs) > 0 {
+		for i := range errs {
+			errs[i].Field = "newPassword"
+		}
+		writeValidationErrors(w, errs)
+		return
+	}
+
+	err = updateUser(req.UserId, func(user *User) {
+		user.Password = req.NewPassword
+		user.MustResetPassword = false
+	})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error updating users.json: "+err.Error(), "")
+		return
+	}
+
+	// The session making the request, if it is the user's, stays logged in
+	current := ""
+	if token := sessionToken(r); token != "" {
+		if session, exists, err := findSession(token); err == nil && exists && session.UserId == req.UserId {
+			current = session.Id
+		}
+	}
+	_, err = revokeSessions(func(session Session) bool {
+		return session.UserId == req.UserId && session.Id != current
+	})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error writing to sessions.json: "+err.Error(), "")
+		return
+	}
+
+	// A reset link asked for earlier shouldn't undo the change
+	if err := revokeAccountTokens(map[string]bool{req.UserId: true}, tokenResetPassword); err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error writing to account_tokens.json: "+err.Error(), "")
+		return
+	}
+
+	fmt.Println("Password changed for:", req.UserId)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{"success": true})
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Concurrent writers of users.json must not lose each other's updates
+func TestUsersConcurrentWrites(t *testing.T) {
+	useDataDir(t, User{UserId: "alice", Password: "alice1234"})
+
+	const writers = 20
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*writers)
+	for i := 0; i < writers; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			errs <- updateUser("alice", func(user *User) {
+				user.Status += "x"
+			})
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			errs <- addUser(User{UserId: fmt.Sprintf("user%d", i), Password: "password"})
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	usersData, err := loadUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(usersData.Users) != writers+1 {
+		t.Errorf("%d users, want %d", len(usersData.Users), writers+1)
+	}
+	alice, _, _ := findUser("alice")
+	if len(alice.Status) != writers {
+		t.Errorf("%d updates kept, want %d", len(alice.Status), writers)
+	}
+	if err := addUser(User{UserId: "alice"}); err != errUserExists {
+		t.Errorf("adding a taken ID: got %v, want errUserExists", err)
+	}
+}
+
+// The admin API must not let a password alone past an admin's 2FA
+func TestAdminSecondFactor(t *testing.T) {
+	useDataDir(t,
+		User{UserId: "root", Password: "root1234", IsAdmin: true, TOTPEnabled: true, TOTPSecret: newTOTPSecret()},
+		User{UserId: "temp", Password: "temp1234", IsAdmin: true, MustResetPassword: true},
+		User{UserId: "alice", Password: "alice1234"},
+	)
+	handler := enforceSessions(setupAPIv1())
+	_, passwordOnly, err := createSession("root", "laptop", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, twoFactor, err := createSession("root", "laptop", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, someoneElse, err := createSession("alice", "laptop", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name     string
+		user     string
+		password string
+		token    string
+		status   int
+		code     string
+	}{
+		{"password only", "root", "root1234", "", http.StatusUnauthorized, "second_factor_required"},
+		{"session without 2FA", "root", "root1234", passwordOnly, http.StatusUnauthorized, "second_factor_required"},
+		{"someone else's session", "root", "root1234", someoneElse, http.StatusUnauthorized, "second_factor_required"},
+		{"session with 2FA", "root", "root1234", twoFactor, http.StatusOK, ""},
+		{"wrong password", "root", "wrong", twoFactor, http.StatusUnauthorized, "admin_required"},
+		{"temporary password", "temp", "temp1234", "", http.StatusUnauthorized, "password_reset_required"},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/admin/list-users", nil)
+		req.SetBasicAuth(c.user, c.password)
+		if c.token != "" {
+			req.AddCookie(&http.Cookie{Name: sessionCookie, Value: c.token})
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		if rec.Code != c.status {
+			t.Errorf("%s: status %d, want %d: %s", c.name, rec.Code, c.status, strings.TrimSpace(rec.Body.String()))
+			continue
+		}
+		if c.code != "" {
+			var reply struct {
+				Error APIError `json:"error"`
+			}
+			json.Unmarshal(rec.Body.Bytes(), &reply)
+			if reply.Error.Code != c.code {
+				t.Errorf("%s: error %q, want %q", c.name, reply.Error.Code, c.code)
+			}
+		}
+	}
+}
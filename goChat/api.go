@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// APIError is the error object returned by every JSON endpoint
+type APIError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Field   string `json:"field,omitempty"`
+}
+
+// Write a uniform JSON error response:
+// {"success": false, "error": {"code": ..., "message": ..., "field": ...}}
+func writeError(w http.ResponseWriter, status int, code, message, field string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": false,
+		"error":   APIError{Code: code, Message: message, Field: field},
+	})
+}
+
+// Write a validation failure. The first problem is reported as "error" like
+// any other failure, and the full list is included as "errors".
+func writeValidationErrors(w http.ResponseWriter, errs ValidationErrors) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(errs.status())
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": false,
+		"error":   errs[0],
+		"errors":  errs,
+	})
+}
+
+// Write a 404 if the user referenced by the given parameter isn't registered.
+// Returns false if a response was written and the handler should stop.
+func requireUser(w http.ResponseWriter, userId, field string) bool {
+	exists, err := userExists(userId)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error reading users.json: "+err.Error(), "")
+		return false
+	}
+	if !exists {
+		writeError(w, http.StatusNotFound, "user_not_found", "User "+userId+" does not exist", field)
+		return false
+	}
+	return true
+}
+
+// apiRouter dispatches /api/v1 requests by path and method
+type apiRouter struct {
+	prefix string
+	routes map[string]map[string]http.HandlerFunc
+}
+
+// Create a router for the given path prefix
+func newAPIRouter(prefix string) *apiRouter {
+	return &apiRouter{
+		prefix: prefix,
+		routes: make(map[string]map[string]http.HandlerFunc),
+	}
+}
+
+// Register a handler for a method and path below the router prefix
+func (router *apiRouter) handle(method, path string, handler http.HandlerFunc) {
+	if router.routes[path] == nil {
+		router.routes[path] = make(map[string]http.HandlerFunc)
+	}
+	router.routes[path][method] = handler
+}
+
+// ServeHTTP finds the route for the request, answering 404 for unknown paths
+// and 405 (with an Allow header) for known paths with the wrong method
+func (router *apiRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, router.prefix)
+
+	methods, ok := router.routes[path]
+	if !ok {
+		writeError(w, http.StatusNotFound, "not_found", "No such endpoint: "+r.URL.Path, "")
+		return
+	}
+
+	handler, ok := methods[r.Method]
+	if !ok {
+		allowed := make([]string, 0, len(methods))
+		for method := range methods {
+			allowed = append(allowed, method)
+		}
+		sort.Strings(allowed)
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", fmt.Sprintf("Method %s is not allowed for %s", r.Method, r.URL.Path), "")
+		return
+	}
+
+	handler(w, r)
+}
+
+// Build the /api/v1 router. The legacy top-level paths registered in main
+// are kept as aliases for the same handlers.
+func setupAPIv1() http.Handler {
+	router := newAPIRouter("/api/v1")
+	router.handle(http.MethodPost, "/register", registerUser)
+	router.handle(http.MethodPost, "/login", loginUser)
+	router.handle(http.MethodPost, "/login/totp", loginTOTP)
+	router.handle(http.MethodPost, "/search-users", searchUsers)
+	router.handle(http.MethodPost, "/send-message", sendMessage)
+	router.handle(http.MethodGet, "/get-messages", getMessages)
+	router.handle(http.MethodGet, "/get-all-messages", getAllMessages)
+	router.handle(http.MethodGet, "/get-recent-chats", getRecentChats)
+	router.handle(http.MethodPost, "/mark-messages-read", markMessagesAsRead)
+	router.handle(http.MethodGet, "/list-scheduled", listScheduled)
+	router.handle(http.MethodPost, "/cancel-scheduled", cancelScheduled)
+	router.handle(http.MethodGet, "/get-disappearing", getDisappearing)
+	router.handle(http.MethodPost, "/set-disappearing", setDisappearing)
+	router.handle(http.MethodGet, "/get-retention", getRetention)
+	router.handle(http.MethodPost, "/set-retention", setRetention)
+	router.handle(http.MethodGet, "/get-archived-messages", getArchivedMessages)
+	router.handle(http.MethodGet, "/search-messages", searchMessages)
+	router.handle(http.MethodGet, "/export-conversation", exportConversation)
+	router.handle(http.MethodPost, "/register-webhook", registerWebhook)
+	router.handle(http.MethodGet, "/list-webhooks", listWebhooks)
+	router.handle(http.MethodPost, "/delete-webhook", deleteWebhook)
+	router.handle(http.MethodPost, "/create-bot", createBot)
+	router.handle(http.MethodPost, "/create-bot-token", createBotToken)
+	router.handle(http.MethodGet, "/list-bot-tokens", listBotTokens)
+	router.handle(http.MethodPost, "/revoke-bot-token", revokeBotToken)
+	router.handle(http.MethodPost, "/bot/send-message", botSendMessage)
+	router.handle(http.MethodPost, "/keys/publish-device", publishDeviceKeys)
+	router.handle(http.MethodPost, "/keys/add-prekeys", addPrekeys)
+	router.handle(http.MethodGet, "/keys/list-devices", listDevices)
+	router.handle(http.MethodPost, "/keys/claim-bundles", claimPrekeyBundles)
+	router.handle(http.MethodPost, "/keys/remove-device", removeDevice)
+	router.handle(http.MethodGet, "/sessions/list", listSessions)
+	router.handle(http.MethodPost, "/sessions/revoke", revokeSession)
+	router.handle(http.MethodPost, "/sessions/revoke-others", revokeOtherSessions)
+	router.handle(http.MethodPost, "/logout", logoutSession)
+	router.handle(http.MethodGet, "/sync", syncChanges)
+	router.handle(http.MethodGet, "/contacts/list", listContacts)
+	router.handle(http.MethodPost, "/contacts/request", requestContact)
+	router.handle(http.MethodPost, "/contacts/accept", acceptContact)
+	router.handle(http.MethodPost, "/contacts/remove", removeContact)
+	router.handle(http.MethodPost, "/contacts/block", blockContact)
+	router.handle(http.MethodPost, "/contacts/unblock", unblockContact)
+	router.handle(http.MethodPost, "/contacts/set-privacy", setContactPrivacy)
+	router.handle(http.MethodGet, "/profile/get", getProfile)
+	router.handle(http.MethodPost, "/profile/update", updateProfile)
+	router.handle(http.MethodPost, "/profile/upload-avatar", uploadAvatar)
+	router.handle(http.MethodPost, "/profile/remove-avatar", removeAvatar)
+	router.handle(http.MethodGet, "/profile/avatar", serveAvatar)
+	router.handle(http.MethodPost, "/change-password", changePassword)
+	router.handle(http.MethodPost, "/email/verify", verifyEmail)
+	router.handle(http.MethodPost, "/email/resend-verification", resendVerification)
+	router.handle(http.MethodPost, "/password/forgot", forgotPassword)
+	router.handle(http.MethodPost, "/password/reset", resetPassword)
+	router.handle(http.MethodGet, "/2fa/status", getTOTPStatus)
+	router.handle(http.MethodPost, "/2fa/setup", setupTOTP)
+	router.handle(http.MethodPost, "/2fa/enable", enableTOTP)
+	router.handle(http.MethodPost, "/2fa/disable", disableTOTP)
+	router.handle(http.MethodPost, "/2fa/recovery-codes", regenerateRecoveryCodes)
+	router.handle(http.MethodGet, "/admin/list-users", adminOnly(adminListUsers))
+	router.handle(http.MethodPost, "/admin/disable-user", adminOnly(adminDisableUser))
+	router.handle(http.MethodPost, "/admin/enable-user", adminOnly(adminEnableUser))
+	router.handle(http.MethodPost, "/admin/reset-password", adminOnly(adminResetPassword))
+	router.handle(http.MethodPost, "/admin/reset-2fa", adminOnly(adminResetTOTP))
+	router.handle(http.MethodPost, "/admin/delete-user", adminOnly(adminDeleteUser))
+	router.handle(http.MethodGet, "/admin/stats", adminOnly(adminStats))
+	router.handle(http.MethodPost, "/admin/create-snapshot", adminOnly(adminCreateSnapshot))
+	router.handle(http.MethodGet, "/admin/list-snapshots", adminOnly(adminListSnapshots))
+	router.handle(http.MethodPost, "/admin/register-webhook", adminOnly(adminRegisterWebhook))
+	router.handle(http.MethodGet, "/admin/list-webhooks", adminOnly(adminListWebhooks))
+	router.handle(http.MethodPost, "/admin/delete-webhook", adminOnly(adminDeleteWebhook))
+	return router
+}
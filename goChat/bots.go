@@ -0,0 +1,502 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BotToken struct to store an API token issued to a bot. Only a hash of the
+// token is stored; the token itself is shown once when it's created.
+type BotToken struct {
+	Id            string     `json:"id"`
+	BotId         string     `json:"botId"`
+	Owner         string     `json:"owner"`
+	Hash          string     `json:"hash,omitempty"`
+	Conversations []string   `json:"conversations"` // Users the bot may post to with this token
+	CreatedAt     time.Time  `json:"createdAt"`
+	LastUsedAt    *time.Time `json:"lastUsedAt,omitempty"` // Only updated once per botTokenUseInterval
+	RevokedAt     *time.Time `json:"revokedAt,omitempty"`
+}
+
+// BotTokensData struct to match our JSON structure
+type BotTokensData struct {
+	Tokens []BotToken `json:"tokens"`
+}
+
+// BotRequest struct for creating a bot account
+type BotRequest struct {
+	BotId string `json:"botId"`
+}
+
+// BotTokenRequest struct for issuing a token
+type BotTokenRequest struct {
+	BotId         string   `json:"botId"`
+	Conversations []string `json:"conversations"`
+}
+
+// BotAuditEntry is one line of the bot audit log
+type BotAuditEntry struct {
+	Time       time.Time `json:"time"`
+	Action     string    `json:"action"` // create_bot, create_token, revoke_token, send_message, auth_failed
+	TokenId    string    `json:"tokenId,omitempty"`
+	BotId      string    `json:"botId,omitempty"`
+	Actor      string    `json:"actor,omitempty"` // Owner for management actions
+	Receiver   string    `json:"receiver,omitempty"`
+	RemoteAddr string    `json:"remoteAddr"`
+	Success    bool      `json:"success"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// Prefix that makes bot tokens easy to recognize in logs and secret scanners
+const botTokenPrefix = "gcb_"
+
+// How stale a token's LastUsedAt may get before a post updates it, so a busy
+// bot doesn't rewrite bot_tokens.json on every message
+const botTokenUseInterval = 10 * time.Minute
+
+// Guards bot_tokens.json and the audit log
+var (
+	botTokensMu sync.Mutex
+	botAuditMu  sync.Mutex
+)
+
+// Read all bot tokens from bot_tokens.json
+func loadBotTokens() (BotTokensData, error) {
+	tokensData := BotTokensData{Tokens: []BotToken{}}
+
+	data, err := os.ReadFile("bot_tokens.json")
+	if os.IsNotExist(err) {
+		return tokensData, nil
+	}
+	if err != nil {
+		return tokensData, err
+	}
+
+	err = json.Unmarshal(data, &tokensData)
+	return tokensData, err
+}
+
+// Write all bot tokens to bot_tokens.json
+func saveBotTokens(tokensData BotTokensData) error {
+	newData, err := json.MarshalIndent(tokensData, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic("bot_tokens.json", newData, 0600)
+}
+
+// Hash a presented token for lookup
+func hashBotToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Append an entry to bot_audit.jsonl, one JSON object per line
+func recordBotAudit(entry BotAuditEntry) {
+	botAuditMu.Lock()
+	defer botAuditMu.Unlock()
+
+	entry.Time = time.Now()
+	line, err := json.Marshal(entry)
+	if err != nil {
+		fmt.Println("Error encoding bot audit entry:", err)
+		return
+	}
+
+	file, err := os.OpenFile("bot_audit.jsonl", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		fmt.Println("Error opening bot_audit.jsonl:", err)
+		return
+	}
+	defer file.Close()
+
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		fmt.Println("Error writing to bot_audit.jsonl:", err)
+	}
+}
+
+// Find the bot account and check that owner created it
+func findOwnedBot(usersData UsersData, botId, owner string) (User, bool) {
+	for _, user := range usersData.Users {
+		if user.UserId == botId && user.IsBot && user.BotOwner == owner {
+			return user, true
+		}
+	}
+	return User{}, false
+}
+
+// Handler for creating a bot account owned by the calling user
+func createBot(w http.ResponseWriter, r *http.Request) {
+	owner := r.URL.Query().Get("user")
+	if owner == "" {
+		writeError(w, http.StatusBadRequest, "missing_parameter", "User ID is required", "user")
+		return
+	}
+	if !requireSessionUser(w, r, owner, "user") || !requireUser(w, owner, "user") {
+		return
+	}
+
+	var botReq BotRequest
+	if err := json.NewDecoder(r.Body).Decode(&botReq); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_json", "Invalid JSON: "+err.Error(), "")
+		return
+	}
+
+	// Bot IDs follow the same rules as usernames
+	botReq.BotId = normalizeText(botReq.BotId)
+	var errs ValidationErrors
+	validateUsername(botReq.BotId, &errs)
+	if len(errs) > 0 {
+		errs[0].Field = "botId"
+		writeValidationErrors(w, errs)
+		return
+	}
+
+	bot := User{UserId: botReq.BotId, IsBot: true, BotOwner: owner}
+	err := addUser(bot)
+	if err == errUserExists {
+		writeError(w, http.StatusConflict, "user_exists", "Username is already taken", "botId")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error writing to users.json: "+err.Error(), "")
+		return
+	}
+
+	recordBotAudit(BotAuditEntry{Action: "create_bot", BotId: bot.UserId, Actor: owner, RemoteAddr: r.RemoteAddr, Success: true})
+	fmt.Printf("Bot %s created by %s\n", bot.UserId, owner)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"bot":     bot,
+	})
+}
+
+// Handler for issuing an API token for one of the user's bots
+func createBotToken(w http.ResponseWriter, r *http.Request) {
+	owner := r.URL.Query().Get("user")
+	if owner == "" {
+		writeError(w, http.StatusBadRequest, "missing_parameter", "User ID is required", "user")
+		return
+	}
+	if !requireSessionUser(w, r, owner, "user") {
+		return
+	}
+
+	var tokenReq BotTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&tokenReq); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_json", "Invalid JSON: "+err.Error(), "")
+		return
+	}
+
+	usersData, err := loadUsers()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error reading users.json: "+err.Error(), "")
+		return
+	}
+	if _, ok := findOwnedBot(usersData, tokenReq.BotId, owner); !ok {
+		writeError(w, http.StatusNotFound, "bot_not_found", "No bot "+tokenReq.BotId+" owned by "+owner, "botId")
+		return
+	}
+
+	// Tokens are always scoped to an explicit list of conversations
+	if len(tokenReq.Conversations) == 0 {
+		writeError(w, http.StatusBadRequest, "invalid_field", "At least one conversation is required", "conversations")
+		return
+	}
+	for _, receiver := range tokenReq.Conversations {
+		if !requireUser(w, receiver, "conversations") {
+			return
+		}
+	}
+
+	secret := botTokenPrefix + randomHex(24)
+	token := BotToken{
+		Id:            randomHex(8),
+		BotId:         tokenReq.BotId,
+		Owner:         owner,
+		Hash:          hashBotToken(secret),
+		Conversations: tokenReq.Conversations,
+		CreatedAt:     time.Now(),
+	}
+
+	botTokensMu.Lock()
+	tokensData, err := loadBotTokens()
+	if err == nil {
+		tokensData.Tokens = append(tokensData.Tokens, token)
+		err = saveBotTokens(tokensData)
+	}
+	botTokensMu.Unlock()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error updating bot_tokens.json: "+err.Error(), "")
+		return
+	}
+
+	recordBotAudit(BotAuditEntry{Action: "create_token", TokenId: token.Id, BotId: token.BotId, Actor: owner, RemoteAddr: r.RemoteAddr, Success: true})
+
+	// The plain token is only ever shown in this response
+	token.Hash = ""
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"token":   secret,
+		"info":    token,
+	})
+}
+
+// Handler for listing the tokens of the user's bots
+func listBotTokens(w http.ResponseWriter, r *http.Request) {
+	owner := r.URL.Query().Get("user")
+	if owner == "" {
+		writeError(w, http.StatusBadRequest, "missing_parameter", "User ID is required", "user")
+		return
+	}
+	if !requireSessionUser(w, r, owner, "user") {
+		return
+	}
+
+	botTokensMu.Lock()
+	tokensData, err := loadBotTokens()
+	botTokensMu.Unlock()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error reading bot_tokens.json: "+err.Error(), "")
+		return
+	}
+
+	ownedTokens := []BotToken{}
+	for _, token := range tokensData.Tokens {
+		if token.Owner == owner {
+			token.Hash = ""
+			ownedTokens = append(ownedTokens, token)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"tokens":  ownedTokens,
+	})
+}
+
+// Handler for revoking a bot token. Revoked tokens stay in the file so the
+// audit log can still be matched to them.
+func revokeBotToken(w http.ResponseWriter, r *http.Request) {
+	owner := r.URL.Query().Get("user")
+	tokenId := r.URL.Query().Get("id")
+	if owner == "" || tokenId == "" {
+		field := "user"
+		if owner != "" {
+			field = "id"
+		}
+		writeError(w, http.StatusBadRequest, "missing_parameter", "Missing user or token ID", field)
+		return
+	}
+	if !requireSessionUser(w, r, owner, "user") {
+		return
+	}
+
+	botTokensMu.Lock()
+	defer botTokensMu.Unlock()
+
+	tokensData, err := loadBotTokens()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error reading bot_tokens.json: "+err.Error(), "")
+		return
+	}
+
+	found := false
+	for i, token := range tokensData.Tokens {
+		if token.Id == tokenId && token.Owner == owner {
+			if token.RevokedAt == nil {
+				now := time.Now()
+				tokensData.Tokens[i].RevokedAt = &now
+			}
+			found = true
+			break
+		}
+	}
+	if !found {
+		writeError(w, http.StatusNotFound, "token_not_found", "No such token", "id")
+		return
+	}
+
+	if err := saveBotTokens(tokensData); err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error writing to bot_tokens.json: "+err.Error(), "")
+		return
+	}
+
+	recordBotAudit(BotAuditEntry{Action: "revoke_token", TokenId: tokenId, Actor: owner, RemoteAddr: r.RemoteAddr, Success: true})
+	fmt.Printf("Bot token %s revoked by %s\n", tokenId, owner)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{"success": true})
+}
+
+// Find the active token matching the request's Authorization header and
+// record that it was used, if it hasn't been for botTokenUseInterval
+func authenticateBot(r *http.Request) (BotToken, bool) {
+	presented, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || !strings.HasPrefix(presented, botTokenPrefix) {
+		return BotToken{}, false
+	}
+	hash := hashBotToken(presented)
+
+	botTokensMu.Lock()
+	defer botTokensMu.Unlock()
+
+	tokensData, err := loadBotTokens()
+	if err != nil {
+		fmt.Println("Error reading bot_tokens.json:", err)
+		return BotToken{}, false
+	}
+
+	for i, token := range tokensData.Tokens {
+		if token.Hash == hash && token.RevokedAt == nil {
+			// Tokens stop working while the bot or its owner is disabled
+			if enabled, err := botEnabled(token.BotId); err != nil || !enabled {
+				if err != nil {
+					fmt.Println("Error reading users.json:", err)
+				}
+				return BotToken{}, false
+			}
+			now := time.Now()
+			if token.LastUsedAt == nil || now.Sub(*token.LastUsedAt) >= botTokenUseInterval {
+				tokensData.Tokens[i].LastUsedAt = &now
+				if err := saveBotTokens(tokensData); err != nil {
+					fmt.Println("Error writing to bot_tokens.json:", err)
+				}
+			}
+			return tokensData.Tokens[i], true
+		}
+	}
+	return BotToken{}, false
+}
+
+// Whether a bot and its owner both exist and are enabled
+func botEnabled(botId string) (bool, error) {
+	bot, exists, err := findUser(botId)
+	if err != nil || !exists || bot.Disabled {
+		return false, err
+	}
+	owner, exists, err := findUser(bot.BotOwner)
+	return exists && !owner.Disabled, err
+}
+
+// Revoke every active token issued to or by the given users, so disabling
+// an owner stops all of their bots. Returns how many tokens were revoked.
+func revokeBotTokens(users map[string]bool) (int, error) {
+	botTokensMu.Lock()
+	defer botTokensMu.Unlock()
+
+	tokensData, err := loadBotTokens()
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	revoked := 0
+	for i, token := range tokensData.Tokens {
+		if token.RevokedAt == nil && (users[token.BotId] || users[token.Owner]) {
+			tokensData.Tokens[i].RevokedAt = &now
+			revoked++
+		}
+	}
+	if revoked == 0 {
+		return 0, nil
+	}
+	return revoked, saveBotTokens(tokensData)
+}
+
+// Handler for bots posting a message with a bearer token
+func botSendMessage(w http.ResponseWriter, r *http.Request) {
+	token, ok := authenticateBot(r)
+	if !ok {
+		recordBotAudit(BotAuditEntry{Action: "auth_failed", RemoteAddr: r.RemoteAddr, Error: "missing, unknown or revoked token, or disabled bot"})
+		w.Header().Set("WWW-Authenticate", `Bearer realm="goChat bots"`)
+		writeError(w, http.StatusUnauthorized, "invalid_token", "A valid bot token is required", "")
+		return
+	}
+
+	audit := BotAuditEntry{Action: "send_message", TokenId: token.Id, BotId: token.BotId, RemoteAddr: r.RemoteAddr}
+
+	var msgReq MessageRequest
+	if err := json.NewDecoder(r.Body).Decode(&msgReq); err != nil {
+		audit.Error = "invalid JSON"
+		recordBotAudit(audit)
+		writeError(w, http.StatusBadRequest, "invalid_json", "Invalid JSON: "+err.Error(), "")
+		return
+	}
+
+	errs, err := validateMessage(&msgReq)
+	if err != nil {
+		audit.Error = err.Error()
+		recordBotAudit(audit)
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error reading users.json: "+err.Error(), "")
+		return
+	}
+	audit.Receiver = msgReq.Receiver
+	if len(errs) > 0 {
+		audit.Error = errs.Error()
+		recordBotAudit(audit)
+		writeValidationErrors(w, errs)
+		return
+	}
+
+	// The token only grants access to the conversations it was issued for
+	allowed := false
+	for _, receiver := range token.Conversations {
+		if receiver == msgReq.Receiver {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		audit.Error = "conversation not in token scope"
+		recordBotAudit(audit)
+		writeError(w, http.StatusForbidden, "out_of_scope", "This token can't post to "+msgReq.Receiver, "receiver")
+		return
+	}
+
+	// Blocks and contacts-only settings apply to bots and their owners too
+	if allowed, err := checkMessagingAllowed(token.BotId, msgReq.Receiver, token.Owner); err != nil {
+		audit.Error = err.Error()
+		recordBotAudit(audit)
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error reading contacts.json: "+err.Error(), "")
+		return
+	} else if !allowed {
+		audit.Error = "receiver not accepting messages"
+		recordBotAudit(audit)
+		writeError(w, http.StatusForbidden, "not_accepting_messages", msgReq.Receiver+" isn't accepting messages from this bot", "receiver")
+		return
+	}
+
+	message := Message{
+		Sender:    token.BotId,
+		Receiver:  msgReq.Receiver,
+		Content:   msgReq.Content,
+		Timestamp: time.Now(),
+		IsRead:    false,
+		IsBot:     true,
+		Type:      msgReq.Type,
+	}
+	if err := storeMessage(message); err != nil {
+		audit.Error = err.Error()
+		recordBotAudit(audit)
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error storing message: "+err.Error(), "")
+		return
+	}
+
+	audit.Success = true
+	recordBotAudit(audit)
+	fmt.Printf("Bot %s posted to %s\n", token.BotId, msgReq.Receiver)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{"success": true})
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Post a message with a bot token and return the status
+func botPost(secret, body string) int {
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/bot/send-message", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+secret)
+	rec := httptest.NewRecorder()
+	enforceSessions(setupAPIv1()).ServeHTTP(rec, req)
+	return rec.Code
+}
+
+func TestBotOwnerAccess(t *testing.T) {
+	useDataDir(t,
+		User{UserId: "alice", Password: "alice1234"},
+		User{UserId: "bob", Password: "bob12345"},
+		User{UserId: "helper", IsBot: true, BotOwner: "alice"},
+	)
+	tokensData := BotTokensData{Tokens: []BotToken{{Id: "token1", BotId: "helper", Owner: "alice", Conversations: []string{"bob"}}}}
+	if err := saveBotTokens(tokensData); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name   string
+		method string
+		target string
+		userId string
+		body   string
+		status int
+	}{
+		{"creating a bot for someone else", http.MethodPost, "/api/v1/create-bot?user=alice", "bob", `{"botId":"spambot"}`, http.StatusForbidden},
+		{"minting a token for someone else's bot", http.MethodPost, "/api/v1/create-bot-token?user=alice", "bob", `{"botId":"helper","conversations":["bob"]}`, http.StatusForbidden},
+		{"listing someone else's tokens", http.MethodGet, "/api/v1/list-bot-tokens?user=alice", "bob", "", http.StatusForbidden},
+		{"revoking someone else's token", http.MethodPost, "/api/v1/revoke-bot-token?user=alice&id=token1", "bob", "", http.StatusForbidden},
+		{"revoking as the wrong owner", http.MethodPost, "/api/v1/revoke-bot-token?user=bob&id=token1", "bob", "", http.StatusNotFound},
+		{"minting a token", http.MethodPost, "/api/v1/create-bot-token?user=alice", "alice", `{"botId":"helper","conversations":["bob"]}`, http.StatusOK},
+		{"revoking own token", http.MethodPost, "/api/v1/revoke-bot-token?user=alice&id=token1", "alice", "", http.StatusOK},
+	}
+	for _, c := range cases {
+		if rec := apiRequest(t, c.method, c.target, c.userId, c.body); rec.Code != c.status {
+			t.Errorf("%s: status %d, want %d: %s", c.name, rec.Code, c.status, strings.TrimSpace(rec.Body.String()))
+		}
+	}
+}
+
+// Posting must not rewrite bot_tokens.json every time, and every outcome,
+// failures included, goes in the audit log
+func TestBotSendMessage(t *testing.T) {
+	useDataDir(t,
+		User{UserId: "alice", Password: "alice1234"},
+		User{UserId: "bob", Password: "bob12345"},
+		User{UserId: "helper", IsBot: true, BotOwner: "alice"},
+	)
+	secret := botTokenPrefix + "secret"
+	lastUsed := time.Now().Add(-time.Minute)
+	tokensData := BotTokensData{Tokens: []BotToken{{Id: "token1", BotId: "helper", Owner: "alice", Hash: hashBotToken(secret), Conversations: []string{"bob"}, LastUsedAt: &lastUsed}}}
+	if err := saveBotTokens(tokensData); err != nil {
+		t.Fatal(err)
+	}
+	before, _ := os.ReadFile("bot_tokens.json")
+
+	post := func(body string) int { return botPost(secret, body) }
+	if status := post(`{"receiver":"bob","content":"build passed"}`); status != http.StatusOK {
+		t.Fatalf("posting: status %d", status)
+	}
+	if status := post(`{"receiver":"alice","content":"hi"}`); status != http.StatusForbidden {
+		t.Errorf("posting out of scope: status %d", status)
+	}
+	if after, _ := os.ReadFile("bot_tokens.json"); string(after) != string(before) {
+		t.Errorf("bot_tokens.json rewritten although the token was used a minute ago")
+	}
+
+	// Make contacts.json unreadable to reach the internal_error path
+	if err := os.Mkdir("contacts.json", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if status := post(`{"receiver":"bob","content":"again"}`); status != http.StatusInternalServerError {
+		t.Errorf("posting with a broken contacts.json: status %d", status)
+	}
+
+	file, err := os.Open("bot_audit.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var outcomes []string
+	for scanner := bufio.NewScanner(file); scanner.Scan(); {
+		var entry BotAuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatal(err)
+		}
+		outcome := "ok"
+		if !entry.Success {
+			outcome = "failed"
+		}
+		outcomes = append(outcomes, entry.Receiver+" "+outcome)
+	}
+	if got := strings.Join(outcomes, ", "); got != "bob ok, alice failed, bob failed" {
+		t.Errorf("audit log: %s", got)
+	}
+}
+
+// A bot is held to the receiver's blocks and contacts-only setting through
+// its owner too, and stops working when its owner is disabled
+func TestBotMessagingRules(t *testing.T) {
+	useDataDir(t,
+		User{UserId: "alice", Password: "alice1234"},
+		User{UserId: "bob", Password: "bob12345"},
+		User{UserId: "helper", IsBot: true, BotOwner: "alice"},
+		User{UserId: "root", Password: "root1234", IsAdmin: true},
+	)
+	secret := botTokenPrefix + "secret"
+	tokensData := BotTokensData{Tokens: []BotToken{{Id: "token1", BotId: "helper", Owner: "alice", Hash: hashBotToken(secret), Conversations: []string{"bob"}}}}
+	if err := saveBotTokens(tokensData); err != nil {
+		t.Fatal(err)
+	}
+	message := `{"receiver":"bob","content":"build passed"}`
+
+	steps := []struct {
+		name   string
+		target string // Request bob makes before the bot posts
+		body   string
+		status int
+	}{
+		{"blocking the owner", "/api/v1/contacts/block?user=bob&contact=alice", "", http.StatusForbidden},
+		{"unblocking the owner", "/api/v1/contacts/unblock?user=bob&contact=alice", "", http.StatusOK},
+		{"accepting only contacts", "/api/v1/contacts/set-privacy?user=bob", `{"contactsOnly":true}`, http.StatusForbidden},
+		{"adding the bot", "/api/v1/contacts/request?user=bob&contact=helper", "", http.StatusOK},
+	}
+	for _, step := range steps {
+		if rec := apiRequest(t, http.MethodPost, step.target, "bob", step.body); rec.Code != http.StatusOK {
+			t.Fatalf("%s: status %d: %s", step.name, rec.Code, rec.Body.String())
+		}
+		if status := botPost(secret, message); status != step.status {
+			t.Errorf("posting after %s: status %d, want %d", step.name, status, step.status)
+		}
+	}
+
+	if rec := apiRequest(t, http.MethodPost, "/api/v1/admin/disable-user?user=alice", "", ""); rec.Code != http.StatusOK {
+		t.Fatalf("disabling the owner: status %d: %s", rec.Code, rec.Body.String())
+	}
+	if status := botPost(secret, message); status != http.StatusUnauthorized {
+		t.Errorf("posting for a disabled owner: status %d", status)
+	}
+	tokensData, err := loadBotTokens()
+	if err != nil || tokensData.Tokens[0].RevokedAt == nil {
+		t.Errorf("token not revoked when its owner was disabled: %v", err)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"gochat/internal/client"
+	"gochat/internal/tui"
+)
+
+// gochat-cli's TUI, driven with scripted key presses against the real
+// router: it shows the incoming message and sends the typed reply
+func TestTUIRoundTrip(t *testing.T) {
+	useDataDir(t, User{UserId: "alice", Password: "alice1234"}, User{UserId: "bob", Password: "bob12345"})
+	server := httptest.NewServer(enforceSessions(setupAPIv1()))
+	defer server.Close()
+
+	clients := map[string]*client.Client{}
+	for userId, password := range map[string]string{"alice": "alice1234", "bob": "bob12345"} {
+		clients[userId] = client.NewClient(server.URL)
+		if _, err := clients[userId].Login(userId, password, "test"); err != nil {
+			t.Fatalf("logging in %s: %v", userId, err)
+		}
+	}
+	if _, err := clients["bob"].Send("bob", "alice", "hello from bob"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Open the first recent chat, type a reply, send it and quit
+	keys := strings.NewReader("\r" + "hi bob" + "\r" + "\x03")
+	var frames bytes.Buffer
+	if err := tui.New(clients["alice"], "alice", keys, &frames, 80, 24).Run(); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(frames.String(), "hello from bob") {
+		t.Error("the incoming message was never drawn")
+	}
+
+	messages, err := clients["bob"].Messages("bob", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 2 || messages[1].Sender != "alice" || messages[1].Content != "hi bob" || !messages[0].IsRead {
+		t.Errorf("conversation after the TUI ran: %+v", messages)
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gochat/internal/envelope"
+	"gochat/internal/store"
+)
+
+// problem is one inconsistency found by the check command
+type problem struct {
+	File    string `json:"file"`
+	Message string `json:"message"`
+}
+
+// checker collects problems across the data files
+type checker struct {
+	problems []problem
+}
+
+func (c *checker) add(file, format string, args ...interface{}) {
+	c.problems = append(c.problems, problem{File: file, Message: fmt.Sprintf(format, args...)})
+}
+
+// Check users.json, chats.json and recentChats.json for problems the server
+// can't recover from on its own
+func checkData(s dataStore) []problem {
+	c := &checker{}
+
+	// users.json: duplicate or empty IDs and bots without an owner
+	users := map[string]User{}
+	usersData, err := s.loadUsers()
+	if err != nil {
+		c.add("users.json", "unreadable: %v", err)
+	}
+	seen := map[string]string{}
+	for i, user := range usersData.Users {
+		if strings.TrimSpace(user.UserId) == "" {
+			c.add("users.json", "user #%d has an empty userId", i)
+			continue
+		}
+		if _, dup := users[user.UserId]; dup {
+			c.add("users.json", "duplicate user %q", user.UserId)
+			continue
+		}
+		// Registration compares IDs exactly, but two IDs that only differ in
+		// case are almost always a mistake
+		if other, ok := seen[strings.ToLower(user.UserId)]; ok {
+			c.add("users.json", "users %q and %q differ only in case", other, user.UserId)
+		}
+		seen[strings.ToLower(user.UserId)] = user.UserId
+		users[user.UserId] = user
+
+		if !user.IsBot && user.Password == "" {
+			c.add("users.json", "user %q has no password", user.UserId)
+		}
+		if user.Avatar != "" {
+			if _, err := os.Stat(s.path(filepath.Join("avatars", user.Avatar+".png"))); err != nil {
+				c.add("users.json", "avatar of user %q is missing", user.UserId)
+			}
+		}
+	}
+	for _, user := range usersData.Users {
+		if user.IsBot {
+			if _, ok := users[user.BotOwner]; !ok {
+				c.add("users.json", "bot %q belongs to unknown user %q", user.UserId, user.BotOwner)
+			}
+		}
+	}
+
+	// chats.json: undecodable entries, zero timestamps, dangling users
+	messages, bad, err := s.loadMessages()
+	if err != nil {
+		c.add("chats.json", "unreadable: %v", err)
+	}
+	badIndexes := make([]int, 0, len(bad))
+	for i := range bad {
+		badIndexes = append(badIndexes, i)
+	}
+	sort.Ints(badIndexes)
+	for _, i := range badIndexes {
+		c.add("chats.json", "message #%d is malformed: %v", i, bad[i])
+	}
+	if _, torn, err := s.readMessageLog(); err != nil {
+		c.add("chats.log", "unreadable: %v", err)
+	} else if torn > 0 {
+		c.add("chats.log", "%d bytes of an incomplete record at the end; the server truncates them at startup", torn)
+	}
+	dangling := map[string]int{}
+	for i, message := range messages {
+		if message.Timestamp.IsZero() {
+			c.add("chats.json", "message #%d (%s -> %s) has no timestamp", i, message.Sender, message.Receiver)
+		}
+		for _, userId := range []string{message.Sender, message.Receiver} {
+			if _, ok := users[userId]; !ok {
+				dangling[userId]++
+			}
+		}
+	}
+	unknown := make([]string, 0, len(dangling))
+	for userId := range dangling {
+		unknown = append(unknown, userId)
+	}
+	sort.Strings(unknown)
+	for _, userId := range unknown {
+		c.add("chats.json", "%d messages refer to unknown user %q", dangling[userId], userId)
+	}
+
+	// recentChats.json: must match what rebuild would derive from chats.json.
+	// Conversations that only exist in the archive may keep their entries.
+	index, err := s.loadArchiveIndex()
+	if err != nil {
+		c.add("archive/index.json", "unreadable: %v", err)
+	}
+	var recentChatsData RecentChatsData
+	if err := s.load("recentChats.json", &recentChatsData); err != nil {
+		c.add("recentChats.json", "unreadable: %v (run rebuild-recent)", err)
+		return c.problems
+	}
+	locked := 0
+	for i, chat := range recentChatsData.Chats {
+		recentChatsData.Chats[i].LastMessage, err = s.openText(chat.LastMessage, envelope.RecentChatContext(chat.UserId, chat.ContactId))
+		if err != nil && !errors.Is(err, envelope.ErrNoKey) {
+			c.add("recentChats.json", "entry for %s -> %s can't be decrypted: %v", chat.UserId, chat.ContactId, err)
+		}
+		if envelope.IsSealed(recentChatsData.Chats[i].LastMessage) {
+			locked++
+		}
+	}
+	for _, message := range messages {
+		if envelope.IsSealed(message.Content) {
+			locked++
+		}
+	}
+	if locked > 0 {
+		// Encrypted copies of the same text differ, so there is nothing to compare
+		c.add("recentChats.json", "not checked: %d values are encrypted with keys that aren't loaded (pass -keys or set GOCHAT_ENCRYPTION_KEYS)", locked)
+		return c.problems
+	}
+	for _, problem := range store.CheckRecentChats(recentChatsData, messages, index) {
+		c.add("recentChats.json", "%s", problem)
+	}
+	return c.problems
+}
+
+// check reports every problem found and fails if there are any
+func (a *admin) check(args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("usage: check")
+	}
+
+	problems := checkData(a.store)
+	if a.asJSON {
+		if problems == nil {
+			problems = []problem{}
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(map[string]interface{}{"ok": len(problems) == 0, "problems": problems})
+	} else {
+		for _, p := range problems {
+			fmt.Printf("%-17s %s\n", p.File, p.Message)
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("found %d problems", len(problems))
+	}
+	if !a.asJSON {
+		fmt.Println("No problems found")
+	}
+	return nil
+}
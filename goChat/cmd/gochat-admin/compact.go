@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"gochat/internal/store"
+)
+
+// compact applies the retention policies in retention.json once, as the
+// server's hourly compaction does: messages past their retention period
+// are moved to the archive or deleted, and expired disappearing messages
+// are deleted. The segments are written before chats.json, so a failure in
+// between can duplicate messages in the archive but never lose them.
+func (a *admin) compact(args []string) error {
+	if len(args) != 0 {
+		return errors.New("usage: compact")
+	}
+	s := a.store
+
+	config, err := store.LoadRetention(s.dir)
+	if err != nil {
+		return fmt.Errorf("reading retention.json: %w", err)
+	}
+	chatsData, err := s.loadChats()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	kept, archived, deleted := config.Compact(chatsData.Messages, now)
+	if len(archived) > 0 {
+		index, err := s.loadArchiveIndex()
+		if err != nil {
+			return err
+		}
+		for start := 0; start < len(archived); start += store.ArchiveSegmentSize {
+			end := start + store.ArchiveSegmentSize
+			if end > len(archived) {
+				end = len(archived)
+			}
+			segment := store.NewSegment(archived[start:end])
+			sealed, err := s.sealMessages(archived[start:end])
+			if err != nil {
+				return err
+			}
+			if err := store.WriteSegment(s.dir, segment.File, sealed); err != nil {
+				return fmt.Errorf("writing archive: %w", err)
+			}
+			index.Segments = append(index.Segments, segment)
+		}
+		if err := store.SaveArchiveIndex(s.dir, index); err != nil {
+			return fmt.Errorf("writing archive: %w", err)
+		}
+	}
+
+	if len(archived) > 0 || len(deleted) > 0 {
+		chatsData.Messages = kept
+		if err := s.saveChats(chatsData); err != nil {
+			return err
+		}
+	}
+
+	// Deleted messages may have been the last message of a conversation,
+	// and the change log shouldn't keep a copy of them
+	if len(deleted) > 0 {
+		if _, err := s.rebuildRecentChats(kept); err != nil {
+			return err
+		}
+		changes, err := s.loadChanges()
+		if err != nil {
+			return err
+		}
+		purged := false
+		for i, change := range changes {
+			if change.Message != nil && config.Deletes(*change.Message, now) {
+				changes[i] = Change{Seq: change.Seq, Type: change.Type, Users: []string{}, Time: change.Time}
+				purged = true
+			}
+		}
+		if purged {
+			if err := s.saveChanges(changes); err != nil {
+				return err
+			}
+		}
+	}
+
+	if a.asJSON {
+		return a.printJSON(map[string]interface{}{"success": true, "archived": len(archived), "deleted": len(deleted)})
+	}
+	fmt.Printf("Archived %d and deleted %d messages\n", len(archived), len(deleted))
+	return nil
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"gochat/internal/envelope"
+	"gochat/internal/store"
+)
+
+// Encrypted values use the server's envelope format from
+// internal/envelope. Without the keys, encrypted values are passed through
+// as they are.
+
+// Decrypt a stored value sealed for context. Plaintext is returned as it
+// is; so is a value whose key isn't loaded, together with an
+// envelope.ErrNoKey error.
+func (s dataStore) openText(value, context string) (string, error) {
+	plaintext, err := s.keys.Open(value, context)
+	if err != nil {
+		return value, err
+	}
+	return string(plaintext), nil
+}
+
+// Encrypt a value for context under a new data key wrapped with the first
+// key of the ring. Without keys the value is returned unchanged.
+func (s dataStore) sealText(text, context string) (string, error) {
+	return s.keys.Seal([]byte(text), context)
+}
+
+// Encrypt the bodies of a copy of messages for writing, giving an ID to
+// any message without one so its body can be bound to it
+func (s dataStore) sealMessages(messages []Message) ([]Message, error) {
+	sealed := make([]Message, len(messages))
+	for i, message := range messages {
+		if message.Id == "" {
+			message.Id = store.NewMessageId()
+		}
+		content, err := s.sealText(message.Content, envelope.MessageContext(message.Id))
+		if err != nil {
+			return nil, err
+		}
+		message.Content = content
+		sealed[i] = message
+	}
+	return sealed, nil
+}
+
+// genKey prints a new key ring entry
+func (a *admin) genKey(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: gen-key <id>")
+	}
+	entry, err := envelope.NewKey(args[0])
+	if err != nil {
+		return err
+	}
+	fmt.Println(entry)
+	return nil
+}
+
+// Counts reported by reencrypt for one file
+type reencryptCount struct {
+	File    string `json:"file"`
+	Values  int    `json:"values"`
+	Changed int    `json:"changed"`
+}
+
+// reencrypt brings every stored message body under the first key of the
+// ring: plaintext and values from before encryption contexts are encrypted
+// afresh, bound to their record, and data keys wrapped with an older key
+// are rewrapped. Messages in chats.json and the archive that predate
+// message IDs get one. chats.log is folded into chats.json on the way.
+func (a *admin) reencrypt(args []string) error {
+	flags := flag.NewFlagSet("reencrypt", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "count what would change without writing anything")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 0 {
+		return errors.New("usage: reencrypt [-dry-run]")
+	}
+	s := a.store
+	if len(s.keys) == 0 {
+		return errors.New("no encryption keys loaded; pass -keys or set GOCHAT_ENCRYPTION_KEYS")
+	}
+
+	var counts []reencryptCount
+	reseal := func(count *reencryptCount, value *string, context string) error {
+		result, changed, err := s.keys.Reseal(*value, context)
+		if err != nil {
+			return fmt.Errorf("%s: %w", count.File, err)
+		}
+		count.Values++
+		if changed {
+			count.Changed++
+			*value = result
+		}
+		return nil
+	}
+
+	// chats.json and chats.log
+	var chatsData struct {
+		Messages   []Message `json:"messages"`
+		Checkpoint uint64    `json:"checkpoint,omitempty"`
+	}
+	if err := s.load("chats.json", &chatsData); err != nil {
+		return fmt.Errorf("%w (fix it before re-encrypting)", err)
+	}
+	records, torn, err := s.readMessageLog()
+	if err != nil {
+		return err
+	}
+	if torn > 0 {
+		return errors.New("chats.log ends in an incomplete record; start and stop the server to recover it first")
+	}
+	chats := reencryptCount{File: "chats.json"}
+	folded := false
+	for _, record := range records {
+		if record.Seq > chatsData.Checkpoint {
+			chatsData.Messages = append(chatsData.Messages, record.Message)
+			chatsData.Checkpoint = record.Seq
+			folded = true
+		}
+	}
+	if chatsData.Messages == nil {
+		chatsData.Messages = []Message{}
+	}
+	for i := range chatsData.Messages {
+		message := &chatsData.Messages[i]
+		if message.Id == "" && !envelope.IsBound(message.Content) {
+			message.Id = store.NewMessageId()
+		}
+		if err := reseal(&chats, &message.Content, envelope.MessageContext(message.Id)); err != nil {
+			return err
+		}
+	}
+	counts = append(counts, chats)
+
+	// recentChats.json
+	recentChatsData := RecentChatsData{Chats: []RecentChat{}}
+	if err := s.load("recentChats.json", &recentChatsData); err != nil {
+		return err
+	}
+	recent := reencryptCount{File: "recentChats.json"}
+	for i := range recentChatsData.Chats {
+		chat := &recentChatsData.Chats[i]
+		if err := reseal(&recent, &chat.LastMessage, envelope.RecentChatContext(chat.UserId, chat.ContactId)); err != nil {
+			return err
+		}
+	}
+	counts = append(counts, recent)
+
+	// scheduled.json
+	scheduledData := ScheduledData{Messages: []ScheduledMessage{}}
+	if err := s.load("scheduled.json", &scheduledData); err != nil {
+		return err
+	}
+	scheduled := reencryptCount{File: "scheduled.json"}
+	for i := range scheduledData.Messages {
+		message := &scheduledData.Messages[i]
+		if err := reseal(&scheduled, &message.Content, envelope.ScheduledContext(message.Id)); err != nil {
+			return err
+		}
+	}
+	counts = append(counts, scheduled)
+
+	// webhook_deadletter.jsonl
+	letters, err := s.loadDeadLetters()
+	if err != nil {
+		return err
+	}
+	deadLetters := reencryptCount{File: "webhook_deadletter.jsonl"}
+	for i := range letters {
+		message := &letters[i].Event.Message
+		if err := reseal(&deadLetters, &message.Content, envelope.MessageContext(message.Id)); err != nil {
+			return err
+		}
+	}
+	counts = append(counts, deadLetters)
+
+	// changes.jsonl
+	changes, err := s.loadChanges()
+	if err != nil {
+		return err
+	}
+	changeLog := reencryptCount{File: "changes.jsonl"}
+	for i := range changes {
+		if changes[i].Message == nil {
+			continue
+		}
+		message := changes[i].Message
+		if err := reseal(&changeLog, &message.Content, envelope.MessageContext(message.Id)); err != nil {
+			return err
+		}
+	}
+	counts = append(counts, changeLog)
+
+	// Archive segments, rewritten one by one under their own names
+	index, err := s.loadArchiveIndex()
+	if err != nil {
+		return err
+	}
+	segments := map[string][]Message{}
+	archive := reencryptCount{File: "archive"}
+	for _, segment := range index.Segments {
+		messages, err := store.ReadSegment(s.dir, segment)
+		if err != nil {
+			return err
+		}
+		before := archive.Changed
+		for i := range messages {
+			message := &messages[i]
+			if message.Id == "" && !envelope.IsBound(message.Content) {
+				message.Id = store.NewMessageId()
+			}
+			if err := reseal(&archive, &message.Content, envelope.MessageContext(message.Id)); err != nil {
+				return fmt.Errorf("%s: %w", segment.File, err)
+			}
+		}
+		if archive.Changed > before {
+			segments[segment.File] = messages
+		}
+	}
+	counts = append(counts, archive)
+
+	if !*dryRun {
+		if chats.Changed > 0 || folded {
+			if err := s.save("chats.json", chatsData); err != nil {
+				return err
+			}
+			if err := os.Truncate(s.path(store.LogFile), 0); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		if recent.Changed > 0 {
+			if err := s.save("recentChats.json", recentChatsData); err != nil {
+				return err
+			}
+		}
+		if scheduled.Changed > 0 {
+			if err := s.save("scheduled.json", scheduledData); err != nil {
+				return err
+			}
+		}
+		if deadLetters.Changed > 0 {
+			if err := s.saveDeadLetters(letters); err != nil {
+				return err
+			}
+		}
+		if changeLog.Changed > 0 {
+			if err := s.saveChanges(changes); err != nil {
+				return err
+			}
+		}
+		for file, messages := range segments {
+			if err := store.WriteSegment(s.dir, file, messages); err != nil {
+				return err
+			}
+		}
+	}
+
+	if a.asJSON {
+		return a.printJSON(map[string]interface{}{"success": true, "dryRun": *dryRun, "key": s.keys.Active(), "files": counts})
+	}
+	verb := "Re-encrypted"
+	if *dryRun {
+		verb = "Would re-encrypt"
+	}
+	for _, count := range counts {
+		fmt.Printf("%-26s %d of %d values\n", count.File, count.Changed, count.Values)
+	}
+	fmt.Printf("%s under key %s. Snapshots still need the old keys.\n", verb, s.keys.Active())
+	return nil
+}
+
+// Read the dead-letter log, one JSON object per line
+func (s dataStore) loadDeadLetters() ([]DeadLetter, error) {
+	file, err := os.Open(s.path("webhook_deadletter.jsonl"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var letters []DeadLetter
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var letter DeadLetter
+		if err := json.Unmarshal(scanner.Bytes(), &letter); err != nil {
+			return nil, fmt.Errorf("webhook_deadletter.jsonl: %w", err)
+		}
+		letters = append(letters, letter)
+	}
+	return letters, scanner.Err()
+}
+
+// Replace the dead-letter log
+func (s dataStore) saveDeadLetters(letters []DeadLetter) error {
+	var buf strings.Builder
+	for _, letter := range letters {
+		line, err := json.Marshal(letter)
+		if err != nil {
+			return err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	tmp := s.path("webhook_deadletter.jsonl.tmp")
+	if err := os.WriteFile(tmp, []byte(buf.String()), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path("webhook_deadletter.jsonl"))
+}
+
+// Read the change log kept for device sync, one JSON object per line
+func (s dataStore) loadChanges() ([]Change, error) {
+	file, err := os.Open(s.path("changes.jsonl"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var changes []Change
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var change Change
+		if err := json.Unmarshal(scanner.Bytes(), &change); err != nil {
+			return nil, fmt.Errorf("changes.jsonl: %w", err)
+		}
+		changes = append(changes, change)
+	}
+	return changes, scanner.Err()
+}
+
+// Replace the change log
+func (s dataStore) saveChanges(changes []Change) error {
+	var buf strings.Builder
+	for _, change := range changes {
+		line, err := json.Marshal(change)
+		if err != nil {
+			return err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	tmp := s.path("changes.jsonl.tmp")
+	if err := os.WriteFile(tmp, []byte(buf.String()), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path("changes.jsonl"))
+}
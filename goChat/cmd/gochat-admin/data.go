@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gochat/internal/envelope"
+	"gochat/internal/store"
+)
+
+// The data file types come from internal/store, shared with the server
+type (
+	User             = store.User
+	UsersData        = store.UsersData
+	Message          = store.Message
+	RecentChat       = store.RecentChat
+	RecentChatsData  = store.RecentChatsData
+	ScheduledMessage = store.ScheduledMessage
+	ScheduledData    = store.ScheduledData
+	DeadLetter       = store.DeadLetter
+	Change           = store.Change
+	ArchiveSegment   = store.ArchiveSegment
+	ArchiveIndex     = store.ArchiveIndex
+)
+
+// dataStore reads and writes the data files in one directory. keys is the
+// encryption key ring, empty when message bodies aren't encrypted or the
+// keys weren't given.
+type dataStore struct {
+	dir  string
+	keys envelope.Ring
+}
+
+// Absolute path of a data file
+func (s dataStore) path(name string) string {
+	return filepath.Join(s.dir, name)
+}
+
+// Decode a JSON data file into v. A missing file leaves v untouched.
+func (s dataStore) load(name string, v interface{}) error {
+	data, err := os.ReadFile(s.path(name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return nil
+}
+
+// Write a JSON data file in the server's format. The new content goes to a
+// temporary file first so a crash can't leave a half-written file behind.
+func (s dataStore) save(name string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path(name + ".tmp")
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path(name))
+}
+
+// Keep a copy of a data file before replacing it
+func (s dataStore) backup(name string) (string, error) {
+	data, err := os.ReadFile(s.path(name))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	backup := s.path(fmt.Sprintf("%s.%s.bak", name, time.Now().Format("20060102-150405")))
+	return backup, os.WriteFile(backup, data, 0644)
+}
+
+func (s dataStore) loadUsers() (UsersData, error) {
+	usersData := UsersData{Users: []User{}}
+	err := s.load("users.json", &usersData)
+	return usersData, err
+}
+
+func (s dataStore) saveUsers(usersData UsersData) error {
+	return s.save("users.json", usersData)
+}
+
+// Read chats.json one message at a time so a single bad entry, such as a
+// malformed timestamp, doesn't hide the rest, followed by the messages in
+// chats.log that are newer than the checkpoint. Messages that can't be
+// decoded or decrypted are reported by index in bad; bodies encrypted with
+// a key that isn't loaded are left encrypted.
+func (s dataStore) loadMessages() (messages []Message, bad map[int]error, err error) {
+	var raw struct {
+		Messages   []json.RawMessage `json:"messages"`
+		Checkpoint uint64            `json:"checkpoint"`
+	}
+	if err := s.load("chats.json", &raw); err != nil {
+		return nil, nil, err
+	}
+
+	records, _, err := s.readMessageLog()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, record := range records {
+		if record.Seq > raw.Checkpoint {
+			entry, err := json.Marshal(record.Message)
+			if err != nil {
+				return nil, nil, err
+			}
+			raw.Messages = append(raw.Messages, entry)
+		}
+	}
+
+	bad = map[int]error{}
+	for i, entry := range raw.Messages {
+		var message Message
+		if err := json.Unmarshal(entry, &message); err != nil {
+			bad[i] = err
+			continue
+		}
+		if message.Content, err = s.openText(message.Content, envelope.MessageContext(message.Id)); err != nil && !errors.Is(err, envelope.ErrNoKey) {
+			bad[i] = err
+			continue
+		}
+		messages = append(messages, message)
+	}
+	return messages, bad, nil
+}
+
+// Read chats.json with the messages of chats.log that are newer than the
+// checkpoint folded in, and decrypt every body. Unlike loadMessages this
+// fails on anything it can't read, for the commands that rewrite
+// chats.json.
+func (s dataStore) loadChats() (store.ChatsData, error) {
+	chatsData := store.ChatsData{Messages: []Message{}}
+	if err := s.load("chats.json", &chatsData); err != nil {
+		return chatsData, fmt.Errorf("%w (run check)", err)
+	}
+	records, torn, err := s.readMessageLog()
+	if err != nil {
+		return chatsData, err
+	}
+	if torn > 0 {
+		return chatsData, errors.New("chats.log ends in an incomplete record; start and stop the server to recover it first")
+	}
+	for _, record := range records {
+		if record.Seq > chatsData.Checkpoint {
+			chatsData.Messages = append(chatsData.Messages, record.Message)
+			chatsData.Checkpoint = record.Seq
+		}
+	}
+	if chatsData.Messages == nil {
+		chatsData.Messages = []Message{}
+	}
+
+	for i, message := range chatsData.Messages {
+		content, err := s.openText(message.Content, envelope.MessageContext(message.Id))
+		if errors.Is(err, envelope.ErrNoKey) {
+			return chatsData, errors.New("messages are encrypted with keys that aren't loaded; pass -keys or set GOCHAT_ENCRYPTION_KEYS")
+		}
+		if err != nil {
+			return chatsData, fmt.Errorf("chats.json: message %d: %w", i, err)
+		}
+		chatsData.Messages[i].Content = content
+	}
+	return chatsData, nil
+}
+
+// Write chats.json the way the server checkpoints it, with the bodies
+// encrypted, and empty chats.log, whose messages it now holds
+func (s dataStore) saveChats(chatsData store.ChatsData) error {
+	messages, err := s.sealMessages(chatsData.Messages)
+	if err != nil {
+		return err
+	}
+	if err := s.save("chats.json", store.ChatsData{Messages: messages, Checkpoint: chatsData.Checkpoint}); err != nil {
+		return err
+	}
+	if err := os.Truncate(s.path(store.LogFile), 0); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Read the complete records of chats.log. torn counts the bytes after the
+// last complete record, left by an interrupted write; the server truncates
+// them when it starts.
+func (s dataStore) readMessageLog() (records []store.LogRecord, torn int64, err error) {
+	records, valid, size, err := store.ReadLog(s.dir)
+	return records, size - valid, err
+}
+
+func (s dataStore) loadArchiveIndex() (ArchiveIndex, error) {
+	return store.LoadArchiveIndex(s.dir)
+}
+
+// Read every message of one archive segment, decrypting what the loaded
+// keys allow
+func (s dataStore) readSegment(segment ArchiveSegment) ([]Message, error) {
+	messages, err := store.ReadSegment(s.dir, segment)
+	if err != nil {
+		return nil, err
+	}
+	for i, message := range messages {
+		if messages[i].Content, err = s.openText(message.Content, envelope.MessageContext(message.Id)); err != nil && !errors.Is(err, envelope.ErrNoKey) {
+			return nil, fmt.Errorf("%s: %w", segment.File, err)
+		}
+	}
+	return messages, nil
+}
+
+// Encrypt the lastMessage of every entry for writing recentChats.json
+func (s dataStore) sealRecentChats(recentChatsData RecentChatsData) (RecentChatsData, error) {
+	sealed := RecentChatsData{Chats: make([]RecentChat, len(recentChatsData.Chats))}
+	for i, chat := range recentChatsData.Chats {
+		lastMessage, err := s.sealText(chat.LastMessage, envelope.RecentChatContext(chat.UserId, chat.ContactId))
+		if err != nil {
+			return sealed, err
+		}
+		chat.LastMessage = lastMessage
+		sealed.Chats[i] = chat
+	}
+	return sealed, nil
+}
+
+// Regenerate recentChats.json from messages and the archive, as the
+// server does when it rebuilds
+func (s dataStore) rebuildRecentChats(messages []Message) (RecentChatsData, error) {
+	latest := store.LatestMessages(messages)
+	index, err := s.loadArchiveIndex()
+	if err != nil {
+		return RecentChatsData{}, err
+	}
+	if err := store.AddArchivedLatest(latest, index, s.readSegment); err != nil {
+		return RecentChatsData{}, err
+	}
+	recentChatsData := store.RecentChatsFromLatest(latest)
+	sealed, err := s.sealRecentChats(recentChatsData)
+	if err != nil {
+		return recentChatsData, err
+	}
+	return recentChatsData, s.save("recentChats.json", sealed)
+}
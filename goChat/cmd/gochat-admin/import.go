@@ -0,0 +1,647 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// History from other chat apps is imported with
+//
+//	gochat-admin import-slack [-user-map map.json] [-dry-run] export.zip
+//	gochat-admin import-whatsapp [-user-map map.json] [-dry-run] [-date-order dmy|mdy] [-tz zone] chat.txt
+//
+// goChat only has one-on-one conversations, so Slack DMs are imported, as
+// are channels in which exactly two mapped users posted; other channels and
+// WhatsApp group chats are reported and skipped. Imported messages keep
+// their original timestamps, are marked read, and are merged into
+// chats.json in time order. Messages that are already present are skipped,
+// so an import can safely be re-run after fixing the user map.
+
+// ImportOptions controls an import run
+type ImportOptions struct {
+	UserMap   map[string]string // Source user ID, name or email -> goChat UserId
+	DryRun    bool
+	DateOrder string         // WhatsApp only: "dmy", "mdy" or "" to detect
+	Location  *time.Location // WhatsApp only: zone the export's times are in
+}
+
+// ImportReport summarizes an import run
+type ImportReport struct {
+	Conversations map[string]int `json:"conversations"` // "alice <-> bob" -> messages found
+	Imported      int            `json:"imported"`
+	Duplicates    int            `json:"duplicates"`
+	Unmapped      map[string]int `json:"unmapped"` // Source user -> messages that couldn't be imported
+	Skipped       []string       `json:"skipped"`  // Channels or chats that couldn't be imported, with the reason
+}
+
+// Read a user map file: a JSON object from source user to goChat UserId
+func loadUserMap(path string) (map[string]string, error) {
+	userMap := map[string]string{}
+	if path == "" {
+		return userMap, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &userMap); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return userMap, nil
+}
+
+// userMapper resolves source users to goChat users. Explicit map entries
+// win; otherwise a source user matches a goChat user with the same email
+// or the same UserId, ignoring case.
+type userMapper struct {
+	explicit map[string]string
+	byEmail  map[string]string
+	byId     map[string]string
+}
+
+func (s dataStore) newUserMapper(explicit map[string]string) (*userMapper, error) {
+	usersData, err := s.loadUsers()
+	if err != nil {
+		return nil, err
+	}
+	mapper := &userMapper{explicit: explicit, byEmail: map[string]string{}, byId: map[string]string{}}
+	for _, user := range usersData.Users {
+		mapper.byId[strings.ToLower(user.UserId)] = user.UserId
+		if user.Email != "" {
+			mapper.byEmail[strings.ToLower(user.Email)] = user.UserId
+		}
+	}
+	return mapper, nil
+}
+
+// Find the goChat user for any of a source user's identifiers
+func (m *userMapper) resolve(keys ...string) (string, bool) {
+	for _, key := range keys {
+		if target, ok := m.explicit[key]; ok && key != "" {
+			userId, exists := m.byId[strings.ToLower(target)]
+			return userId, exists
+		}
+	}
+	for _, key := range keys {
+		if key == "" {
+			continue
+		}
+		if userId, ok := m.byEmail[strings.ToLower(key)]; ok {
+			return userId, true
+		}
+		if userId, ok := m.byId[strings.ToLower(key)]; ok {
+			return userId, true
+		}
+	}
+	return "", false
+}
+
+// Slack export structures, limited to the fields the importer needs
+type slackUser struct {
+	Id      string `json:"id"`
+	Name    string `json:"name"`
+	Profile struct {
+		RealName    string `json:"real_name"`
+		DisplayName string `json:"display_name"`
+		Email       string `json:"email"`
+	} `json:"profile"`
+}
+
+type slackChannel struct {
+	Id      string   `json:"id"`
+	Name    string   `json:"name"`
+	Members []string `json:"members"`
+}
+
+type slackMessage struct {
+	Type    string `json:"type"`
+	Subtype string `json:"subtype"`
+	User    string `json:"user"`
+	Text    string `json:"text"`
+	Ts      string `json:"ts"`
+	Files   []struct {
+		Name string `json:"name"`
+	} `json:"files"`
+}
+
+// Slack subtypes that are real messages rather than channel events
+var slackMessageSubtypes = map[string]bool{"": true, "me_message": true, "thread_broadcast": true, "file_share": true}
+
+// Mentions look like <@U012AB3CD> or <@U012AB3CD|name>
+var slackMentionPattern = regexp.MustCompile(`<@([A-Z0-9]+)(\|[^>]*)?>`)
+
+// Parse a Slack "ts" value ("1355517523.000005") as a time
+func parseSlackTimestamp(ts string) (time.Time, error) {
+	seconds, fraction, _ := strings.Cut(ts, ".")
+	sec, err := strconv.ParseInt(seconds, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid ts %q", ts)
+	}
+	var micros int64
+	if fraction != "" {
+		fraction = (fraction + "000000")[:6]
+		if micros, err = strconv.ParseInt(fraction, 10, 64); err != nil {
+			return time.Time{}, fmt.Errorf("invalid ts %q", ts)
+		}
+	}
+	return time.Unix(sec, micros*1000), nil
+}
+
+// Decode a JSON file from the zip, treating a missing file as empty
+func readZipJSON(files map[string]*zip.File, name string, out interface{}) error {
+	file, ok := files[name]
+	if !ok {
+		return nil
+	}
+	reader, err := file.Open()
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	if err := json.NewDecoder(reader).Decode(out); err != nil {
+		return fmt.Errorf("parsing %s: %w", name, err)
+	}
+	return nil
+}
+
+// Read a Slack workspace export zip into goChat messages
+func (s dataStore) readSlackExport(zipPath string, opts ImportOptions, report *ImportReport) ([]Message, error) {
+	archive, err := zip.OpenReader(zipPath)
+	if err != nil {
+		return nil, err
+	}
+	defer archive.Close()
+
+	files := map[string]*zip.File{}
+	for _, file := range archive.File {
+		files[file.Name] = file
+	}
+
+	var users []slackUser
+	if err := readZipJSON(files, "users.json", &users); err != nil {
+		return nil, err
+	}
+	if _, ok := files["users.json"]; !ok {
+		return nil, errors.New("users.json not found; is this a Slack export?")
+	}
+
+	mapper, err := s.newUserMapper(opts.UserMap)
+	if err != nil {
+		return nil, err
+	}
+	mapped := map[string]string{} // Slack user ID -> goChat UserId
+	names := map[string]string{}  // Slack user ID -> name for reports
+	for _, user := range users {
+		names[user.Id] = user.Name
+		if userId, ok := mapper.resolve(user.Id, user.Name, user.Profile.Email, user.Profile.DisplayName, user.Profile.RealName); ok {
+			mapped[user.Id] = userId
+		}
+	}
+
+	// Conversations are directories named after the channel, or after the
+	// conversation ID for DMs and private groups
+	type conversation struct {
+		dir    string
+		label  string
+		direct bool
+	}
+	var conversations []conversation
+	for _, listing := range []struct {
+		file   string
+		direct bool
+	}{{"channels.json", false}, {"groups.json", false}, {"mpims.json", false}, {"dms.json", true}} {
+		var channels []slackChannel
+		if err := readZipJSON(files, listing.file, &channels); err != nil {
+			return nil, err
+		}
+		for _, channel := range channels {
+			dir, label := channel.Name, "#"+channel.Name
+			if dir == "" {
+				dir, label = channel.Id, "DM "+channel.Id
+			}
+			conversations = append(conversations, conversation{dir: dir, label: label, direct: listing.direct})
+		}
+	}
+
+	var messages []Message
+	for _, conv := range conversations {
+		var dayFiles []string
+		for name := range files {
+			if path.Dir(name) == conv.dir && strings.HasSuffix(name, ".json") {
+				dayFiles = append(dayFiles, name)
+			}
+		}
+		sort.Strings(dayFiles)
+
+		var posted []slackMessage
+		for _, name := range dayFiles {
+			var day []slackMessage
+			if err := readZipJSON(files, name, &day); err != nil {
+				return nil, err
+			}
+			posted = append(posted, day...)
+		}
+
+		// Work out who the conversation is between
+		participants := map[string]bool{}
+		unmappedHere := map[string]int{}
+		for _, msg := range posted {
+			if msg.Type != "message" || !slackMessageSubtypes[msg.Subtype] || msg.User == "" {
+				continue
+			}
+			if userId, ok := mapped[msg.User]; ok {
+				participants[userId] = true
+			} else {
+				unmappedHere[names[msg.User]+" ("+msg.User+")"]++
+			}
+		}
+		for name, count := range unmappedHere {
+			report.Unmapped[name] += count
+		}
+		if len(participants) != 2 {
+			reason := fmt.Sprintf("%d mapped participants", len(participants))
+			if !conv.direct && len(participants) > 2 {
+				reason = "group conversations are not supported"
+			}
+			report.Skipped = append(report.Skipped, fmt.Sprintf("%s: %s", conv.label, reason))
+			continue
+		}
+		var pair []string
+		for userId := range participants {
+			pair = append(pair, userId)
+		}
+		sort.Strings(pair)
+
+		count := 0
+		for _, msg := range posted {
+			if msg.Type != "message" || !slackMessageSubtypes[msg.Subtype] {
+				continue
+			}
+			sender, ok := mapped[msg.User]
+			if !ok {
+				continue
+			}
+			timestamp, err := parseSlackTimestamp(msg.Ts)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", conv.label, err)
+			}
+
+			content := slackMentionPattern.ReplaceAllStringFunc(msg.Text, func(mention string) string {
+				id := slackMentionPattern.FindStringSubmatch(mention)[1]
+				if userId, ok := mapped[id]; ok {
+					return "@" + userId
+				}
+				return "@" + names[id]
+			})
+			content = strings.NewReplacer("&lt;", "<", "&gt;", ">", "&amp;", "&").Replace(content)
+			if msg.Subtype == "me_message" {
+				content = "* " + sender + " " + content
+			}
+			// Attachments aren't supported; keep a note of what was shared
+			for _, file := range msg.Files {
+				content = strings.TrimSpace(content + "\n[file: " + file.Name + "]")
+			}
+			if strings.TrimSpace(content) == "" {
+				continue
+			}
+
+			receiver := pair[0]
+			if receiver == sender {
+				receiver = pair[1]
+			}
+			messages = append(messages, Message{
+				Sender:    sender,
+				Receiver:  receiver,
+				Content:   content,
+				Timestamp: timestamp,
+				IsRead:    true,
+			})
+			count++
+		}
+		report.Conversations[pair[0]+" <-> "+pair[1]] += count
+	}
+	return messages, nil
+}
+
+// WhatsApp message headers, e.g. "12/31/20, 9:41 PM - Alice: Hi" (Android)
+// or "[31/12/2020, 21:41:05] Alice: Hi" (iOS)
+var (
+	whatsAppAndroidLine = regexp.MustCompile(`^(\d{1,2})[/.](\d{1,2})[/.](\d{2,4}),? (\d{1,2}:\d{2}(?::\d{2})?)(?: ?([AaPp]\.? ?[Mm]\.?))? - (.*)$`)
+	whatsAppIOSLine     = regexp.MustCompile(`^\[(\d{1,2})[/.](\d{1,2})[/.](\d{2,4}),? (\d{1,2}:\d{2}(?::\d{2})?)(?: ?([AaPp]\.? ?[Mm]\.?))?\] (.*)$`)
+)
+
+// One header line of a WhatsApp export before the date is interpreted
+type whatsAppEntry struct {
+	first, second, year int
+	clock, meridiem     string
+	sender, content     string
+}
+
+// Turn a parsed header into a time, given the export's day/month order
+func (e whatsAppEntry) timestamp(dayFirst bool, loc *time.Location) (time.Time, error) {
+	day, month := e.first, e.second
+	if !dayFirst {
+		day, month = e.second, e.first
+	}
+	year := e.year
+	if year < 100 {
+		year += 2000
+	}
+
+	layout := "15:04"
+	if strings.Count(e.clock, ":") == 2 {
+		layout = "15:04:05"
+	}
+	clock := e.clock
+	if e.meridiem != "" {
+		layout = strings.Replace(layout, "15", "3", 1) + " PM"
+		clock += " " + strings.ToUpper(strings.NewReplacer(".", "", " ", "").Replace(e.meridiem))
+	}
+	t, err := time.Parse(layout, clock)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if month < 1 || month > 12 || day < 1 || day > 31 {
+		return time.Time{}, fmt.Errorf("invalid date %d/%d/%d", e.first, e.second, e.year)
+	}
+	return time.Date(year, time.Month(month), day, t.Hour(), t.Minute(), t.Second(), 0, loc), nil
+}
+
+// Read a WhatsApp "Export chat" text file into goChat messages
+func (s dataStore) readWhatsAppExport(filePath string, opts ImportOptions, report *ImportReport) ([]Message, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	// Newer exports use invisible direction marks and narrow spaces
+	cleaner := strings.NewReplacer("\u200e", "", "\u200f", "", "\u202f", " ", "\u00a0", " ", "\ufeff", "")
+
+	var entries []whatsAppEntry
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := cleaner.Replace(strings.TrimRight(scanner.Text(), "\r"))
+		match := whatsAppAndroidLine.FindStringSubmatch(line)
+		if match == nil {
+			match = whatsAppIOSLine.FindStringSubmatch(line)
+		}
+		if match == nil {
+			// Continuation of a multi-line message
+			if len(entries) > 0 {
+				entries[len(entries)-1].content += "\n" + line
+			}
+			continue
+		}
+
+		first, _ := strconv.Atoi(match[1])
+		second, _ := strconv.Atoi(match[2])
+		year, _ := strconv.Atoi(match[3])
+		sender, content, ok := strings.Cut(match[6], ": ")
+		if !ok {
+			// Notices such as "Messages are end-to-end encrypted" have no sender
+			entries = append(entries, whatsAppEntry{})
+			continue
+		}
+		entries = append(entries, whatsAppEntry{
+			first: first, second: second, year: year,
+			clock: match[4], meridiem: match[5],
+			sender: sender, content: content,
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	// Day/month order depends on the phone's locale. Detect it from any
+	// date that's only valid one way round, defaulting to day first.
+	dayFirst := opts.DateOrder != "mdy"
+	if opts.DateOrder == "" {
+		for _, entry := range entries {
+			if entry.first > 12 {
+				dayFirst = true
+				break
+			}
+			if entry.second > 12 {
+				dayFirst = false
+				break
+			}
+		}
+	}
+
+	mapper, err := s.newUserMapper(opts.UserMap)
+	if err != nil {
+		return nil, err
+	}
+	senders := map[string]string{} // WhatsApp name -> goChat UserId
+	var names []string
+	for _, entry := range entries {
+		if entry.sender == "" {
+			continue
+		}
+		if _, seen := senders[entry.sender]; seen {
+			continue
+		}
+		names = append(names, entry.sender)
+		userId, _ := mapper.resolve(entry.sender)
+		senders[entry.sender] = userId
+	}
+	if len(names) > 2 {
+		report.Skipped = append(report.Skipped, fmt.Sprintf("%s: group conversations are not supported (%d participants)", path.Base(filePath), len(names)))
+		return nil, nil
+	}
+
+	participants := map[string]bool{}
+	for _, name := range names {
+		if senders[name] != "" {
+			participants[senders[name]] = true
+		}
+	}
+	if len(participants) != 2 {
+		for _, entry := range entries {
+			if entry.sender != "" && senders[entry.sender] == "" {
+				report.Unmapped[entry.sender]++
+			}
+		}
+		report.Skipped = append(report.Skipped, fmt.Sprintf("%s: need two mapped participants, found %d", path.Base(filePath), len(participants)))
+		return nil, nil
+	}
+	pair := []string{senders[names[0]], senders[names[1]]}
+	sort.Strings(pair)
+
+	var messages []Message
+	for _, entry := range entries {
+		if entry.sender == "" {
+			continue
+		}
+		timestamp, err := entry.timestamp(dayFirst, opts.Location)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path.Base(filePath), err)
+		}
+		sender := senders[entry.sender]
+		receiver := pair[0]
+		if receiver == sender {
+			receiver = pair[1]
+		}
+		messages = append(messages, Message{
+			Sender:    sender,
+			Receiver:  receiver,
+			Content:   strings.TrimSpace(entry.content),
+			Timestamp: timestamp,
+			IsRead:    true,
+		})
+	}
+	report.Conversations[pair[0]+" <-> "+pair[1]] += len(messages)
+	return messages, nil
+}
+
+// Merge imported messages into chats.json in time order, skipping ones
+// that are already stored, and rebuild the recent chats
+func (s dataStore) mergeImportedMessages(imported []Message, dryRun bool, report *ImportReport) error {
+	chatsData, err := s.loadChats()
+	if err != nil {
+		return err
+	}
+
+	existing := map[string]bool{}
+	messageKey := func(message Message) string {
+		return message.Sender + "\x00" + message.Receiver + "\x00" + strconv.FormatInt(message.Timestamp.UnixNano(), 10) + "\x00" + message.Content
+	}
+	for _, message := range chatsData.Messages {
+		existing[messageKey(message)] = true
+	}
+
+	for _, message := range imported {
+		key := messageKey(message)
+		if existing[key] {
+			report.Duplicates++
+			continue
+		}
+		existing[key] = true
+		chatsData.Messages = append(chatsData.Messages, message)
+		report.Imported++
+	}
+	if dryRun || report.Imported == 0 {
+		return nil
+	}
+
+	sort.SliceStable(chatsData.Messages, func(i, j int) bool {
+		return chatsData.Messages[i].Timestamp.Before(chatsData.Messages[j].Timestamp)
+	})
+	if err := s.saveChats(chatsData); err != nil {
+		return err
+	}
+	_, err = s.rebuildRecentChats(chatsData.Messages)
+	return err
+}
+
+// Print the outcome of an import
+func printImportReport(w io.Writer, report *ImportReport, dryRun bool) {
+	if dryRun {
+		fmt.Fprintln(w, "Dry run: nothing was written")
+	}
+
+	var conversations []string
+	for name := range report.Conversations {
+		conversations = append(conversations, name)
+	}
+	sort.Strings(conversations)
+	for _, name := range conversations {
+		fmt.Fprintf(w, "  %s: %d messages\n", name, report.Conversations[name])
+	}
+
+	verb := "Imported"
+	if dryRun {
+		verb = "Would import"
+	}
+	fmt.Fprintf(w, "%s %d messages (%d already present)\n", verb, report.Imported, report.Duplicates)
+
+	if len(report.Skipped) > 0 {
+		fmt.Fprintln(w, "Skipped:")
+		for _, skipped := range report.Skipped {
+			fmt.Fprintln(w, "  "+skipped)
+		}
+	}
+	if len(report.Unmapped) > 0 {
+		var unmapped []string
+		for name := range report.Unmapped {
+			unmapped = append(unmapped, name)
+		}
+		sort.Strings(unmapped)
+		fmt.Fprintln(w, "Unmapped users (add them to the -user-map file):")
+		for _, name := range unmapped {
+			fmt.Fprintf(w, "  %s: %d messages\n", name, report.Unmapped[name])
+		}
+	}
+}
+
+// importHistory imports a Slack export or a WhatsApp chat, depending on
+// kind ("slack" or "whatsapp")
+func (a *admin) importHistory(kind string, args []string) error {
+	flags := flag.NewFlagSet("import-"+kind, flag.ContinueOnError)
+	userMapFile := flags.String("user-map", "", "JSON `file` mapping imported users to goChat user IDs")
+	dryRun := flags.Bool("dry-run", false, "report what the import would do without writing anything")
+	usageText := "usage: import-slack [-user-map F] [-dry-run] <export.zip>"
+	var dateOrder, zone *string
+	if kind == "whatsapp" {
+		dateOrder = flags.String("date-order", "", "date order of the export: dmy or mdy (detected by default)")
+		zone = flags.String("tz", "Local", "time zone of the times in the export")
+		usageText = "usage: import-whatsapp [-user-map F] [-dry-run] [-date-order dmy|mdy] [-tz Z] <chat.txt>"
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New(usageText)
+	}
+	source := flags.Arg(0)
+
+	userMap, err := loadUserMap(*userMapFile)
+	if err != nil {
+		return fmt.Errorf("reading user map: %w", err)
+	}
+	opts := ImportOptions{UserMap: userMap, DryRun: *dryRun}
+	if kind == "whatsapp" {
+		if *dateOrder != "" && *dateOrder != "dmy" && *dateOrder != "mdy" {
+			return errors.New("-date-order must be dmy or mdy")
+		}
+		loc, err := time.LoadLocation(*zone)
+		if err != nil {
+			return fmt.Errorf("unknown time zone %q", *zone)
+		}
+		opts.DateOrder, opts.Location = *dateOrder, loc
+	}
+
+	report := &ImportReport{Conversations: map[string]int{}, Unmapped: map[string]int{}, Skipped: []string{}}
+	var messages []Message
+	if kind == "slack" {
+		messages, err = a.store.readSlackExport(source, opts, report)
+	} else {
+		messages, err = a.store.readWhatsAppExport(source, opts, report)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := a.store.mergeImportedMessages(messages, opts.DryRun, report); err != nil {
+		return err
+	}
+	if a.asJSON {
+		return a.printJSON(map[string]interface{}{"success": true, "dryRun": opts.DryRun, "report": report})
+	}
+	printImportReport(os.Stdout, report, opts.DryRun)
+	return nil
+}
@@ -0,0 +1,508 @@
+// Command gochat-admin maintains a goChat data directory offline. Stop the
+// server before using it: the server doesn't expect its files to change
+// underneath it.
+//
+// Usage:
+//
+//	gochat-admin [-data DIR] [-json] <command> [arguments]
+//
+// Commands:
+//
+//	create-user [-email E] [-admin] <user>   add an account
+//	reset-password [-force] <user>           set a new password
+//	promote-admin <user>                     give a user the admin role
+//	check                                    verify users.json, chats.json and recentChats.json
+//	rebuild-recent                           regenerate recentChats.json from chats.json
+//	compact                                  apply the retention policies once
+//	stats                                    print counts and file sizes
+//	snapshot [-keep N]                       take a snapshot and delete all but the newest N
+//	snapshots                                list the server's snapshots
+//	verify-snapshot <name|latest>            check a snapshot against its manifest
+//	restore [-dry-run] <name|latest>         roll back to a snapshot
+//	restore [-dry-run] -at <time>            roll back to the newest snapshot at or before a time
+//	gen-key <id>                             print a new encryption key ring entry
+//	reencrypt [-dry-run]                     encrypt message bodies under the first key of the ring
+//	import-slack [flags] <export.zip>        import direct messages from a Slack export
+//	import-whatsapp [flags] <chat.txt>       import a WhatsApp chat export
+//
+// Passwords are read from GOCHAT_PASSWORD or the first line of stdin. The
+// server also rebuilds recentChats.json at startup when it doesn't match
+// the messages; rebuild-recent does the same without starting it. Messages
+// the server has appended to chats.log but not yet checkpointed into
+// chats.json are read along with it. When message bodies are encrypted at
+// rest, the tool reads the same key ring as the server (-keys or
+// GOCHAT_ENCRYPTION_KEYS); without it, encrypted bodies stay encrypted and
+// the recent chats comparison is skipped; compact and the imports, which
+// rewrite chats.json, refuse to run.
+//
+// The imports take -user-map (a JSON file mapping source users to goChat
+// user IDs) and -dry-run; import-whatsapp also takes -date-order (dmy or
+// mdy, detected by default) and -tz (the zone of the export's times).
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gochat/internal/envelope"
+	"gochat/internal/store"
+	"gochat/internal/validate"
+)
+
+// admin holds the options shared by every command
+type admin struct {
+	store  dataStore
+	asJSON bool
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, `Usage: gochat-admin [flags] <command> [arguments]
+
+Works directly on the data files; stop the server first.
+
+Commands:
+  create-user [-email E] [-admin] <user>   add an account
+  reset-password [-force] <user>           set a new password
+  promote-admin <user>                     give a user the admin role
+  check                                    verify users.json, chats.json and recentChats.json
+  rebuild-recent                           regenerate recentChats.json from chats.json
+  compact                                  apply the retention policies once
+  stats                                    print counts and file sizes
+  snapshot [-keep N]                       take a snapshot and delete all but the newest N
+  snapshots                                list the server's snapshots
+  verify-snapshot <name|latest>            check a snapshot against its manifest
+  restore [-dry-run] <name|latest>         roll back to a snapshot
+  restore [-dry-run] -at <time>            roll back to the newest snapshot at or before a time
+  gen-key <id>                             print a new encryption key ring entry
+  reencrypt [-dry-run]                     encrypt message bodies under the first key of the ring
+  import-slack [flags] <export.zip>        import direct messages from a Slack export
+  import-whatsapp [flags] <chat.txt>       import a WhatsApp chat export
+
+Flags:`)
+	flag.PrintDefaults()
+}
+
+func main() {
+	dataDir := flag.String("data", ".", "goChat data `directory` (where users.json lives)")
+	asJSON := flag.Bool("json", false, "print machine-readable JSON instead of text")
+	keyFile := flag.String("keys", "", "encryption key ring `file` (default $GOCHAT_ENCRYPTION_KEYS)")
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	keys, err := envelope.LoadRing(*keyFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "gochat-admin: reading encryption keys:", err)
+		os.Exit(1)
+	}
+	a := &admin{store: dataStore{dir: *dataDir, keys: keys}, asJSON: *asJSON}
+
+	command, args := flag.Arg(0), flag.Args()[1:]
+	switch command {
+	case "create-user":
+		err = a.createUser(args)
+	case "reset-password":
+		err = a.resetPassword(args)
+	case "check":
+		err = a.check(args)
+	case "promote-admin":
+		err = a.promoteAdmin(args)
+	case "rebuild-recent":
+		err = a.rebuildRecent(args)
+	case "compact":
+		err = a.compact(args)
+	case "stats":
+		err = a.stats(args)
+	case "snapshots":
+		err = a.snapshots(args)
+	case "snapshot":
+		err = a.snapshot(args)
+	case "verify-snapshot":
+		err = a.verifySnapshot(args)
+	case "restore":
+		err = a.restore(args)
+	case "gen-key":
+		err = a.genKey(args)
+	case "reencrypt":
+		err = a.reencrypt(args)
+	case "import-slack":
+		err = a.importHistory("slack", args)
+	case "import-whatsapp":
+		err = a.importHistory("whatsapp", args)
+	default:
+		fmt.Fprintf(os.Stderr, "gochat-admin: unknown command %q\n", command)
+		usage()
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "gochat-admin:", err)
+		os.Exit(1)
+	}
+}
+
+// Print a value as indented JSON
+func (a *admin) printJSON(value interface{}) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(value)
+}
+
+// Read a password from GOCHAT_PASSWORD or the first line of stdin
+func readPassword() (string, error) {
+	if password := os.Getenv("GOCHAT_PASSWORD"); password != "" {
+		return password, nil
+	}
+	fmt.Fprint(os.Stderr, "Password: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// createUser adds an account, optionally with the admin role
+func (a *admin) createUser(args []string) error {
+	flags := flag.NewFlagSet("create-user", flag.ContinueOnError)
+	email := flags.String("email", "", "email address")
+	isAdmin := flags.Bool("admin", false, "give the user the admin role")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("usage: create-user [-email E] [-admin] <user>")
+	}
+	// The server's registration rules, except that the email is optional
+	userId := validate.NormalizeText(flags.Arg(0))
+	if err := validate.Username(userId); err != nil {
+		return err
+	}
+	userEmail := strings.ToLower(validate.NormalizeText(*email))
+	if userEmail != "" {
+		if err := validate.Email(userEmail); err != nil {
+			return err
+		}
+	}
+
+	usersData, err := a.store.loadUsers()
+	if err != nil {
+		return err
+	}
+	for _, user := range usersData.Users {
+		if user.UserId == userId {
+			return fmt.Errorf("user %q already exists", userId)
+		}
+	}
+
+	password, err := readPassword()
+	if err != nil {
+		return err
+	}
+	password = validate.NormalizePassword(password)
+	if err := validate.Password(password, userId); err != nil {
+		return err
+	}
+
+	usersData.Users = append(usersData.Users, User{
+		UserId:   userId,
+		Password: password,
+		Email:    userEmail,
+		IsAdmin:  *isAdmin,
+	})
+	if err := a.store.saveUsers(usersData); err != nil {
+		return err
+	}
+
+	if a.asJSON {
+		return a.printJSON(map[string]interface{}{"success": true, "userId": userId, "isAdmin": *isAdmin})
+	}
+	fmt.Printf("Created user %s\n", userId)
+	return nil
+}
+
+// resetPassword sets a user's password. With -force the user has to
+// choose a new one at the next login, as after an admin reset on the server.
+func (a *admin) resetPassword(args []string) error {
+	flags := flag.NewFlagSet("reset-password", flag.ContinueOnError)
+	force := flags.Bool("force", false, "make the user change the password at the next login")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("usage: reset-password [-force] <user>")
+	}
+	userId := flags.Arg(0)
+
+	usersData, err := a.store.loadUsers()
+	if err != nil {
+		return err
+	}
+	index := -1
+	for i, user := range usersData.Users {
+		if user.UserId == userId {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		return fmt.Errorf("user %q does not exist", userId)
+	}
+	if usersData.Users[index].IsBot {
+		return fmt.Errorf("%q is a bot; bots authenticate with tokens", userId)
+	}
+
+	password, err := readPassword()
+	if err != nil {
+		return err
+	}
+	password = validate.NormalizePassword(password)
+	if err := validate.Password(password, userId); err != nil {
+		return err
+	}
+
+	usersData.Users[index].Password = password
+	usersData.Users[index].MustResetPassword = *force
+	if err := a.store.saveUsers(usersData); err != nil {
+		return err
+	}
+
+	if a.asJSON {
+		return a.printJSON(map[string]interface{}{"success": true, "userId": userId})
+	}
+	fmt.Printf("Password of %s reset\n", userId)
+	return nil
+}
+
+// promoteAdmin gives a user the admin role, enabling the account if it
+// was disabled. It's how the first admin of a server is made.
+func (a *admin) promoteAdmin(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: promote-admin <user>")
+	}
+	userId := args[0]
+
+	usersData, err := a.store.loadUsers()
+	if err != nil {
+		return err
+	}
+	index := -1
+	for i, user := range usersData.Users {
+		if user.UserId == userId {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		return fmt.Errorf("user %q does not exist", userId)
+	}
+
+	usersData.Users[index].IsAdmin = true
+	usersData.Users[index].Disabled = false
+	if err := a.store.saveUsers(usersData); err != nil {
+		return err
+	}
+
+	if a.asJSON {
+		return a.printJSON(map[string]interface{}{"success": true, "userId": userId})
+	}
+	fmt.Println(userId, "is now an admin")
+	return nil
+}
+
+// rebuildRecent regenerates recentChats.json from chats.json, keeping a
+// backup of the old file
+func (a *admin) rebuildRecent(args []string) error {
+	if len(args) != 0 {
+		return errors.New("usage: rebuild-recent")
+	}
+
+	messages, bad, err := a.store.loadMessages()
+	if err != nil {
+		return err
+	}
+	if len(bad) > 0 {
+		fmt.Fprintf(os.Stderr, "Skipping %d malformed messages in chats.json\n", len(bad))
+	}
+	for _, message := range messages {
+		if envelope.IsSealed(message.Content) {
+			return errors.New("messages are encrypted with keys that aren't loaded; pass -keys or set GOCHAT_ENCRYPTION_KEYS")
+		}
+	}
+
+	backup, err := a.store.backup("recentChats.json")
+	if err != nil {
+		return err
+	}
+	recentChatsData, err := a.store.rebuildRecentChats(messages)
+	if err != nil {
+		return err
+	}
+
+	if a.asJSON {
+		return a.printJSON(map[string]interface{}{"success": true, "chats": len(recentChatsData.Chats), "backup": backup})
+	}
+	fmt.Printf("Rebuilt recentChats.json with %d entries from %d messages\n", len(recentChatsData.Chats), len(messages))
+	if backup != "" {
+		fmt.Println("Previous file saved as", backup)
+	}
+	return nil
+}
+
+// Statistics printed by the stats command
+type statistics struct {
+	Users             int              `json:"users"`
+	Admins            int              `json:"admins"`
+	Bots              int              `json:"bots"`
+	DisabledUsers     int              `json:"disabledUsers"`
+	Messages          int              `json:"messages"`
+	MalformedMessages int              `json:"malformedMessages"`
+	Conversations     int              `json:"conversations"`
+	ArchivedMessages  int              `json:"archivedMessages"`
+	OldestMessage     *time.Time       `json:"oldestMessage,omitempty"`
+	NewestMessage     *time.Time       `json:"newestMessage,omitempty"`
+	TopSenders        []senderCount    `json:"topSenders"`
+	Files             map[string]int64 `json:"files"`
+	TotalBytes        int64            `json:"totalBytes"`
+}
+
+type senderCount struct {
+	UserId   string `json:"userId"`
+	Messages int    `json:"messages"`
+}
+
+// stats prints account and message counts and the size of the data files
+func (a *admin) stats(args []string) error {
+	if len(args) != 0 {
+		return errors.New("usage: stats")
+	}
+
+	st := statistics{Files: map[string]int64{}, TopSenders: []senderCount{}}
+
+	usersData, err := a.store.loadUsers()
+	if err != nil {
+		return err
+	}
+	for _, user := range usersData.Users {
+		st.Users++
+		if user.IsAdmin {
+			st.Admins++
+		}
+		if user.IsBot {
+			st.Bots++
+		}
+		if user.Disabled {
+			st.DisabledUsers++
+		}
+	}
+
+	messages, bad, err := a.store.loadMessages()
+	if err != nil {
+		return err
+	}
+	st.Messages = len(messages)
+	st.MalformedMessages = len(bad)
+	conversations := map[[2]string]bool{}
+	sent := map[string]int{}
+	for _, message := range messages {
+		conversations[store.ConversationKey(message.Sender, message.Receiver)] = true
+		sent[message.Sender]++
+		if message.Timestamp.IsZero() {
+			continue
+		}
+		if st.OldestMessage == nil || message.Timestamp.Before(*st.OldestMessage) {
+			t := message.Timestamp
+			st.OldestMessage = &t
+		}
+		if st.NewestMessage == nil || message.Timestamp.After(*st.NewestMessage) {
+			t := message.Timestamp
+			st.NewestMessage = &t
+		}
+	}
+	st.Conversations = len(conversations)
+	for userId, count := range sent {
+		st.TopSenders = append(st.TopSenders, senderCount{userId, count})
+	}
+	sort.Slice(st.TopSenders, func(i, j int) bool {
+		if st.TopSenders[i].Messages != st.TopSenders[j].Messages {
+			return st.TopSenders[i].Messages > st.TopSenders[j].Messages
+		}
+		return st.TopSenders[i].UserId < st.TopSenders[j].UserId
+	})
+	if len(st.TopSenders) > 5 {
+		st.TopSenders = st.TopSenders[:5]
+	}
+
+	index, err := a.store.loadArchiveIndex()
+	if err != nil {
+		return err
+	}
+	for _, segment := range index.Segments {
+		st.ArchivedMessages += segment.Count
+	}
+
+	entries, err := os.ReadDir(a.store.dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !(strings.HasSuffix(name, ".json") || strings.HasSuffix(name, ".jsonl") || name == "chats.log") {
+			continue
+		}
+		if info, err := entry.Info(); err == nil {
+			st.Files[name] = info.Size()
+			st.TotalBytes += info.Size()
+		}
+	}
+	filepath.Walk(a.store.path("archive"), func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			st.Files["archive"] += info.Size()
+			st.TotalBytes += info.Size()
+		}
+		return nil
+	})
+
+	if a.asJSON {
+		return a.printJSON(st)
+	}
+
+	fmt.Printf("Users:          %d (%d admins, %d bots, %d disabled)\n", st.Users, st.Admins, st.Bots, st.DisabledUsers)
+	fmt.Printf("Messages:       %d in %d conversations\n", st.Messages, st.Conversations)
+	if st.MalformedMessages > 0 {
+		fmt.Printf("Malformed:      %d (run check)\n", st.MalformedMessages)
+	}
+	fmt.Printf("Archived:       %d\n", st.ArchivedMessages)
+	if st.OldestMessage != nil {
+		fmt.Printf("Oldest message: %s\n", st.OldestMessage.Local().Format("2006-01-02 15:04"))
+		fmt.Printf("Newest message: %s\n", st.NewestMessage.Local().Format("2006-01-02 15:04"))
+	}
+	if len(st.TopSenders) > 0 {
+		fmt.Println("Top senders:")
+		for _, s := range st.TopSenders {
+			fmt.Printf("  %-20s %d\n", s.UserId, s.Messages)
+		}
+	}
+	fmt.Println("Files:")
+	names := make([]string, 0, len(st.Files))
+	for name := range st.Files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Printf("  %-26s %d bytes\n", name, st.Files[name])
+	}
+	fmt.Printf("  %-26s %d bytes\n", "total", st.TotalBytes)
+	return nil
+}
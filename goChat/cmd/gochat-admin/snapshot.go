@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gochat/internal/store"
+)
+
+// Snapshots are taken by the server (on a schedule or via
+// /api/v1/admin/create-snapshot) and by the snapshot command into
+// snapshots/<name>/ with a manifest of checksums, in the format of
+// internal/store. Restoring first saves the current files as another
+// snapshot, so a restore can itself be rolled back.
+
+// Snapshot manifests come from internal/store, shared with the server
+type (
+	SnapshotFile     = store.SnapshotFile
+	SnapshotManifest = store.SnapshotManifest
+)
+
+// Find a snapshot by name, "latest", or as the newest one taken at or
+// before a point in time
+func (s dataStore) findSnapshot(name string, at time.Time) (SnapshotManifest, error) {
+	snapshots, err := store.ListSnapshots(s.dir)
+	if err != nil {
+		return SnapshotManifest{}, err
+	}
+	for _, snapshot := range snapshots {
+		switch {
+		case !at.IsZero():
+			if !snapshot.CreatedAt.After(at) {
+				return snapshot, nil
+			}
+		case name == "latest" || snapshot.Name == name:
+			return snapshot, nil
+		}
+	}
+	if !at.IsZero() {
+		return SnapshotManifest{}, fmt.Errorf("no snapshot taken at or before %s", at.Format(time.RFC3339))
+	}
+	return SnapshotManifest{}, fmt.Errorf("snapshot %q not found", name)
+}
+
+// Check every file of a snapshot against its manifest, and that the JSON
+// files still parse
+func (s dataStore) verifySnapshot(manifest SnapshotManifest) []string {
+	var problems []string
+	dir := s.path(filepath.Join("snapshots", manifest.Name))
+	for _, want := range manifest.Files {
+		path := filepath.Join(dir, filepath.FromSlash(want.Name))
+		got, err := store.ChecksumFile(path)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", want.Name, err))
+			continue
+		}
+		if got.Size != want.Size || got.SHA256 != want.SHA256 {
+			problems = append(problems, fmt.Sprintf("%s: checksum mismatch", want.Name))
+			continue
+		}
+		if strings.HasSuffix(want.Name, ".json") {
+			data, err := os.ReadFile(path)
+			if err == nil && !json.Valid(data) {
+				problems = append(problems, fmt.Sprintf("%s: not valid JSON", want.Name))
+			}
+		}
+	}
+	return problems
+}
+
+// Copy a file, replacing dst through a temporary file
+func copyFile(src, dst string) error {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(dst+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(dst+".tmp", dst)
+}
+
+// snapshots lists the available snapshots
+func (a *admin) snapshots(args []string) error {
+	if len(args) != 0 {
+		return errors.New("usage: snapshots")
+	}
+	snapshots, err := store.ListSnapshots(a.store.dir)
+	if err != nil {
+		return err
+	}
+	if a.asJSON {
+		if snapshots == nil {
+			snapshots = []SnapshotManifest{}
+		}
+		return a.printJSON(snapshots)
+	}
+	if len(snapshots) == 0 {
+		fmt.Println("No snapshots")
+		return nil
+	}
+	for _, snapshot := range snapshots {
+		var size int64
+		for _, file := range snapshot.Files {
+			size += file.Size
+		}
+		fmt.Printf("%-44s %s  %-11s %3d files  %d bytes\n", snapshot.Name, snapshot.CreatedAt.Local().Format("2006-01-02 15:04"), snapshot.Reason, len(snapshot.Files), size)
+	}
+	return nil
+}
+
+// snapshot takes a snapshot of the data files and deletes the oldest ones
+// beyond -keep, as the server's scheduled snapshots do
+func (a *admin) snapshot(args []string) error {
+	flags := flag.NewFlagSet("snapshot", flag.ContinueOnError)
+	keep := flags.Int("keep", store.DefaultSnapshotKeep, "number of snapshots to keep")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 0 || *keep < 1 {
+		return errors.New("usage: snapshot [-keep N]")
+	}
+
+	manifest, err := store.CreateSnapshot(a.store.dir, "manual")
+	if err != nil {
+		return err
+	}
+	removed, err := store.RotateSnapshots(a.store.dir, *keep)
+	if err != nil {
+		return fmt.Errorf("created %s, but rotating snapshots failed: %w", manifest.Name, err)
+	}
+
+	if a.asJSON {
+		return a.printJSON(map[string]interface{}{"success": true, "snapshot": manifest, "removed": removed})
+	}
+	fmt.Printf("Created snapshot %s with %d files\n", manifest.Name, len(manifest.Files))
+	if removed > 0 {
+		fmt.Printf("Removed %d old snapshots\n", removed)
+	}
+	return nil
+}
+
+// verifySnapshot checks a snapshot's files against its manifest
+func (a *admin) verifySnapshot(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: verify-snapshot <name|latest>")
+	}
+	manifest, err := a.store.findSnapshot(args[0], time.Time{})
+	if err != nil {
+		return err
+	}
+
+	problems := a.store.verifySnapshot(manifest)
+	if a.asJSON {
+		a.printJSON(map[string]interface{}{"snapshot": manifest.Name, "ok": len(problems) == 0, "problems": append([]string{}, problems...)})
+	} else {
+		for _, problem := range problems {
+			fmt.Println(problem)
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("snapshot %s is damaged", manifest.Name)
+	}
+	if !a.asJSON {
+		fmt.Printf("Snapshot %s is intact (%d files)\n", manifest.Name, len(manifest.Files))
+	}
+	return nil
+}
+
+// restore rolls the data directory back to a snapshot. The snapshot is
+// verified first, the current files are saved as a new snapshot, and the
+// restored data is checked afterwards.
+func (a *admin) restore(args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	at := flags.String("at", "", "restore the newest snapshot taken at or before this RFC 3339 time")
+	dryRun := flags.Bool("dry-run", false, "verify the snapshot and show what would change without restoring")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	var pointInTime time.Time
+	name := "latest"
+	switch {
+	case *at != "" && flags.NArg() == 0:
+		t, err := time.Parse(time.RFC3339, *at)
+		if err != nil {
+			return fmt.Errorf("invalid -at time %q; use RFC 3339", *at)
+		}
+		pointInTime = t
+	case *at == "" && flags.NArg() == 1:
+		name = flags.Arg(0)
+	default:
+		return errors.New("usage: restore [-dry-run] <name|latest> or restore [-dry-run] -at <time>")
+	}
+
+	manifest, err := a.store.findSnapshot(name, pointInTime)
+	if err != nil {
+		return err
+	}
+	if problems := a.store.verifySnapshot(manifest); len(problems) > 0 {
+		for _, problem := range problems {
+			fmt.Fprintln(os.Stderr, problem)
+		}
+		return fmt.Errorf("snapshot %s failed verification; nothing was restored", manifest.Name)
+	}
+
+	inSnapshot := map[string]bool{}
+	for _, file := range manifest.Files {
+		inSnapshot[file.Name] = true
+	}
+	var removed []string
+	for _, name := range store.SnapshotFiles {
+		if _, err := os.Stat(a.store.path(name)); err == nil && !inSnapshot[name] {
+			removed = append(removed, name)
+		}
+	}
+
+	if *dryRun {
+		fmt.Printf("Would restore %s (%s, %d files)\n", manifest.Name, manifest.CreatedAt.Local().Format("2006-01-02 15:04"), len(manifest.Files))
+		for _, name := range removed {
+			fmt.Printf("Would remove %s, which did not exist yet\n", name)
+		}
+		return nil
+	}
+
+	backup, err := store.CreateSnapshot(a.store.dir, "pre-restore")
+	if err != nil {
+		return fmt.Errorf("saving the current files: %w", err)
+	}
+
+	dir := a.store.path(filepath.Join("snapshots", manifest.Name))
+	// The archive index goes last so it never lists a segment that isn't in place yet
+	sort.SliceStable(manifest.Files, func(i, j int) bool {
+		return manifest.Files[i].Name != "archive/index.json" && manifest.Files[j].Name == "archive/index.json"
+	})
+	for _, file := range manifest.Files {
+		src := filepath.Join(dir, filepath.FromSlash(file.Name))
+		if err := copyFile(src, a.store.path(filepath.FromSlash(file.Name))); err != nil {
+			return fmt.Errorf("restoring %s: %w (previous files are in snapshot %s)", file.Name, err, backup.Name)
+		}
+	}
+	if !inSnapshot["archive/index.json"] {
+		os.Remove(a.store.path(filepath.Join("archive", "index.json")))
+	}
+	for _, name := range removed {
+		if err := os.Remove(a.store.path(name)); err != nil {
+			return err
+		}
+	}
+
+	problems := checkData(a.store)
+	if a.asJSON {
+		return a.printJSON(map[string]interface{}{
+			"success":  true,
+			"restored": manifest.Name,
+			"backup":   backup.Name,
+			"problems": append([]problem{}, problems...),
+		})
+	}
+	fmt.Printf("Restored %s; the previous files were saved as %s\n", manifest.Name, backup.Name)
+	for _, p := range problems {
+		fmt.Printf("%-17s %s\n", p.File, p.Message)
+	}
+	if len(problems) > 0 {
+		fmt.Println("The restored data has problems; see `gochat-admin check` (the server rebuilds recentChats.json itself)")
+	}
+	return nil
+}
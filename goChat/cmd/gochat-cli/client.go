@@ -0,0 +1,20 @@
+package main
+
+import "gochat/internal/client"
+
+// The API client lives in internal/client, shared with the TUI
+type (
+	Client           = client.Client
+	APIError         = client.APIError
+	Message          = client.Message
+	SessionInfo      = client.SessionInfo
+	SyncChange       = client.SyncChange
+	SyncResult       = client.SyncResult
+	ContactList      = client.ContactList
+	RecentChat       = client.RecentChat
+	User             = client.User
+	ScheduledMessage = client.ScheduledMessage
+	Profile          = client.Profile
+	TOTPSetup        = client.TOTPSetup
+	TOTPStatus       = client.TOTPStatus
+)
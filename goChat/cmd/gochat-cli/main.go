@@ -0,0 +1,872 @@
+// Command gochat-cli is a terminal client for the goChat HTTP API.
+//
+// Usage:
+//
+//	gochat-cli [-server URL] [-user ID] [-json] <command> [arguments]
+//
+// Commands:
+//
+//	login <user>                  check credentials and remember the user
+//	recent                        list recent chats
+//	chat <contact>                print the conversation with a contact
+//	send <contact> <message...>   send a message (-at or -in to schedule it)
+//	scheduled                     list pending scheduled messages
+//	unschedule <id>               cancel a scheduled message
+//	follow [contact]              print new messages as they arrive
+//	export <contact>              save a conversation as JSON, HTML or text
+//	tui                           open the full-screen chat interface
+//	contacts [action] [user]      list contacts, or request/accept/remove/block/unblock
+//	devices                       list the devices you are logged in on
+//	logout [-others | <id>]       log out this device, the others, or one of them
+//	2fa [setup|disable|recovery-codes]
+//	                              show or change two-factor authentication
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gochat/internal/client"
+)
+
+// config is remembered between runs so commands don't need -user every time
+type config struct {
+	Server  string `json:"server"`
+	UserId  string `json:"userId"`
+	Session string `json:"session,omitempty"` // Session token from the last login
+}
+
+// cli holds the options shared by every command
+type cli struct {
+	client *Client
+	userId string
+	asJSON bool
+	cfg    config
+}
+
+// Path of the saved configuration file
+func configPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "gochat", "cli.json"), nil
+}
+
+// Load the saved configuration, returning defaults if there is none
+func loadConfig() config {
+	cfg := config{Server: "http://localhost:8080"}
+	path, err := configPath()
+	if err != nil {
+		return cfg
+	}
+	if data, err := os.ReadFile(path); err == nil {
+		json.Unmarshal(data, &cfg)
+	}
+	return cfg
+}
+
+// Save the configuration for later runs
+func saveConfig(cfg config) error {
+	path, err := configPath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, `Usage: gochat-cli [flags] <command> [arguments]
+
+Commands:
+  login <user>                  check credentials and remember the user
+  recent                        list recent chats
+  chat <contact>                print the conversation with a contact
+  send <contact> <message...>   send a message (-at or -in to schedule it)
+  scheduled                     list pending scheduled messages
+  unschedule <id>               cancel a scheduled message
+  follow [contact]              print new messages as they arrive
+  export <contact>              save a conversation as JSON, HTML or text
+  tui                           open the full-screen chat interface
+  contacts [action] [user]      list contacts, or request/accept/remove/block/unblock
+  devices                       list the devices you are logged in on
+  logout [-others | <id>]       log out this device, the others, or one of them
+  profile [user]                show a profile, or change yours with
+                                set name|bio|status|timezone <value...> or avatar <file>|-remove
+  2fa [setup|disable|recovery-codes]
+                                show or change two-factor authentication
+
+Flags:`)
+	flag.PrintDefaults()
+}
+
+func main() {
+	cfg := loadConfig()
+	if env := os.Getenv("GOCHAT_SERVER"); env != "" {
+		cfg.Server = env
+	}
+
+	server := flag.String("server", cfg.Server, "goChat server URL (or set GOCHAT_SERVER)")
+	user := flag.String("user", cfg.UserId, "user to act as (defaults to the last login)")
+	asJSON := flag.Bool("json", false, "print machine-readable JSON instead of text")
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	c := &cli{
+		client: client.NewClient(*server),
+		userId: *user,
+		asJSON: *asJSON,
+		cfg:    cfg,
+	}
+	c.cfg.Server = *server
+	if *server == cfg.Server && *user == cfg.UserId {
+		c.client.Session = cfg.Session
+	}
+
+	command, args := flag.Arg(0), flag.Args()[1:]
+	var err error
+	switch command {
+	case "login":
+		err = c.login(args)
+	case "recent":
+		err = c.recent(args)
+	case "chat":
+		err = c.chat(args)
+	case "send":
+		err = c.send(args)
+	case "scheduled":
+		err = c.scheduled(args)
+	case "unschedule":
+		err = c.unschedule(args)
+	case "follow":
+		err = c.follow(args)
+	case "export":
+		err = c.export(args)
+	case "tui":
+		err = c.runTUI(args)
+	case "contacts":
+		err = c.contacts(args)
+	case "devices":
+		err = c.devices(args)
+	case "logout":
+		err = c.logout(args)
+	case "profile":
+		err = c.profile(args)
+	case "2fa":
+		err = c.twoFactor(args)
+	default:
+		fmt.Fprintf(os.Stderr, "gochat-cli: unknown command %q\n", command)
+		usage()
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "gochat-cli:", err)
+		os.Exit(1)
+	}
+}
+
+// Make sure a user is logged in before running a command that needs one;
+// the server only acts for the user a session belongs to
+func (c *cli) requireUser() error {
+	if c.userId == "" {
+		return errors.New("no user selected; run `gochat-cli login <user>` first")
+	}
+	if c.client.Session == "" {
+		return fmt.Errorf("no session for %s; run `gochat-cli login %s` first", c.userId, c.userId)
+	}
+	return nil
+}
+
+// Print a value as indented JSON
+func (c *cli) printJSON(value interface{}) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(value)
+}
+
+// Print one message as a line of text
+func printMessage(msg Message) {
+	if msg.IsSystem {
+		fmt.Printf("[%s] * %s\n", msg.Timestamp.Local().Format("2006-01-02 15:04"), msg.Content)
+		return
+	}
+	fmt.Printf("[%s] %s -> %s: %s\n", msg.Timestamp.Local().Format("2006-01-02 15:04"), msg.Sender, msg.Receiver, msg.Text())
+}
+
+// Read a value from the environment variable, or else prompt for it and
+// read a line of stdin
+func readInput(in *bufio.Reader, env, prompt string) (string, error) {
+	if value := os.Getenv(env); value != "" {
+		return value, nil
+	}
+	fmt.Fprint(os.Stderr, prompt)
+	line, err := in.ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// login checks credentials and remembers the user for later commands.
+// The password is read from GOCHAT_PASSWORD or the first line of stdin;
+// with two-factor authentication on, the code comes from GOCHAT_TOTP_CODE
+// or the next line.
+func (c *cli) login(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: login <user>")
+	}
+
+	in := bufio.NewReader(os.Stdin)
+	password, err := readInput(in, "GOCHAT_PASSWORD", "Password: ")
+	if err != nil {
+		return err
+	}
+
+	deviceName := "gochat-cli"
+	if host, err := os.Hostname(); err == nil {
+		deviceName += " on " + host
+	}
+	userId, err := c.client.Login(args[0], password, deviceName)
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && apiErr.Code == "totp_required" {
+		code, readErr := readInput(in, "GOCHAT_TOTP_CODE", "Authenticator or recovery code: ")
+		if readErr != nil {
+			return readErr
+		}
+		userId, err = c.client.LoginTOTP(apiErr.Challenge, code)
+	}
+	if err != nil {
+		return err
+	}
+
+	c.cfg.UserId = userId
+	c.cfg.Session = c.client.Session
+	if err := saveConfig(c.cfg); err != nil {
+		return err
+	}
+
+	if c.asJSON {
+		return c.printJSON(map[string]string{"userId": userId, "server": c.cfg.Server})
+	}
+	fmt.Printf("Logged in as %s on %s\n", userId, c.cfg.Server)
+	return nil
+}
+
+// contacts lists the user's contacts and requests, runs a contact action
+// on another user, or with "only on|off" chooses whether to accept
+// messages only from contacts
+func (c *cli) contacts(args []string) error {
+	if err := c.requireUser(); err != nil {
+		return err
+	}
+
+	switch {
+	case len(args) == 0 || (len(args) == 1 && args[0] == "list"):
+		list, err := c.client.Contacts(c.userId)
+		if err != nil {
+			return err
+		}
+		if c.asJSON {
+			return c.printJSON(list)
+		}
+		for _, group := range []struct {
+			title string
+			ids   []string
+		}{
+			{"Contacts", list.Contacts}, {"Requests to you", list.Incoming},
+			{"Requests sent", list.Outgoing}, {"Blocked", list.Blocked},
+		} {
+			if len(group.ids) > 0 {
+				fmt.Printf("%s: %s\n", group.title, strings.Join(group.ids, ", "))
+			}
+		}
+		if list.ContactsOnly {
+			fmt.Println("Only contacts can message you")
+		}
+		return nil
+
+	case len(args) == 2 && args[0] == "only":
+		if args[1] != "on" && args[1] != "off" {
+			return errors.New("usage: contacts only on|off")
+		}
+		if err := c.client.SetContactsOnly(c.userId, args[1] == "on"); err != nil {
+			return err
+		}
+		if c.asJSON {
+			return c.printJSON(map[string]interface{}{"success": true, "contactsOnly": args[1] == "on"})
+		}
+		fmt.Printf("Messages only from contacts: %s\n", args[1])
+		return nil
+
+	case len(args) == 2:
+		switch args[0] {
+		case "request", "accept", "remove", "block", "unblock":
+		default:
+			return fmt.Errorf("unknown contacts action %q", args[0])
+		}
+		status, err := c.client.UpdateContact(args[0], c.userId, args[1])
+		if err != nil {
+			return err
+		}
+		if c.asJSON {
+			return c.printJSON(map[string]interface{}{"success": true, "status": status})
+		}
+		switch {
+		case status == "accepted":
+			fmt.Printf("%s is now a contact\n", args[1])
+		case status != "":
+			fmt.Printf("Contact request sent to %s\n", args[1])
+		default:
+			fmt.Println("Done")
+		}
+		return nil
+	}
+	return errors.New("usage: contacts [list | request|accept|remove|block|unblock <user> | only on|off]")
+}
+
+// devices lists the sessions of the logged-in user, newest activity first
+func (c *cli) devices(args []string) error {
+	if len(args) != 0 {
+		return errors.New("usage: devices")
+	}
+	if c.client.Session == "" {
+		return errors.New("no session; run `gochat-cli login <user>` first")
+	}
+
+	sessions, err := c.client.Sessions()
+	if err != nil {
+		return err
+	}
+	if c.asJSON {
+		return c.printJSON(sessions)
+	}
+	for _, session := range sessions {
+		marker := " "
+		if session.Current {
+			marker = "*"
+		}
+		fmt.Printf("%s %s  %-30s last seen %s\n", marker, session.Id, session.DeviceName, session.LastSeenAt.Local().Format("2006-01-02 15:04"))
+	}
+	return nil
+}
+
+// logout ends this device's session, every other session with -others,
+// or the session with the given ID
+func (c *cli) logout(args []string) error {
+	flags := flag.NewFlagSet("logout", flag.ContinueOnError)
+	others := flags.Bool("others", false, "log out every other device instead of this one")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 1 || (*others && flags.NArg() == 1) {
+		return errors.New("usage: logout [-others | <id>]")
+	}
+	if c.client.Session == "" {
+		return errors.New("no session; run `gochat-cli login <user>` first")
+	}
+
+	switch {
+	case *others:
+		revoked, err := c.client.RevokeOtherSessions()
+		if err != nil {
+			return err
+		}
+		if c.asJSON {
+			return c.printJSON(map[string]interface{}{"success": true, "revoked": revoked})
+		}
+		fmt.Printf("Logged out %d other devices\n", revoked)
+		return nil
+	case flags.NArg() == 1:
+		if err := c.client.RevokeSession(flags.Arg(0)); err != nil {
+			return err
+		}
+	default:
+		if err := c.client.Logout(); err != nil {
+			return err
+		}
+		c.cfg.Session = ""
+		if err := saveConfig(c.cfg); err != nil {
+			return err
+		}
+	}
+	if c.asJSON {
+		return c.printJSON(map[string]bool{"success": true})
+	}
+	fmt.Println("Logged out")
+	return nil
+}
+
+// recent lists the user's conversations
+func (c *cli) recent(args []string) error {
+	if err := c.requireUser(); err != nil {
+		return err
+	}
+
+	chats, err := c.client.RecentChats(c.userId)
+	if err != nil {
+		return err
+	}
+	if c.asJSON {
+		return c.printJSON(chats)
+	}
+
+	if len(chats) == 0 {
+		fmt.Println("No recent chats")
+		return nil
+	}
+	for _, chat := range chats {
+		marker := " "
+		if !chat.IsRead {
+			marker = "*"
+		}
+		fmt.Printf("%s %-20s %s  %s\n", marker, chat.ContactId, chat.Timestamp.Local().Format("2006-01-02 15:04"), chat.LastMessage)
+	}
+	return nil
+}
+
+// chat prints the whole conversation with a contact and marks it read
+func (c *cli) chat(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: chat <contact>")
+	}
+	if err := c.requireUser(); err != nil {
+		return err
+	}
+
+	messages, err := c.client.Messages(c.userId, args[0])
+	if err != nil {
+		return err
+	}
+	if err := c.client.MarkRead(c.userId, args[0]); err != nil {
+		return err
+	}
+
+	if c.asJSON {
+		return c.printJSON(messages)
+	}
+	for _, msg := range messages {
+		printMessage(msg)
+	}
+	return nil
+}
+
+// send posts a message to a contact, or schedules it with -at or -in
+func (c *cli) send(args []string) error {
+	flags := flag.NewFlagSet("send", flag.ContinueOnError)
+	at := flags.String("at", "", "deliver at this time (RFC 3339 or \"2006-01-02 15:04\" local time)")
+	in := flags.Duration("in", 0, "deliver after this delay, e.g. 2h30m")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	args = flags.Args()
+	if len(args) < 2 {
+		return errors.New("usage: send [-at time | -in duration] <contact> <message...>")
+	}
+	if err := c.requireUser(); err != nil {
+		return err
+	}
+
+	var sendAt time.Time
+	switch {
+	case *at != "" && *in != 0:
+		return errors.New("use either -at or -in, not both")
+	case *at != "":
+		parsed, err := parseSendAt(*at)
+		if err != nil {
+			return err
+		}
+		sendAt = parsed
+	case *in != 0:
+		sendAt = time.Now().Add(*in)
+	}
+
+	content := strings.Join(args[1:], " ")
+	if content == "-" {
+		// Read the message body from stdin so scripts can pipe output in
+		data, err := bufio.NewReader(os.Stdin).ReadString(0)
+		if err != nil && data == "" {
+			return err
+		}
+		content = data
+	}
+
+	if !sendAt.IsZero() {
+		scheduled, reply, err := c.client.Schedule(c.userId, args[0], content, sendAt)
+		if err != nil {
+			return err
+		}
+		if c.asJSON {
+			return c.printJSON(map[string]interface{}{"success": true, "reply": reply, "scheduled": scheduled})
+		}
+		if reply != "" {
+			fmt.Println(reply)
+		}
+		if scheduled != nil {
+			fmt.Printf("Message %s scheduled for %s\n", scheduled.Id, scheduled.SendAt.Local().Format("2006-01-02 15:04"))
+		}
+		return nil
+	}
+
+	reply, err := c.client.Send(c.userId, args[0], content)
+	if err != nil {
+		return err
+	}
+	if c.asJSON {
+		return c.printJSON(map[string]interface{}{"success": true, "reply": reply})
+	}
+	if reply != "" {
+		fmt.Println(reply)
+		return nil
+	}
+	fmt.Println("Message sent")
+	return nil
+}
+
+// Parse a -at value as RFC 3339, or as a local date and time
+func parseSendAt(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02 15:04", value, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid -at time %q; use RFC 3339 or \"2006-01-02 15:04\"", value)
+	}
+	return t, nil
+}
+
+// scheduled lists the user's pending scheduled messages
+func (c *cli) scheduled(args []string) error {
+	if len(args) != 0 {
+		return errors.New("usage: scheduled")
+	}
+	if err := c.requireUser(); err != nil {
+		return err
+	}
+
+	pending, err := c.client.Scheduled(c.userId)
+	if err != nil {
+		return err
+	}
+	if c.asJSON {
+		return c.printJSON(pending)
+	}
+	if len(pending) == 0 {
+		fmt.Println("No scheduled messages")
+		return nil
+	}
+	for _, msg := range pending {
+		fmt.Printf("%s  [%s] -> %s: %s\n", msg.Id, msg.SendAt.Local().Format("2006-01-02 15:04"), msg.Receiver, msg.Content)
+	}
+	return nil
+}
+
+// unschedule cancels a pending scheduled message
+func (c *cli) unschedule(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: unschedule <id>")
+	}
+	if err := c.requireUser(); err != nil {
+		return err
+	}
+
+	if err := c.client.CancelScheduled(c.userId, args[0]); err != nil {
+		return err
+	}
+	if c.asJSON {
+		return c.printJSON(map[string]bool{"success": true})
+	}
+	fmt.Println("Scheduled message cancelled")
+	return nil
+}
+
+// follow polls for new messages, optionally limited to one contact, and
+// prints each one as it arrives. JSON mode prints one object per line.
+func (c *cli) follow(args []string) error {
+	flags := flag.NewFlagSet("follow", flag.ContinueOnError)
+	interval := flags.Duration("interval", 2*time.Second, "how often to poll the server")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 1 {
+		return errors.New("usage: follow [-interval d] [contact]")
+	}
+	contact := flags.Arg(0)
+	if err := c.requireUser(); err != nil {
+		return err
+	}
+
+	fetch := func() ([]Message, error) {
+		if contact != "" {
+			return c.client.Messages(c.userId, contact)
+		}
+		return c.client.AllMessages(c.userId)
+	}
+
+	// Only messages newer than the latest one at startup are printed
+	messages, err := fetch()
+	if err != nil {
+		return err
+	}
+	var since time.Time
+	for _, msg := range messages {
+		if msg.Timestamp.After(since) {
+			since = msg.Timestamp
+		}
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	for {
+		time.Sleep(*interval)
+
+		messages, err := fetch()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "gochat-cli:", err)
+			continue
+		}
+
+		latest := since
+		for _, msg := range messages {
+			if !msg.Timestamp.After(since) {
+				continue
+			}
+			if c.asJSON {
+				encoder.Encode(msg)
+			} else {
+				printMessage(msg)
+			}
+			if msg.Timestamp.After(latest) {
+				latest = msg.Timestamp
+			}
+		}
+		since = latest
+	}
+}
+
+// export saves a conversation, including archived messages, to a file
+func (c *cli) export(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	format := flags.String("format", "text", "json, html or text")
+	tz := flags.String("tz", "Local", "time zone for timestamps, e.g. Europe/Berlin")
+	asZip := flags.Bool("zip", false, "download a zip archive")
+	output := flags.String("o", "", "output file (default: the server's file name; - for stdout)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("usage: export [-format f] [-tz zone] [-zip] [-o file] <contact>")
+	}
+	if err := c.requireUser(); err != nil {
+		return err
+	}
+
+	// The server doesn't know our local zone by name, so send the IANA name if we can find one
+	zone := *tz
+	if zone == "Local" {
+		zone = localZoneName()
+	}
+
+	data, fileName, err := c.client.Export(c.userId, flags.Arg(0), *format, zone, *asZip)
+	if err != nil {
+		return err
+	}
+
+	target := *output
+	if target == "" {
+		target = fileName
+	}
+	if target == "" || target == "-" {
+		_, err := os.Stdout.Write(data)
+		return err
+	}
+	if err := os.WriteFile(target, data, 0644); err != nil {
+		return err
+	}
+	if !c.asJSON {
+		fmt.Printf("Saved %s (%d bytes)\n", target, len(data))
+	}
+	return nil
+}
+
+// Best-effort IANA name of the local time zone, or "" to use UTC
+func localZoneName() string {
+	if tz := os.Getenv("TZ"); tz != "" {
+		return strings.TrimPrefix(tz, ":")
+	}
+	if link, err := os.Readlink("/etc/localtime"); err == nil {
+		if _, name, ok := strings.Cut(link, "zoneinfo/"); ok {
+			return name
+		}
+	}
+	return ""
+}
+
+// profile shows a user's profile or changes the current user's
+func (c *cli) profile(args []string) error {
+	if err := c.requireUser(); err != nil {
+		return err
+	}
+
+	var profile *Profile
+	var err error
+	switch {
+	case len(args) <= 1:
+		userId := c.userId
+		if len(args) == 1 {
+			userId = args[0]
+		}
+		profile, err = c.client.Profile(userId)
+
+	case args[0] == "set" && len(args) >= 3:
+		field, ok := map[string]string{"name": "displayName", "bio": "bio", "status": "status", "timezone": "timezone"}[args[1]]
+		if !ok {
+			return fmt.Errorf("unknown profile field %q", args[1])
+		}
+		profile, err = c.client.UpdateProfile(c.userId, map[string]string{field: strings.Join(args[2:], " ")})
+
+	case args[0] == "avatar" && len(args) == 2 && args[1] == "-remove":
+		if err := c.client.RemoveAvatar(c.userId); err != nil {
+			return err
+		}
+		profile, err = c.client.Profile(c.userId)
+
+	case args[0] == "avatar" && len(args) == 2:
+		image, readErr := os.ReadFile(args[1])
+		if readErr != nil {
+			return readErr
+		}
+		profile, err = c.client.UploadAvatar(c.userId, image)
+
+	default:
+		return errors.New("usage: profile [user] | profile set name|bio|status|timezone <value...> | profile avatar <file>|-remove")
+	}
+	if err != nil {
+		return err
+	}
+
+	if c.asJSON {
+		return c.printJSON(profile)
+	}
+	fmt.Printf("%s (%s)\n", profile.DisplayName, profile.UserId)
+	for _, line := range []struct{ label, value string }{
+		{"Status", profile.Status}, {"Bio", profile.Bio}, {"Time zone", profile.Timezone}, {"Avatar", profile.AvatarURL},
+	} {
+		if line.value != "" {
+			fmt.Printf("  %-10s %s\n", line.label+":", line.value)
+		}
+	}
+	return nil
+}
+
+// twoFactor shows whether two-factor authentication is on, or sets it up,
+// turns it off or replaces the recovery codes. Setup prints a QR code to
+// scan with an authenticator app and asks for the first code. Passwords
+// and codes are read like at login.
+func (c *cli) twoFactor(args []string) error {
+	if err := c.requireUser(); err != nil {
+		return err
+	}
+	in := bufio.NewReader(os.Stdin)
+
+	if len(args) == 0 {
+		status, err := c.client.TOTPStatus(c.userId)
+		if err != nil {
+			return err
+		}
+		if c.asJSON {
+			return c.printJSON(status)
+		}
+		switch {
+		case status.Enabled:
+			fmt.Printf("Two-factor authentication is on (%d recovery codes left)\n", status.RecoveryCodesLeft)
+		case status.Pending:
+			fmt.Println("Two-factor authentication is off; setup was started but not finished")
+		default:
+			fmt.Println("Two-factor authentication is off")
+		}
+		return nil
+	}
+	if len(args) != 1 {
+		return errors.New("usage: 2fa [setup|disable|recovery-codes]")
+	}
+
+	password, err := readInput(in, "GOCHAT_PASSWORD", "Password: ")
+	if err != nil {
+		return err
+	}
+	var codes []string
+	switch args[0] {
+	case "setup":
+		setup, err := c.client.SetupTOTP(c.userId, password)
+		if err != nil {
+			return err
+		}
+		if !c.asJSON {
+			fmt.Fprintln(os.Stderr, "Scan this code with your authenticator app:")
+			fmt.Fprint(os.Stderr, setup.QRText)
+			fmt.Fprintf(os.Stderr, "or enter the key by hand: %s\n", setup.Secret)
+		}
+		code, err := readInput(in, "GOCHAT_TOTP_CODE", "Code shown by the app: ")
+		if err != nil {
+			return err
+		}
+		if codes, err = c.client.EnableTOTP(c.userId, code); err != nil {
+			return err
+		}
+
+	case "disable":
+		code, err := readInput(in, "GOCHAT_TOTP_CODE", "Authenticator or recovery code: ")
+		if err != nil {
+			return err
+		}
+		if err := c.client.DisableTOTP(c.userId, password, code); err != nil {
+			return err
+		}
+		if c.asJSON {
+			return c.printJSON(map[string]bool{"enabled": false})
+		}
+		fmt.Println("Two-factor authentication is off")
+		return nil
+
+	case "recovery-codes":
+		code, err := readInput(in, "GOCHAT_TOTP_CODE", "Authenticator or recovery code: ")
+		if err != nil {
+			return err
+		}
+		if codes, err = c.client.RegenerateRecoveryCodes(c.userId, password, code); err != nil {
+			return err
+		}
+
+	default:
+		return errors.New("usage: 2fa [setup|disable|recovery-codes]")
+	}
+
+	if c.asJSON {
+		return c.printJSON(map[string][]string{"recoveryCodes": codes})
+	}
+	fmt.Println("Two-factor authentication is on. Keep these recovery codes somewhere safe;")
+	fmt.Println("each one logs you in once if you lose your authenticator:")
+	for _, code := range codes {
+		fmt.Println("  " + code)
+	}
+	return nil
+}
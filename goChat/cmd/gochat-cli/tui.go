@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"golang.org/x/term"
+
+	"gochat/internal/tui"
+)
+
+// runTUI puts the terminal into raw mode and runs the TUI on stdin/stdout
+func (c *cli) runTUI(args []string) error {
+	if err := c.requireUser(); err != nil {
+		return err
+	}
+
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return errors.New("tui needs an interactive terminal")
+	}
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return err
+	}
+	defer term.Restore(fd, state)
+
+	size := func() (int, int) {
+		width, height, err := term.GetSize(int(os.Stdout.Fd()))
+		if err != nil {
+			return 80, 24
+		}
+		return width, height
+	}
+	width, height := size()
+
+	t := tui.New(c.client, c.userId, os.Stdin, os.Stdout, width, height)
+	t.SizeFunc = size
+
+	// Switch to the alternate screen and hide the cursor while running
+	fmt.Fprint(os.Stdout, "\x1b[?1049h\x1b[?25l")
+	defer fmt.Fprint(os.Stdout, "\x1b[?25h\x1b[?1049l")
+
+	return t.Run()
+}
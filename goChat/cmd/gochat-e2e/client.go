@@ -0,0 +1,12 @@
+package main
+
+import "gochat/internal/e2eclient"
+
+// The protocol and API client live in internal/e2eclient
+type (
+	Client       = e2eclient.Client
+	APIError     = e2eclient.APIError
+	Message      = e2eclient.Message
+	Device       = e2eclient.Device
+	PrekeyBundle = e2eclient.PrekeyBundle
+)
@@ -0,0 +1,305 @@
+// Command gochat-e2e is the reference client for end-to-end encrypted
+// messages on a goChat server. The server only stores and relays the
+// envelopes; keys never leave the device except for their public halves.
+//
+// Usage:
+//
+//	gochat-e2e [-server URL] [-user ID] [-state FILE] <command> [arguments]
+//
+// Commands:
+//
+//	init [-device ID]             create this device's keys and publish them
+//	devices [user]                list a user's devices and their fingerprints
+//	send <contact> <message...>   send an encrypted message
+//	read <contact>                print the conversation, decrypting what was sent to this device
+//	forget <user>                 drop the pinned keys of a user whose keys changed
+//	remove                        unpublish this device and delete its keys
+//	selftest                      run an end-to-end check against the server
+//
+// The server and user default to those of the last `gochat-cli login`.
+// Each device's keys, the identity keys pinned the first time a device was
+// seen, and the plaintext of messages already read are kept in a state
+// file under the user's config directory. internal/e2eclient/protocol.go
+// describes the key agreement.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gochat/internal/e2eclient"
+)
+
+// cliConfig mirrors the configuration saved by gochat-cli
+type cliConfig struct {
+	Server  string `json:"server"`
+	UserId  string `json:"userId"`
+	Session string `json:"session,omitempty"`
+}
+
+// Read gochat-cli's configuration for the default server and user
+func loadCLIConfig() cliConfig {
+	cfg := cliConfig{Server: "http://localhost:8080"}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return cfg
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "gochat", "cli.json")); err == nil {
+		json.Unmarshal(data, &cfg)
+	}
+	return cfg
+}
+
+// e2e holds the options shared by every command
+type e2e struct {
+	client *Client
+	userId string
+	state  string // State file; defaults to one per user
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, `Usage: gochat-e2e [flags] <command> [arguments]
+
+Commands:
+  init [-device ID]             create this device's keys and publish them
+  devices [user]                list a user's devices and their fingerprints
+  send <contact> <message...>   send an encrypted message
+  read <contact>                print the conversation, decrypting what was sent to this device
+  forget <user>                 drop the pinned keys of a user whose keys changed
+  remove                        unpublish this device and delete its keys
+  selftest                      run an end-to-end check against the server
+
+Flags:`)
+	flag.PrintDefaults()
+}
+
+func main() {
+	cfg := loadCLIConfig()
+	if env := os.Getenv("GOCHAT_SERVER"); env != "" {
+		cfg.Server = env
+	}
+
+	server := flag.String("server", cfg.Server, "goChat server URL (or set GOCHAT_SERVER)")
+	user := flag.String("user", cfg.UserId, "user to act as (defaults to the last gochat-cli login)")
+	state := flag.String("state", "", "state file holding this device's keys (default: one per user in the config directory)")
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	e := &e2e{client: e2eclient.NewClient(*server), userId: *user, state: *state}
+	if *server == cfg.Server && *user == cfg.UserId {
+		e.client.Session = cfg.Session
+	}
+
+	command, args := flag.Arg(0), flag.Args()[1:]
+	var err error
+	switch command {
+	case "init":
+		err = e.init(args)
+	case "devices":
+		err = e.devices(args)
+	case "send":
+		err = e.send(args)
+	case "read":
+		err = e.read(args)
+	case "forget":
+		err = e.forget(args)
+	case "remove":
+		err = e.remove(args)
+	case "selftest":
+		err = selfTest(e.client)
+	default:
+		fmt.Fprintf(os.Stderr, "gochat-e2e: unknown command %q\n", command)
+		usage()
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "gochat-e2e:", err)
+		os.Exit(1)
+	}
+}
+
+// Path of the state file for the selected user
+func (e *e2e) statePath() (string, error) {
+	if e.userId == "" {
+		return "", errors.New("no user selected; run `gochat-cli login <user>` or pass -user")
+	}
+	if e.state != "" {
+		return e.state, nil
+	}
+	return statePath(e.userId)
+}
+
+// Load this device's session
+func (e *e2e) session() (*session, error) {
+	path, err := e.statePath()
+	if err != nil {
+		return nil, err
+	}
+	s, err := openSession(e.client, path)
+	if err != nil {
+		return nil, err
+	}
+	if s.UserId != e.userId {
+		return nil, fmt.Errorf("%s belongs to %s, not %s", path, s.UserId, e.userId)
+	}
+	return s, nil
+}
+
+// init creates and publishes this device's keys
+func (e *e2e) init(args []string) error {
+	flags := flag.NewFlagSet("init", flag.ContinueOnError)
+	hostname, _ := os.Hostname()
+	deviceId := flags.String("device", strings.ReplaceAll(hostname, " ", "-"), "name of this device")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	path, err := e.statePath()
+	if err != nil {
+		return err
+	}
+
+	s, err := createSession(e.client, path, e.userId, *deviceId)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Published device %s for %s with %d one-time prekeys\n", s.Device.DeviceId, s.UserId, prekeyBatch)
+	pinned := s.Pinned[s.UserId+"/"+s.Device.DeviceId]
+	fmt.Printf("Fingerprint: %s\n", e2eclient.Fingerprint(pinned.IdentityKey, pinned.SigningKey))
+	fmt.Printf("Keys saved in %s\n", path)
+	return nil
+}
+
+// devices lists a user's published devices. Compare fingerprints with the
+// other person over another channel to rule out a key swapped by the server.
+func (e *e2e) devices(args []string) error {
+	if len(args) > 1 {
+		return errors.New("usage: devices [user]")
+	}
+	userId := e.userId
+	if len(args) == 1 {
+		userId = args[0]
+	}
+	if userId == "" {
+		return errors.New("usage: devices [user]")
+	}
+
+	devices, err := e.client.Devices(userId)
+	if err != nil {
+		return err
+	}
+	if len(devices) == 0 {
+		fmt.Printf("%s %v\n", userId, errNoDevices)
+		return nil
+	}
+	for _, device := range devices {
+		fmt.Printf("%-20s %s  %d prekeys left\n", device.DeviceId, e2eclient.Fingerprint(device.IdentityKey, device.SigningKey), device.PrekeysLeft)
+	}
+	return nil
+}
+
+// send encrypts and sends a message
+func (e *e2e) send(args []string) error {
+	if len(args) < 2 {
+		return errors.New("usage: send <contact> <message...>")
+	}
+	s, err := e.session()
+	if err != nil {
+		return err
+	}
+	if err := s.send(args[0], strings.Join(args[1:], " ")); err != nil {
+		return err
+	}
+	fmt.Println("Sent encrypted message to", args[0])
+	return nil
+}
+
+// read prints the conversation with a contact, decrypting what it can
+func (e *e2e) read(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: read <contact>")
+	}
+	s, err := e.session()
+	if err != nil {
+		return err
+	}
+
+	messages, err := e.client.Messages(s.UserId, args[0])
+	if err != nil {
+		return err
+	}
+	for _, msg := range messages {
+		stamp := msg.Timestamp.Local().Format("2006-01-02 15:04")
+		switch {
+		case msg.IsSystem:
+			fmt.Printf("[%s] * %s\n", stamp, msg.Content)
+		case msg.Type != "e2e":
+			fmt.Printf("[%s] %s: %s (not encrypted)\n", stamp, msg.Sender, msg.Content)
+		default:
+			text, err := s.open(msg)
+			if err != nil {
+				text = "(can't decrypt: " + err.Error() + ")"
+			}
+			fmt.Printf("[%s] %s: %s\n", stamp, msg.Sender, text)
+		}
+	}
+
+	if err := s.save(); err != nil {
+		return err
+	}
+	return s.refill()
+}
+
+// forget drops the pinned keys of a user so their new keys are accepted
+func (e *e2e) forget(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: forget <user>")
+	}
+	s, err := e.session()
+	if err != nil {
+		return err
+	}
+	forgotten := 0
+	for key := range s.Pinned {
+		if strings.HasPrefix(key, args[0]+"/") && key != s.UserId+"/"+s.Device.DeviceId {
+			delete(s.Pinned, key)
+			forgotten++
+		}
+	}
+	if err := s.save(); err != nil {
+		return err
+	}
+	fmt.Printf("Forgot %d pinned devices of %s\n", forgotten, args[0])
+	return nil
+}
+
+// remove unpublishes this device and deletes its state. Messages sent to
+// it can't be read anymore.
+func (e *e2e) remove(args []string) error {
+	if len(args) != 0 {
+		return errors.New("usage: remove")
+	}
+	s, err := e.session()
+	if err != nil {
+		return err
+	}
+	var apiErr *APIError
+	if err := e.client.RemoveDevice(s.UserId, s.Device.DeviceId); err != nil && !(errors.As(err, &apiErr) && apiErr.Code == "device_not_found") {
+		return err
+	}
+	if err := os.Remove(s.path); err != nil {
+		return err
+	}
+	fmt.Printf("Removed device %s of %s\n", s.Device.DeviceId, s.UserId)
+	return nil
+}
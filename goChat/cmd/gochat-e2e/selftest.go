@@ -0,0 +1,179 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gochat/internal/e2eclient"
+)
+
+// selfTest registers two throwaway users on the server, gives one of them
+// two devices and checks that messages between them are stored as
+// ciphertext, can be read on every device they were sent to, and can't be
+// read once tampered with or attributed to someone else. The test users
+// stay on the server; an admin can delete them.
+func selfTest(server *Client) error {
+	dir, err := os.MkdirTemp("", "gochat-e2e-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return err
+	}
+	alice := "e2e-" + hex.EncodeToString(suffix) + "-a"
+	bob := "e2e-" + hex.EncodeToString(suffix) + "-b"
+	password := "selftest-" + hex.EncodeToString(suffix) + "0"
+
+	// Each user talks to the server through a client with their own session
+	clients := map[string]*Client{}
+	for _, userId := range []string{alice, bob} {
+		if err := server.Register(userId, userId+"@example.com", password); err != nil {
+			return fmt.Errorf("registering %s: %w", userId, err)
+		}
+		client := e2eclient.NewClient(server.BaseURL)
+		if err := client.Login(userId, password); err != nil {
+			return fmt.Errorf("logging in %s: %w", userId, err)
+		}
+		clients[userId] = client
+	}
+	client := clients[alice]
+	fmt.Printf("Registered test users %s and %s\n", alice, bob)
+
+	step := func(name string, err error) error {
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		fmt.Println("ok  ", name)
+		return nil
+	}
+
+	laptop, err := createSession(client, filepath.Join(dir, "alice-laptop.json"), alice, "laptop")
+	if err := step("publish alice/laptop", err); err != nil {
+		return err
+	}
+	phone, err := createSession(client, filepath.Join(dir, "alice-phone.json"), alice, "phone")
+	if err := step("publish alice/phone", err); err != nil {
+		return err
+	}
+	bobDevice, err := createSession(clients[bob], filepath.Join(dir, "bob.json"), bob, "desktop")
+	if err := step("publish bob/desktop", err); err != nil {
+		return err
+	}
+
+	// Alice writes from her laptop
+	const greeting = "The owls are not what they seem"
+	if err := step("send from alice/laptop", laptop.send(bob, greeting)); err != nil {
+		return err
+	}
+	messages, err := client.Messages(alice, bob)
+	if err == nil && len(messages) != 1 {
+		err = fmt.Errorf("expected 1 message, found %d", len(messages))
+	}
+	if err == nil && (messages[0].Type != "e2e" || strings.Contains(messages[0].Content, greeting)) {
+		err = errors.New("server stored the message in plaintext")
+	}
+	if err := step("server only holds ciphertext", err); err != nil {
+		return err
+	}
+	stored := messages[0]
+
+	// Failed attempts don't use up the one-time prekeys, so the devices can
+	// still read the real message afterwards
+	envelope, err := e2eclient.ParseEnvelope(stored.Content)
+	if err != nil {
+		return err
+	}
+	_, err = e2eclient.Decrypt(phone.Device, alice, bob, envelope)
+	if err := step("message attributed to another sender is rejected", expectFailure(err)); err != nil {
+		return err
+	}
+	tampered, err := e2eclient.ParseEnvelope(stored.Content)
+	if err != nil {
+		return err
+	}
+	for i := range tampered.Recipients {
+		tampered.Recipients[i].Ciphertext[len(tampered.Recipients[i].Ciphertext)-1] ^= 1
+	}
+	_, err = e2eclient.Decrypt(bobDevice.Device, bob, alice, tampered)
+	if err := step("tampered ciphertext is rejected", expectFailure(err)); err != nil {
+		return err
+	}
+	_, err = bobDevice.open(Message{Sender: alice, Receiver: bob, Type: "e2e", Content: base64.StdEncoding.EncodeToString([]byte("{}"))})
+	if err := step("malformed envelope is rejected", expectFailure(err)); err != nil {
+		return err
+	}
+
+	readers := []struct {
+		name string
+		s    *session
+	}{{"bob/desktop", bobDevice}, {"alice/phone", phone}, {"alice/laptop", laptop}}
+	for _, reader := range readers {
+		text, err := reader.s.open(stored)
+		if err == nil && text != greeting {
+			err = fmt.Errorf("decrypted %q", text)
+		}
+		if err := step("read on "+reader.name, err); err != nil {
+			return err
+		}
+	}
+
+	// Bob replies; both of Alice's devices can read it
+	const reply = "Neither are the keys"
+	if err := step("send from bob/desktop", bobDevice.send(alice, reply)); err != nil {
+		return err
+	}
+	messages, err = client.Messages(alice, bob)
+	if err == nil && len(messages) != 2 {
+		err = fmt.Errorf("expected 2 messages, found %d", len(messages))
+	}
+	if err != nil {
+		return err
+	}
+	for _, reader := range readers[1:] {
+		text, err := reader.s.open(messages[1])
+		if err == nil && text != reply {
+			err = fmt.Errorf("decrypted %q", text)
+		}
+		if err := step("reply read on "+reader.name, err); err != nil {
+			return err
+		}
+	}
+
+	// Prekeys are topped up when they run low
+	if err := step("prekey supply checked", bobDevice.refill()); err != nil {
+		return err
+	}
+
+	// Removing a device takes it out of the directory
+	err = client.RemoveDevice(alice, "phone")
+	if err == nil {
+		var bundles []PrekeyBundle
+		bundles, err = client.ClaimBundles(alice, "")
+		if err == nil && len(bundles) != 1 {
+			err = fmt.Errorf("expected 1 device left, found %d", len(bundles))
+		}
+	}
+	if err := step("remove alice/phone", err); err != nil {
+		return err
+	}
+
+	fmt.Printf("End-to-end self-test passed; test users %s and %s are left on the server\n", alice, bob)
+	return nil
+}
+
+// Turn an expected failure into success and vice versa
+func expectFailure(err error) error {
+	if err == nil {
+		return errors.New("expected an error")
+	}
+	return nil
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"gochat/internal/e2eclient"
+)
+
+// Prekey supply: a new device publishes prekeyBatch one-time prekeys and
+// tops them up to that number when fewer than prekeyLowWater are left
+const (
+	prekeyBatch    = 50
+	prekeyLowWater = 10
+)
+
+// pinnedDevice is the identity a device was first seen with
+type pinnedDevice struct {
+	IdentityKey string `json:"identityKey"`
+	SigningKey  string `json:"signingKey"`
+}
+
+// localState is what the client keeps on disk for one user's device. It
+// holds private keys, so the file is only readable by its owner.
+type localState struct {
+	UserId   string                  `json:"userId"`
+	Device   *Device                 `json:"device"`
+	Pinned   map[string]pinnedDevice `json:"pinned"`   // By "user/device"
+	Messages map[string]string       `json:"messages"` // Plaintext by content digest
+}
+
+// session is a device's local state together with the server it uses
+type session struct {
+	client *Client
+	path   string
+	localState
+}
+
+var errNoDevices = errors.New("has not published any devices for end-to-end encryption")
+
+// Default location of the state file for a user
+func statePath(userId string) (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "gochat", "e2e", userId+".json"), nil
+}
+
+// Create the keys of a new device, publish them and save the state. An
+// existing state file is never overwritten.
+func createSession(client *Client, path, userId, deviceId string) (*session, error) {
+	if _, err := os.Stat(path); err == nil {
+		return nil, fmt.Errorf("%s already exists; remove the device first", path)
+	}
+	device, err := e2eclient.NewDevice(deviceId)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := device.PublicKeys(prekeyBatch)
+	if err != nil {
+		return nil, err
+	}
+	if err := client.PublishDevice(userId, keys); err != nil {
+		return nil, err
+	}
+
+	s := &session{
+		client: client,
+		path:   path,
+		localState: localState{
+			UserId:   userId,
+			Device:   device,
+			Pinned:   map[string]pinnedDevice{userId + "/" + deviceId: {keys.IdentityKey, keys.SigningKey}},
+			Messages: map[string]string{},
+		},
+	}
+	return s, s.save()
+}
+
+// Load the state of an existing device
+func openSession(client *Client, path string) (*session, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, errors.New("this device has no keys yet; run `gochat-e2e init` first")
+	}
+	if err != nil {
+		return nil, err
+	}
+	s := &session{client: client, path: path}
+	if err := json.Unmarshal(data, &s.localState); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+	if s.Pinned == nil {
+		s.Pinned = map[string]pinnedDevice{}
+	}
+	if s.Messages == nil {
+		s.Messages = map[string]string{}
+	}
+	return s, nil
+}
+
+// Write the state through a temporary file so a crash can't lose the keys
+func (s *session) save() error {
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(s.localState, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// Check a device's keys against the ones pinned when it was first seen,
+// pinning them if it is new
+func (s *session) trust(userId, deviceId, identityKey, signingKey string) error {
+	key := userId + "/" + deviceId
+	if pinned, ok := s.Pinned[key]; ok {
+		if pinned.IdentityKey != identityKey || (signingKey != "" && pinned.SigningKey != signingKey) {
+			return fmt.Errorf("the keys of device %s changed; if %s confirms the new fingerprint, run `gochat-e2e forget %s`", key, userId, userId)
+		}
+		return nil
+	}
+	if signingKey == "" {
+		return fmt.Errorf("device %s is unknown", key)
+	}
+	s.Pinned[key] = pinnedDevice{IdentityKey: identityKey, SigningKey: signingKey}
+	return nil
+}
+
+// Claim and check bundles for every device of a user, leaving out this one
+func (s *session) bundles(userId string) ([]PrekeyBundle, error) {
+	except := ""
+	if userId == s.UserId {
+		except = s.Device.DeviceId
+	}
+	claimed, err := s.client.ClaimBundles(userId, except)
+	if err != nil {
+		return nil, err
+	}
+	bundles := []PrekeyBundle{}
+	for _, bundle := range claimed {
+		if err := e2eclient.VerifyBundle(bundle); err != nil {
+			return nil, err
+		}
+		if err := s.trust(bundle.UserId, bundle.DeviceId, bundle.IdentityKey, bundle.SigningKey); err != nil {
+			return nil, err
+		}
+		bundles = append(bundles, bundle)
+	}
+	return bundles, nil
+}
+
+// Digest a message content is remembered by
+func contentDigest(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+// Encrypt text for every device of the receiver and the user's other
+// devices, and send it
+func (s *session) send(receiver, text string) error {
+	bundles, err := s.bundles(receiver)
+	if err != nil {
+		return err
+	}
+	if len(bundles) == 0 {
+		return fmt.Errorf("%s %w", receiver, errNoDevices)
+	}
+	if receiver != s.UserId {
+		own, err := s.bundles(s.UserId)
+		if err != nil {
+			return err
+		}
+		bundles = append(bundles, own...)
+	}
+
+	content, err := e2eclient.Encrypt(s.Device, s.UserId, []byte(text), bundles)
+	if err != nil {
+		return err
+	}
+	if err := s.client.SendEncrypted(s.UserId, receiver, content); err != nil {
+		return err
+	}
+	// This device isn't a recipient of its own message
+	s.Messages[contentDigest(content)] = text
+	return s.save()
+}
+
+// Decrypt a message of type "e2e". Plaintext is remembered, because the
+// one-time prekey it used is gone afterwards. The caller saves the state.
+func (s *session) open(msg Message) (string, error) {
+	digest := contentDigest(msg.Content)
+	if text, ok := s.Messages[digest]; ok {
+		return text, nil
+	}
+
+	envelope, err := e2eclient.ParseEnvelope(msg.Content)
+	if err != nil {
+		return "", err
+	}
+	identityKey := base64.StdEncoding.EncodeToString(envelope.IdentityKey)
+	if _, pinned := s.Pinned[msg.Sender+"/"+envelope.SenderDevice]; !pinned {
+		// First message from this device: look it up in the directory
+		devices, err := s.client.Devices(msg.Sender)
+		if err != nil {
+			return "", err
+		}
+		for _, device := range devices {
+			if device.DeviceId == envelope.SenderDevice && device.IdentityKey == identityKey {
+				if err := s.trust(msg.Sender, device.DeviceId, device.IdentityKey, device.SigningKey); err != nil {
+					return "", err
+				}
+			}
+		}
+	}
+	if err := s.trust(msg.Sender, envelope.SenderDevice, identityKey, ""); err != nil {
+		return "", err
+	}
+
+	plaintext, err := e2eclient.Decrypt(s.Device, s.UserId, msg.Sender, envelope)
+	if err != nil {
+		return "", err
+	}
+	s.Messages[digest] = string(plaintext)
+	return string(plaintext), nil
+}
+
+// Upload new one-time prekeys when the server is running low
+func (s *session) refill() error {
+	devices, err := s.client.Devices(s.UserId)
+	if err != nil {
+		return err
+	}
+	for _, device := range devices {
+		if device.DeviceId != s.Device.DeviceId {
+			continue
+		}
+		if device.PrekeysLeft >= prekeyLowWater {
+			return nil
+		}
+		prekeys, err := s.Device.NewOneTimePrekeys(prekeyBatch - device.PrekeysLeft)
+		if err != nil {
+			return err
+		}
+		// Save first: an uploaded prekey without its private half is useless
+		if err := s.save(); err != nil {
+			return err
+		}
+		_, err = s.client.AddPrekeys(s.UserId, s.Device.DeviceId, prekeys)
+		return err
+	}
+	return fmt.Errorf("device %s is no longer published; remove it and run init again", s.Device.DeviceId)
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Messages starting with "/" are run through the command registry before
+// they're stored. A command can reply privately to the sender, replace the
+// content that gets stored, or do something else entirely. Start a message
+// with "//" to send a literal slash.
+
+// CommandContext describes the message that invoked a command
+type CommandContext struct {
+	Sender   string
+	Receiver string
+	Name     string // Command name without the slash
+	Args     string // Everything after the command name, trimmed
+}
+
+// CommandResult tells sendMessage what to do after a command ran
+type CommandResult struct {
+	Reply   string // Shown only to the sender; never stored
+	Content string // Stored in place of the original message when Store is set
+	Store   bool
+}
+
+// SlashCommand is one entry in the command registry
+type SlashCommand struct {
+	Name  string
+	Usage string // Argument synopsis, e.g. "<duration> <text>"
+	Help  string
+	Run   func(ctx CommandContext) (CommandResult, error)
+}
+
+// errUsage makes the dispatcher reply with the command's usage line
+var errUsage = errors.New("invalid arguments")
+
+// Registered commands by name
+var commandRegistry = map[string]*SlashCommand{}
+
+// Add a command to the registry. Panics on duplicates so conflicts show up at startup.
+func registerCommand(cmd *SlashCommand) {
+	if _, exists := commandRegistry[cmd.Name]; exists {
+		panic("slash command registered twice: /" + cmd.Name)
+	}
+	commandRegistry[cmd.Name] = cmd
+}
+
+// Usage line for a command, e.g. "/remind <duration> <text>"
+func (cmd *SlashCommand) usageLine() string {
+	if cmd.Usage == "" {
+		return "/" + cmd.Name
+	}
+	return "/" + cmd.Name + " " + cmd.Usage
+}
+
+// Run the command in a message. Content starting with "//" is unescaped
+// and stored as a normal message.
+func runSlashCommand(sender, receiver, content string) CommandResult {
+	if strings.HasPrefix(content, "//") {
+		return CommandResult{Content: content[1:], Store: true}
+	}
+
+	name, args, _ := strings.Cut(content[1:], " ")
+	ctx := CommandContext{
+		Sender:   sender,
+		Receiver: receiver,
+		Name:     strings.ToLower(name),
+		Args:     strings.TrimSpace(args),
+	}
+
+	cmd, ok := commandRegistry[ctx.Name]
+	if !ok {
+		return CommandResult{Reply: fmt.Sprintf("Unknown command /%s. Type /help for a list of commands.", name)}
+	}
+
+	fmt.Printf("Running command /%s for %s\n", cmd.Name, sender)
+	result, err := cmd.Run(ctx)
+	if errors.Is(err, errUsage) {
+		return CommandResult{Reply: "Usage: " + cmd.usageLine()}
+	}
+	if err != nil {
+		return CommandResult{Reply: fmt.Sprintf("/%s failed: %v", cmd.Name, err)}
+	}
+	return result
+}
+
+func init() {
+	registerCommand(&SlashCommand{
+		Name:  "help",
+		Usage: "[command]",
+		Help:  "List commands, or show help for one command",
+		Run:   helpCommand,
+	})
+	registerCommand(&SlashCommand{
+		Name:  "me",
+		Usage: "<action>",
+		Help:  "Send an action, e.g. /me waves",
+		Run: func(ctx CommandContext) (CommandResult, error) {
+			if ctx.Args == "" {
+				return CommandResult{}, errUsage
+			}
+			return CommandResult{Content: "* " + ctx.Sender + " " + ctx.Args, Store: true}, nil
+		},
+	})
+	registerCommand(&SlashCommand{
+		Name:  "shrug",
+		Usage: "[text]",
+		Help:  `Append ¯\_(ツ)_/¯ to your message`,
+		Run: func(ctx CommandContext) (CommandResult, error) {
+			return CommandResult{Content: strings.TrimSpace(ctx.Args + ` ¯\_(ツ)_/¯`), Store: true}, nil
+		},
+	})
+	registerCommand(&SlashCommand{
+		Name:  "remind",
+		Usage: "<duration> <text>",
+		Help:  "Send yourself a reminder later, e.g. /remind 30m call Bob",
+		Run:   remindCommand,
+	})
+	registerCommand(&SlashCommand{
+		Name:  "disappear",
+		Usage: "<duration|off>",
+		Help:  "Set the disappearing-message timer for this conversation, e.g. /disappear 24h",
+		Run:   disappearCommand,
+	})
+	registerCommand(&SlashCommand{
+		Name:  "status",
+		Usage: "[text]",
+		Help:  "Set your status text, or clear it when no text is given",
+		Run:   statusCommand,
+	})
+}
+
+// /help lists every command, or describes one
+func helpCommand(ctx CommandContext) (CommandResult, error) {
+	if ctx.Args != "" {
+		cmd, ok := commandRegistry[strings.ToLower(strings.TrimPrefix(ctx.Args, "/"))]
+		if !ok {
+			return CommandResult{Reply: "No such command: " + ctx.Args}, nil
+		}
+		return CommandResult{Reply: cmd.usageLine() + "\n" + cmd.Help}, nil
+	}
+
+	names := make([]string, 0, len(commandRegistry))
+	for name := range commandRegistry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	lines := []string{"Available commands:"}
+	for _, name := range names {
+		cmd := commandRegistry[name]
+		lines = append(lines, fmt.Sprintf("%s - %s", cmd.usageLine(), cmd.Help))
+	}
+	lines = append(lines, "Start a message with // to send a literal slash.")
+	return CommandResult{Reply: strings.Join(lines, "\n")}, nil
+}
+
+// /remind schedules a message to the sender's own conversation. It goes
+// through the scheduler, so reminders survive restarts and can be listed
+// and cancelled like any other scheduled message.
+func remindCommand(ctx CommandContext) (CommandResult, error) {
+	durationText, text, _ := strings.Cut(ctx.Args, " ")
+	text = strings.TrimSpace(text)
+	delay, err := time.ParseDuration(durationText)
+	if err != nil || text == "" {
+		return CommandResult{}, errUsage
+	}
+	if delay <= 0 || delay > 7*24*time.Hour {
+		return CommandResult{Reply: "Reminders must be between 1s and 7 days away"}, nil
+	}
+
+	due := time.Now().Add(delay)
+	if _, err := scheduleMessage(ctx.Sender, ctx.Sender, "Reminder: "+text, due); err != nil {
+		return CommandResult{}, err
+	}
+	return CommandResult{Reply: fmt.Sprintf("OK, I'll remind you at %s", due.Format("Jan 2 15:04"))}, nil
+}
+
+// /disappear changes the conversation's disappearing-message timer
+func disappearCommand(ctx CommandContext) (CommandResult, error) {
+	var ttl time.Duration
+	if ctx.Args != "off" {
+		parsed, err := time.ParseDuration(ctx.Args)
+		if err != nil {
+			return CommandResult{}, errUsage
+		}
+		ttl = parsed
+	}
+	if ttl != 0 && (ttl < minMessageTTL || ttl > maxMessageTTL) {
+		return CommandResult{Reply: "The timer must be off or between 30s and 365 days"}, nil
+	}
+
+	if err := setConversationTTL(ctx.Sender, ctx.Receiver, ttl); err != nil {
+		return CommandResult{}, err
+	}
+	if ttl == 0 {
+		return CommandResult{Reply: "Disappearing messages are off"}, nil
+	}
+	return CommandResult{Reply: "New messages will disappear after " + describeTTL(ttl)}, nil
+}
+
+// /status updates the sender's status text in users.json
+func statusCommand(ctx CommandContext) (CommandResult, error) {
+	if len([]rune(ctx.Args)) > maxStatusLength {
+		return CommandResult{Reply: fmt.Sprintf("Status text can be at most %d characters", maxStatusLength)}, nil
+	}
+
+	if err := updateUser(ctx.Sender, func(user *User) { user.Status = ctx.Args }); err != nil {
+		return CommandResult{}, err
+	}
+
+	if ctx.Args == "" {
+		return CommandResult{Reply: "Status cleared"}, nil
+	}
+	return CommandResult{Reply: "Status set to: " + ctx.Args}, nil
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// Text rewritten by a command is held to the message limits
+func TestCommandOutputLimits(t *testing.T) {
+	useDataDir(t, User{UserId: "alice", Password: "alice1234"}, User{UserId: "bob", Password: "bob12345"})
+	long := strings.Repeat("x", maxMessageLength-len("/me "))
+
+	for _, content := range []string{"/me " + long, "/shrug " + long} {
+		body, _ := json.Marshal(MessageRequest{Receiver: "bob", Content: content})
+		rec := apiRequest(t, http.MethodPost, "/api/v1/send-message?sender=alice", "alice", string(body))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%.10s... at the limit: %d %s", content, rec.Code, rec.Body)
+		}
+	}
+
+	storeMu.Lock()
+	chatsData, err := loadChats()
+	storeMu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chatsData.Messages) != 0 {
+		t.Errorf("stored %d messages over the limit", len(chatsData.Messages))
+	}
+}
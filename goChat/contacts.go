@@ -0,0 +1,528 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"gochat/internal/store"
+)
+
+// Users build a contact list by sending requests that the other side
+// accepts. Anyone can message anyone unless the receiver has chosen to
+// accept messages only from contacts, or one of them has blocked the
+// other. A refused message always gets the same answer, so the sender
+// can't tell a block from the privacy setting. Blocking also ends the contact and any
+// pending request between the two, hides requests from the blocked user
+// and removes them from the blocker's search results.
+
+// Contact statuses
+const (
+	contactPending  = "pending"
+	contactAccepted = "accepted"
+)
+
+// Contact struct to store a contact request, or an accepted contact, in contacts.json
+type Contact struct {
+	Requester   string     `json:"requester"`
+	Recipient   string     `json:"recipient"`
+	Status      string     `json:"status"` // "pending" until the recipient accepts
+	RequestedAt time.Time  `json:"requestedAt"`
+	AcceptedAt  *time.Time `json:"acceptedAt,omitempty"`
+}
+
+// Block struct to store a block in contacts.json
+type Block struct {
+	Blocker   string    `json:"blocker"`
+	Blocked   string    `json:"blocked"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// ContactsData struct to match our JSON structure
+type ContactsData struct {
+	Contacts     []Contact `json:"contacts"`
+	Blocks       []Block   `json:"blocks"`
+	ContactsOnly []string  `json:"contactsOnly"` // Users who accept messages only from contacts
+}
+
+// ContactList is a user's view of contacts.json
+type ContactList struct {
+	Contacts     []string `json:"contacts"`
+	Incoming     []string `json:"incoming"` // Requests waiting for the user to accept
+	Outgoing     []string `json:"outgoing"` // Requests the user has sent
+	Blocked      []string `json:"blocked"`
+	ContactsOnly bool     `json:"contactsOnly"`
+}
+
+// Contact privacy request struct
+type ContactPrivacyRequest struct {
+	ContactsOnly bool `json:"contactsOnly"`
+}
+
+// Guards contacts.json
+var contactsMu sync.Mutex
+
+// Returned by update functions when the user has blocked the contact
+var errContactBlocked = errors.New("contact is blocked")
+
+// Read contacts, blocks and privacy settings from contacts.json
+func loadContacts() (ContactsData, error) {
+	contactsData := ContactsData{Contacts: []Contact{}, Blocks: []Block{}, ContactsOnly: []string{}}
+
+	data, err := os.ReadFile("contacts.json")
+	if os.IsNotExist(err) {
+		return contactsData, nil
+	}
+	if err != nil {
+		return contactsData, err
+	}
+
+	err = json.Unmarshal(data, &contactsData)
+	return contactsData, err
+}
+
+// Write contacts, blocks and privacy settings to contacts.json
+func saveContacts(contactsData ContactsData) error {
+	newData, err := json.MarshalIndent(contactsData, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic("contacts.json", newData, 0644)
+}
+
+// Index of the contact or request between two users, in either direction
+func (contactsData ContactsData) findContact(user1, user2 string) int {
+	for i, contact := range contactsData.Contacts {
+		if store.ConversationKey(contact.Requester, contact.Recipient) == store.ConversationKey(user1, user2) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Whether blocker has blocked the other user
+func (contactsData ContactsData) hasBlocked(blocker, blocked string) bool {
+	for _, block := range contactsData.Blocks {
+		if block.Blocker == blocker && block.Blocked == blocked {
+			return true
+		}
+	}
+	return false
+}
+
+// Remove the contact or request between two users, if any
+func (contactsData *ContactsData) removeContact(user1, user2 string) bool {
+	index := contactsData.findContact(user1, user2)
+	if index < 0 {
+		return false
+	}
+	contactsData.Contacts = append(contactsData.Contacts[:index], contactsData.Contacts[index+1:]...)
+	return true
+}
+
+// Whether sender may message receiver. Messages to yourself are always
+// allowed, and a block in either direction refuses them. For a bot,
+// botOwner is its owner, whose blocks apply to the bot as well. A receiver
+// who accepts only contacts must have the sender as a contact; since bots
+// can't accept requests, a request the receiver sent to the bot is enough.
+func checkMessagingAllowed(sender, receiver, botOwner string) (bool, error) {
+	if sender == receiver {
+		return true, nil
+	}
+
+	contactsMu.Lock()
+	contactsData, err := loadContacts()
+	contactsMu.Unlock()
+	if err != nil {
+		return false, err
+	}
+
+	for _, userId := range []string{sender, botOwner} {
+		if userId != "" && (contactsData.hasBlocked(userId, receiver) || contactsData.hasBlocked(receiver, userId)) {
+			return false, nil
+		}
+	}
+	if !containsString(contactsData.ContactsOnly, receiver) {
+		return true, nil
+	}
+	index := contactsData.findContact(sender, receiver)
+	if index < 0 {
+		return false, nil
+	}
+	contact := contactsData.Contacts[index]
+	return contact.Status == contactAccepted || (botOwner != "" && contact.Requester == receiver), nil
+}
+
+// Write the response for a refused message. Returns false if a response was
+// written and the handler should stop.
+func requireMessagingAllowed(w http.ResponseWriter, sender, receiver string) bool {
+	allowed, err := checkMessagingAllowed(sender, receiver, "")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error reading contacts.json: "+err.Error(), "")
+		return false
+	}
+	if !allowed {
+		writeError(w, http.StatusForbidden, "not_accepting_messages", receiver+" isn't accepting messages from you", "receiver")
+		return false
+	}
+	return true
+}
+
+// Users that userId has blocked
+func blockedUsers(userId string) (map[string]bool, error) {
+	contactsMu.Lock()
+	contactsData, err := loadContacts()
+	contactsMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	blocked := map[string]bool{}
+	for _, block := range contactsData.Blocks {
+		if block.Blocker == userId {
+			blocked[block.Blocked] = true
+		}
+	}
+	return blocked, nil
+}
+
+// Read the user and contact parameters shared by the contact handlers.
+// Returns false if a response was written and the handler should stop.
+func contactParams(w http.ResponseWriter, r *http.Request) (string, string, bool) {
+	userId := r.URL.Query().Get("user")
+	contactId := r.URL.Query().Get("contact")
+	if userId == "" || contactId == "" {
+		field := "user"
+		if userId != "" {
+			field = "contact"
+		}
+		writeError(w, http.StatusBadRequest, "missing_parameter", "Missing user or contact ID", field)
+		return "", "", false
+	}
+	if userId == contactId {
+		writeError(w, http.StatusBadRequest, "invalid_parameter", "You can't add or block yourself", "contact")
+		return "", "", false
+	}
+	if !requireUser(w, userId, "user") || !requireUser(w, contactId, "contact") {
+		return "", "", false
+	}
+	return userId, contactId, true
+}
+
+// Apply a change to contacts.json under its lock
+func updateContacts(update func(*ContactsData) error) error {
+	contactsMu.Lock()
+	defer contactsMu.Unlock()
+	contactsData, err := loadContacts()
+	if err != nil {
+		return err
+	}
+	if err := update(&contactsData); err != nil {
+		return err
+	}
+	return saveContacts(contactsData)
+}
+
+// Handler for a user's contacts, pending requests, blocks and privacy setting
+func listContacts(w http.ResponseWriter, r *http.Request) {
+	userId := r.URL.Query().Get("user")
+	if userId == "" {
+		writeError(w, http.StatusBadRequest, "missing_parameter", "User ID is required", "user")
+		return
+	}
+	if !requireUser(w, userId, "user") {
+		return
+	}
+
+	contactsMu.Lock()
+	contactsData, err := loadContacts()
+	contactsMu.Unlock()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error reading contacts.json: "+err.Error(), "")
+		return
+	}
+
+	list := ContactList{
+		Contacts:     []string{},
+		Incoming:     []string{},
+		Outgoing:     []string{},
+		Blocked:      []string{},
+		ContactsOnly: containsString(contactsData.ContactsOnly, userId),
+	}
+	for _, contact := range contactsData.Contacts {
+		switch {
+		case contact.Status == contactAccepted && contact.Requester == userId:
+			list.Contacts = append(list.Contacts, contact.Recipient)
+		case contact.Status == contactAccepted && contact.Recipient == userId:
+			list.Contacts = append(list.Contacts, contact.Requester)
+		case contact.Requester == userId:
+			list.Outgoing = append(list.Outgoing, contact.Recipient)
+		case contact.Recipient == userId:
+			list.Incoming = append(list.Incoming, contact.Requester)
+		}
+	}
+	for _, block := range contactsData.Blocks {
+		if block.Blocker == userId {
+			list.Blocked = append(list.Blocked, block.Blocked)
+		}
+	}
+	for _, ids := range [][]string{list.Contacts, list.Incoming, list.Outgoing, list.Blocked} {
+		sort.Strings(ids)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":  true,
+		"contacts": list,
+	})
+}
+
+// Handler for sending a contact request. A request to someone who already
+// asked the user accepts theirs instead. A request to someone who has
+// blocked the user looks sent but is dropped.
+func requestContact(w http.ResponseWriter, r *http.Request) {
+	userId, contactId, ok := contactParams(w, r)
+	if !ok {
+		return
+	}
+
+	status := contactPending
+	blockedBy := false
+	err := updateContacts(func(contactsData *ContactsData) error {
+		if contactsData.hasBlocked(userId, contactId) {
+			return errContactBlocked
+		}
+		if contactsData.hasBlocked(contactId, userId) {
+			blockedBy = true
+			return nil
+		}
+		now := time.Now()
+		index := contactsData.findContact(userId, contactId)
+		switch {
+		case index < 0:
+			contactsData.Contacts = append(contactsData.Contacts, Contact{
+				Requester:   userId,
+				Recipient:   contactId,
+				Status:      contactPending,
+				RequestedAt: now,
+			})
+		case contactsData.Contacts[index].Status == contactAccepted:
+			status = contactAccepted
+		case contactsData.Contacts[index].Recipient == userId:
+			contactsData.Contacts[index].Status = contactAccepted
+			contactsData.Contacts[index].AcceptedAt = &now
+			status = contactAccepted
+		}
+		return nil
+	})
+	if err == errContactBlocked {
+		writeError(w, http.StatusConflict, "contact_blocked", "You have blocked "+contactId+"; unblock them first", "contact")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error updating contacts.json: "+err.Error(), "")
+		return
+	}
+
+	if !blockedBy {
+		fmt.Printf("Contact request %s -> %s: %s\n", userId, contactId, status)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"status":  status,
+	})
+}
+
+// Handler for accepting a contact request sent to the user
+func acceptContact(w http.ResponseWriter, r *http.Request) {
+	userId, contactId, ok := contactParams(w, r)
+	if !ok {
+		return
+	}
+
+	found := false
+	err := updateContacts(func(contactsData *ContactsData) error {
+		index := contactsData.findContact(userId, contactId)
+		if index < 0 || contactsData.Contacts[index].Recipient != userId || contactsData.Contacts[index].Status != contactPending {
+			return nil
+		}
+		now := time.Now()
+		contactsData.Contacts[index].Status = contactAccepted
+		contactsData.Contacts[index].AcceptedAt = &now
+		found = true
+		return nil
+	})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error updating contacts.json: "+err.Error(), "")
+		return
+	}
+	if !found {
+		writeError(w, http.StatusNotFound, "request_not_found", "No contact request from "+contactId, "contact")
+		return
+	}
+
+	fmt.Printf("%s accepted the contact request of %s\n", userId, contactId)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{"success": true})
+}
+
+// Handler for removing a contact, declining a request sent to the user or
+// withdrawing one the user sent
+func removeContact(w http.ResponseWriter, r *http.Request) {
+	userId, contactId, ok := contactParams(w, r)
+	if !ok {
+		return
+	}
+
+	removed := false
+	err := updateContacts(func(contactsData *ContactsData) error {
+		removed = contactsData.removeContact(userId, contactId)
+		return nil
+	})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error updating contacts.json: "+err.Error(), "")
+		return
+	}
+	if !removed {
+		writeError(w, http.StatusNotFound, "contact_not_found", contactId+" is not a contact and has no pending request", "contact")
+		return
+	}
+
+	fmt.Printf("%s removed contact %s\n", userId, contactId)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{"success": true})
+}
+
+// Handler for blocking a user. Any contact or request between the two is
+// removed. Blocking twice is not an error.
+func blockContact(w http.ResponseWriter, r *http.Request) {
+	userId, contactId, ok := contactParams(w, r)
+	if !ok {
+		return
+	}
+
+	err := updateContacts(func(contactsData *ContactsData) error {
+		contactsData.removeContact(userId, contactId)
+		if !contactsData.hasBlocked(userId, contactId) {
+			contactsData.Blocks = append(contactsData.Blocks, Block{Blocker: userId, Blocked: contactId, CreatedAt: time.Now()})
+		}
+		return nil
+	})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error updating contacts.json: "+err.Error(), "")
+		return
+	}
+
+	fmt.Printf("%s blocked %s\n", userId, contactId)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{"success": true})
+}
+
+// Handler for unblocking a user. The contact isn't restored; either side
+// has to send a new request.
+func unblockContact(w http.ResponseWriter, r *http.Request) {
+	userId, contactId, ok := contactParams(w, r)
+	if !ok {
+		return
+	}
+
+	unblocked := false
+	err := updateContacts(func(contactsData *ContactsData) error {
+		blocks := []Block{}
+		for _, block := range contactsData.Blocks {
+			if block.Blocker == userId && block.Blocked == contactId {
+				unblocked = true
+				continue
+			}
+			blocks = append(blocks, block)
+		}
+		contactsData.Blocks = blocks
+		return nil
+	})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error updating contacts.json: "+err.Error(), "")
+		return
+	}
+	if !unblocked {
+		writeError(w, http.StatusNotFound, "block_not_found", contactId+" is not blocked", "contact")
+		return
+	}
+
+	fmt.Printf("%s unblocked %s\n", userId, contactId)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{"success": true})
+}
+
+// Handler for choosing whether to accept messages only from contacts
+func setContactPrivacy(w http.ResponseWriter, r *http.Request) {
+	userId := r.URL.Query().Get("user")
+	if userId == "" {
+		writeError(w, http.StatusBadRequest, "missing_parameter", "User ID is required", "user")
+		return
+	}
+	if !requireUser(w, userId, "user") {
+		return
+	}
+
+	var req ContactPrivacyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_json", "Invalid JSON: "+err.Error(), "")
+		return
+	}
+
+	err := updateContacts(func(contactsData *ContactsData) error {
+		users := []string{}
+		for _, id := range contactsData.ContactsOnly {
+			if id != userId {
+				users = append(users, id)
+			}
+		}
+		if req.ContactsOnly {
+			users = append(users, userId)
+		}
+		contactsData.ContactsOnly = users
+		return nil
+	})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error updating contacts.json: "+err.Error(), "")
+		return
+	}
+
+	fmt.Printf("%s accepts messages only from contacts: %v\n", userId, req.ContactsOnly)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":      true,
+		"contactsOnly": req.ContactsOnly,
+	})
+}
+
+// Remove every contact, request, block and privacy setting of deleted users
+func purgeContacts(users map[string]bool) error {
+	return updateContacts(func(contactsData *ContactsData) error {
+		contacts := []Contact{}
+		for _, contact := range contactsData.Contacts {
+			if !users[contact.Requester] && !users[contact.Recipient] {
+				contacts = append(contacts, contact)
+			}
+		}
+		blocks := []Block{}
+		for _, block := range contactsData.Blocks {
+			if !users[block.Blocker] && !users[block.Blocked] {
+				blocks = append(blocks, block)
+			}
+		}
+		contactsOnly := []string{}
+		for _, userId := range contactsData.ContactsOnly {
+			if !users[userId] {
+				contactsOnly = append(contactsOnly, userId)
+			}
+		}
+		contactsData.Contacts, contactsData.Blocks, contactsData.ContactsOnly = contacts, blocks, contactsOnly
+		return nil
+	})
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"gochat/internal/store"
+)
+
+// Disappearing messages are configured per conversation. Messages stored
+// while a timer is set get an ExpiresAt stamp, and the sweeper deletes them
+// from chats.json once it passes. Compaction never archives them, and reads
+// skip any that expired before the sweeper got to them. The sweeper keeps
+// the earliest pending expiry in memory and only reads chats.json once it
+// is due. Changing the timer only affects messages sent afterwards.
+// Messages have no attachments yet, so there are no files to clean up
+// alongside them.
+
+// ConversationSettings struct to store settings shared by both participants
+type ConversationSettings struct {
+	Users      [2]string `json:"users"`      // Participant IDs, sorted
+	TTLSeconds int64     `json:"ttlSeconds"` // Disappearing-message timer; 0 means off
+	UpdatedBy  string    `json:"updatedBy"`
+	UpdatedAt  time.Time `json:"updatedAt"`
+}
+
+// ConversationsData struct to match our JSON structure
+type ConversationsData struct {
+	Conversations []ConversationSettings `json:"conversations"`
+}
+
+// Disappearing-message request struct
+type DisappearingRequest struct {
+	TTLSeconds int64 `json:"ttlSeconds"`
+}
+
+// Disappearing-message limits
+const (
+	minMessageTTL   = 30 * time.Second
+	maxMessageTTL   = 365 * 24 * time.Hour
+	sweeperInterval = 10 * time.Second
+)
+
+// Guards conversations.json
+var conversationsMu sync.Mutex
+
+// Earliest expiry among the stored messages, or zero when none is set to
+// expire. Unknown until the first sweep. Guarded by storeMu.
+var (
+	nextExpiry      time.Time
+	nextExpiryKnown bool
+)
+
+// Note a newly stored message's expiry in the sweeper's schedule. The
+// caller holds storeMu.
+func scheduleExpiry(message Message) {
+	if message.ExpiresAt != nil && nextExpiryKnown && (nextExpiry.IsZero() || message.ExpiresAt.Before(nextExpiry)) {
+		nextExpiry = *message.ExpiresAt
+	}
+}
+
+// Read conversation settings from conversations.json
+func loadConversations() (ConversationsData, error) {
+	conversationsData := ConversationsData{Conversations: []ConversationSettings{}}
+
+	data, err := os.ReadFile("conversations.json")
+	if os.IsNotExist(err) {
+		return conversationsData, nil
+	}
+	if err != nil {
+		return conversationsData, err
+	}
+
+	err = json.Unmarshal(data, &conversationsData)
+	return conversationsData, err
+}
+
+// Write conversation settings to conversations.json
+func saveConversations(conversationsData ConversationsData) error {
+	newData, err := json.MarshalIndent(conversationsData, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic("conversations.json", newData, 0644)
+}
+
+// Current disappearing-message timer for a conversation, or 0 when off
+func conversationTTL(user1, user2 string) (time.Duration, error) {
+	conversationsMu.Lock()
+	defer conversationsMu.Unlock()
+
+	conversationsData, err := loadConversations()
+	if err != nil {
+		return 0, err
+	}
+	key := store.ConversationKey(user1, user2)
+	for _, settings := range conversationsData.Conversations {
+		if settings.Users == key {
+			return time.Duration(settings.TTLSeconds) * time.Second, nil
+		}
+	}
+	return 0, nil
+}
+
+// Human-readable timer value for system messages
+func describeTTL(ttl time.Duration) string {
+	switch {
+	case ttl == 0:
+		return "off"
+	case ttl%(24*time.Hour) == 0:
+		return fmt.Sprintf("%dd", ttl/(24*time.Hour))
+	default:
+		return ttl.String()
+	}
+}
+
+// Change a conversation's timer and announce it in the conversation
+func setConversationTTL(userId, contactId string, ttl time.Duration) error {
+	if ttl != 0 && (ttl < minMessageTTL || ttl > maxMessageTTL) {
+		return fmt.Errorf("timer must be off or between %s and 365 days", minMessageTTL)
+	}
+
+	conversationsMu.Lock()
+	conversationsData, err := loadConversations()
+	if err != nil {
+		conversationsMu.Unlock()
+		return err
+	}
+
+	key := store.ConversationKey(userId, contactId)
+	settings := ConversationSettings{Users: key}
+	index := -1
+	for i, existing := range conversationsData.Conversations {
+		if existing.Users == key {
+			settings = existing
+			index = i
+			break
+		}
+	}
+	unchanged := settings.TTLSeconds == int64(ttl/time.Second)
+
+	settings.TTLSeconds = int64(ttl / time.Second)
+	settings.UpdatedBy = userId
+	settings.UpdatedAt = time.Now()
+	if index >= 0 {
+		conversationsData.Conversations[index] = settings
+	} else {
+		conversationsData.Conversations = append(conversationsData.Conversations, settings)
+	}
+	err = saveConversations(conversationsData)
+	conversationsMu.Unlock()
+	if err != nil || unchanged {
+		return err
+	}
+
+	// Announce the change to both participants. The announcement itself
+	// never expires so the history of timer changes stays visible.
+	content := fmt.Sprintf("%s turned off disappearing messages", userId)
+	if ttl != 0 {
+		content = fmt.Sprintf("%s set disappearing messages to %s", userId, describeTTL(ttl))
+	}
+	fmt.Println(content)
+	return storeMessage(Message{
+		Sender:    userId,
+		Receiver:  contactId,
+		Content:   content,
+		Timestamp: time.Now(),
+		IsSystem:  true,
+	})
+}
+
+// Delete every message that has expired and fix up the recent chats of
+// the conversations they belonged to
+func sweepExpiredMessages(now time.Time) {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+
+	// Nothing to do until the earliest expiry passes
+	if nextExpiryKnown && (nextExpiry.IsZero() || now.Before(nextExpiry)) {
+		return
+	}
+
+	chatsData, err := loadChats()
+	if err != nil {
+		fmt.Println("Error sweeping expired messages:", err)
+		return
+	}
+
+	kept := make([]Message, 0, len(chatsData.Messages))
+	affected := map[[2]string]bool{}
+	var earliest time.Time
+	for _, message := range chatsData.Messages {
+		if message.Expired(now) {
+			affected[store.ConversationKey(message.Sender, message.Receiver)] = true
+			continue
+		}
+		if message.ExpiresAt != nil && (earliest.IsZero() || message.ExpiresAt.Before(earliest)) {
+			earliest = *message.ExpiresAt
+		}
+		kept = append(kept, message)
+	}
+	if len(affected) == 0 {
+		nextExpiry, nextExpiryKnown = earliest, true
+		return
+	}
+
+	removed := len(chatsData.Messages) - len(kept)
+	chatsData.Messages = kept
+	if err := saveChats(chatsData); err != nil {
+		fmt.Println("Error sweeping expired messages:", err)
+		return
+	}
+	nextExpiry, nextExpiryKnown = earliest, true
+
+	if err := refreshRecentChats(affected, kept); err != nil {
+		fmt.Println("Error updating recent chats after sweep:", err)
+		return
+	}
+	if err := purgeDeletedMessages(func(message Message) bool { return message.Expired(now) }); err != nil {
+		fmt.Println("Error purging expired messages from the change log:", err)
+		return
+	}
+
+	fmt.Printf("Removed %d expired messages from %d conversations\n", removed, len(affected))
+}
+
+// Run the sweeper loop in the background
+func startSweeper() {
+	go func() {
+		sweepExpiredMessages(time.Now())
+		ticker := time.NewTicker(sweeperInterval)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			sweepExpiredMessages(now)
+		}
+	}()
+}
+
+// Handler for reading a conversation's disappearing-message timer
+func getDisappearing(w http.ResponseWriter, r *http.Request) {
+	userId := r.URL.Query().Get("user")
+	contactId := r.URL.Query().Get("contact")
+	if userId == "" || contactId == "" {
+		field := "user"
+		if userId != "" {
+			field = "contact"
+		}
+		writeError(w, http.StatusBadRequest, "missing_parameter", "Missing user or contact ID", field)
+		return
+	}
+	if !requireUser(w, userId, "user") || !requireUser(w, contactId, "contact") {
+		return
+	}
+
+	ttl, err := conversationTTL(userId, contactId)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error reading conversations.json: "+err.Error(), "")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":    true,
+		"ttlSeconds": int64(ttl / time.Second),
+	})
+}
+
+// Handler for changing a conversation's disappearing-message timer.
+// Either participant may change it.
+func setDisappearing(w http.ResponseWriter, r *http.Request) {
+	userId := r.URL.Query().Get("user")
+	contactId := r.URL.Query().Get("contact")
+	if userId == "" || contactId == "" {
+		field := "user"
+		if userId != "" {
+			field = "contact"
+		}
+		writeError(w, http.StatusBadRequest, "missing_parameter", "Missing user or contact ID", field)
+		return
+	}
+	if !requireUser(w, userId, "user") || !requireUser(w, contactId, "contact") {
+		return
+	}
+
+	var req DisappearingRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_json", "Invalid JSON: "+err.Error(), "")
+		return
+	}
+
+	// Bounded in seconds first so the conversion can't overflow
+	seconds := req.TTLSeconds
+	if seconds < 0 || seconds > int64(maxMessageTTL/time.Second) || (seconds != 0 && seconds < int64(minMessageTTL/time.Second)) {
+		writeError(w, http.StatusBadRequest, "invalid_field", "Timer must be 0 (off) or between 30 seconds and 365 days", "ttlSeconds")
+		return
+	}
+	ttl := time.Duration(seconds) * time.Second
+
+	// The timer change is announced in the conversation, so it's refused
+	// wherever a message would be
+	if !requireMessagingAllowed(w, userId, contactId) {
+		return
+	}
+
+	if err := setConversationTTL(userId, contactId, ttl); err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error updating conversation: "+err.Error(), "")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":    true,
+		"ttlSeconds": req.TTLSeconds,
+	})
+}
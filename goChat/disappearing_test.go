@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// Expired messages must not be returned even before the sweeper runs, and
+// the sweeper only reads chats.json once something is due
+func TestExpiredMessagesAreHidden(t *testing.T) {
+	useDataDir(t, User{UserId: "alice", Password: "alice1234"}, User{UserId: "bob", Password: "bob12345"})
+
+	now := time.Now()
+	sweepExpiredMessages(now)
+	if !nextExpiryKnown || !nextExpiry.IsZero() {
+		t.Fatalf("schedule after an empty sweep: %v %v", nextExpiryKnown, nextExpiry)
+	}
+
+	expired := now.Add(-time.Second)
+	pending := now.Add(time.Hour)
+	messages := []Message{
+		{Sender: "alice", Receiver: "bob", Content: "expired", Timestamp: now.Add(-time.Minute), ExpiresAt: &expired},
+		{Sender: "bob", Receiver: "alice", Content: "pending", Timestamp: now, ExpiresAt: &pending},
+	}
+	for _, message := range messages {
+		if err := storeMessage(message); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !nextExpiry.Equal(expired) {
+		t.Errorf("next expiry %v, want %v", nextExpiry, expired)
+	}
+
+	for _, target := range []string{"/api/v1/get-messages?user1=alice&user2=bob", "/api/v1/get-all-messages?user=alice"} {
+		rec := apiRequest(t, http.MethodGet, target, "alice", "")
+		var response struct {
+			Messages []Message `json:"messages"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil || rec.Code != http.StatusOK {
+			t.Fatalf("%s: %d %s", target, rec.Code, rec.Body)
+		}
+		if len(response.Messages) != 1 || response.Messages[0].Content != "pending" {
+			t.Errorf("%s returned %+v", target, response.Messages)
+		}
+	}
+
+	sweepExpiredMessages(now)
+	if !nextExpiry.Equal(pending) {
+		t.Errorf("next expiry after sweep %v, want %v", nextExpiry, pending)
+	}
+	storeMu.Lock()
+	chatsData, err := loadChats()
+	storeMu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chatsData.Messages) != 1 || chatsData.Messages[0].Content != "pending" {
+		t.Errorf("chats after sweep: %+v", chatsData.Messages)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"gochat/internal/e2eclient"
+)
+
+// Two gochat-e2e clients exchange encrypted messages through the real
+// router: the server only ever holds ciphertext, and each side decrypts
+// what the other sent
+func TestE2ERoundTrip(t *testing.T) {
+	useDataDir(t, User{UserId: "alice", Password: "alice1234"}, User{UserId: "bob", Password: "bob12345"})
+	server := httptest.NewServer(enforceSessions(setupAPIv1()))
+	defer server.Close()
+
+	clients := map[string]*e2eclient.Client{}
+	devices := map[string]*e2eclient.Device{}
+	for userId, password := range map[string]string{"alice": "alice1234", "bob": "bob12345"} {
+		client := e2eclient.NewClient(server.URL)
+		if err := client.Login(userId, password); err != nil {
+			t.Fatalf("logging in %s: %v", userId, err)
+		}
+		device, err := e2eclient.NewDevice(userId + "-laptop")
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys, err := device.PublicKeys(5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := client.PublishDevice(userId, keys); err != nil {
+			t.Fatalf("publishing %s's device: %v", userId, err)
+		}
+		clients[userId], devices[userId] = client, device
+	}
+
+	send := func(sender, receiver, text string) {
+		t.Helper()
+		bundles, err := clients[sender].ClaimBundles(receiver, "")
+		if err != nil || len(bundles) != 1 {
+			t.Fatalf("claiming %s's bundles: %d, %v", receiver, len(bundles), err)
+		}
+		if err := e2eclient.VerifyBundle(bundles[0]); err != nil {
+			t.Fatal(err)
+		}
+		content, err := e2eclient.Encrypt(devices[sender], sender, []byte(text), bundles)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := clients[sender].SendEncrypted(sender, receiver, content); err != nil {
+			t.Fatalf("sending as %s: %v", sender, err)
+		}
+	}
+	read := func(reader string, message e2eclient.Message) string {
+		t.Helper()
+		if message.Type != "e2e" {
+			t.Fatalf("message stored as type %q", message.Type)
+		}
+		envelope, err := e2eclient.ParseEnvelope(message.Content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		plaintext, err := e2eclient.Decrypt(devices[reader], reader, message.Sender, envelope)
+		if err != nil {
+			t.Fatalf("decrypting as %s: %v", reader, err)
+		}
+		return string(plaintext)
+	}
+
+	send("alice", "bob", "The owls are not what they seem")
+	send("bob", "alice", "Neither are the keys")
+
+	messages, err := clients["bob"].Messages("bob", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 2 {
+		t.Fatalf("found %d messages", len(messages))
+	}
+	for _, message := range messages {
+		if strings.Contains(message.Content, "The owls") || strings.Contains(message.Content, "the keys") {
+			t.Errorf("server stored %q in plaintext", message.Content)
+		}
+	}
+	if text := read("bob", messages[0]); text != "The owls are not what they seem" {
+		t.Errorf("bob read %q", text)
+	}
+	if text := read("alice", messages[1]); text != "Neither are the keys" {
+		t.Errorf("alice read %q", text)
+	}
+
+	// Only the intended device can read a message
+	envelope, err := e2eclient.ParseEnvelope(messages[0].Content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e2eclient.Decrypt(devices["alice"], "alice", "bob", envelope); err == nil {
+		t.Error("the sender's device decrypted a message it wasn't a recipient of")
+	}
+}
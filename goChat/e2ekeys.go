@@ -0,0 +1,463 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// End-to-end encrypted messages are sealed by the clients; the server only
+// keeps a directory of public keys and relays the ciphertext. Every device
+// publishes an X25519 identity key, an Ed25519 signing key, a signed
+// prekey and a batch of one-time prekeys. A sender claims a prekey bundle
+// for each of the receiver's devices (using up one one-time prekey per
+// device), derives a key per device and sends a single message of type
+// "e2e" whose content is the base64 envelope. cmd/gochat-e2e is the
+// reference client.
+
+// Message type of an end-to-end encrypted envelope. Plaintext messages
+// have no type.
+const messageTypeE2E = "e2e"
+
+// Key directory limits
+const (
+	maxDevicesPerUser = 10
+	maxOneTimePrekeys = 100 // Stored per device
+	maxDeviceIdLength = 64
+	maxEnvelopeLength = 64 << 10 // Bytes of base64 content
+)
+
+// SignedPrekey is a medium-term X25519 prekey. Signature is the Ed25519
+// signature of the raw public key by the device's signing key.
+type SignedPrekey struct {
+	Id        int    `json:"id"`
+	PublicKey string `json:"publicKey"`
+	Signature string `json:"signature"`
+}
+
+// OneTimePrekey is an X25519 prekey handed out to a single sender
+type OneTimePrekey struct {
+	Id        int    `json:"id"`
+	PublicKey string `json:"publicKey"`
+}
+
+// DeviceKeys struct to store a device's public keys. Keys are standard
+// base64 of 32 raw bytes.
+type DeviceKeys struct {
+	UserId         string          `json:"userId,omitempty"` // Taken from the query string when publishing
+	DeviceId       string          `json:"deviceId"`
+	IdentityKey    string          `json:"identityKey"`
+	SigningKey     string          `json:"signingKey"`
+	SignedPrekey   SignedPrekey    `json:"signedPrekey"`
+	OneTimePrekeys []OneTimePrekey `json:"oneTimePrekeys"`
+	UpdatedAt      time.Time       `json:"updatedAt"`
+}
+
+// E2EKeysData struct to match our JSON structure
+type E2EKeysData struct {
+	Devices []DeviceKeys `json:"devices"`
+}
+
+// DeviceInfo is a published device as listed to other users
+type DeviceInfo struct {
+	UserId       string       `json:"userId"`
+	DeviceId     string       `json:"deviceId"`
+	IdentityKey  string       `json:"identityKey"`
+	SigningKey   string       `json:"signingKey"`
+	SignedPrekey SignedPrekey `json:"signedPrekey"`
+	PrekeysLeft  int          `json:"prekeysLeft"` // One-time prekeys not yet claimed
+	UpdatedAt    time.Time    `json:"updatedAt"`
+}
+
+// PrekeyBundle holds what a sender needs to encrypt to one device.
+// OneTimePrekey is missing when the device has run out.
+type PrekeyBundle struct {
+	UserId        string         `json:"userId"`
+	DeviceId      string         `json:"deviceId"`
+	IdentityKey   string         `json:"identityKey"`
+	SigningKey    string         `json:"signingKey"`
+	SignedPrekey  SignedPrekey   `json:"signedPrekey"`
+	OneTimePrekey *OneTimePrekey `json:"oneTimePrekey,omitempty"`
+}
+
+// PrekeysRequest struct for adding one-time prekeys to a device
+type PrekeysRequest struct {
+	OneTimePrekeys []OneTimePrekey `json:"oneTimePrekeys"`
+}
+
+// Guards e2e_keys.json
+var e2eKeysMu sync.Mutex
+
+// Read the key directory from e2e_keys.json
+func loadE2EKeys() (E2EKeysData, error) {
+	keysData := E2EKeysData{Devices: []DeviceKeys{}}
+
+	data, err := os.ReadFile("e2e_keys.json")
+	if os.IsNotExist(err) {
+		return keysData, nil
+	}
+	if err != nil {
+		return keysData, err
+	}
+
+	err = json.Unmarshal(data, &keysData)
+	return keysData, err
+}
+
+// Write the key directory to e2e_keys.json
+func saveE2EKeys(keysData E2EKeysData) error {
+	newData, err := json.MarshalIndent(keysData, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic("e2e_keys.json", newData, 0644)
+}
+
+// Decode a base64 public key, which must be 32 bytes
+func decodePublicKey(encoded string) ([]byte, bool) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	return key, err == nil && len(key) == 32
+}
+
+// validateDeviceId allows the same characters as usernames
+func validateDeviceId(deviceId string, errs *ValidationErrors) {
+	if deviceId == "" {
+		errs.add("deviceId", "Device ID is required")
+		return
+	}
+	if len(deviceId) > maxDeviceIdLength {
+		errs.add("deviceId", "Device ID can be at most 64 characters")
+		return
+	}
+	for _, r := range deviceId {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '_' || r == '-') {
+			errs.add("deviceId", "Device ID may only contain letters, digits, '.', '_' and '-'")
+			return
+		}
+	}
+}
+
+// validatePrekeys checks one-time prekeys for well-formed keys and IDs
+// that aren't used twice, including by the prekeys the device already has
+func validatePrekeys(prekeys, existing []OneTimePrekey, errs *ValidationErrors) {
+	if len(prekeys)+len(existing) > maxOneTimePrekeys {
+		errs.add("oneTimePrekeys", fmt.Sprintf("A device can hold at most %d one-time prekeys", maxOneTimePrekeys))
+		return
+	}
+	ids := map[int]bool{}
+	for _, prekey := range existing {
+		ids[prekey.Id] = true
+	}
+	for _, prekey := range prekeys {
+		if _, ok := decodePublicKey(prekey.PublicKey); !ok {
+			errs.add("oneTimePrekeys", "One-time prekeys must be 32 bytes of base64")
+			return
+		}
+		if ids[prekey.Id] {
+			errs.add("oneTimePrekeys", fmt.Sprintf("One-time prekey ID %d is used twice", prekey.Id))
+			return
+		}
+		ids[prekey.Id] = true
+	}
+}
+
+// validateDeviceKeys checks the keys a device publishes, including the
+// signature on its signed prekey
+func validateDeviceKeys(keys DeviceKeys) ValidationErrors {
+	var errs ValidationErrors
+	validateDeviceId(keys.DeviceId, &errs)
+	if _, ok := decodePublicKey(keys.IdentityKey); !ok {
+		errs.add("identityKey", "Identity key must be 32 bytes of base64")
+	}
+	signingKey, ok := decodePublicKey(keys.SigningKey)
+	if !ok {
+		errs.add("signingKey", "Signing key must be 32 bytes of base64")
+	}
+	prekey, prekeyOk := decodePublicKey(keys.SignedPrekey.PublicKey)
+	signature, err := base64.StdEncoding.DecodeString(keys.SignedPrekey.Signature)
+	switch {
+	case !prekeyOk:
+		errs.add("signedPrekey", "Signed prekey must be 32 bytes of base64")
+	case err != nil || len(signature) != ed25519.SignatureSize:
+		errs.add("signedPrekey", "Signed prekey signature must be 64 bytes of base64")
+	case ok && !ed25519.Verify(ed25519.PublicKey(signingKey), prekey, signature):
+		errs.add("signedPrekey", "Signed prekey signature does not match the signing key")
+	}
+	validatePrekeys(keys.OneTimePrekeys, nil, &errs)
+	return errs
+}
+
+// Public view of a device
+func (keys DeviceKeys) info() DeviceInfo {
+	return DeviceInfo{
+		UserId:       keys.UserId,
+		DeviceId:     keys.DeviceId,
+		IdentityKey:  keys.IdentityKey,
+		SigningKey:   keys.SigningKey,
+		SignedPrekey: keys.SignedPrekey,
+		PrekeysLeft:  len(keys.OneTimePrekeys),
+		UpdatedAt:    keys.UpdatedAt,
+	}
+}
+
+// Handler for publishing a device's keys. Publishing an existing device ID
+// replaces its keys, which is what a reinstalled client does.
+func publishDeviceKeys(w http.ResponseWriter, r *http.Request) {
+	userId := r.URL.Query().Get("user")
+	if userId == "" {
+		writeError(w, http.StatusBadRequest, "missing_parameter", "User ID is required", "user")
+		return
+	}
+	if !requireUser(w, userId, "user") {
+		return
+	}
+
+	var keys DeviceKeys
+	if err := json.NewDecoder(r.Body).Decode(&keys); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_json", "Invalid JSON: "+err.Error(), "")
+		return
+	}
+	if errs := validateDeviceKeys(keys); len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return
+	}
+	keys.UserId = userId
+	keys.UpdatedAt = time.Now()
+	if keys.OneTimePrekeys == nil {
+		keys.OneTimePrekeys = []OneTimePrekey{}
+	}
+
+	e2eKeysMu.Lock()
+	defer e2eKeysMu.Unlock()
+
+	keysData, err := loadE2EKeys()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error reading e2e_keys.json: "+err.Error(), "")
+		return
+	}
+	devices, replaced := 0, false
+	for i, device := range keysData.Devices {
+		if device.UserId != userId {
+			continue
+		}
+		devices++
+		if device.DeviceId == keys.DeviceId {
+			keysData.Devices[i] = keys
+			replaced = true
+		}
+	}
+	if !replaced {
+		if devices >= maxDevicesPerUser {
+			writeError(w, http.StatusConflict, "too_many_devices", fmt.Sprintf("A user can have at most %d devices; remove one first", maxDevicesPerUser), "deviceId")
+			return
+		}
+		keysData.Devices = append(keysData.Devices, keys)
+	}
+	if err := saveE2EKeys(keysData); err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error writing to e2e_keys.json: "+err.Error(), "")
+		return
+	}
+
+	fmt.Printf("Published keys for device %s of %s (%d one-time prekeys)\n", keys.DeviceId, userId, len(keys.OneTimePrekeys))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"device":  keys.info(),
+	})
+}
+
+// Handler for topping up a device's one-time prekeys
+func addPrekeys(w http.ResponseWriter, r *http.Request) {
+	userId := r.URL.Query().Get("user")
+	deviceId := r.URL.Query().Get("device")
+	if userId == "" || deviceId == "" {
+		field := "user"
+		if userId != "" {
+			field = "device"
+		}
+		writeError(w, http.StatusBadRequest, "missing_parameter", "Missing user or device ID", field)
+		return
+	}
+
+	var prekeysReq PrekeysRequest
+	if err := json.NewDecoder(r.Body).Decode(&prekeysReq); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_json", "Invalid JSON: "+err.Error(), "")
+		return
+	}
+
+	e2eKeysMu.Lock()
+	defer e2eKeysMu.Unlock()
+
+	keysData, err := loadE2EKeys()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error reading e2e_keys.json: "+err.Error(), "")
+		return
+	}
+	for i, device := range keysData.Devices {
+		if device.UserId != userId || device.DeviceId != deviceId {
+			continue
+		}
+
+		var errs ValidationErrors
+		validatePrekeys(prekeysReq.OneTimePrekeys, device.OneTimePrekeys, &errs)
+		if len(errs) > 0 {
+			writeValidationErrors(w, errs)
+			return
+		}
+		keysData.Devices[i].OneTimePrekeys = append(device.OneTimePrekeys, prekeysReq.OneTimePrekeys...)
+		keysData.Devices[i].UpdatedAt = time.Now()
+		if err := saveE2EKeys(keysData); err != nil {
+			writeError(w, http.StatusInternalServerError, "internal_error", "Error writing to e2e_keys.json: "+err.Error(), "")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":     true,
+			"prekeysLeft": len(keysData.Devices[i].OneTimePrekeys),
+		})
+		return
+	}
+	writeError(w, http.StatusNotFound, "device_not_found", "No such device", "device")
+}
+
+// Handler for listing a user's devices and their public keys
+func listDevices(w http.ResponseWriter, r *http.Request) {
+	userId := r.URL.Query().Get("user")
+	if userId == "" {
+		writeError(w, http.StatusBadRequest, "missing_parameter", "User ID is required", "user")
+		return
+	}
+	if !requireUser(w, userId, "user") {
+		return
+	}
+
+	e2eKeysMu.Lock()
+	keysData, err := loadE2EKeys()
+	e2eKeysMu.Unlock()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error reading e2e_keys.json: "+err.Error(), "")
+		return
+	}
+
+	devices := []DeviceInfo{}
+	for _, device := range keysData.Devices {
+		if device.UserId == userId {
+			devices = append(devices, device.info())
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"devices": devices,
+	})
+}
+
+// Handler for claiming a prekey bundle for each of a user's devices. Every
+// claim uses up one one-time prekey per device; devices that have run out
+// are still returned, with only their signed prekey. A sender encrypting
+// for its own other devices leaves itself out with ?except=.
+func claimPrekeyBundles(w http.ResponseWriter, r *http.Request) {
+	userId := r.URL.Query().Get("user")
+	except := r.URL.Query().Get("except")
+	if userId == "" {
+		writeError(w, http.StatusBadRequest, "missing_parameter", "User ID is required", "user")
+		return
+	}
+	if !requireUser(w, userId, "user") {
+		return
+	}
+
+	e2eKeysMu.Lock()
+	defer e2eKeysMu.Unlock()
+
+	keysData, err := loadE2EKeys()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error reading e2e_keys.json: "+err.Error(), "")
+		return
+	}
+
+	bundles := []PrekeyBundle{}
+	claimed := false
+	for i, device := range keysData.Devices {
+		if device.UserId != userId || device.DeviceId == except {
+			continue
+		}
+		bundle := PrekeyBundle{
+			UserId:       device.UserId,
+			DeviceId:     device.DeviceId,
+			IdentityKey:  device.IdentityKey,
+			SigningKey:   device.SigningKey,
+			SignedPrekey: device.SignedPrekey,
+		}
+		if len(device.OneTimePrekeys) > 0 {
+			prekey := device.OneTimePrekeys[0]
+			bundle.OneTimePrekey = &prekey
+			keysData.Devices[i].OneTimePrekeys = device.OneTimePrekeys[1:]
+			claimed = true
+		}
+		bundles = append(bundles, bundle)
+	}
+	if claimed {
+		if err := saveE2EKeys(keysData); err != nil {
+			writeError(w, http.StatusInternalServerError, "internal_error", "Error writing to e2e_keys.json: "+err.Error(), "")
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"bundles": bundles,
+	})
+}
+
+// Handler for removing one of the user's devices from the directory
+func removeDevice(w http.ResponseWriter, r *http.Request) {
+	userId := r.URL.Query().Get("user")
+	deviceId := r.URL.Query().Get("device")
+	if userId == "" || deviceId == "" {
+		field := "user"
+		if userId != "" {
+			field = "device"
+		}
+		writeError(w, http.StatusBadRequest, "missing_parameter", "Missing user or device ID", field)
+		return
+	}
+
+	e2eKeysMu.Lock()
+	defer e2eKeysMu.Unlock()
+
+	keysData, err := loadE2EKeys()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error reading e2e_keys.json: "+err.Error(), "")
+		return
+	}
+
+	remaining := []DeviceKeys{}
+	for _, device := range keysData.Devices {
+		if device.UserId != userId || device.DeviceId != deviceId {
+			remaining = append(remaining, device)
+		}
+	}
+	if len(remaining) == len(keysData.Devices) {
+		writeError(w, http.StatusNotFound, "device_not_found", "No such device", "device")
+		return
+	}
+
+	keysData.Devices = remaining
+	if err := saveE2EKeys(keysData); err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error writing to e2e_keys.json: "+err.Error(), "")
+		return
+	}
+
+	fmt.Printf("Removed device %s of %s\n", deviceId, userId)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{"success": true})
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+
+	"gochat/internal/envelope"
+	"gochat/internal/store"
+)
+
+// Message bodies can be encrypted at rest with envelope encryption: every
+// body gets its own random data key, the body is sealed with AES-GCM under
+// that key, and the data key is wrapped with AES-GCM under a key
+// encryption key from the key ring. Each body is bound to its message ID
+// (recent-chat previews to their conversation, scheduled messages to
+// their ID), so a ciphertext copied onto another record fails to decrypt
+// instead of showing up in the wrong conversation. Encryption happens in the storage
+// helpers (chats.json, chats.log, archive segments, recentChats.json,
+// scheduled.json and the webhook dead-letter log), so handlers only ever
+// see plaintext. Messages have no attachments yet; when they do, their
+// blobs are sealed the same way. The format itself is in internal/envelope,
+// which gochat-admin shares.
+//
+// The key ring is read from the file given with -encryption-keys or from
+// GOCHAT_ENCRYPTION_KEYS. It lists one `<id>:<base64 32-byte key>` entry
+// per line (or separated by commas); the first entry encrypts, and all of
+// them decrypt. To rotate, put a new key first and run `gochat-admin
+// reencrypt`, which rewraps every data key under it; the old key can be
+// dropped once no snapshot needs it. Without a key ring values are stored
+// in plaintext, and existing plaintext stays readable after encryption is
+// turned on.
+
+// Environment variable holding the key ring itself
+const encryptionKeysEnv = envelope.KeysEnv
+
+// Key ring in use; empty when encryption at rest is off
+var encryptionKeys envelope.Ring
+
+// Load the key ring from a file, or from the environment when no file is
+// given. Neither means encryption at rest is off.
+func loadEncryptionKeys(file string) error {
+	keys, err := envelope.LoadRing(file)
+	if err != nil {
+		return err
+	}
+	encryptionKeys = keys
+	return nil
+}
+
+// ID of the key that encrypts new values, or "" when encryption is off
+func activeKeyID() string {
+	return encryptionKeys.Active()
+}
+
+// Encrypt a text value such as a message body, bound to the record given
+// by context
+func sealText(text, context string) (string, error) {
+	return encryptionKeys.Seal([]byte(text), context)
+}
+
+// Decrypt a text value sealed for context
+func openText(value, context string) (string, error) {
+	data, err := encryptionKeys.Open(value, context)
+	return string(data), err
+}
+
+// Copy of messages with their bodies encrypted, for writing to disk.
+// Messages stored before they had IDs get one here.
+func sealMessages(messages []Message) ([]Message, error) {
+	sealed := make([]Message, len(messages))
+	for i, message := range messages {
+		if message.Id == "" {
+			message.Id = store.NewMessageId()
+		}
+		content, err := sealText(message.Content, envelope.MessageContext(message.Id))
+		if err != nil {
+			return nil, err
+		}
+		message.Content = content
+		sealed[i] = message
+	}
+	return sealed, nil
+}
+
+// Decrypt message bodies read from disk, in place
+func openMessages(messages []Message) error {
+	for i := range messages {
+		content, err := openText(messages[i].Content, envelope.MessageContext(messages[i].Id))
+		if err != nil {
+			return fmt.Errorf("decrypting message from %s: %w", messages[i].Sender, err)
+		}
+		messages[i].Content = content
+	}
+	return nil
+}
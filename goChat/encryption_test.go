@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	"gochat/internal/envelope"
+)
+
+// A sealed body moved onto another message must not decrypt there
+func TestEncryptedBodiesBoundToMessages(t *testing.T) {
+	useDataDir(t, User{UserId: "alice", Password: "alice1234"}, User{UserId: "bob", Password: "bob12345"})
+	entry, err := envelope.NewKey("k1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encryptionKeys, err = envelope.ParseRing(entry); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { encryptionKeys = nil })
+
+	now := time.Now()
+	storeMu.Lock()
+	err = saveChats(ChatsData{Messages: []Message{
+		{Sender: "alice", Receiver: "bob", Content: "first", Timestamp: now},
+		{Sender: "bob", Receiver: "alice", Content: "second", Timestamp: now},
+	}})
+	storeMu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile("chats.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stored ChatsData
+	if err := json.Unmarshal(data, &stored); err != nil {
+		t.Fatal(err)
+	}
+	for _, message := range stored.Messages {
+		if message.Id == "" || !envelope.IsBound(message.Content) {
+			t.Fatalf("stored message without an ID or a bound body: %+v", message)
+		}
+	}
+
+	stored.Messages[0].Content, stored.Messages[1].Content = stored.Messages[1].Content, stored.Messages[0].Content
+	if data, err = json.Marshal(stored); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile("chats.json", data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	storeMu.Lock()
+	_, err = loadChats()
+	storeMu.Unlock()
+	if err == nil {
+		t.Errorf("swapped bodies decrypted")
+	}
+}
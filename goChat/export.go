@@ -0,0 +1,274 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+	_ "time/tzdata" // The container image has no zoneinfo of its own
+
+	"gochat/internal/store"
+)
+
+// Conversations can be exported as JSON (the stored Message list, lossless),
+// a self-contained HTML page, or plain text. Exports include archived
+// history. Messages have no attachments and there are no group chats yet,
+// so a zip export only bundles the transcript itself. End-to-end encrypted
+// messages keep their envelope in the JSON export and are shown as a
+// placeholder in the others.
+
+// ConversationExport is the JSON export format
+type ConversationExport struct {
+	Success    bool      `json:"success"`
+	Users      [2]string `json:"users"`
+	ExportedAt time.Time `json:"exportedAt"`
+	TimeZone   string    `json:"timeZone"`
+	Messages   []Message `json:"messages"`
+}
+
+// Export formats by name, with the content type and file extension of each
+var exportFormats = map[string]struct{ contentType, extension string }{
+	"json": {"application/json", "json"},
+	"html": {"text/html; charset=utf-8", "html"},
+	"text": {"text/plain; charset=utf-8", "txt"},
+}
+
+// Every message between two users, archived ones included, oldest first
+func conversationHistory(user1, user2 string) ([]Message, error) {
+	now := time.Now()
+	keep := func(message Message) bool {
+		inConversation := (message.Sender == user1 && message.Receiver == user2) ||
+			(message.Sender == user2 && message.Receiver == user1)
+		return inConversation && !message.Expired(now)
+	}
+
+	messages, err := loadArchivedMessages(user1, user2, keep)
+	if err != nil {
+		return nil, err
+	}
+
+	storeMu.Lock()
+	chatsData, err := loadChats()
+	storeMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	// A compaction interrupted after writing its segment can leave the same
+	// message in both places. Copies are matched by ID, since two identical
+	// messages can be sent in the same instant.
+	archived := map[string]bool{}
+	for _, message := range messages {
+		if message.Id != "" {
+			archived[message.Id] = true
+		}
+	}
+	for _, message := range chatsData.Messages {
+		if keep(message) && (message.Id == "" || !archived[message.Id]) {
+			messages = append(messages, message)
+		}
+	}
+
+	sort.SliceStable(messages, func(i, j int) bool {
+		return messages[i].Timestamp.Before(messages[j].Timestamp)
+	})
+	return messages, nil
+}
+
+// One line of the text export
+func exportTextLine(message Message, loc *time.Location) string {
+	stamp := message.Timestamp.In(loc).Format("2006-01-02 15:04:05 MST")
+	if message.IsSystem {
+		return fmt.Sprintf("[%s] * %s", stamp, message.Content)
+	}
+	return fmt.Sprintf("[%s] %s: %s", stamp, message.Sender, strings.ReplaceAll(store.Preview(message), "\n", "\n    "))
+}
+
+// Plain-text transcript
+func renderExportText(users [2]string, messages []Message, loc *time.Location) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Conversation between %s and %s\n", users[0], users[1])
+	fmt.Fprintf(&buf, "Exported %s, times in %s\n\n", time.Now().In(loc).Format("2006-01-02 15:04 MST"), loc)
+	for _, message := range messages {
+		buf.WriteString(exportTextLine(message, loc))
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
+
+// Self-contained HTML page; styles are inline so the file works offline
+var exportHTMLTemplate = template.Must(template.New("export").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Conversation between {{index .Users 0}} and {{index .Users 1}}</title>
+<style>
+body { font-family: sans-serif; background: #f8f9fa; margin: 0; padding: 24px; }
+main { max-width: 720px; margin: 0 auto; }
+h1 { font-size: 20px; margin-bottom: 4px; }
+.meta { color: #777; font-size: 13px; margin-bottom: 24px; }
+.message { margin: 8px 0; display: flex; }
+.message .bubble { max-width: 70%; padding: 8px 12px; border-radius: 8px; background: #fff; box-shadow: 0 1px 2px rgba(0,0,0,0.1); white-space: pre-wrap; }
+.message.first .bubble { background: #4481eb; color: #fff; }
+.message.first { justify-content: flex-end; }
+.message.system { justify-content: center; }
+.message.system .bubble { background: transparent; box-shadow: none; color: #777; font-style: italic; }
+.sender { font-weight: bold; font-size: 12px; }
+.time { font-size: 11px; opacity: 0.7; margin-top: 4px; }
+</style>
+</head>
+<body>
+<main>
+<h1>Conversation between {{index .Users 0}} and {{index .Users 1}}</h1>
+<div class="meta">Exported {{.ExportedAt}} &middot; times in {{.TimeZone}} &middot; {{len .Messages}} messages</div>
+{{range .Messages}}<div class="message{{if .System}} system{{else if .First}} first{{end}}">
+<div class="bubble">{{if not .System}}<div class="sender">{{.Sender}}{{if .Bot}} (bot){{end}}</div>{{end}}{{.Content}}<div class="time">{{.Time}}</div></div>
+</div>
+{{end}}</main>
+</body>
+</html>
+`))
+
+// Messages as shown on the HTML page
+type exportHTMLMessage struct {
+	Sender, Content, Time string
+	First, System, Bot    bool
+}
+
+// HTML transcript. Messages from the first user are on the right.
+func renderExportHTML(users [2]string, messages []Message, loc *time.Location) ([]byte, error) {
+	page := struct {
+		Users      [2]string
+		ExportedAt string
+		TimeZone   string
+		Messages   []exportHTMLMessage
+	}{
+		Users:      users,
+		ExportedAt: time.Now().In(loc).Format("2006-01-02 15:04 MST"),
+		TimeZone:   loc.String(),
+	}
+	for _, message := range messages {
+		page.Messages = append(page.Messages, exportHTMLMessage{
+			Sender:  message.Sender,
+			Content: store.Preview(message),
+			Time:    message.Timestamp.In(loc).Format("2006-01-02 15:04:05 MST"),
+			First:   message.Sender == users[0],
+			System:  message.IsSystem,
+			Bot:     message.IsBot,
+		})
+	}
+
+	var buf bytes.Buffer
+	if err := exportHTMLTemplate.Execute(&buf, page); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Put the transcript into a zip archive
+func zipExport(name string, content []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	file, err := archive.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: time.Now()})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := file.Write(content); err != nil {
+		return nil, err
+	}
+	if err := archive.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Handler for exporting the conversation between the user and a contact
+func exportConversation(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	userId := query.Get("user")
+	contactId := query.Get("contact")
+	if userId == "" || contactId == "" {
+		field := "user"
+		if userId != "" {
+			field = "contact"
+		}
+		writeError(w, http.StatusBadRequest, "missing_parameter", "Missing user or contact ID", field)
+		return
+	}
+	if query.Get("group") != "" {
+		writeError(w, http.StatusBadRequest, "invalid_field", "Group conversations are not supported", "group")
+		return
+	}
+
+	formatName := query.Get("format")
+	if formatName == "" {
+		formatName = "json"
+	}
+	format, ok := exportFormats[formatName]
+	if !ok {
+		writeError(w, http.StatusBadRequest, "invalid_field", "Format must be json, html or text", "format")
+		return
+	}
+
+	loc := time.UTC
+	if tz := query.Get("tz"); tz != "" {
+		var err error
+		if loc, err = time.LoadLocation(tz); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_field", "Unknown time zone: "+tz, "tz")
+			return
+		}
+	}
+
+	if !requireUser(w, userId, "user") || !requireUser(w, contactId, "contact") {
+		return
+	}
+
+	messages, err := conversationHistory(userId, contactId)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error reading messages: "+err.Error(), "")
+		return
+	}
+
+	users := [2]string{userId, contactId}
+	var content []byte
+	switch formatName {
+	case "json":
+		content, err = json.MarshalIndent(ConversationExport{
+			Success:    true,
+			Users:      users,
+			ExportedAt: time.Now().In(loc),
+			TimeZone:   loc.String(),
+			Messages:   messages,
+		}, "", "  ")
+	case "html":
+		content, err = renderExportHTML(users, messages, loc)
+	case "text":
+		content = renderExportText(users, messages, loc)
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error rendering export: "+err.Error(), "")
+		return
+	}
+
+	fmt.Printf("Exported %d messages between %s and %s as %s\n", len(messages), userId, contactId, formatName)
+
+	fileName := fmt.Sprintf("gochat-%s-%s.%s", userId, contactId, format.extension)
+	if query.Get("attachments") == "true" {
+		content, err = zipExport(fileName, content)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "internal_error", "Error creating zip: "+err.Error(), "")
+			return
+		}
+		fileName = strings.TrimSuffix(fileName, "."+format.extension) + ".zip"
+		format.contentType = "application/zip"
+	}
+
+	w.Header().Set("Content-Type", format.contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fileName))
+	w.Write(content)
+}
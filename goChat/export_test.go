@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// Copies left in both the archive and chats.json are exported once, but
+// identical messages sent in the same instant are both kept
+func TestConversationHistoryDuplicates(t *testing.T) {
+	useDataDir(t, User{UserId: "alice", Password: "alice1234"}, User{UserId: "bob", Password: "bob12345"})
+
+	now := time.Now()
+	archived := Message{Id: "archived", Sender: "alice", Receiver: "bob", Content: "in both places", Timestamp: now.Add(-time.Hour)}
+	archiveMu.Lock()
+	segment, err := writeArchiveSegment([]Message{archived})
+	if err == nil {
+		err = saveArchiveIndex(ArchiveIndex{Segments: []ArchiveSegment{segment}})
+	}
+	archiveMu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storeMu.Lock()
+	err = saveChats(ChatsData{Messages: []Message{
+		archived,
+		{Id: "first", Sender: "bob", Receiver: "alice", Content: "ok", Timestamp: now},
+		{Id: "second", Sender: "bob", Receiver: "alice", Content: "ok", Timestamp: now},
+	}})
+	storeMu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	messages, err := conversationHistory("alice", "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, message := range messages {
+		ids = append(ids, message.Id)
+	}
+	if len(ids) != 3 || ids[0] != "archived" || ids[1] != "first" || ids[2] != "second" {
+		t.Errorf("exported %v", ids)
+	}
+}
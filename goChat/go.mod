@@ -0,0 +1,10 @@
+module gochat
+
+go 1.20
+
+require (
+	golang.org/x/term v0.15.0
+	golang.org/x/text v0.14.0
+)
+
+require golang.org/x/sys v0.15.0 // indirect
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// Run the test in an empty data directory holding only users.json with the
+// given users. The handlers use paths relative to the working directory,
+// so tests using this must not run in parallel.
+func useDataDir(t *testing.T, users ...User) {
+	t.Helper()
+	workDir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resetOpenFiles()
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		resetOpenFiles()
+		os.Chdir(workDir)
+	})
+
+	loginChallengesMu.Lock()
+	loginChallenges = map[string]*loginChallenge{}
+	loginChallengesMu.Unlock()
+
+	// Mail goes to a file so the links can be read back
+	previous := mailer
+	mailer = &fileMailer{from: "goChat <noreply@localhost>", path: "mail.mbox"}
+	t.Cleanup(func() { mailer = previous })
+
+	data, _ := json.MarshalIndent(UsersData{Users: users}, "", "  ")
+	if err := os.WriteFile("users.json", data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Close the message and change logs so they are reopened in the current
+// working directory
+func resetOpenFiles() {
+	storeMu.Lock()
+	closeMessageLog()
+	changeLogOpen = false
+	nextExpiryKnown = false
+	storeMu.Unlock()
+}
+
+// Token of the last link with the given query parameter, e.g. "reset",
+// in the mail sent so far
+func lastMailedToken(param string) string {
+	data, _ := os.ReadFile("mail.mbox")
+	text := string(data)
+	start := strings.LastIndex(text, "/?"+param+"=")
+	if start < 0 {
+		return ""
+	}
+	token := text[start+len(param)+3:]
+	if end := strings.IndexAny(token, " \r\n"); end >= 0 {
+		token = token[:end]
+	}
+	return token
+}
+
+// Make an API request as userId with a fresh session, or with the Basic
+// credentials of the admin root, root1234, when userId is empty
+func apiRequest(t *testing.T, method, target, userId, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if userId == "" {
+		req.SetBasicAuth("root", "root1234")
+	} else {
+		_, token, err := createSession(userId, "test", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(sessionHeader, token)
+	}
+	rec := httptest.NewRecorder()
+	enforceSessions(setupAPIv1()).ServeHTTP(rec, req)
+	return rec
+}
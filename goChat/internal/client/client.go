@@ -0,0 +1,514 @@
+// Package client talks to the goChat /api/v1 endpoints. gochat-cli and its
+// full-screen TUI are built on it, and the server's tests use it to drive
+// them against the real router.
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Message mirrors the server's Message JSON
+type Message struct {
+	Sender    string    `json:"sender"`
+	Receiver  string    `json:"receiver"`
+	Content   string    `json:"content"`
+	Timestamp time.Time `json:"timestamp"`
+	IsRead    bool      `json:"isRead"`
+	IsSystem  bool      `json:"isSystem,omitempty"`
+	Type      string    `json:"type,omitempty"`
+}
+
+// Text is what is shown for a message. End-to-end encrypted messages can only be
+// read with gochat-e2e.
+func (msg Message) Text() string {
+	if msg.Type == "e2e" {
+		return "🔒 Encrypted message (read it with gochat-e2e)"
+	}
+	return msg.Content
+}
+
+// SessionInfo mirrors the server's SessionInfo JSON
+type SessionInfo struct {
+	Id         string    `json:"id"`
+	DeviceName string    `json:"deviceName"`
+	CreatedAt  time.Time `json:"createdAt"`
+	LastSeenAt time.Time `json:"lastSeenAt"`
+	Current    bool      `json:"current"`
+}
+
+// SyncChange mirrors the server's SyncChange JSON
+type SyncChange struct {
+	Type      string    `json:"type"`
+	Message   *Message  `json:"message,omitempty"`
+	UserId    string    `json:"userId,omitempty"`
+	ContactId string    `json:"contactId,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+// SyncResult is the reply of /sync
+type SyncResult struct {
+	SyncToken string       `json:"syncToken"`
+	Changes   []SyncChange `json:"changes"`
+	More      bool         `json:"more"`
+	Reset     bool         `json:"reset"`
+}
+
+// ContactList mirrors the server's ContactList JSON
+type ContactList struct {
+	Contacts     []string `json:"contacts"`
+	Incoming     []string `json:"incoming"`
+	Outgoing     []string `json:"outgoing"`
+	Blocked      []string `json:"blocked"`
+	ContactsOnly bool     `json:"contactsOnly"`
+}
+
+// RecentChat mirrors the server's RecentChat JSON
+type RecentChat struct {
+	UserId      string    `json:"userId"`
+	ContactId   string    `json:"contactId"`
+	LastMessage string    `json:"lastMessage"`
+	Timestamp   time.Time `json:"timestamp"`
+	IsRead      bool      `json:"isRead"`
+}
+
+// User mirrors the server's User JSON as returned by search and login
+type User struct {
+	UserId string `json:"userId"`
+	Email  string `json:"email,omitempty"`
+}
+
+// ScheduledMessage mirrors the server's ScheduledMessage JSON
+type ScheduledMessage struct {
+	Id        string    `json:"id"`
+	Sender    string    `json:"sender"`
+	Receiver  string    `json:"receiver"`
+	Content   string    `json:"content"`
+	SendAt    time.Time `json:"sendAt"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Profile mirrors the server's Profile JSON
+type Profile struct {
+	UserId      string `json:"userId"`
+	DisplayName string `json:"displayName"`
+	AvatarURL   string `json:"avatarUrl,omitempty"`
+	Bio         string `json:"bio,omitempty"`
+	Status      string `json:"status,omitempty"`
+	Timezone    string `json:"timezone,omitempty"`
+	IsBot       bool   `json:"isBot,omitempty"`
+}
+
+// rawBody is a request body sent as-is instead of as JSON
+type rawBody struct {
+	contentType string
+	data        []byte
+}
+
+// TOTPSetup is a new authenticator secret waiting to be confirmed
+type TOTPSetup struct {
+	Secret     string `json:"secret"`
+	OtpauthURI string `json:"otpauthUri"`
+	QRText     string `json:"qrText"`
+}
+
+// TOTPStatus mirrors the server's two-factor settings
+type TOTPStatus struct {
+	Enabled           bool `json:"enabled"`
+	Pending           bool `json:"pending"`
+	RecoveryCodesLeft int  `json:"recoveryCodesLeft"`
+}
+
+// APIError is the server's uniform error object
+type APIError struct {
+	Status    int    `json:"-"`
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	Field     string `json:"field,omitempty"`
+	Challenge string `json:"-"` // Set with totp_required, for LoginTOTP
+}
+
+// Error formats the server error for display
+func (e *APIError) Error() string {
+	if e.Field != "" {
+		return fmt.Sprintf("%s (%s): %s", e.Code, e.Field, e.Message)
+	}
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// Client talks to the goChat /api/v1 endpoints
+type Client struct {
+	BaseURL    string
+	HTTPClient *http.Client
+	Session    string // Session token from the last login, if any
+}
+
+// NewClient creates a client for the server at baseURL
+func NewClient(baseURL string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimRight(baseURL, "/"),
+		HTTPClient: &http.Client{Timeout: 15 * time.Second},
+	}
+}
+
+// do sends a request to an /api/v1 endpoint and decodes the JSON reply into out
+func (c *Client) do(method, path string, query url.Values, body interface{}, out interface{}) error {
+	data, _, err := c.send(method, path, query, body)
+	if err != nil {
+		return err
+	}
+	if out != nil {
+		if err := json.Unmarshal(data, out); err != nil {
+			return fmt.Errorf("decoding response: %w", err)
+		}
+	}
+	return nil
+}
+
+// send performs the request and returns the raw body of a successful reply.
+// Error replies are turned into an *APIError.
+func (c *Client) send(method, path string, query url.Values, body interface{}) ([]byte, http.Header, error) {
+	target := c.BaseURL + "/api/v1" + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+
+	var reader io.Reader
+	contentType := "application/json"
+	if raw, ok := body.(rawBody); ok {
+		reader, contentType = bytes.NewReader(raw.data), raw.contentType
+	} else if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, target, reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.Session != "" {
+		req.Header.Set("X-GoChat-Session", c.Session)
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var failure struct {
+			Error     APIError `json:"error"`
+			Challenge string   `json:"challenge"`
+		}
+		if json.Unmarshal(data, &failure) != nil || failure.Error.Code == "" {
+			return nil, nil, fmt.Errorf("server returned %s", resp.Status)
+		}
+		failure.Error.Status = resp.StatusCode
+		failure.Error.Challenge = failure.Challenge
+		return nil, nil, &failure.Error
+	}
+	return data, resp.Header, nil
+}
+
+// Login checks the user's credentials, registering this device as a new
+// session, and returns the user ID to act as. The session token is kept
+// for later requests. Users with two-factor authentication get an
+// *APIError with code totp_required and a Challenge for LoginTOTP.
+func (c *Client) Login(userId, password, deviceName string) (string, error) {
+	var resp struct {
+		UserId string `json:"userId"`
+		Token  string `json:"token"`
+	}
+	body := map[string]string{"userId": userId, "password": password, "deviceName": deviceName}
+	err := c.do(http.MethodPost, "/login", nil, body, &resp)
+	if err == nil {
+		c.Session = resp.Token
+	}
+	return resp.UserId, err
+}
+
+// LoginTOTP finishes a login with the challenge from Login and an
+// authenticator or recovery code
+func (c *Client) LoginTOTP(challenge, code string) (string, error) {
+	var resp struct {
+		UserId string `json:"userId"`
+		Token  string `json:"token"`
+	}
+	body := map[string]string{"challenge": challenge, "code": code}
+	err := c.do(http.MethodPost, "/login/totp", nil, body, &resp)
+	if err == nil {
+		c.Session = resp.Token
+	}
+	return resp.UserId, err
+}
+
+// Sessions lists the devices the user is logged in on
+func (c *Client) Sessions() ([]SessionInfo, error) {
+	var resp struct {
+		Sessions []SessionInfo `json:"sessions"`
+	}
+	err := c.do(http.MethodGet, "/sessions/list", nil, nil, &resp)
+	return resp.Sessions, err
+}
+
+// RevokeSession logs out one of the user's devices
+func (c *Client) RevokeSession(id string) error {
+	return c.do(http.MethodPost, "/sessions/revoke", url.Values{"id": {id}}, nil, nil)
+}
+
+// RevokeOtherSessions logs out every other device and returns how many
+func (c *Client) RevokeOtherSessions() (int, error) {
+	var resp struct {
+		Revoked int `json:"revoked"`
+	}
+	err := c.do(http.MethodPost, "/sessions/revoke-others", nil, nil, &resp)
+	return resp.Revoked, err
+}
+
+// Logout ends this device's session
+func (c *Client) Logout() error {
+	return c.do(http.MethodPost, "/logout", nil, nil, nil)
+}
+
+// Sync returns the changes since this session last synced
+func (c *Client) Sync() (*SyncResult, error) {
+	var resp SyncResult
+	if err := c.do(http.MethodGet, "/sync", nil, nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// RecentChats lists the user's conversations, newest first
+func (c *Client) RecentChats(userId string) ([]RecentChat, error) {
+	var resp struct {
+		RecentChats []RecentChat `json:"recentChats"`
+	}
+	err := c.do(http.MethodGet, "/get-recent-chats", url.Values{"userId": {userId}}, nil, &resp)
+	return resp.RecentChats, err
+}
+
+// Messages returns the conversation between two users in the order stored
+func (c *Client) Messages(user1, user2 string) ([]Message, error) {
+	var resp struct {
+		Messages []Message `json:"messages"`
+	}
+	err := c.do(http.MethodGet, "/get-messages", url.Values{"user1": {user1}, "user2": {user2}}, nil, &resp)
+	return resp.Messages, err
+}
+
+// AllMessages returns every message the user sent or received
+func (c *Client) AllMessages(userId string) ([]Message, error) {
+	var resp struct {
+		Messages []Message `json:"messages"`
+	}
+	err := c.do(http.MethodGet, "/get-all-messages", url.Values{"user": {userId}}, nil, &resp)
+	return resp.Messages, err
+}
+
+// Send posts a message from sender to receiver. Slash commands may return
+// a private reply for the sender.
+func (c *Client) Send(sender, receiver, content string) (string, error) {
+	var resp struct {
+		Reply string `json:"reply"`
+	}
+	body := map[string]string{"receiver": receiver, "content": content}
+	err := c.do(http.MethodPost, "/send-message", url.Values{"sender": {sender}}, body, &resp)
+	return resp.Reply, err
+}
+
+// Schedule asks the server to deliver a message at sendAt. Slash commands
+// run immediately; the returned entry is nil when nothing was scheduled.
+func (c *Client) Schedule(sender, receiver, content string, sendAt time.Time) (*ScheduledMessage, string, error) {
+	var resp struct {
+		Reply     string            `json:"reply"`
+		Scheduled *ScheduledMessage `json:"scheduled"`
+	}
+	body := map[string]interface{}{"receiver": receiver, "content": content, "sendAt": sendAt}
+	err := c.do(http.MethodPost, "/send-message", url.Values{"sender": {sender}}, body, &resp)
+	return resp.Scheduled, resp.Reply, err
+}
+
+// Scheduled lists the user's pending scheduled messages, soonest first
+func (c *Client) Scheduled(userId string) ([]ScheduledMessage, error) {
+	var resp struct {
+		Scheduled []ScheduledMessage `json:"scheduled"`
+	}
+	err := c.do(http.MethodGet, "/list-scheduled", url.Values{"user": {userId}}, nil, &resp)
+	return resp.Scheduled, err
+}
+
+// CancelScheduled cancels one of the user's pending scheduled messages
+func (c *Client) CancelScheduled(userId, id string) error {
+	return c.do(http.MethodPost, "/cancel-scheduled", url.Values{"user": {userId}, "id": {id}}, nil, nil)
+}
+
+// Export downloads a conversation in the given format ("json", "html" or
+// "text"), with timestamps in the tz time zone. It returns the file contents
+// and the file name suggested by the server.
+func (c *Client) Export(userId, contact, format, tz string, asZip bool) ([]byte, string, error) {
+	query := url.Values{"user": {userId}, "contact": {contact}, "format": {format}}
+	if tz != "" {
+		query.Set("tz", tz)
+	}
+	if asZip {
+		query.Set("attachments", "true")
+	}
+	data, header, err := c.send(http.MethodGet, "/export-conversation", query, nil)
+	if err != nil {
+		return nil, "", err
+	}
+
+	fileName := ""
+	if _, params, err := mime.ParseMediaType(header.Get("Content-Disposition")); err == nil {
+		fileName = params["filename"]
+	}
+	return data, fileName, nil
+}
+
+// MarkRead marks every message from contact to userId as read
+func (c *Client) MarkRead(userId, contact string) error {
+	return c.do(http.MethodPost, "/mark-messages-read", url.Values{"user": {userId}, "contact": {contact}}, nil, nil)
+}
+
+// SearchUsers finds users whose ID or display name contains term, leaving
+// out the ones userId has blocked
+func (c *Client) SearchUsers(userId, term string) ([]User, error) {
+	var resp struct {
+		Users []User `json:"users"`
+	}
+	err := c.do(http.MethodPost, "/search-users", url.Values{"user": {userId}}, map[string]string{"searchTerm": term}, &resp)
+	return resp.Users, err
+}
+
+// Contacts returns the user's contacts, pending requests and blocks
+func (c *Client) Contacts(userId string) (*ContactList, error) {
+	var resp struct {
+		Contacts ContactList `json:"contacts"`
+	}
+	if err := c.do(http.MethodGet, "/contacts/list", url.Values{"user": {userId}}, nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp.Contacts, nil
+}
+
+// UpdateContact runs a contact action: request, accept, remove, block or
+// unblock. For a request it returns "pending" or "accepted".
+func (c *Client) UpdateContact(action, userId, contact string) (string, error) {
+	var resp struct {
+		Status string `json:"status"`
+	}
+	err := c.do(http.MethodPost, "/contacts/"+action, url.Values{"user": {userId}, "contact": {contact}}, nil, &resp)
+	return resp.Status, err
+}
+
+// SetContactsOnly chooses whether the user accepts messages only from contacts
+func (c *Client) SetContactsOnly(userId string, contactsOnly bool) error {
+	return c.do(http.MethodPost, "/contacts/set-privacy", url.Values{"user": {userId}}, map[string]bool{"contactsOnly": contactsOnly}, nil)
+}
+
+// Profile returns a user's profile
+func (c *Client) Profile(userId string) (*Profile, error) {
+	var resp struct {
+		Profile Profile `json:"profile"`
+	}
+	if err := c.do(http.MethodGet, "/profile/get", url.Values{"user": {userId}}, nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp.Profile, nil
+}
+
+// UpdateProfile changes the given profile fields (displayName, bio, status
+// or timezone) and returns the updated profile
+func (c *Client) UpdateProfile(userId string, fields map[string]string) (*Profile, error) {
+	var resp struct {
+		Profile Profile `json:"profile"`
+	}
+	if err := c.do(http.MethodPost, "/profile/update", url.Values{"user": {userId}}, fields, &resp); err != nil {
+		return nil, err
+	}
+	return &resp.Profile, nil
+}
+
+// UploadAvatar replaces the user's avatar with a PNG, JPEG or GIF image
+func (c *Client) UploadAvatar(userId string, image []byte) (*Profile, error) {
+	var resp struct {
+		Profile Profile `json:"profile"`
+	}
+	body := rawBody{contentType: http.DetectContentType(image), data: image}
+	if err := c.do(http.MethodPost, "/profile/upload-avatar", url.Values{"user": {userId}}, body, &resp); err != nil {
+		return nil, err
+	}
+	return &resp.Profile, nil
+}
+
+// RemoveAvatar removes the user's avatar
+func (c *Client) RemoveAvatar(userId string) error {
+	return c.do(http.MethodPost, "/profile/remove-avatar", url.Values{"user": {userId}}, nil, nil)
+}
+
+// TOTPStatus reports whether the user has two-factor authentication on
+func (c *Client) TOTPStatus(userId string) (*TOTPStatus, error) {
+	var resp struct {
+		TOTP TOTPStatus `json:"totp"`
+	}
+	if err := c.do(http.MethodGet, "/2fa/status", url.Values{"user": {userId}}, nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp.TOTP, nil
+}
+
+// SetupTOTP creates a new authenticator secret, which takes effect once
+// EnableTOTP confirms a code from it
+func (c *Client) SetupTOTP(userId, password string) (*TOTPSetup, error) {
+	var resp TOTPSetup
+	body := map[string]string{"userId": userId, "password": password}
+	if err := c.do(http.MethodPost, "/2fa/setup", nil, body, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// EnableTOTP turns two-factor authentication on and returns the recovery codes
+func (c *Client) EnableTOTP(userId, code string) ([]string, error) {
+	var resp struct {
+		RecoveryCodes []string `json:"recoveryCodes"`
+	}
+	err := c.do(http.MethodPost, "/2fa/enable", nil, map[string]string{"userId": userId, "code": code}, &resp)
+	return resp.RecoveryCodes, err
+}
+
+// DisableTOTP turns two-factor authentication off
+func (c *Client) DisableTOTP(userId, password, code string) error {
+	body := map[string]string{"userId": userId, "password": password, "code": code}
+	return c.do(http.MethodPost, "/2fa/disable", nil, body, nil)
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes and returns the new ones
+func (c *Client) RegenerateRecoveryCodes(userId, password, code string) ([]string, error) {
+	var resp struct {
+		RecoveryCodes []string `json:"recoveryCodes"`
+	}
+	body := map[string]string{"userId": userId, "password": password, "code": code}
+	err := c.do(http.MethodPost, "/2fa/recovery-codes", nil, body, &resp)
+	return resp.RecoveryCodes, err
+}
@@ -0,0 +1,204 @@
+// Package e2eclient is the client side of goChat's end-to-end encrypted
+// messages: the key agreement and envelope format (protocol.go) and the
+// API calls that publish keys and relay envelopes. gochat-e2e is built on
+// it, and the server's tests use it to check the round trip.
+package e2eclient
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Message mirrors the server's Message JSON
+type Message struct {
+	Sender    string    `json:"sender"`
+	Receiver  string    `json:"receiver"`
+	Content   string    `json:"content"`
+	Timestamp time.Time `json:"timestamp"`
+	IsSystem  bool      `json:"isSystem,omitempty"`
+	Type      string    `json:"type,omitempty"`
+}
+
+// DeviceInfo mirrors the server's DeviceInfo JSON
+type DeviceInfo struct {
+	UserId       string       `json:"userId"`
+	DeviceId     string       `json:"deviceId"`
+	IdentityKey  string       `json:"identityKey"`
+	SigningKey   string       `json:"signingKey"`
+	SignedPrekey SignedPrekey `json:"signedPrekey"`
+	PrekeysLeft  int          `json:"prekeysLeft"`
+	UpdatedAt    time.Time    `json:"updatedAt"`
+}
+
+// APIError is the server's uniform error object
+type APIError struct {
+	Status  int    `json:"-"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Field   string `json:"field,omitempty"`
+}
+
+// Error formats the server error for display
+func (e *APIError) Error() string {
+	if e.Field != "" {
+		return fmt.Sprintf("%s (%s): %s", e.Code, e.Field, e.Message)
+	}
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// Client talks to the goChat /api/v1 endpoints
+type Client struct {
+	BaseURL    string
+	HTTPClient *http.Client
+	Session    string // Session token of the user the client acts for
+}
+
+// NewClient creates a client for the server at baseURL
+func NewClient(baseURL string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimRight(baseURL, "/"),
+		HTTPClient: &http.Client{Timeout: 15 * time.Second},
+	}
+}
+
+// do sends a request to an /api/v1 endpoint and decodes the JSON reply
+// into out. Error replies are turned into an *APIError.
+func (c *Client) do(method, path string, query url.Values, body interface{}, out interface{}) error {
+	target := c.BaseURL + "/api/v1" + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, target, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.Session != "" {
+		req.Header.Set("X-GoChat-Session", c.Session)
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var failure struct {
+			Error APIError `json:"error"`
+		}
+		if json.Unmarshal(data, &failure) != nil || failure.Error.Code == "" {
+			return fmt.Errorf("server returned %s", resp.Status)
+		}
+		failure.Error.Status = resp.StatusCode
+		return &failure.Error
+	}
+	if out != nil {
+		if err := json.Unmarshal(data, out); err != nil {
+			return fmt.Errorf("decoding response: %w", err)
+		}
+	}
+	return nil
+}
+
+// Register creates an account
+func (c *Client) Register(userId, email, password string) error {
+	body := map[string]string{"userId": userId, "email": email, "password": password}
+	return c.do(http.MethodPost, "/register", nil, body, nil)
+}
+
+// Login starts a session for the user and keeps its token for later
+// requests
+func (c *Client) Login(userId, password string) error {
+	var resp struct {
+		Token string `json:"token"`
+	}
+	body := map[string]string{"userId": userId, "password": password, "deviceName": "gochat-e2e"}
+	err := c.do(http.MethodPost, "/login", nil, body, &resp)
+	if err == nil {
+		c.Session = resp.Token
+	}
+	return err
+}
+
+// PublishDevice publishes or replaces the keys of one of the user's devices
+func (c *Client) PublishDevice(userId string, keys DeviceKeys) error {
+	return c.do(http.MethodPost, "/keys/publish-device", url.Values{"user": {userId}}, keys, nil)
+}
+
+// AddPrekeys uploads more one-time prekeys and returns how many the
+// server now holds for the device
+func (c *Client) AddPrekeys(userId, deviceId string, prekeys []OneTimePrekey) (int, error) {
+	var resp struct {
+		PrekeysLeft int `json:"prekeysLeft"`
+	}
+	body := map[string]interface{}{"oneTimePrekeys": prekeys}
+	err := c.do(http.MethodPost, "/keys/add-prekeys", url.Values{"user": {userId}, "device": {deviceId}}, body, &resp)
+	return resp.PrekeysLeft, err
+}
+
+// Devices lists a user's published devices
+func (c *Client) Devices(userId string) ([]DeviceInfo, error) {
+	var resp struct {
+		Devices []DeviceInfo `json:"devices"`
+	}
+	err := c.do(http.MethodGet, "/keys/list-devices", url.Values{"user": {userId}}, nil, &resp)
+	return resp.Devices, err
+}
+
+// ClaimBundles claims a prekey bundle for each of a user's devices except
+// the one named by except, if any
+func (c *Client) ClaimBundles(userId, except string) ([]PrekeyBundle, error) {
+	var resp struct {
+		Bundles []PrekeyBundle `json:"bundles"`
+	}
+	query := url.Values{"user": {userId}}
+	if except != "" {
+		query.Set("except", except)
+	}
+	err := c.do(http.MethodPost, "/keys/claim-bundles", query, nil, &resp)
+	return resp.Bundles, err
+}
+
+// RemoveDevice takes one of the user's devices out of the key directory
+func (c *Client) RemoveDevice(userId, deviceId string) error {
+	return c.do(http.MethodPost, "/keys/remove-device", url.Values{"user": {userId}, "device": {deviceId}}, nil, nil)
+}
+
+// SendEncrypted posts an envelope as a message of type "e2e"
+func (c *Client) SendEncrypted(sender, receiver, envelope string) error {
+	body := map[string]string{"receiver": receiver, "content": envelope, "type": "e2e"}
+	return c.do(http.MethodPost, "/send-message", url.Values{"sender": {sender}}, body, nil)
+}
+
+// Messages returns the conversation between two users in the order stored
+func (c *Client) Messages(user1, user2 string) ([]Message, error) {
+	var resp struct {
+		Messages []Message `json:"messages"`
+	}
+	err := c.do(http.MethodGet, "/get-messages", url.Values{"user1": {user1}, "user2": {user2}}, nil, &resp)
+	return resp.Messages, err
+}
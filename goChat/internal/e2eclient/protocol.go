@@ -0,0 +1,480 @@
+package e2eclient
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// The protocol is an X3DH key agreement run for every message. The sender
+// generates an ephemeral X25519 key and, for each recipient device,
+// combines
+//
+//	DH1 = DH(sender identity, recipient signed prekey)
+//	DH2 = DH(ephemeral, recipient identity)
+//	DH3 = DH(ephemeral, recipient signed prekey)
+//	DH4 = DH(ephemeral, recipient one-time prekey)   if one was claimed
+//
+// into an AES-256-GCM key with HKDF-SHA256. The additional data binds the
+// ciphertext to both users, both devices and both identity keys, so the
+// server can't pass a message off as coming from someone else. There is no
+// ratchet: forward secrecy comes from one-time prekeys, which the recipient
+// deletes after the first use. The code in this file only depends on the
+// standard library and can be copied into other clients.
+
+// Protocol version and HKDF info string
+const (
+	envelopeVersion = 1
+	protocolInfo    = "goChat e2e v1"
+)
+
+// Envelope is the JSON document carried, base64 encoded, as the content
+// of a message of type "e2e". It holds one ciphertext per recipient device.
+type Envelope struct {
+	Version      int                 `json:"v"`
+	SenderDevice string              `json:"senderDevice"`
+	IdentityKey  []byte              `json:"identityKey"` // Sender device's X25519 identity key
+	Recipients   []EnvelopeRecipient `json:"recipients"`
+}
+
+// EnvelopeRecipient is the copy of a message sealed for one device
+type EnvelopeRecipient struct {
+	UserId          string `json:"userId"`
+	DeviceId        string `json:"deviceId"`
+	EphemeralKey    []byte `json:"ephemeralKey"`
+	SignedPrekeyId  int    `json:"signedPrekeyId"`
+	OneTimePrekeyId *int   `json:"oneTimePrekeyId,omitempty"`
+	Ciphertext      []byte `json:"ciphertext"` // GCM nonce followed by the sealed message
+}
+
+// SignedPrekey mirrors the server's SignedPrekey JSON
+type SignedPrekey struct {
+	Id        int    `json:"id"`
+	PublicKey string `json:"publicKey"`
+	Signature string `json:"signature"`
+}
+
+// OneTimePrekey mirrors the server's OneTimePrekey JSON
+type OneTimePrekey struct {
+	Id        int    `json:"id"`
+	PublicKey string `json:"publicKey"`
+}
+
+// DeviceKeys mirrors the JSON body of /keys/publish-device
+type DeviceKeys struct {
+	DeviceId       string          `json:"deviceId"`
+	IdentityKey    string          `json:"identityKey"`
+	SigningKey     string          `json:"signingKey"`
+	SignedPrekey   SignedPrekey    `json:"signedPrekey"`
+	OneTimePrekeys []OneTimePrekey `json:"oneTimePrekeys"`
+}
+
+// PrekeyBundle mirrors the server's PrekeyBundle JSON
+type PrekeyBundle struct {
+	UserId        string         `json:"userId"`
+	DeviceId      string         `json:"deviceId"`
+	IdentityKey   string         `json:"identityKey"`
+	SigningKey    string         `json:"signingKey"`
+	SignedPrekey  SignedPrekey   `json:"signedPrekey"`
+	OneTimePrekey *OneTimePrekey `json:"oneTimePrekey,omitempty"`
+}
+
+// Device holds the private keys of this device. Prekeys are kept by ID;
+// one-time prekeys are deleted as soon as a message has used them.
+type Device struct {
+	DeviceId       string         `json:"deviceId"`
+	IdentityKey    []byte         `json:"identityKey"` // X25519 private key
+	SigningKey     []byte         `json:"signingKey"`  // Ed25519 seed
+	SignedPrekeyId int            `json:"signedPrekeyId"`
+	SignedPrekeys  map[int][]byte `json:"signedPrekeys"`
+	OneTimePrekeys map[int][]byte `json:"oneTimePrekeys"`
+	NextPrekeyId   int            `json:"nextPrekeyId"`
+}
+
+var errNotForDevice = errors.New("message was not encrypted for this device")
+
+// Generate a fresh X25519 private key
+func newX25519Key() (*ecdh.PrivateKey, error) {
+	return ecdh.X25519().GenerateKey(rand.Reader)
+}
+
+// Parse a raw X25519 public key
+func parsePublicKey(raw []byte) (*ecdh.PublicKey, error) {
+	return ecdh.X25519().NewPublicKey(raw)
+}
+
+// Parse a base64 X25519 public key
+func parseBase64PublicKey(encoded string) (*ecdh.PublicKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	return parsePublicKey(raw)
+}
+
+// NewDevice creates the keys of a new device with a signed prekey
+func NewDevice(deviceId string) (*Device, error) {
+	identity, err := newX25519Key()
+	if err != nil {
+		return nil, err
+	}
+	_, signing, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	device := &Device{
+		DeviceId:       deviceId,
+		IdentityKey:    identity.Bytes(),
+		SigningKey:     signing.Seed(),
+		SignedPrekeys:  map[int][]byte{},
+		OneTimePrekeys: map[int][]byte{},
+		NextPrekeyId:   1,
+	}
+	if err := device.RotateSignedPrekey(); err != nil {
+		return nil, err
+	}
+	return device, nil
+}
+
+// Next prekey ID, shared by signed and one-time prekeys
+func (d *Device) nextId() int {
+	id := d.NextPrekeyId
+	d.NextPrekeyId++
+	return id
+}
+
+// RotateSignedPrekey replaces the signed prekey. The old private key is
+// kept so messages already encrypted to it can still be read.
+func (d *Device) RotateSignedPrekey() error {
+	prekey, err := newX25519Key()
+	if err != nil {
+		return err
+	}
+	d.SignedPrekeyId = d.nextId()
+	d.SignedPrekeys[d.SignedPrekeyId] = prekey.Bytes()
+	return nil
+}
+
+// NewOneTimePrekeys generates n one-time prekeys and returns their public
+// halves for uploading
+func (d *Device) NewOneTimePrekeys(n int) ([]OneTimePrekey, error) {
+	prekeys := []OneTimePrekey{}
+	for i := 0; i < n; i++ {
+		prekey, err := newX25519Key()
+		if err != nil {
+			return nil, err
+		}
+		id := d.nextId()
+		d.OneTimePrekeys[id] = prekey.Bytes()
+		prekeys = append(prekeys, OneTimePrekey{Id: id, PublicKey: base64.StdEncoding.EncodeToString(prekey.PublicKey().Bytes())})
+	}
+	return prekeys, nil
+}
+
+func (d *Device) identity() (*ecdh.PrivateKey, error) {
+	return ecdh.X25519().NewPrivateKey(d.IdentityKey)
+}
+
+// IdentityPublicKey returns the device's public identity key
+func (d *Device) IdentityPublicKey() []byte {
+	identity, err := d.identity()
+	if err != nil {
+		return nil
+	}
+	return identity.PublicKey().Bytes()
+}
+
+// SigningPublicKey returns the device's public signing key
+func (d *Device) SigningPublicKey() []byte {
+	return ed25519.NewKeyFromSeed(d.SigningKey).Public().(ed25519.PublicKey)
+}
+
+// PublicKeys returns what the device publishes, along with n new one-time
+// prekeys
+func (d *Device) PublicKeys(n int) (DeviceKeys, error) {
+	prekey, err := ecdh.X25519().NewPrivateKey(d.SignedPrekeys[d.SignedPrekeyId])
+	if err != nil {
+		return DeviceKeys{}, err
+	}
+	prekeyPublic := prekey.PublicKey().Bytes()
+	oneTime, err := d.NewOneTimePrekeys(n)
+	if err != nil {
+		return DeviceKeys{}, err
+	}
+	return DeviceKeys{
+		DeviceId:    d.DeviceId,
+		IdentityKey: base64.StdEncoding.EncodeToString(d.IdentityPublicKey()),
+		SigningKey:  base64.StdEncoding.EncodeToString(d.SigningPublicKey()),
+		SignedPrekey: SignedPrekey{
+			Id:        d.SignedPrekeyId,
+			PublicKey: base64.StdEncoding.EncodeToString(prekeyPublic),
+			Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(ed25519.NewKeyFromSeed(d.SigningKey), prekeyPublic)),
+		},
+		OneTimePrekeys: oneTime,
+	}, nil
+}
+
+// Fingerprint is a short, comparable rendering of a device's public
+// identity and signing keys, both base64 encoded
+func Fingerprint(identityKey, signingKey string) string {
+	sum := sha256.Sum256([]byte(identityKey + ":" + signingKey))
+	digits := hex.EncodeToString(sum[:16])
+	groups := []string{}
+	for i := 0; i < len(digits); i += 4 {
+		groups = append(groups, digits[i:i+4])
+	}
+	return strings.Join(groups, " ")
+}
+
+// VerifyBundle checks the signature on a bundle's signed prekey
+func VerifyBundle(bundle PrekeyBundle) error {
+	signingKey, err := base64.StdEncoding.DecodeString(bundle.SigningKey)
+	if err != nil || len(signingKey) != ed25519.PublicKeySize {
+		return fmt.Errorf("device %s/%s has a malformed signing key", bundle.UserId, bundle.DeviceId)
+	}
+	prekey, err := base64.StdEncoding.DecodeString(bundle.SignedPrekey.PublicKey)
+	if err != nil {
+		return fmt.Errorf("device %s/%s has a malformed signed prekey", bundle.UserId, bundle.DeviceId)
+	}
+	signature, err := base64.StdEncoding.DecodeString(bundle.SignedPrekey.Signature)
+	if err != nil || !ed25519.Verify(signingKey, prekey, signature) {
+		return fmt.Errorf("device %s/%s has a signed prekey with a bad signature", bundle.UserId, bundle.DeviceId)
+	}
+	return nil
+}
+
+// HKDF-SHA256 (RFC 5869) producing a single 32-byte key
+func hkdf(secret, salt, info []byte) []byte {
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(secret)
+	prk := extract.Sum(nil)
+
+	expand := hmac.New(sha256.New, prk)
+	expand.Write(info)
+	expand.Write([]byte{1})
+	return expand.Sum(nil)
+}
+
+// Derive the message key from the DH outputs
+func deriveKey(shared ...[]byte) []byte {
+	secret := make([]byte, 32, 32+32*len(shared))
+	for i := range secret {
+		secret[i] = 0xFF // Domain separation, as in X3DH
+	}
+	for _, s := range shared {
+		secret = append(secret, s...)
+	}
+	return hkdf(secret, make([]byte, 32), []byte(protocolInfo))
+}
+
+// Additional data binding a ciphertext to its sender and recipient
+func associatedData(senderUser, senderDevice string, senderIdentity []byte, recipientUser, recipientDevice string, recipientIdentity []byte) []byte {
+	ad := []byte(protocolInfo)
+	for _, part := range []string{senderUser, senderDevice, recipientUser, recipientDevice} {
+		ad = append(ad, 0)
+		ad = append(ad, part...)
+	}
+	ad = append(ad, senderIdentity...)
+	return append(ad, recipientIdentity...)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Encrypt seals plaintext from senderUser's device d for every device in
+// bundles and returns the message content: the base64 envelope. Bundles
+// must have been checked with VerifyBundle.
+func Encrypt(d *Device, senderUser string, plaintext []byte, bundles []PrekeyBundle) (string, error) {
+	identity, err := d.identity()
+	if err != nil {
+		return "", err
+	}
+	envelope := Envelope{
+		Version:      envelopeVersion,
+		SenderDevice: d.DeviceId,
+		IdentityKey:  identity.PublicKey().Bytes(),
+	}
+
+	for _, bundle := range bundles {
+		recipientIdentity, err := parseBase64PublicKey(bundle.IdentityKey)
+		if err != nil {
+			return "", fmt.Errorf("identity key of %s/%s: %w", bundle.UserId, bundle.DeviceId, err)
+		}
+		signedPrekey, err := parseBase64PublicKey(bundle.SignedPrekey.PublicKey)
+		if err != nil {
+			return "", fmt.Errorf("signed prekey of %s/%s: %w", bundle.UserId, bundle.DeviceId, err)
+		}
+		ephemeral, err := newX25519Key()
+		if err != nil {
+			return "", err
+		}
+
+		dh1, err := identity.ECDH(signedPrekey)
+		if err != nil {
+			return "", err
+		}
+		dh2, err := ephemeral.ECDH(recipientIdentity)
+		if err != nil {
+			return "", err
+		}
+		dh3, err := ephemeral.ECDH(signedPrekey)
+		if err != nil {
+			return "", err
+		}
+		shared := [][]byte{dh1, dh2, dh3}
+
+		recipient := EnvelopeRecipient{
+			UserId:         bundle.UserId,
+			DeviceId:       bundle.DeviceId,
+			EphemeralKey:   ephemeral.PublicKey().Bytes(),
+			SignedPrekeyId: bundle.SignedPrekey.Id,
+		}
+		if bundle.OneTimePrekey != nil {
+			oneTime, err := parseBase64PublicKey(bundle.OneTimePrekey.PublicKey)
+			if err != nil {
+				return "", fmt.Errorf("one-time prekey of %s/%s: %w", bundle.UserId, bundle.DeviceId, err)
+			}
+			dh4, err := ephemeral.ECDH(oneTime)
+			if err != nil {
+				return "", err
+			}
+			shared = append(shared, dh4)
+			id := bundle.OneTimePrekey.Id
+			recipient.OneTimePrekeyId = &id
+		}
+
+		aead, err := newGCM(deriveKey(shared...))
+		if err != nil {
+			return "", err
+		}
+		nonce := make([]byte, aead.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return "", err
+		}
+		ad := associatedData(senderUser, d.DeviceId, envelope.IdentityKey, bundle.UserId, bundle.DeviceId, recipientIdentity.Bytes())
+		recipient.Ciphertext = aead.Seal(nonce, nonce, plaintext, ad)
+		envelope.Recipients = append(envelope.Recipients, recipient)
+	}
+
+	data, err := json.Marshal(envelope)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(data), nil
+}
+
+// ParseEnvelope decodes the content of an "e2e" message
+func ParseEnvelope(content string) (Envelope, error) {
+	var envelope Envelope
+	data, err := base64.StdEncoding.DecodeString(content)
+	if err != nil {
+		return envelope, fmt.Errorf("envelope is not base64: %w", err)
+	}
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return envelope, fmt.Errorf("envelope is not valid JSON: %w", err)
+	}
+	if envelope.Version != envelopeVersion {
+		return envelope, fmt.Errorf("unsupported envelope version %d", envelope.Version)
+	}
+	return envelope, nil
+}
+
+// Decrypt opens the copy of an envelope sealed for recipientUser's device
+// d. senderUser is the sender recorded by the server; if it was changed,
+// decryption fails. The caller must check envelope.IdentityKey against the
+// identity key it trusts for the sender's device. A one-time prekey used
+// by the message is deleted from d, so d must be saved afterwards.
+func Decrypt(d *Device, recipientUser, senderUser string, envelope Envelope) ([]byte, error) {
+	var recipient *EnvelopeRecipient
+	for i := range envelope.Recipients {
+		if envelope.Recipients[i].UserId == recipientUser && envelope.Recipients[i].DeviceId == d.DeviceId {
+			recipient = &envelope.Recipients[i]
+		}
+	}
+	if recipient == nil {
+		return nil, errNotForDevice
+	}
+
+	identity, err := d.identity()
+	if err != nil {
+		return nil, err
+	}
+	senderIdentity, err := parsePublicKey(envelope.IdentityKey)
+	if err != nil {
+		return nil, fmt.Errorf("sender identity key: %w", err)
+	}
+	ephemeral, err := parsePublicKey(recipient.EphemeralKey)
+	if err != nil {
+		return nil, fmt.Errorf("ephemeral key: %w", err)
+	}
+	signedPrekeyBytes, ok := d.SignedPrekeys[recipient.SignedPrekeyId]
+	if !ok {
+		return nil, fmt.Errorf("signed prekey %d is no longer available", recipient.SignedPrekeyId)
+	}
+	signedPrekey, err := ecdh.X25519().NewPrivateKey(signedPrekeyBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	dh1, err := signedPrekey.ECDH(senderIdentity)
+	if err != nil {
+		return nil, err
+	}
+	dh2, err := identity.ECDH(ephemeral)
+	if err != nil {
+		return nil, err
+	}
+	dh3, err := signedPrekey.ECDH(ephemeral)
+	if err != nil {
+		return nil, err
+	}
+	shared := [][]byte{dh1, dh2, dh3}
+	if recipient.OneTimePrekeyId != nil {
+		oneTimeBytes, ok := d.OneTimePrekeys[*recipient.OneTimePrekeyId]
+		if !ok {
+			return nil, fmt.Errorf("one-time prekey %d was already used or never existed", *recipient.OneTimePrekeyId)
+		}
+		oneTime, err := ecdh.X25519().NewPrivateKey(oneTimeBytes)
+		if err != nil {
+			return nil, err
+		}
+		dh4, err := oneTime.ECDH(ephemeral)
+		if err != nil {
+			return nil, err
+		}
+		shared = append(shared, dh4)
+	}
+
+	aead, err := newGCM(deriveKey(shared...))
+	if err != nil {
+		return nil, err
+	}
+	if len(recipient.Ciphertext) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	ad := associatedData(senderUser, envelope.SenderDevice, envelope.IdentityKey, recipientUser, d.DeviceId, identity.PublicKey().Bytes())
+	nonce, sealed := recipient.Ciphertext[:aead.NonceSize()], recipient.Ciphertext[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, sealed, ad)
+	if err != nil {
+		return nil, errors.New("message could not be authenticated")
+	}
+	if recipient.OneTimePrekeyId != nil {
+		delete(d.OneTimePrekeys, *recipient.OneTimePrekeyId)
+	}
+	return plaintext, nil
+}
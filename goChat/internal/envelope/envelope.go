@@ -0,0 +1,290 @@
+// Package envelope is the envelope encryption goChat uses for values at
+// rest, shared by the server and gochat-admin. Every value gets its own
+// random data key, the value is sealed with AES-GCM under that key, and the
+// data key is wrapped with AES-GCM under a key encryption key from the key
+// ring. A sealed value looks like enc:v2:<key ID>:<wrapped data key>:
+// <sealed value>, both parts in unpadded base64. The wrapped key is bound to
+// the key ID and the value to a context naming the record it belongs to,
+// such as a message ID, so a ciphertext moved to another record won't
+// decrypt. Values from before contexts are marked enc:v1: and still open.
+//
+// A key ring lists one `<id>:<base64 32-byte key>` entry per line (or
+// separated by commas); the first entry encrypts, and all of them decrypt.
+// An empty ring stores values in plaintext, and plaintext stays readable
+// once a ring is in use.
+package envelope
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Prefix of a sealed value, and of one sealed without a context
+const (
+	Prefix   = "enc:v2:"
+	prefixV1 = "enc:v1:"
+)
+
+// Environment variable holding the key ring when no file is given
+const KeysEnv = "GOCHAT_ENCRYPTION_KEYS"
+
+// ErrNoKey is returned for values sealed under a key that isn't in the ring
+var ErrNoKey = errors.New("no encryption key loaded for this value")
+
+var errMalformed = errors.New("malformed encrypted value")
+
+// Key is one key encryption key of a ring
+type Key struct {
+	ID   string
+	aead cipher.AEAD
+}
+
+// Ring is a key ring; the first key encrypts. A nil ring leaves values in
+// plaintext.
+type Ring []Key
+
+// Create an AES-256-GCM cipher
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// ParseRing parses a key ring, one `<id>:<base64 key>` entry per line or
+// comma. Blank lines and lines starting with # are ignored.
+func ParseRing(text string) (Ring, error) {
+	var ring Ring
+	seen := map[string]bool{}
+	for _, entry := range strings.FieldsFunc(text, func(r rune) bool { return r == '\n' || r == ',' }) {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		id, encoded, ok := strings.Cut(entry, ":")
+		if !ok || id == "" {
+			return nil, errors.New("key entry must look like <id>:<base64 key>")
+		}
+		if seen[id] {
+			return nil, fmt.Errorf("key %q is listed twice", id)
+		}
+		seen[id] = true
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("key %q must be 32 bytes of base64", id)
+		}
+		aead, err := newGCM(key)
+		if err != nil {
+			return nil, err
+		}
+		ring = append(ring, Key{ID: id, aead: aead})
+	}
+	return ring, nil
+}
+
+// LoadRing reads the key ring from a file, or from $GOCHAT_ENCRYPTION_KEYS
+// when no file is given. Neither gives an empty ring, but a file without
+// keys is an error.
+func LoadRing(file string) (Ring, error) {
+	text := os.Getenv(KeysEnv)
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		text = string(data)
+	}
+	ring, err := ParseRing(text)
+	if err != nil {
+		return nil, err
+	}
+	if file != "" && len(ring) == 0 {
+		return nil, fmt.Errorf("%s holds no keys", file)
+	}
+	return ring, nil
+}
+
+// NewKey returns a ring entry with a new random key
+func NewKey(id string) (string, error) {
+	if id == "" || strings.ContainsAny(id, ":,\n") {
+		return "", errors.New("key IDs can't be empty or contain colons, commas or newlines")
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return id + ":" + base64.StdEncoding.EncodeToString(key), nil
+}
+
+// Contexts of the values goChat seals
+func MessageContext(messageId string) string     { return "message:" + messageId }
+func ScheduledContext(scheduledId string) string { return "scheduled:" + scheduledId }
+func RecentChatContext(userId, contactId string) string {
+	return "recent:" + userId + ":" + contactId
+}
+
+// IsSealed reports whether a stored value is encrypted
+func IsSealed(value string) bool {
+	return strings.HasPrefix(value, Prefix) || strings.HasPrefix(value, prefixV1)
+}
+
+// IsBound reports whether a stored value is encrypted and bound to a
+// context. Plaintext and values from before contexts aren't.
+func IsBound(value string) bool {
+	return strings.HasPrefix(value, Prefix)
+}
+
+// Active returns the ID of the key that encrypts, or "" for an empty ring
+func (r Ring) Active() string {
+	if len(r) == 0 {
+		return ""
+	}
+	return r[0].ID
+}
+
+// The key with the given ID, or nil
+func (r Ring) key(id string) *Key {
+	for i := range r {
+		if r[i].ID == id {
+			return &r[i]
+		}
+	}
+	return nil
+}
+
+// AES-GCM seal with a fresh random nonce, prepended to the ciphertext
+func gcmSeal(aead cipher.AEAD, plaintext, additional []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, additional), nil
+}
+
+// Reverse gcmSeal
+func gcmOpen(aead cipher.AEAD, sealed, additional []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], additional)
+}
+
+// Split a sealed value into its key, wrapped data key and sealed body
+func (r Ring) parse(value string) (*Key, []byte, []byte, error) {
+	value = strings.TrimPrefix(value, prefixV1)
+	parts := strings.Split(strings.TrimPrefix(value, Prefix), ":")
+	if len(parts) != 3 {
+		return nil, nil, nil, errMalformed
+	}
+	wrapped, err1 := base64.RawStdEncoding.DecodeString(parts[1])
+	body, err2 := base64.RawStdEncoding.DecodeString(parts[2])
+	if err1 != nil || err2 != nil {
+		return nil, nil, nil, errMalformed
+	}
+	key := r.key(parts[0])
+	if key == nil {
+		return nil, nil, nil, fmt.Errorf("%w (key %q)", ErrNoKey, parts[0])
+	}
+	return key, wrapped, body, nil
+}
+
+// Assemble a sealed value around a data key and a sealed body
+func wrap(key Key, dataKey, body []byte) (string, error) {
+	wrapped, err := gcmSeal(key.aead, dataKey, []byte(key.ID))
+	if err != nil {
+		return "", err
+	}
+	return Prefix + key.ID + ":" + base64.RawStdEncoding.EncodeToString(wrapped) + ":" + base64.RawStdEncoding.EncodeToString(body), nil
+}
+
+// Unwrap the data key of a sealed value
+func unwrap(key *Key, wrapped []byte) ([]byte, error) {
+	dataKey, err := gcmOpen(key.aead, wrapped, []byte(key.ID))
+	if err != nil {
+		return nil, fmt.Errorf("unwrapping data key with key %q: %w", key.ID, err)
+	}
+	return dataKey, nil
+}
+
+// Seal encrypts data for the given context under a new data key wrapped
+// with the active key. An empty ring returns the data unchanged.
+func (r Ring) Seal(data []byte, context string) (string, error) {
+	if len(r) == 0 {
+		return string(data), nil
+	}
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", err
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return "", err
+	}
+	body, err := gcmSeal(aead, data, []byte(context))
+	if err != nil {
+		return "", err
+	}
+	return wrap(r[0], dataKey, body)
+}
+
+// Open decrypts a value sealed for the given context under any key of the
+// ring. Values that aren't sealed are returned as they are.
+func (r Ring) Open(value, context string) ([]byte, error) {
+	if !IsSealed(value) {
+		return []byte(value), nil
+	}
+	key, wrapped, body, err := r.parse(value)
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := unwrap(key, wrapped)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	if !IsBound(value) {
+		return gcmOpen(aead, body, nil)
+	}
+	return gcmOpen(aead, body, []byte(context))
+}
+
+// Reseal brings a stored value under the active key, bound to context.
+// Plaintext and values from before contexts are encrypted afresh; bound
+// values under another key only have their data key rewrapped, the body is
+// left as it is. changed is false when there was nothing to do.
+func (r Ring) Reseal(value, context string) (result string, changed bool, err error) {
+	if len(r) == 0 {
+		return value, false, errors.New("no encryption keys loaded")
+	}
+	if !IsBound(value) {
+		plaintext, err := r.Open(value, context)
+		if err != nil {
+			return value, false, err
+		}
+		result, err = r.Seal(plaintext, context)
+		return result, err == nil, err
+	}
+	key, wrapped, body, err := r.parse(value)
+	if err != nil {
+		return value, false, err
+	}
+	if key.ID == r[0].ID {
+		return value, false, nil
+	}
+	dataKey, err := unwrap(key, wrapped)
+	if err != nil {
+		return value, false, err
+	}
+	result, err = wrap(r[0], dataKey, body)
+	return result, err == nil, err
+}
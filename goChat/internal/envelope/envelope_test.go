@@ -0,0 +1,132 @@
+package envelope
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func mustRing(t *testing.T, ids ...string) Ring {
+	t.Helper()
+	var entries []string
+	for _, id := range ids {
+		entry, err := NewKey(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, entry)
+	}
+	ring, err := ParseRing(strings.Join(entries, "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ring
+}
+
+func TestSealAndOpen(t *testing.T) {
+	ring := mustRing(t, "k1")
+	sealed, err := ring.Seal([]byte("hello"), MessageContext("m1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsSealed(sealed) || !IsBound(sealed) || strings.Contains(sealed, "hello") {
+		t.Fatalf("not sealed: %s", sealed)
+	}
+	if plaintext, err := ring.Open(sealed, MessageContext("m1")); err != nil || string(plaintext) != "hello" {
+		t.Errorf("opened %q, %v", plaintext, err)
+	}
+
+	// Without a ring values stay as they are, and plaintext reads back
+	if value, err := Ring(nil).Seal([]byte("hello"), MessageContext("m1")); err != nil || value != "hello" {
+		t.Errorf("empty ring sealed to %q, %v", value, err)
+	}
+	if plaintext, err := ring.Open("plain", MessageContext("m1")); err != nil || string(plaintext) != "plain" {
+		t.Errorf("opened plaintext as %q, %v", plaintext, err)
+	}
+
+	if _, err := mustRing(t, "k2").Open(sealed, MessageContext("m1")); !errors.Is(err, ErrNoKey) {
+		t.Errorf("opening without the key: %v", err)
+	}
+	if _, err := ring.Open(sealed[:len(sealed)-2]+"AA", MessageContext("m1")); err == nil {
+		t.Errorf("tampered value opened")
+	}
+}
+
+// A body copied onto another record must not decrypt there
+func TestContextBinding(t *testing.T) {
+	ring := mustRing(t, "k1")
+	sealed, err := ring.Seal([]byte("hello"), MessageContext("m1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ring.Open(sealed, MessageContext("m2")); err == nil {
+		t.Errorf("body opened under another message ID")
+	}
+
+	// Values from before contexts open under any context, and resealing
+	// binds them
+	dataKey := make([]byte, 32)
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := gcmSeal(aead, []byte("legacy"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy, err := wrap(ring[0], dataKey, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy = prefixV1 + strings.TrimPrefix(legacy, Prefix)
+	if plaintext, err := ring.Open(legacy, MessageContext("m3")); err != nil || string(plaintext) != "legacy" {
+		t.Fatalf("opened legacy value as %q, %v", plaintext, err)
+	}
+	bound, changed, err := ring.Reseal(legacy, MessageContext("m3"))
+	if err != nil || !changed || !IsBound(bound) {
+		t.Fatalf("reseal of legacy value: %s, changed %v, %v", bound, changed, err)
+	}
+	if _, err := ring.Open(bound, MessageContext("m4")); err == nil {
+		t.Errorf("resealed legacy value opened under another message ID")
+	}
+}
+
+func TestReseal(t *testing.T) {
+	old := mustRing(t, "old")
+	sealed, err := old.Seal([]byte("hello"), MessageContext("m1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Rotating puts the new key first and keeps the old one for reading
+	rotated := append(mustRing(t, "new"), old...)
+	resealed, changed, err := rotated.Reseal(sealed, MessageContext("m1"))
+	if err != nil || !changed {
+		t.Fatalf("reseal: changed %v, %v", changed, err)
+	}
+	if !strings.HasPrefix(resealed, Prefix+"new:") {
+		t.Errorf("resealed under the wrong key: %s", resealed)
+	}
+	if plaintext, err := rotated[:1].Open(resealed, MessageContext("m1")); err != nil || string(plaintext) != "hello" {
+		t.Errorf("opened %q, %v", plaintext, err)
+	}
+	if _, changed, _ := rotated.Reseal(resealed, MessageContext("m1")); changed {
+		t.Errorf("value under the active key resealed again")
+	}
+}
+
+func TestParseRing(t *testing.T) {
+	for _, text := range []string{
+		"k1",
+		"k1:c2hvcnQ=",
+		"k1:AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=,k1:AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=",
+	} {
+		if _, err := ParseRing(text); err == nil {
+			t.Errorf("%q parsed", text)
+		}
+	}
+	ring, err := ParseRing("# comment\n\nk1:AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=, k2:AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=")
+	if err != nil || len(ring) != 2 || ring.Active() != "k1" {
+		t.Errorf("parsed %d keys, active %q, %v", len(ring), ring.Active(), err)
+	}
+}
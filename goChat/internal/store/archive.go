@@ -0,0 +1,157 @@
+package store
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Archived messages are written to gzip-compressed JSON Lines segments
+// under archive/, listed in archive/index.json. Segments are never
+// modified in place: a rewritten segment goes to a new file that is
+// renamed over the old one, since snapshots hard-link them.
+
+// Directory holding the archive segments and their index
+const ArchiveDir = "archive"
+
+// Messages per segment written by compaction
+const ArchiveSegmentSize = 5000
+
+// ArchiveSegment describes one compressed archive file
+type ArchiveSegment struct {
+	File      string    `json:"file"` // Relative to the archive directory
+	Count     int       `json:"count"`
+	From      time.Time `json:"from"` // Oldest message timestamp
+	To        time.Time `json:"to"`   // Newest message timestamp
+	Users     []string  `json:"users"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// ArchiveIndex matches archive/index.json
+type ArchiveIndex struct {
+	Segments []ArchiveSegment `json:"segments"`
+}
+
+// LoadArchiveIndex reads the archive index in dir. A missing index lists
+// no segments.
+func LoadArchiveIndex(dir string) (ArchiveIndex, error) {
+	index := ArchiveIndex{Segments: []ArchiveSegment{}}
+
+	data, err := os.ReadFile(filepath.Join(dir, ArchiveDir, "index.json"))
+	if os.IsNotExist(err) {
+		return index, nil
+	}
+	if err != nil {
+		return index, err
+	}
+
+	err = json.Unmarshal(data, &index)
+	return index, err
+}
+
+// SaveArchiveIndex writes the archive index through a temporary file so
+// it's never half-written
+func SaveArchiveIndex(dir string, index ArchiveIndex) error {
+	newData, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, ArchiveDir, "index.json")
+	if err := os.WriteFile(path+".tmp", newData, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// NewSegment describes a new segment for messages, under a fresh file name
+func NewSegment(messages []Message) ArchiveSegment {
+	segment := ArchiveSegment{
+		File:      fmt.Sprintf("segment-%s-%s.jsonl.gz", time.Now().UTC().Format("20060102T150405Z"), randomHex(4)),
+		Count:     len(messages),
+		CreatedAt: time.Now(),
+	}
+
+	users := map[string]bool{}
+	for i, message := range messages {
+		if i == 0 || message.Timestamp.Before(segment.From) {
+			segment.From = message.Timestamp
+		}
+		if message.Timestamp.After(segment.To) {
+			segment.To = message.Timestamp
+		}
+		users[message.Sender] = true
+		users[message.Receiver] = true
+	}
+	for user := range users {
+		segment.Users = append(segment.Users, user)
+	}
+	sort.Strings(segment.Users)
+	return segment
+}
+
+// WriteSegment writes messages, as they are, to the segment file in dir.
+// The content goes to a temporary file that is renamed into place.
+func WriteSegment(dir, file string, messages []Message) error {
+	if err := os.MkdirAll(filepath.Join(dir, ArchiveDir), 0755); err != nil {
+		return err
+	}
+	path := filepath.Join(dir, ArchiveDir, file)
+	out, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	gz := gzip.NewWriter(out)
+	encoder := json.NewEncoder(gz)
+	for _, message := range messages {
+		if err := encoder.Encode(message); err != nil {
+			return err
+		}
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// ReadSegment reads every message of a segment in dir, as stored
+func ReadSegment(dir string, segment ArchiveSegment) ([]Message, error) {
+	file, err := os.Open(filepath.Join(dir, ArchiveDir, segment.File))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", segment.File, err)
+	}
+	defer gz.Close()
+
+	messages := make([]Message, 0, segment.Count)
+	scanner := bufio.NewScanner(gz)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var message Message
+		if err := json.Unmarshal(scanner.Bytes(), &message); err != nil {
+			return nil, fmt.Errorf("%s: %w", segment.File, err)
+		}
+		messages = append(messages, message)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", segment.File, err)
+	}
+	return messages, nil
+}
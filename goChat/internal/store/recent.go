@@ -0,0 +1,132 @@
+package store
+
+import (
+	"fmt"
+	"sort"
+)
+
+// recentChats.json is derived from the message history: for every
+// conversation, each participant has one entry describing its latest
+// message. The server rebuilds and checks it at startup and gochat-admin
+// does the same offline, both with the functions here.
+
+// RecentChatsFromLatest turns the latest message of each conversation into
+// index entries, newest first: read for the sender, and carrying the
+// message's read state for the receiver
+func RecentChatsFromLatest(latest map[[2]string]Message) RecentChatsData {
+	byPair := map[[2]string]RecentChat{}
+	for _, message := range latest {
+		byPair[[2]string{message.Sender, message.Receiver}] = RecentChat{
+			UserId:      message.Sender,
+			ContactId:   message.Receiver,
+			LastMessage: Preview(message),
+			Timestamp:   message.Timestamp,
+			IsRead:      true,
+		}
+		byPair[[2]string{message.Receiver, message.Sender}] = RecentChat{
+			UserId:      message.Receiver,
+			ContactId:   message.Sender,
+			LastMessage: Preview(message),
+			Timestamp:   message.Timestamp,
+			IsRead:      message.IsRead,
+		}
+	}
+
+	recentChatsData := RecentChatsData{Chats: []RecentChat{}}
+	for _, chat := range byPair {
+		recentChatsData.Chats = append(recentChatsData.Chats, chat)
+	}
+	sort.Slice(recentChatsData.Chats, func(i, j int) bool {
+		a, b := recentChatsData.Chats[i], recentChatsData.Chats[j]
+		if !a.Timestamp.Equal(b.Timestamp) {
+			return a.Timestamp.After(b.Timestamp)
+		}
+		if a.UserId != b.UserId {
+			return a.UserId < b.UserId
+		}
+		return a.ContactId < b.ContactId
+	})
+	return recentChatsData
+}
+
+// AddArchivedLatest adds to latest the latest archived message of every
+// conversation that has no hot messages, so recent chats of fully archived
+// conversations survive a rebuild. read returns a segment's messages with
+// their bodies opened.
+func AddArchivedLatest(latest map[[2]string]Message, index ArchiveIndex, read func(ArchiveSegment) ([]Message, error)) error {
+	archived := map[[2]string]Message{}
+	for _, segment := range index.Segments {
+		messages, err := read(segment)
+		if err != nil {
+			return err
+		}
+		for key, message := range LatestMessages(messages) {
+			if _, hot := latest[key]; hot {
+				continue
+			}
+			if current, ok := archived[key]; !ok || !message.Timestamp.Before(current.Timestamp) {
+				archived[key] = message
+			}
+		}
+	}
+	for key, message := range archived {
+		latest[key] = message
+	}
+	return nil
+}
+
+// CheckRecentChats compares the index with the hot messages it is derived
+// from. Entries for conversations without hot messages are accepted when
+// the archive holds messages of both participants, since a rebuild would
+// keep them too.
+func CheckRecentChats(recentChatsData RecentChatsData, messages []Message, index ArchiveIndex) []string {
+	var problems []string
+
+	rebuilt := RecentChatsFromLatest(LatestMessages(messages))
+	expected := map[[2]string]RecentChat{}
+	for _, chat := range rebuilt.Chats {
+		expected[[2]string{chat.UserId, chat.ContactId}] = chat
+	}
+
+	archived := func(user1, user2 string) bool {
+		for _, segment := range index.Segments {
+			has1, has2 := false, false
+			for _, user := range segment.Users {
+				has1 = has1 || user == user1
+				has2 = has2 || user == user2
+			}
+			if has1 && has2 {
+				return true
+			}
+		}
+		return false
+	}
+
+	found := map[[2]string]bool{}
+	for _, chat := range recentChatsData.Chats {
+		key := [2]string{chat.UserId, chat.ContactId}
+		if found[key] {
+			problems = append(problems, fmt.Sprintf("duplicate entry for %s -> %s", chat.UserId, chat.ContactId))
+			continue
+		}
+		found[key] = true
+
+		want, ok := expected[key]
+		switch {
+		case !ok && !archived(chat.UserId, chat.ContactId):
+			problems = append(problems, fmt.Sprintf("entry for %s -> %s has no messages behind it", chat.UserId, chat.ContactId))
+		case !ok:
+			// Conversation only exists in the archive
+		case want.LastMessage != chat.LastMessage || !want.Timestamp.Equal(chat.Timestamp):
+			problems = append(problems, fmt.Sprintf("entry for %s -> %s does not show the latest message", chat.UserId, chat.ContactId))
+		case want.IsRead != chat.IsRead:
+			problems = append(problems, fmt.Sprintf("entry for %s -> %s has the wrong read state", chat.UserId, chat.ContactId))
+		}
+	}
+	for _, chat := range rebuilt.Chats {
+		if !found[[2]string{chat.UserId, chat.ContactId}] {
+			problems = append(problems, fmt.Sprintf("missing entry for %s -> %s", chat.UserId, chat.ContactId))
+		}
+	}
+	return problems
+}
@@ -0,0 +1,118 @@
+package store
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Each message falls under the retention policy of whichever participant
+// keeps history for the shorter time; when both keep it equally long,
+// archiving wins over deleting. Disappearing messages are never archived:
+// expired ones are deleted, and ones still waiting to expire stay put for
+// the sweeper.
+
+// RetentionRule says how long messages are kept and what happens after
+type RetentionRule struct {
+	Days   int    `json:"days"`   // 0 keeps messages forever
+	Action string `json:"action"` // "archive" or "delete"
+}
+
+// UserRetention is a user's own override of the default rule
+type UserRetention struct {
+	UserId string `json:"userId"`
+	RetentionRule
+}
+
+// RetentionConfig matches retention.json
+type RetentionConfig struct {
+	Default RetentionRule   `json:"default"`
+	Users   []UserRetention `json:"users"`
+}
+
+// LoadRetention reads the retention settings in dir, defaulting to
+// keeping everything
+func LoadRetention(dir string) (RetentionConfig, error) {
+	config := RetentionConfig{Default: RetentionRule{Action: "archive"}, Users: []UserRetention{}}
+
+	data, err := os.ReadFile(filepath.Join(dir, "retention.json"))
+	if os.IsNotExist(err) {
+		return config, nil
+	}
+	if err != nil {
+		return config, err
+	}
+
+	if err := json.Unmarshal(data, &config); err != nil {
+		return config, err
+	}
+	if config.Default.Action == "" {
+		config.Default.Action = "archive"
+	}
+	return config, nil
+}
+
+// RuleFor returns the rule that applies to a user
+func (config RetentionConfig) RuleFor(userId string) RetentionRule {
+	for _, override := range config.Users {
+		if override.UserId == userId {
+			return override.RetentionRule
+		}
+	}
+	return config.Default
+}
+
+// RuleForMessage returns the rule that applies to a message: the
+// participant with the shorter retention wins, and archiving wins a tie
+func (config RetentionConfig) RuleForMessage(message Message) RetentionRule {
+	sender := config.RuleFor(message.Sender)
+	receiver := config.RuleFor(message.Receiver)
+	switch {
+	case sender.Days == 0:
+		return receiver
+	case receiver.Days == 0 || sender.Days < receiver.Days:
+		return sender
+	case receiver.Days < sender.Days:
+		return receiver
+	case sender.Action == "archive":
+		return sender
+	default:
+		return receiver
+	}
+}
+
+// Whether a message has outlived its rule, and the rule's action
+func (config RetentionConfig) pastRetention(message Message, now time.Time) (bool, string) {
+	rule := config.RuleForMessage(message)
+	return rule.Days > 0 && now.Sub(message.Timestamp) >= time.Duration(rule.Days)*24*time.Hour, rule.Action
+}
+
+// Deletes reports whether compaction deletes a message: it has expired,
+// or it is past a rule that deletes
+func (config RetentionConfig) Deletes(message Message, now time.Time) bool {
+	past, action := config.pastRetention(message, now)
+	return message.Expired(now) || (past && action == "delete")
+}
+
+// Compact sorts messages into the ones that stay, the ones to archive and
+// the ones to delete, in their original order
+func (config RetentionConfig) Compact(messages []Message, now time.Time) (kept, archived, deleted []Message) {
+	kept = make([]Message, 0, len(messages))
+	for _, message := range messages {
+		if config.Deletes(message, now) {
+			deleted = append(deleted, message)
+			continue
+		}
+		if past, _ := config.pastRetention(message, now); !past {
+			kept = append(kept, message)
+			continue
+		}
+		if message.ExpiresAt != nil {
+			kept = append(kept, message) // The sweeper deletes it once it expires
+			continue
+		}
+		archived = append(archived, message)
+	}
+	return kept, archived, deleted
+}
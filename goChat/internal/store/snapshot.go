@@ -0,0 +1,233 @@
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A snapshot is a directory under snapshots/ holding copies of the data
+// files and a manifest of their checksums. Archive segments and avatars
+// are never modified in place, so they are hard-linked instead of copied
+// when possible. CreateSnapshot doesn't lock anything; the server holds
+// its store locks around it, and gochat-admin runs with the server
+// stopped.
+
+// Directory holding one subdirectory per snapshot
+const SnapshotDir = "snapshots"
+
+// Directory holding the avatar images
+const AvatarDir = "avatars"
+
+// Snapshots kept by default: a week of the server's schedule
+const DefaultSnapshotKeep = 28
+
+// SnapshotFile describes one file in a snapshot
+type SnapshotFile struct {
+	Name   string `json:"name"` // Relative to the data directory
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// SnapshotManifest matches snapshots/<name>/manifest.json
+type SnapshotManifest struct {
+	Name      string         `json:"name"`
+	CreatedAt time.Time      `json:"createdAt"`
+	Reason    string         `json:"reason"` // "scheduled", "admin", "manual" or "pre-restore"
+	Files     []SnapshotFile `json:"files"`
+}
+
+// SnapshotFiles lists the data files captured by a snapshot, besides the
+// archive and avatars
+var SnapshotFiles = []string{
+	"users.json", "chats.json", "chats.log", "recentChats.json", "scheduled.json",
+	"conversations.json", "retention.json", "webhooks.json", "bot_tokens.json",
+	"e2e_keys.json", "sessions.json", "changes.jsonl", "contacts.json",
+	"account_tokens.json",
+}
+
+// CopyFile copies src to dst, returning its size and checksum. Immutable
+// files are hard-linked when the file system allows it.
+func CopyFile(src, dst string, link bool) (SnapshotFile, error) {
+	if link {
+		if err := os.Link(src, dst); err == nil {
+			return ChecksumFile(dst)
+		}
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return SnapshotFile{}, err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return SnapshotFile{}, err
+	}
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(out, hash), in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return SnapshotFile{Size: size, SHA256: hex.EncodeToString(hash.Sum(nil))}, err
+}
+
+// ChecksumFile returns the size and checksum of a file
+func ChecksumFile(path string) (SnapshotFile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return SnapshotFile{}, err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	return SnapshotFile{Size: size, SHA256: hex.EncodeToString(hash.Sum(nil))}, err
+}
+
+// CreateSnapshot takes a snapshot of every data file in dir. The snapshot
+// is assembled in a temporary directory and renamed into place, so a
+// failed snapshot never shows up in the list.
+func CreateSnapshot(dir, reason string) (SnapshotManifest, error) {
+	now := time.Now()
+	manifest := SnapshotManifest{
+		Name:      fmt.Sprintf("snapshot-%s-%s", now.UTC().Format("20060102T150405Z"), randomHex(2)),
+		CreatedAt: now,
+		Reason:    reason,
+		Files:     []SnapshotFile{},
+	}
+	tmpDir := filepath.Join(dir, SnapshotDir, "."+manifest.Name+".tmp")
+	if err := os.MkdirAll(filepath.Join(tmpDir, ArchiveDir), 0755); err != nil {
+		return manifest, err
+	}
+	failed := true
+	defer func() {
+		if failed {
+			os.RemoveAll(tmpDir)
+		}
+	}()
+
+	for _, name := range SnapshotFiles {
+		if _, err := os.Stat(filepath.Join(dir, name)); os.IsNotExist(err) {
+			continue
+		}
+		file, err := CopyFile(filepath.Join(dir, name), filepath.Join(tmpDir, name), false)
+		if err != nil {
+			return manifest, fmt.Errorf("copying %s: %w", name, err)
+		}
+		file.Name = name
+		manifest.Files = append(manifest.Files, file)
+	}
+
+	index, err := LoadArchiveIndex(dir)
+	if err != nil {
+		return manifest, err
+	}
+	if len(index.Segments) > 0 {
+		archived := []string{filepath.Join(ArchiveDir, "index.json")}
+		for _, segment := range index.Segments {
+			archived = append(archived, filepath.Join(ArchiveDir, segment.File))
+		}
+		for i, name := range archived {
+			file, err := CopyFile(filepath.Join(dir, name), filepath.Join(tmpDir, name), i > 0)
+			if err != nil {
+				return manifest, fmt.Errorf("copying %s: %w", name, err)
+			}
+			file.Name = filepath.ToSlash(name)
+			manifest.Files = append(manifest.Files, file)
+		}
+	}
+
+	// Avatars are never rewritten either, so they are linked like segments
+	avatars, err := os.ReadDir(filepath.Join(dir, AvatarDir))
+	if err != nil && !os.IsNotExist(err) {
+		return manifest, err
+	}
+	if len(avatars) > 0 {
+		if err := os.MkdirAll(filepath.Join(tmpDir, AvatarDir), 0755); err != nil {
+			return manifest, err
+		}
+	}
+	for _, entry := range avatars {
+		if entry.IsDir() {
+			continue
+		}
+		name := filepath.Join(AvatarDir, entry.Name())
+		file, err := CopyFile(filepath.Join(dir, name), filepath.Join(tmpDir, name), true)
+		if err != nil {
+			return manifest, fmt.Errorf("copying %s: %w", name, err)
+		}
+		file.Name = filepath.ToSlash(name)
+		manifest.Files = append(manifest.Files, file)
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return manifest, err
+	}
+	if err := os.WriteFile(filepath.Join(tmpDir, "manifest.json"), data, 0644); err != nil {
+		return manifest, err
+	}
+	if err := os.Rename(tmpDir, filepath.Join(dir, SnapshotDir, manifest.Name)); err != nil {
+		return manifest, err
+	}
+	failed = false
+	return manifest, nil
+}
+
+// ListSnapshots reads every snapshot manifest in dir, newest first.
+// Directories without a readable manifest are skipped.
+func ListSnapshots(dir string) ([]SnapshotManifest, error) {
+	entries, err := os.ReadDir(filepath.Join(dir, SnapshotDir))
+	if os.IsNotExist(err) {
+		return []SnapshotManifest{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots := []SnapshotManifest{}
+	for _, entry := range entries {
+		if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, SnapshotDir, entry.Name(), "manifest.json"))
+		if err != nil {
+			continue
+		}
+		var manifest SnapshotManifest
+		if json.Unmarshal(data, &manifest) == nil && manifest.Name != "" {
+			snapshots = append(snapshots, manifest)
+		}
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].CreatedAt.After(snapshots[j].CreatedAt)
+	})
+	return snapshots, nil
+}
+
+// RotateSnapshots deletes all but the newest keep snapshots in dir and
+// returns how many it removed
+func RotateSnapshots(dir string, keep int) (int, error) {
+	snapshots, err := ListSnapshots(dir)
+	if err != nil || len(snapshots) <= keep {
+		return 0, err
+	}
+	removed := 0
+	for _, snapshot := range snapshots[keep:] {
+		if err := os.RemoveAll(filepath.Join(dir, SnapshotDir, snapshot.Name)); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
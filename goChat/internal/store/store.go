@@ -0,0 +1,174 @@
+// Package store describes goChat's data files: the types stored in them
+// and the readers and writers for the formats that aren't plain JSON (the
+// message log, archive segments and snapshots), plus how recentChats.json
+// is derived from the history. The server and gochat-admin both use it, so
+// the tool always reads and checks the files the way the server writes them. Functions take the data directory explicitly; the
+// server passes ".".
+//
+// Message bodies may be encrypted at rest (see internal/envelope). The
+// readers and writers here leave them as stored; sealing and opening is up
+// to the caller, which holds the key ring.
+package store
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+)
+
+// User is an entry of users.json
+type User struct {
+	UserId            string   `json:"userId"`
+	Password          string   `json:"password,omitempty"` // Omit password when returning to client
+	Email             string   `json:"email,omitempty"`
+	EmailVerified     bool     `json:"emailVerified,omitempty"`     // Set by opening the link mailed at registration
+	IsBot             bool     `json:"isBot,omitempty"`             // Bot accounts post through API tokens and can't log in
+	BotOwner          string   `json:"botOwner,omitempty"`          // User who created the bot
+	Status            string   `json:"status,omitempty"`            // Custom status text, set with /status
+	IsAdmin           bool     `json:"isAdmin,omitempty"`           // Admins manage accounts through /api/v1/admin
+	Disabled          bool     `json:"disabled,omitempty"`          // Disabled accounts can't log in or send messages
+	MustResetPassword bool     `json:"mustResetPassword,omitempty"` // Set by an admin reset, cleared by change-password
+	DisplayName       string   `json:"displayName,omitempty"`
+	Avatar            string   `json:"avatar,omitempty"` // Checksum of the avatar image in avatars/
+	Bio               string   `json:"bio,omitempty"`
+	Timezone          string   `json:"timezone,omitempty"`        // IANA zone name, e.g. Europe/Berlin
+	TOTPSecret        string   `json:"totpSecret,omitempty"`      // Base32 authenticator secret, pending until TOTPEnabled
+	TOTPEnabled       bool     `json:"totpEnabled,omitempty"`     // Logins need a code from the authenticator
+	TOTPLastCounter   uint64   `json:"totpLastCounter,omitempty"` // Time step of the last code used, so codes can't be replayed
+	RecoveryCodes     []string `json:"recoveryCodes,omitempty"`   // SHA-256 hashes of the unused recovery codes
+}
+
+// UsersData matches users.json
+type UsersData struct {
+	Users []User `json:"users"`
+}
+
+// Message is a chat message, as kept in chats.json, chats.log, the archive
+// and the change log
+type Message struct {
+	Id        string     `json:"id,omitempty"` // Assigned when stored; encrypted bodies are bound to it
+	Sender    string     `json:"sender"`
+	Receiver  string     `json:"receiver"`
+	Content   string     `json:"content"`
+	Timestamp time.Time  `json:"timestamp"`
+	IsRead    bool       `json:"isRead"`
+	IsBot     bool       `json:"isBot,omitempty"`     // Posted by a bot through the bot API
+	IsSystem  bool       `json:"isSystem,omitempty"`  // Announcement such as a timer change
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"` // Set when the conversation has a disappearing-message timer
+	Type      string     `json:"type,omitempty"`      // "e2e" when Content is an end-to-end encrypted envelope
+}
+
+// ChatsData matches chats.json
+type ChatsData struct {
+	Messages   []Message `json:"messages"`
+	Checkpoint uint64    `json:"checkpoint,omitempty"` // Sequence number of the last chats.log record included
+}
+
+// RecentChat is an entry of recentChats.json
+type RecentChat struct {
+	UserId      string    `json:"userId"`
+	ContactId   string    `json:"contactId"`
+	LastMessage string    `json:"lastMessage"`
+	Timestamp   time.Time `json:"timestamp"`
+	IsRead      bool      `json:"isRead"`
+}
+
+// RecentChatsData matches recentChats.json
+type RecentChatsData struct {
+	Chats []RecentChat `json:"chats"`
+}
+
+// ScheduledMessage is a message waiting in scheduled.json for delivery
+type ScheduledMessage struct {
+	Id        string    `json:"id"`
+	Sender    string    `json:"sender"`
+	Receiver  string    `json:"receiver"`
+	Content   string    `json:"content"`
+	SendAt    time.Time `json:"sendAt"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// ScheduledData matches scheduled.json
+type ScheduledData struct {
+	Messages []ScheduledMessage `json:"messages"`
+}
+
+// WebhookEvent is the JSON body POSTed to webhook URLs
+type WebhookEvent struct {
+	Id        string    `json:"id"`
+	Type      string    `json:"type"`
+	CreatedAt time.Time `json:"createdAt"`
+	Message   Message   `json:"message"`
+}
+
+// DeadLetter is a line of webhook_deadletter.jsonl: a delivery that failed
+// every attempt
+type DeadLetter struct {
+	WebhookId string       `json:"webhookId"`
+	URL       string       `json:"url"`
+	Attempts  int          `json:"attempts"`
+	LastError string       `json:"lastError"`
+	FailedAt  time.Time    `json:"failedAt"`
+	Event     WebhookEvent `json:"event"`
+}
+
+// Change is a line of changes.jsonl, the change log devices sync from
+type Change struct {
+	Seq       uint64    `json:"seq"`
+	Type      string    `json:"type"`
+	Users     []string  `json:"users"`               // Users whose devices receive the change
+	Message   *Message  `json:"message,omitempty"`   // New message, for type "message"
+	UserId    string    `json:"userId,omitempty"`    // Reader, for type "read"
+	ContactId string    `json:"contactId,omitempty"` // Sender of the messages read, for type "read"
+	Time      time.Time `json:"time"`
+}
+
+// Expired reports whether a disappearing message's time is up
+func (message Message) Expired(now time.Time) bool {
+	return message.ExpiresAt != nil && !message.ExpiresAt.After(now)
+}
+
+// Recent chats show this in place of an end-to-end encrypted envelope
+const E2EPreview = "🔒 Encrypted message"
+
+// Preview is the text that stands for a message in recent chats
+func Preview(message Message) string {
+	if message.Type == "e2e" {
+		return E2EPreview
+	}
+	return message.Content
+}
+
+// ConversationKey orders the participants of a conversation stably
+func ConversationKey(user1, user2 string) [2]string {
+	if user2 < user1 {
+		return [2]string{user2, user1}
+	}
+	return [2]string{user1, user2}
+}
+
+// LatestMessages picks the latest message of every conversation
+func LatestMessages(messages []Message) map[[2]string]Message {
+	latest := map[[2]string]Message{}
+	for _, message := range messages {
+		key := ConversationKey(message.Sender, message.Receiver)
+		if current, ok := latest[key]; !ok || !message.Timestamp.Before(current.Timestamp) {
+			latest[key] = message
+		}
+	}
+	return latest
+}
+
+// NewMessageId returns a new random message ID
+func NewMessageId() string {
+	return randomHex(8)
+}
+
+// Random hex string of n bytes
+func randomHex(n int) string {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		panic("crypto/rand failed: " + err.Error())
+	}
+	return hex.EncodeToString(buf)
+}
@@ -0,0 +1,134 @@
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// A torn final record is left out and reported through valid
+func TestReadLog(t *testing.T) {
+	dir := t.TempDir()
+	var data []byte
+	for seq := uint64(1); seq <= 2; seq++ {
+		record, err := EncodeLogRecord(LogRecord{Seq: seq, Message: Message{Sender: "alice", Receiver: "bob", Content: "hi"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		data = append(data, record...)
+	}
+	complete := int64(len(data))
+	data = append(data, 0, 0, 0, 9, 1, 2)
+	if err := os.WriteFile(filepath.Join(dir, LogFile), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	records, valid, size, err := ReadLog(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[1].Seq != 2 || valid != complete || size != int64(len(data)) {
+		t.Errorf("read %d records, valid %d of %d bytes", len(records), valid, size)
+	}
+}
+
+// Segments are described and read back as written
+func TestSegmentRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now().Truncate(time.Second)
+	messages := []Message{
+		{Id: "m1", Sender: "bob", Receiver: "alice", Content: "newer", Timestamp: now},
+		{Id: "m2", Sender: "alice", Receiver: "carol", Content: "older", Timestamp: now.Add(-time.Hour)},
+	}
+	segment := NewSegment(messages)
+	if !segment.From.Equal(now.Add(-time.Hour)) || !segment.To.Equal(now) || segment.CreatedAt.IsZero() || len(segment.Users) != 3 || segment.Users[0] != "alice" {
+		t.Errorf("segment described as %+v", segment)
+	}
+	if err := WriteSegment(dir, segment.File, messages); err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveArchiveIndex(dir, ArchiveIndex{Segments: []ArchiveSegment{segment}}); err != nil {
+		t.Fatal(err)
+	}
+
+	index, err := LoadArchiveIndex(dir)
+	if err != nil || len(index.Segments) != 1 || !index.Segments[0].To.Equal(now) {
+		t.Fatalf("index %+v, %v", index, err)
+	}
+	read, err := ReadSegment(dir, index.Segments[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(read) != 2 || read[0].Id != "m1" || read[1].Content != "older" {
+		t.Errorf("read back %+v", read)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	config := RetentionConfig{
+		Default: RetentionRule{Days: 2, Action: "archive"},
+		Users:   []UserRetention{{UserId: "carol", RetentionRule: RetentionRule{Days: 1, Action: "delete"}}},
+	}
+	now := time.Now()
+	old := now.Add(-72 * time.Hour)
+	expired := now.Add(-time.Minute)
+	pending := now.Add(time.Hour)
+	kept, archived, deleted := config.Compact([]Message{
+		{Id: "recent", Sender: "alice", Receiver: "bob", Timestamp: now},
+		{Id: "old", Sender: "alice", Receiver: "bob", Timestamp: old},
+		{Id: "carol", Sender: "alice", Receiver: "carol", Timestamp: old},
+		{Id: "expired", Sender: "alice", Receiver: "bob", Timestamp: now, ExpiresAt: &expired},
+		{Id: "pending", Sender: "alice", Receiver: "bob", Timestamp: old, ExpiresAt: &pending},
+	}, now)
+
+	ids := func(messages []Message) string {
+		var result string
+		for _, message := range messages {
+			result += message.Id + " "
+		}
+		return result
+	}
+	if got := ids(kept); got != "recent pending " {
+		t.Errorf("kept %s", got)
+	}
+	if got := ids(archived); got != "old " {
+		t.Errorf("archived %s", got)
+	}
+	if got := ids(deleted); got != "carol expired " {
+		t.Errorf("deleted %s", got)
+	}
+}
+
+// A rebuilt index passes the check, and archived conversations keep their
+// entries while stale or missing ones are reported
+func TestCheckRecentChats(t *testing.T) {
+	now := time.Now()
+	messages := []Message{
+		{Sender: "alice", Receiver: "bob", Content: "first", Timestamp: now.Add(-time.Minute), IsRead: true},
+		{Sender: "bob", Receiver: "alice", Content: "second", Timestamp: now},
+	}
+	index := ArchiveIndex{Segments: []ArchiveSegment{{File: "s1", Users: []string{"alice", "carol"}}}}
+	archivedLatest := Message{Sender: "carol", Receiver: "alice", Content: "archived", Timestamp: now.Add(-time.Hour)}
+
+	latest := LatestMessages(messages)
+	err := AddArchivedLatest(latest, index, func(ArchiveSegment) ([]Message, error) {
+		return []Message{archivedLatest}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	recentChatsData := RecentChatsFromLatest(latest)
+	if len(recentChatsData.Chats) != 4 || recentChatsData.Chats[0].LastMessage != "second" || recentChatsData.Chats[0].IsRead {
+		t.Fatalf("rebuilt %+v", recentChatsData.Chats)
+	}
+	if problems := CheckRecentChats(recentChatsData, messages, index); len(problems) != 0 {
+		t.Errorf("rebuilt index has problems: %v", problems)
+	}
+
+	recentChatsData.Chats[0].LastMessage = "first"
+	recentChatsData.Chats = append(recentChatsData.Chats[:1], recentChatsData.Chats[2:]...)
+	if problems := CheckRecentChats(recentChatsData, messages, index); len(problems) != 2 {
+		t.Errorf("expected a stale and a missing entry, got %v", problems)
+	}
+}
@@ -0,0 +1,79 @@
+package store
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+)
+
+// New messages are appended to chats.log instead of rewriting chats.json.
+// Each record is a 4-byte big-endian payload length, a 4-byte CRC-32C of
+// the payload and the payload itself, a JSON LogRecord. chats.json is the
+// compacted checkpoint: it records the sequence number of the last log
+// record folded into it, so records at or below that number are already
+// in it. A crash during an append leaves a torn final record, which is
+// detected by its length or checksum.
+
+// Message log file, next to the checkpoint in chats.json
+const LogFile = "chats.log"
+
+// Largest payload accepted when reading the log. Anything bigger is a
+// damaged length prefix.
+const maxLogRecord = 16 << 20
+
+// LogRecord is the payload of one log record
+type LogRecord struct {
+	Seq     uint64  `json:"seq"`
+	Message Message `json:"message"`
+}
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// EncodeLogRecord encodes one log record with its length and checksum
+// header
+func EncodeLogRecord(record LogRecord) ([]byte, error) {
+	payload, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 8+len(payload))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.Checksum(payload, crc32c))
+	copy(buf[8:], payload)
+	return buf, nil
+}
+
+// ReadLog reads every complete record of the message log in dir. valid is
+// the size of the intact prefix; when it is smaller than the file, the
+// rest is a torn or damaged record. A missing log has no records.
+func ReadLog(dir string) (records []LogRecord, valid int64, size int64, err error) {
+	data, err := os.ReadFile(filepath.Join(dir, LogFile))
+	if os.IsNotExist(err) {
+		return nil, 0, 0, nil
+	}
+	if err != nil {
+		return nil, 0, 0, fmt.Errorf("reading %s: %w", LogFile, err)
+	}
+
+	for len(data)-int(valid) >= 8 {
+		header := data[valid : valid+8]
+		length := binary.BigEndian.Uint32(header[0:4])
+		if length > maxLogRecord || int64(len(data))-valid-8 < int64(length) {
+			break
+		}
+		payload := data[valid+8 : valid+8+int64(length)]
+		if crc32.Checksum(payload, crc32c) != binary.BigEndian.Uint32(header[4:8]) {
+			break
+		}
+		var record LogRecord
+		if json.Unmarshal(payload, &record) != nil {
+			break
+		}
+		records = append(records, record)
+		valid += 8 + int64(length)
+	}
+	return records, valid, int64(len(data)), nil
+}
@@ -0,0 +1,560 @@
+// Package tui is gochat-cli's full-screen client. It is a single event loop
+// over key presses and poll ticks, and only needs an io.Reader for keys and
+// an io.Writer for frames, so the server's tests drive it against an
+// in-process httptest server with pipes and buffers.
+package tui
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"gochat/internal/client"
+)
+
+// Which part of the screen receives key presses
+const (
+	focusContacts = iota
+	focusInput
+	focusSearch
+)
+
+// Width of the contact list pane, including its border
+const contactPaneWidth = 28
+
+// key is a decoded key press: either a printable rune or a named key
+type key struct {
+	r    rune
+	name string // "up", "down", "enter", "backspace", "tab", "esc", "pgup", "pgdn", "ctrl-c", "ctrl-f"
+}
+
+// contactEntry is one row of the contact pane
+type contactEntry struct {
+	userId string
+	detail string
+	unread bool
+}
+
+// TUI holds the full-screen client state
+type TUI struct {
+	client   *client.Client
+	userId   string
+	in       io.Reader
+	out      io.Writer
+	width    int
+	height   int
+	interval time.Duration
+	SizeFunc func() (int, int) // Optional; re-checked on every tick to follow resizes
+
+	contacts  []client.RecentChat
+	results   []client.User // Search results, shown instead of contacts while searching
+	searching bool
+	selected  int
+
+	current  string // Contact whose conversation is open
+	messages []client.Message
+	scroll   int // Lines scrolled up from the bottom of the conversation
+
+	input  []rune
+	search []rune
+	focus  int
+	status string
+	quit   bool
+}
+
+// New creates a TUI for userId that reads keys from in and draws to out
+func New(c *client.Client, userId string, in io.Reader, out io.Writer, width, height int) *TUI {
+	return &TUI{
+		client:   c,
+		userId:   userId,
+		in:       in,
+		out:      out,
+		width:    width,
+		height:   height,
+		interval: 2 * time.Second,
+		focus:    focusContacts,
+		status:   "Tab: switch pane  /: search  Enter: open/send  Esc: back  Ctrl-C: quit",
+	}
+}
+
+// Run processes key presses and poll ticks until the user quits or input ends
+func (t *TUI) Run() error {
+	keys := make(chan key)
+	readErr := make(chan error, 1)
+	go t.readKeys(keys, readErr)
+
+	t.refresh()
+	t.render()
+
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+
+	for !t.quit {
+		select {
+		case k := <-keys:
+			t.handleKey(k)
+		case err := <-readErr:
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		case <-ticker.C:
+			if t.SizeFunc != nil {
+				t.width, t.height = t.SizeFunc()
+			}
+			t.refresh()
+		}
+		t.render()
+	}
+	return nil
+}
+
+// readKeys decodes raw terminal input into key presses
+func (t *TUI) readKeys(keys chan<- key, readErr chan<- error) {
+	buf := make([]byte, 256)
+	for {
+		n, err := t.in.Read(buf)
+		for _, k := range decodeKeys(buf[:n]) {
+			keys <- k
+		}
+		if err != nil {
+			readErr <- err
+			return
+		}
+	}
+}
+
+// decodeKeys splits one read from the terminal into key presses
+func decodeKeys(data []byte) []key {
+	var keys []key
+	for len(data) > 0 {
+		switch {
+		case data[0] == 0x1b && len(data) >= 3 && data[1] == '[':
+			// CSI sequences: arrows and page up/down
+			consumed := 3
+			switch data[2] {
+			case 'A':
+				keys = append(keys, key{name: "up"})
+			case 'B':
+				keys = append(keys, key{name: "down"})
+			case '5', '6':
+				name := "pgup"
+				if data[2] == '6' {
+					name = "pgdn"
+				}
+				keys = append(keys, key{name: name})
+				if len(data) >= 4 && data[3] == '~' {
+					consumed = 4
+				}
+			}
+			data = data[consumed:]
+			continue
+		case data[0] == 0x1b:
+			keys = append(keys, key{name: "esc"})
+		case data[0] == '\r' || data[0] == '\n':
+			keys = append(keys, key{name: "enter"})
+		case data[0] == 0x7f || data[0] == 0x08:
+			keys = append(keys, key{name: "backspace"})
+		case data[0] == '\t':
+			keys = append(keys, key{name: "tab"})
+		case data[0] == 0x03:
+			keys = append(keys, key{name: "ctrl-c"})
+		case data[0] == 0x06:
+			keys = append(keys, key{name: "ctrl-f"})
+		case data[0] < 0x20:
+			// Ignore other control characters
+		default:
+			r, size := utf8.DecodeRune(data)
+			keys = append(keys, key{r: r})
+			data = data[size:]
+			continue
+		}
+		data = data[1:]
+	}
+	return keys
+}
+
+// handleKey applies one key press to the TUI state
+func (t *TUI) handleKey(k key) {
+	if k.name == "ctrl-c" {
+		t.quit = true
+		return
+	}
+	if k.name == "ctrl-f" {
+		t.startSearch()
+		return
+	}
+
+	switch t.focus {
+	case focusSearch:
+		switch k.name {
+		case "enter":
+			t.runSearch()
+		case "esc":
+			t.cancelSearch()
+		case "backspace":
+			if len(t.search) > 0 {
+				t.search = t.search[:len(t.search)-1]
+			}
+		case "":
+			t.search = append(t.search, k.r)
+		}
+
+	case focusContacts:
+		entries := t.entries()
+		switch k.name {
+		case "up":
+			if t.selected > 0 {
+				t.selected--
+			}
+		case "down":
+			if t.selected < len(entries)-1 {
+				t.selected++
+			}
+		case "enter":
+			if t.selected < len(entries) {
+				t.openConversation(entries[t.selected].userId)
+			}
+		case "tab":
+			t.focus = focusInput
+		case "esc":
+			t.cancelSearch()
+		case "":
+			switch k.r {
+			case '/':
+				t.startSearch()
+			case 'q':
+				t.quit = true
+			}
+		}
+
+	case focusInput:
+		switch k.name {
+		case "enter":
+			t.sendInput()
+		case "backspace":
+			if len(t.input) > 0 {
+				t.input = t.input[:len(t.input)-1]
+			}
+		case "tab", "esc":
+			t.focus = focusContacts
+		case "up", "pgup":
+			t.scroll += t.scrollStep(k.name)
+		case "down", "pgdn":
+			t.scroll -= t.scrollStep(k.name)
+			if t.scroll < 0 {
+				t.scroll = 0
+			}
+		case "":
+			t.input = append(t.input, k.r)
+		}
+	}
+}
+
+// Lines moved by one scroll key press
+func (t *TUI) scrollStep(name string) int {
+	if name == "pgup" || name == "pgdn" {
+		return t.conversationHeight() - 1
+	}
+	return 1
+}
+
+// Start typing a contact search term
+func (t *TUI) startSearch() {
+	t.focus = focusSearch
+	t.search = t.search[:0]
+}
+
+// Leave search mode and show recent chats again
+func (t *TUI) cancelSearch() {
+	t.searching = false
+	t.results = nil
+	t.selected = 0
+	t.focus = focusContacts
+}
+
+// Look up users matching the search term through /search-users
+func (t *TUI) runSearch() {
+	users, err := t.client.SearchUsers(t.userId, string(t.search))
+	if err != nil {
+		t.status = "Search failed: " + err.Error()
+		t.focus = focusContacts
+		return
+	}
+
+	// Don't offer the current user as a contact
+	t.results = t.results[:0]
+	for _, user := range users {
+		if user.UserId != t.userId {
+			t.results = append(t.results, user)
+		}
+	}
+	t.searching = true
+	t.selected = 0
+	t.focus = focusContacts
+	t.status = fmt.Sprintf("%d users match %q. Esc returns to recent chats", len(t.results), string(t.search))
+}
+
+// Rows for the contact pane: search results while searching, otherwise recent chats
+func (t *TUI) entries() []contactEntry {
+	var entries []contactEntry
+	if t.searching {
+		for _, user := range t.results {
+			entries = append(entries, contactEntry{userId: user.UserId, detail: user.Email})
+		}
+		return entries
+	}
+	for _, chat := range t.contacts {
+		entries = append(entries, contactEntry{userId: chat.ContactId, detail: chat.LastMessage, unread: !chat.IsRead})
+	}
+	return entries
+}
+
+// Open the conversation with a contact and move focus to the input box
+func (t *TUI) openConversation(contact string) {
+	t.current = contact
+	t.scroll = 0
+	t.focus = focusInput
+	t.loadConversation()
+}
+
+// Fetch recent chats and the open conversation
+func (t *TUI) refresh() {
+	chats, err := t.client.RecentChats(t.userId)
+	if err != nil {
+		t.status = "Refresh failed: " + err.Error()
+		return
+	}
+	// Keep the selection on the same contact when the list is reordered
+	if !t.searching {
+		selectedId := ""
+		if t.selected < len(t.contacts) {
+			selectedId = t.contacts[t.selected].ContactId
+		}
+		t.selected = 0
+		for i, chat := range chats {
+			if chat.ContactId == selectedId {
+				t.selected = i
+			}
+		}
+	}
+	t.contacts = chats
+	if t.current != "" {
+		t.loadConversation()
+	}
+}
+
+// Fetch the open conversation and mark incoming messages as read
+func (t *TUI) loadConversation() {
+	messages, err := t.client.Messages(t.userId, t.current)
+	if err != nil {
+		t.status = "Loading messages failed: " + err.Error()
+		return
+	}
+	t.messages = messages
+
+	unread := false
+	for _, msg := range messages {
+		if msg.Receiver == t.userId && !msg.IsRead {
+			unread = true
+			break
+		}
+	}
+	if !unread {
+		return
+	}
+	if err := t.client.MarkRead(t.userId, t.current); err != nil {
+		t.status = "Marking messages read failed: " + err.Error()
+		return
+	}
+	for i := range t.contacts {
+		if t.contacts[i].ContactId == t.current {
+			t.contacts[i].IsRead = true
+		}
+	}
+}
+
+// Send the input box contents to the open conversation
+func (t *TUI) sendInput() {
+	content := strings.TrimSpace(string(t.input))
+	if content == "" {
+		return
+	}
+	if t.current == "" {
+		t.status = "Pick a contact before sending"
+		return
+	}
+
+	reply, err := t.client.Send(t.userId, t.current, content)
+	if err != nil {
+		t.status = "Send failed: " + err.Error()
+		return
+	}
+	t.input = t.input[:0]
+	t.scroll = 0
+	t.status = "Message sent"
+	if reply != "" {
+		// Command replies are private, so they only appear in the status line
+		t.status = strings.ReplaceAll(reply, "\n", "  ")
+	}
+	t.refresh()
+}
+
+// Number of lines available to the conversation pane
+func (t *TUI) conversationHeight() int {
+	// Title, separator, input separator, input line and status line
+	height := t.height - 5
+	if height < 1 {
+		height = 1
+	}
+	return height
+}
+
+// fit pads or truncates s to exactly width characters
+func fit(s string, width int) string {
+	if width <= 0 {
+		return ""
+	}
+	runes := []rune(s)
+	if len(runes) > width {
+		if width == 1 {
+			return "…"
+		}
+		return string(runes[:width-1]) + "…"
+	}
+	return s + strings.Repeat(" ", width-len(runes))
+}
+
+// wrap splits s into lines of at most width characters
+func wrap(s string, width int) []string {
+	if width <= 0 {
+		return nil
+	}
+	var lines []string
+	for _, paragraph := range strings.Split(s, "\n") {
+		runes := []rune(paragraph)
+		for len(runes) > width {
+			lines = append(lines, string(runes[:width]))
+			runes = runes[width:]
+		}
+		lines = append(lines, string(runes))
+	}
+	return lines
+}
+
+// Lines of the conversation pane, oldest first
+func (t *TUI) conversationLines(width int) []string {
+	if t.current == "" {
+		return []string{"Select a contact to start chatting"}
+	}
+	if len(t.messages) == 0 {
+		return []string{"This is the beginning of your conversation with " + t.current}
+	}
+
+	var lines []string
+	for _, msg := range t.messages {
+		prefix := msg.Timestamp.Local().Format("15:04") + " " + msg.Sender + ": "
+		if msg.IsSystem {
+			prefix = msg.Timestamp.Local().Format("15:04") + " * "
+		}
+		lines = append(lines, wrap(prefix+msg.Text(), width)...)
+	}
+	return lines
+}
+
+// render draws the whole screen
+func (t *TUI) render() {
+	width, height := t.width, t.height
+	if width < contactPaneWidth+10 || height < 6 {
+		fmt.Fprint(t.out, "\x1b[H\x1b[2JTerminal too small")
+		return
+	}
+	rightWidth := width - contactPaneWidth - 1
+	bodyHeight := t.conversationHeight()
+
+	// Contact pane rows
+	entries := t.entries()
+	contactRows := make([]string, bodyHeight)
+	first := 0
+	if t.selected >= bodyHeight {
+		first = t.selected - bodyHeight + 1
+	}
+	for row := 0; row < bodyHeight; row++ {
+		i := first + row
+		if i >= len(entries) {
+			contactRows[row] = strings.Repeat(" ", contactPaneWidth)
+			continue
+		}
+		marker := "  "
+		if entries[i].unread {
+			marker = "● "
+		}
+		text := fit(marker+entries[i].userId, contactPaneWidth)
+		if i == t.selected {
+			// Reverse video for the selection, bold while the pane has focus
+			style := "\x1b[7m"
+			if t.focus == focusContacts {
+				style = "\x1b[1;7m"
+			}
+			text = style + text + "\x1b[0m"
+		}
+		contactRows[row] = text
+	}
+
+	// Conversation pane rows, anchored to the bottom and scrolled up by t.scroll
+	lines := t.conversationLines(rightWidth)
+	maxScroll := len(lines) - bodyHeight
+	if maxScroll < 0 {
+		maxScroll = 0
+	}
+	if t.scroll > maxScroll {
+		t.scroll = maxScroll
+	}
+	end := len(lines) - t.scroll
+	start := end - bodyHeight
+	if start < 0 {
+		start = 0
+	}
+	visible := lines[start:end]
+
+	var frame strings.Builder
+	frame.WriteString("\x1b[H")
+
+	title := "goChat — " + t.userId
+	if t.current != "" {
+		title += "  |  " + t.current
+	}
+	if t.searching {
+		title += "  |  search results"
+	}
+	frame.WriteString("\x1b[1m" + fit(title, width) + "\x1b[0m\r\n")
+	frame.WriteString(strings.Repeat("─", contactPaneWidth) + "┬" + strings.Repeat("─", rightWidth) + "\r\n")
+
+	for row := 0; row < bodyHeight; row++ {
+		right := ""
+		// Pad the top when the conversation is shorter than the pane
+		if offset := row - (bodyHeight - len(visible)); offset >= 0 {
+			right = visible[offset]
+		}
+		frame.WriteString(contactRows[row] + "│" + fit(right, rightWidth) + "\r\n")
+	}
+
+	frame.WriteString(strings.Repeat("─", contactPaneWidth) + "┴" + strings.Repeat("─", rightWidth) + "\r\n")
+
+	// Input line doubles as the search box
+	var prompt string
+	switch t.focus {
+	case focusSearch:
+		prompt = "Search: " + string(t.search) + "█"
+	case focusInput:
+		prompt = "> " + string(t.input) + "█"
+	default:
+		prompt = "> " + string(t.input)
+	}
+	frame.WriteString(fit(prompt, width) + "\r\n")
+	frame.WriteString("\x1b[2m" + fit(t.status, width) + "\x1b[0m")
+
+	fmt.Fprint(t.out, frame.String())
+}
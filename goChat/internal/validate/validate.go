@@ -0,0 +1,109 @@
+// Package validate holds the account rules shared by the server and
+// gochat-admin, so the tool can't create accounts the server would refuse.
+// The errors are written for end users: the server returns them as field
+// errors and gochat-admin prints them as they are.
+package validate
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Account limits
+const (
+	MinUsernameLength = 3
+	MaxUsernameLength = 32
+	MaxEmailLength    = 254
+	MinPasswordLength = 8
+	MaxPasswordLength = 128
+)
+
+// NormalizeText converts input to Unicode NFC and trims surrounding whitespace
+func NormalizeText(s string) string {
+	return strings.TrimSpace(norm.NFC.String(s))
+}
+
+// NormalizePassword converts a password to Unicode NFC. Spaces are
+// significant in passwords, so unlike NormalizeText it trims nothing.
+func NormalizePassword(password string) string {
+	return norm.NFC.String(password)
+}
+
+// Username checks username length and allowed characters
+func Username(username string) error {
+	length := utf8.RuneCountInString(username)
+	if length == 0 {
+		return errors.New("Username is required")
+	}
+	if length < MinUsernameLength || length > MaxUsernameLength {
+		return fmt.Errorf("Username must be between %d and %d characters", MinUsernameLength, MaxUsernameLength)
+	}
+
+	// Letters, digits, '.', '_' and '-' only, starting with a letter or digit
+	for i, r := range username {
+		isAlnum := r < utf8.RuneSelf && (unicode.IsLetter(r) || unicode.IsDigit(r))
+		if i == 0 && !isAlnum {
+			return errors.New("Username must start with a letter or digit")
+		}
+		if !isAlnum && r != '.' && r != '_' && r != '-' {
+			return errors.New("Username may only contain letters, digits, '.', '_' and '-'")
+		}
+	}
+	return nil
+}
+
+// Email parses the address according to RFC 5322
+func Email(email string) error {
+	if email == "" {
+		return errors.New("Email is required")
+	}
+	if len(email) > MaxEmailLength {
+		return errors.New("Email is too long")
+	}
+
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Name != "" || addr.Address != email {
+		// Reject display-name forms like "Bob <bob@example.com>"
+		return errors.New("Email address is not valid")
+	}
+
+	// Require a dotted domain so "user@localhost" style addresses are rejected
+	at := strings.LastIndex(email, "@")
+	domain := email[at+1:]
+	if !strings.Contains(domain, ".") || strings.HasPrefix(domain, ".") || strings.HasSuffix(domain, ".") {
+		return errors.New("Email domain is not valid")
+	}
+	return nil
+}
+
+// Password enforces the password policy
+func Password(password, username string) error {
+	length := utf8.RuneCountInString(password)
+	if length < MinPasswordLength || length > MaxPasswordLength {
+		return fmt.Errorf("Password must be between %d and %d characters", MinPasswordLength, MaxPasswordLength)
+	}
+
+	hasLetter, hasDigit := false, false
+	for _, r := range password {
+		switch {
+		case unicode.IsLetter(r):
+			hasLetter = true
+		case unicode.IsDigit(r):
+			hasDigit = true
+		}
+	}
+	if !hasLetter || !hasDigit {
+		return errors.New("Password must contain at least one letter and one digit")
+	}
+
+	if username != "" && strings.EqualFold(password, username) {
+		return errors.New("Password must not match the username")
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package validate
+
+import "testing"
+
+func TestAccountRules(t *testing.T) {
+	for _, username := range []string{"alice", "a.b_c-d", "abc"} {
+		if err := Username(username); err != nil {
+			t.Errorf("Username(%q): %v", username, err)
+		}
+	}
+	for _, username := range []string{"", "ab", "-alice", "al ice", "alicé", "a23456789012345678901234567890123"} {
+		if Username(username) == nil {
+			t.Errorf("Username(%q) accepted", username)
+		}
+	}
+
+	if err := Email("alice@example.com"); err != nil {
+		t.Errorf("Email: %v", err)
+	}
+	for _, email := range []string{"", "alice", "alice@localhost", "Alice <alice@example.com>", "alice@example."} {
+		if Email(email) == nil {
+			t.Errorf("Email(%q) accepted", email)
+		}
+	}
+
+	if err := Password("correct horse 1", "alice"); err != nil {
+		t.Errorf("Password: %v", err)
+	}
+	for _, password := range []string{"short1", "lettersonly", "12345678"} {
+		if Password(password, "alice") == nil {
+			t.Errorf("Password(%q) accepted", password)
+		}
+	}
+	if Password("Alice123", "alice123") == nil {
+		t.Error("password matching the username accepted")
+	}
+}
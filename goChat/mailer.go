@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"mime"
+	"net"
+	netmail "net/mail"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Outgoing mail goes through a Mailer. By default messages are only
+// printed to the log, which is enough for development; -smtp sends them
+// through a mail server and -mail-file appends them to an mbox file,
+// which is what the OpenAPI check reads the links back from.
+
+// Mail is one outgoing plain-text message
+type Mail struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers outgoing mail
+type Mailer interface {
+	Send(mail Mail) error
+}
+
+// Environment variables holding the SMTP credentials, kept out of the
+// command line so they don't show up in the process list
+const (
+	smtpUserEnv     = "GOCHAT_SMTP_USER"
+	smtpPasswordEnv = "GOCHAT_SMTP_PASSWORD"
+)
+
+// How long to wait for the mail server
+const smtpTimeout = 30 * time.Second
+
+// Mailer used by the handlers, set up by configureMailer
+var mailer Mailer = logMailer{from: "goChat <noreply@localhost>"}
+
+// Format a message with the headers every mailer writes
+func formatMail(from string, mail Mail, now time.Time) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", from)
+	fmt.Fprintf(&buf, "To: %s\r\n", mail.To)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", mail.Subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("\r\n")
+	buf.WriteString(strings.ReplaceAll(mail.Body, "\n", "\r\n"))
+	return buf.Bytes()
+}
+
+// logMailer prints messages to the server log instead of sending them
+type logMailer struct {
+	from string
+}
+
+// Send prints the message
+func (m logMailer) Send(mail Mail) error {
+	fmt.Printf("Mail to %s (not sent, no -smtp server configured):\n%s\n", mail.To, strings.ReplaceAll(string(formatMail(m.from, mail, time.Now())), "\r\n", "\n"))
+	return nil
+}
+
+// fileMailer appends messages to an mbox file
+type fileMailer struct {
+	from string
+	path string
+	mu   sync.Mutex
+}
+
+// Send appends the message, escaping body lines that would start a new one
+func (m *fileMailer) Send(mail Mail) error {
+	now := time.Now()
+	lines := strings.Split(strings.ReplaceAll(string(formatMail(m.from, mail, now)), "\r\n", "\n"), "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(line, "From ") {
+			lines[i] = ">" + line
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	file, err := os.OpenFile(m.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(file, "From gochat %s\n%s\n\n", now.UTC().Format(time.ANSIC), strings.Join(lines, "\n"))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// smtpMailer sends messages through a mail server, upgrading to TLS when
+// the server offers STARTTLS. Credentials are only sent over TLS.
+type smtpMailer struct {
+	from     string
+	addr     string // host:port
+	user     string
+	password string
+}
+
+// Send delivers the message to the mail server
+func (m smtpMailer) Send(mail Mail) error {
+	host, _, err := net.SplitHostPort(m.addr)
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialTimeout("tcp", m.addr, smtpTimeout)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(smtpTimeout))
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if m.user != "" {
+		// PlainAuth refuses to send credentials without TLS, except to localhost
+		if err := client.Auth(smtp.PlainAuth("", m.user, m.password, host)); err != nil {
+			return err
+		}
+	}
+
+	sender := m.from
+	if addr, err := netmail.ParseAddress(m.from); err == nil {
+		sender = addr.Address
+	}
+	if err := client.Mail(sender); err != nil {
+		return err
+	}
+	if err := client.Rcpt(mail.To); err != nil {
+		return err
+	}
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := writer.Write(formatMail(m.from, mail, time.Now())); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// Choose the mailer from the command-line flags. An SMTP server wins over
+// a mail file; with neither, mail is only logged.
+func configureMailer(smtpAddr, mailFile, from string) error {
+	if _, err := netmail.ParseAddress(from); err != nil {
+		return fmt.Errorf("-mail-from is not a valid address: %w", err)
+	}
+	switch {
+	case smtpAddr != "":
+		if _, _, err := net.SplitHostPort(smtpAddr); err != nil {
+			return fmt.Errorf("-smtp must be host:port: %w", err)
+		}
+		mailer = smtpMailer{from: from, addr: smtpAddr, user: os.Getenv(smtpUserEnv), password: os.Getenv(smtpPasswordEnv)}
+	case mailFile != "":
+		mailer = &fileMailer{from: from, path: mailFile}
+	default:
+		mailer = logMailer{from: from}
+	}
+	return nil
+}
@@ -2,63 +2,50 @@ package main
 
 import (
 	"encoding/json"//decoding json
+	"errors"
+	"flag"
 	"fmt"//printing to console
 	"net/http"//handling http requests
+	"net/url"
 	"os" //reading/writing files
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
-)
 
-// User struct to store user data
-type User struct {
-	UserId   string `json:"userId"`
-	Password string `json:"password,omitempty"` // Omit password when returning to client
-	Email    string `json:"email,omitempty"`
-}
+	"gochat/internal/envelope"
+	"gochat/internal/store"
+)
 
-// UsersData struct to match our JSON structure
-type UsersData struct {
-	Users []User `json:"users"`
-}
+// The data file types are shared with gochat-admin through internal/store
+type (
+	User            = store.User
+	UsersData       = store.UsersData
+	Message         = store.Message
+	ChatsData       = store.ChatsData
+	RecentChat      = store.RecentChat
+	RecentChatsData = store.RecentChatsData
+)
 
 // Search request struct
 type SearchRequest struct {
 	SearchTerm string `json:"searchTerm"`
 }
 
-// Message struct to store chat messages
-type Message struct {
-	Sender    string    `json:"sender"`
-	Receiver  string    `json:"receiver"`
-	Content   string    `json:"content"`
-	Timestamp time.Time `json:"timestamp"`
-	IsRead    bool      `json:"isRead"`
-}
-
-// ChatsData struct to match our JSON structure
-type ChatsData struct {
-	Messages []Message `json:"messages"`
-}
-
 // Message request struct
 type MessageRequest struct {
-	Receiver string `json:"receiver"`
-	Content  string `json:"content"`
+	Receiver string     `json:"receiver"`
+	Content  string     `json:"content"`
+	SendAt   *time.Time `json:"sendAt,omitempty"` // Deliver later instead of now
+	Type     string     `json:"type,omitempty"`   // "e2e" for an encrypted envelope
 }
 
-// RecentChat struct to store recent chat information
-type RecentChat struct {
+// ContactInfo struct summarizes a conversation in getAllMessages responses
+type ContactInfo struct {
 	UserId      string    `json:"userId"`
-	ContactId   string    `json:"contactId"`
 	LastMessage string    `json:"lastMessage"`
 	Timestamp   time.Time `json:"timestamp"`
-	IsRead      bool      `json:"isRead"`
-}
-
-// RecentChatsData struct to match our JSON structure
-type RecentChatsData struct {
-	Chats []RecentChat `json:"chats"`
 }
 
 // CORS middleware
@@ -66,7 +53,7 @@ func enableCORS(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
 		
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
@@ -81,7 +68,7 @@ func enableCORS(next http.Handler) http.Handler {
 func registerUser(w http.ResponseWriter, r *http.Request) {
 	// Only accept POST requests
 	if r.Method != http.MethodPost {
-		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Invalid request method", "")
 		return
 	}
 	
@@ -98,14 +85,14 @@ func registerUser(w http.ResponseWriter, r *http.Request) {
 		// Parse JSON request body
 		err := json.NewDecoder(r.Body).Decode(&newUser)
 		if err != nil {
-			http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+			writeError(w, http.StatusBadRequest, "invalid_json", "Invalid JSON: "+err.Error(), "")
 			return
 		}
 	} else {
 		// Parse form data
 		err := r.ParseForm()
 		if err != nil {
-			http.Error(w, "Error parsing form data: "+err.Error(), http.StatusBadRequest)
+			writeError(w, http.StatusBadRequest, "invalid_form", "Error parsing form data: "+err.Error(), "")
 			return
 		}
 		
@@ -116,62 +103,42 @@ func registerUser(w http.ResponseWriter, r *http.Request) {
 		fmt.Println("Form data parsed - Username:", newUser.UserId, "Email:", newUser.Email)
 	}
 	
-	// Read existing users from file
-	usersData := UsersData{Users: []User{}}
-	
-	// Check if the file exists
-	if _, err := os.Stat("users.json"); err == nil {
-		// File exists, read it
-		data, err := os.ReadFile("users.json")
-		if err != nil {
-			http.Error(w, "Error reading users.json: "+err.Error(), http.StatusInternalServerError)
-			return
-		}
-		
-		// Unmarshal existing user data
-		err = json.Unmarshal(data, &usersData)
-		if err != nil {
-			http.Error(w, "Error parsing users.json: "+err.Error(), http.StatusInternalServerError)
-			return
+	// Validate and normalize the submitted fields
+	if errs := validateRegistration(&newUser); len(errs) > 0 {
+		fmt.Println("Registration rejected:", errs.Error())
+		if isAjaxRequest {
+			writeValidationErrors(w, errs)
+		} else {
+			http.Redirect(w, r, "/?"+errs.redirectQuery(), http.StatusFound)
 		}
-		
-		fmt.Println("Current number of users:", len(usersData.Users))
-	} else {
-		fmt.Println("users.json does not exist yet, creating new file")
+		return
 	}
 	
-	// Check if user already exists
-	for _, user := range usersData.Users {
-		if user.UserId == newUser.UserId {
-			fmt.Println("User already exists:", newUser.UserId)
-			if isAjaxRequest {
-				w.Header().Set("Content-Type", "application/json")
-				json.NewEncoder(w).Encode(map[string]bool{"success": false})
-			} else {
-				http.Redirect(w, r, "/?error=user_exists", http.StatusFound)
-			}
-			return
+	// Add the new user. Only the submitted credentials are kept; flags such
+	// as isAdmin or emailVerified can't be set by the client.
+	newUser = User{UserId: newUser.UserId, Password: newUser.Password, Email: newUser.Email}
+	err := addUser(newUser)
+	if err == errUserExists {
+		fmt.Println("User already exists:", newUser.UserId)
+		if isAjaxRequest {
+			writeError(w, http.StatusConflict, "user_exists", "Username is already taken", "username")
+		} else {
+			http.Redirect(w, r, "/?error=user_exists", http.StatusFound)
 		}
-	}
-	
-	// Add the new user
-	usersData.Users = append(usersData.Users, newUser)
-	
-	// Write updated users to file
-	newData, err := json.MarshalIndent(usersData, "", "  ")
-	if err != nil {
-		http.Error(w, "Error encoding users data: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
-	
-	err = os.WriteFile("users.json", newData, 0644)
 	if err != nil {
-		http.Error(w, "Error writing to users.json: "+err.Error(), http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error writing to users.json: "+err.Error(), "")
 		return
 	}
 	
 	fmt.Println("User registered successfully:", newUser.UserId)
 	
+	// The account works without verifying, so a mail failure doesn't fail registration
+	if err := sendVerificationMail(newUser); err != nil {
+		fmt.Printf("Error sending verification link to %s: %v\n", newUser.UserId, err)
+	}
+	
 	// Return success response
 	if isAjaxRequest {
 		w.Header().Set("Content-Type", "application/json")
@@ -187,33 +154,34 @@ func registerUser(w http.ResponseWriter, r *http.Request) {
 func loginUser(w http.ResponseWriter, r *http.Request) {
 	// Only accept POST requests
 	if r.Method != http.MethodPost {
-		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Invalid request method", "")
 		return
 	}
 	
 	// Check if this is a browser form submission or an AJAX request
 	isAjaxRequest := r.Header.Get("Content-Type") == "application/json"
 	
-	var loginData User
+	var loginData LoginRequest
 	
 	// Parse request differently based on request type
 	if isAjaxRequest {
 		// Parse JSON request body
 		err := json.NewDecoder(r.Body).Decode(&loginData)
 		if err != nil {
-			http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+			writeError(w, http.StatusBadRequest, "invalid_json", "Invalid JSON: "+err.Error(), "")
 			return
 		}
 	} else {
 		// Parse form data
 		err := r.ParseForm()
 		if err != nil {
-			http.Error(w, "Error parsing form data: "+err.Error(), http.StatusBadRequest)
+			writeError(w, http.StatusBadRequest, "invalid_form", "Error parsing form data: "+err.Error(), "")
 			return
 		}
 		
 		loginData.UserId = r.FormValue("username")
 		loginData.Password = r.FormValue("password")
+		loginData.DeviceName = r.FormValue("device")
 	}
 	
 	// Read existing users from file
@@ -223,8 +191,7 @@ func loginUser(w http.ResponseWriter, r *http.Request) {
 	if _, err := os.Stat("users.json"); err != nil {
 		// File doesn't exist, no users yet
 		if isAjaxRequest {
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(map[string]bool{"success": false})
+			writeError(w, http.StatusUnauthorized, "invalid_credentials", "Invalid username or password", "")
 		} else {
 			http.Redirect(w, r, "/?error=invalid_credentials", http.StatusFound)
 		}
@@ -234,38 +201,54 @@ func loginUser(w http.ResponseWriter, r *http.Request) {
 	// Read the file
 	data, err := os.ReadFile("users.json")
 	if err != nil {
-		http.Error(w, "Error reading users.json: "+err.Error(), http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error reading users.json: "+err.Error(), "")
 		return
 	}
 	
 	// Unmarshal the user data
 	err = json.Unmarshal(data, &usersData)
 	if err != nil {
-		http.Error(w, "Error parsing users.json: "+err.Error(), http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error parsing users.json: "+err.Error(), "")
 		return
 	}
 	
 	// Check user credentials
 	for _, user := range usersData.Users {
-		if user.UserId == loginData.UserId && user.Password == loginData.Password {
-			// Authentication successful
-			fmt.Println("User authenticated:", user.UserId)
+		if user.UserId == loginData.UserId && user.Password == loginData.Password && !user.IsBot {
+			// Correct credentials, but the account may be locked
+			if user.Disabled {
+				fmt.Println("Login refused for disabled account:", user.UserId)
+				if isAjaxRequest {
+					writeError(w, http.StatusForbidden, "account_disabled", "This account has been disabled", "")
+				} else {
+					http.Redirect(w, r, "/?error=account_disabled", http.StatusFound)
+				}
+				return
+			}
+			if user.MustResetPassword {
+				fmt.Println("Password reset required for:", user.UserId)
+				if isAjaxRequest {
+					writeError(w, http.StatusForbidden, "password_reset_required", "Choose a new password to continue", "password")
+				} else {
+					http.Redirect(w, r, "/?error=password_reset_required&user="+url.QueryEscape(user.UserId), http.StatusFound)
+				}
+				return
+			}
+			
+			deviceName := loginData.DeviceName
+			if deviceName == "" {
+				deviceName = describeDevice(r.UserAgent())
+			}
 			
-			// If it's an AJAX request, return JSON response
-			if isAjaxRequest {
-				w.Header().Set("Content-Type", "application/json")
-				
-				json.NewEncoder(w).Encode(map[string]interface{}{
-					"success": true,
-					"redirectTo": "/dashboard?userId=" + user.UserId,
-					"userId": user.UserId,
-					"email": user.Email,
-				})
-			} else {
-				// For form submission, redirect to dashboard with userId parameter
-				fmt.Println("Redirecting user to dashboard:", user.UserId)
-				http.Redirect(w, r, "/dashboard?userId="+user.UserId, http.StatusFound)
+			// With two-factor authentication on, the password only earns a
+			// challenge that /login/totp exchanges for a session
+			if user.TOTPEnabled {
+				fmt.Println("Second factor required for:", user.UserId)
+				writeTOTPRequired(w, r, isAjaxRequest, newLoginChallenge(user.UserId, deviceName))
+				return
 			}
+			
+			completeLogin(w, r, user, deviceName, false, isAjaxRequest)
 			return
 		}
 	}
@@ -273,18 +256,50 @@ func loginUser(w http.ResponseWriter, r *http.Request) {
 	// If we get here, login failed
 	fmt.Println("Login failed for:", loginData.UserId)
 	if isAjaxRequest {
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]bool{"success": false})
+		writeError(w, http.StatusUnauthorized, "invalid_credentials", "Invalid username or password", "")
 	} else {
 		http.Redirect(w, r, "/?error=invalid_credentials", http.StatusFound)
 	}
 }
 
+// Finish a login once the credentials are checked: register the device as
+// a session and send the client on to the dashboard
+func completeLogin(w http.ResponseWriter, r *http.Request, user User, deviceName string, secondFactor, isAjaxRequest bool) {
+	// Authentication successful: register this device as a session
+	fmt.Println("User authenticated:", user.UserId)
+	session, token, err := createSession(user.UserId, deviceName, secondFactor)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error creating session: "+err.Error(), "")
+		return
+	}
+	setSessionCookie(w, token)
+	fmt.Printf("New session %s for %s on %s\n", session.Id, user.UserId, session.DeviceName)
+	
+	// If it's an AJAX request, return JSON response
+	if isAjaxRequest {
+		w.Header().Set("Content-Type", "application/json")
+		
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"redirectTo": "/dashboard?userId=" + user.UserId,
+			"userId": user.UserId,
+			"email": user.Email,
+			"token": token,
+			"sessionId": session.Id,
+			"syncToken": strconv.FormatUint(session.SyncSeq, 10),
+		})
+	} else {
+		// For form submission, redirect to dashboard with userId parameter
+		fmt.Println("Redirecting user to dashboard:", user.UserId)
+		http.Redirect(w, r, "/dashboard?userId="+user.UserId, http.StatusFound)
+	}
+}
+
 // Handler for user search
 func searchUsers(w http.ResponseWriter, r *http.Request) {
 	// Only accept POST requests
 	if r.Method != http.MethodPost {
-		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Invalid request method", "")
 		return
 	}
 	
@@ -292,7 +307,7 @@ func searchUsers(w http.ResponseWriter, r *http.Request) {
 	var searchReq SearchRequest
 	err := json.NewDecoder(r.Body).Decode(&searchReq)
 	if err != nil {
-		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, "invalid_json", "Invalid JSON: "+err.Error(), "")
 		return
 	}
 	
@@ -313,37 +328,58 @@ func searchUsers(w http.ResponseWriter, r *http.Request) {
 	// Read the file
 	data, err := os.ReadFile("users.json")
 	if err != nil {
-		http.Error(w, "Error reading users.json: "+err.Error(), http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error reading users.json: "+err.Error(), "")
 		return
 	}
 	
 	// Unmarshal the user data
 	err = json.Unmarshal(data, &usersData)
 	if err != nil {
-		http.Error(w, "Error parsing users.json: "+err.Error(), http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error parsing users.json: "+err.Error(), "")
 		return
 	}
 	
+	// Users the searcher has blocked are left out
+	blocked := map[string]bool{}
+	if searcher := r.URL.Query().Get("user"); searcher != "" {
+		blocked, err = blockedUsers(searcher)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "internal_error", "Error reading contacts.json: "+err.Error(), "")
+			return
+		}
+	}
+	
 	// Filter users based on search term
 	results := []User{}
+	profiles := map[string]ProfileSummary{}
+	term := strings.ToLower(searchReq.SearchTerm)
 	for _, user := range usersData.Users {
+		if blocked[user.UserId] {
+			continue
+		}
+		
 		// Don't include password in search results
 		userWithoutPassword := User{
 			UserId: user.UserId,
 			Email:  user.Email,
+			IsBot:  user.IsBot,
+			Status: user.Status,
 		}
 		
-		// Check if user ID contains search term (case insensitive)
-		if strings.Contains(strings.ToLower(user.UserId), strings.ToLower(searchReq.SearchTerm)) {
+		// Check if user ID or display name contains search term (case insensitive)
+		if strings.Contains(strings.ToLower(user.UserId), term) || strings.Contains(strings.ToLower(user.DisplayName), term) {
 			results = append(results, userWithoutPassword)
+			profile := profileOf(user)
+			profiles[user.UserId] = ProfileSummary{DisplayName: profile.DisplayName, AvatarURL: profile.AvatarURL, Status: profile.Status}
 		}
 	}
 	
 	// Return results
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"success": true,
-		"users":   results,
+		"success":  true,
+		"users":    results,
+		"profiles": profiles,
 	})
 }
 
@@ -397,48 +433,75 @@ func dashboardRedirect(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(html))
 }
 
-// Function to update recent chats after a message is sent
-func updateRecentChats(sender, receiver, message string, timestamp time.Time, isRead bool) {
-	// Read existing recent chats from file
-	recentChatsData := RecentChatsData{Chats: []RecentChat{}}
+// Read all users from users.json, returning an empty list if the file doesn't exist
+func loadUsers() (UsersData, error) {
+	usersData := UsersData{Users: []User{}}
 	
-	// Check if the file exists
-	if _, err := os.Stat("recentChats.json"); err == nil {
-		// File exists, read it
-		data, err := os.ReadFile("recentChats.json")
-		if err != nil {
-			fmt.Println("Error reading recentChats.json:", err)
-			return
-		}
-		
-		// Unmarshal existing recent chats data
-		err = json.Unmarshal(data, &recentChatsData)
-		if err != nil {
-			fmt.Println("Error parsing recentChats.json:", err)
-			return
-		}
+	data, err := os.ReadFile("users.json")
+	if os.IsNotExist(err) {
+		return usersData, nil
 	}
-	
-	// Update recent chats for sender
-	updateSingleRecentChat(&recentChatsData, sender, receiver, message, timestamp, true) // For sender, mark as read
-	
-	// Update recent chats for receiver
-	updateSingleRecentChat(&recentChatsData, receiver, sender, message, timestamp, isRead) // For receiver, use the provided read status
-	
-	// Write updated recent chats to file
-	newData, err := json.MarshalIndent(recentChatsData, "", "  ")
 	if err != nil {
-		fmt.Println("Error encoding recent chats data:", err)
-		return
+		return usersData, err
 	}
 	
-	err = os.WriteFile("recentChats.json", newData, 0644)
+	err = json.Unmarshal(data, &usersData)
+	return usersData, err
+}
+
+// Guards read-modify-write cycles on users.json. Readers don't need it:
+// the file is only ever replaced whole.
+var usersMu sync.Mutex
+
+// Returned by addUser when the ID is taken
+var errUserExists = errors.New("user already exists")
+
+// Write all users to users.json. Callers hold usersMu.
+func saveUsers(usersData UsersData) error {
+	newData, err := json.MarshalIndent(usersData, "", "  ")
 	if err != nil {
-		fmt.Println("Error writing to recentChats.json:", err)
-		return
+		return err
+	}
+	return writeFileAtomic("users.json", newData, 0644)
+}
+
+// Add a user to users.json unless the ID is taken. IDs match exactly, as
+// at login and in every lookup.
+func addUser(newUser User) error {
+	usersMu.Lock()
+	defer usersMu.Unlock()
+	usersData, err := loadUsers()
+	if err != nil {
+		return err
+	}
+	for _, user := range usersData.Users {
+		if user.UserId == newUser.UserId {
+			return errUserExists
+		}
+	}
+	usersData.Users = append(usersData.Users, newUser)
+	return saveUsers(usersData)
+}
+
+// Look up a registered user by ID
+func findUser(userId string) (User, bool, error) {
+	usersData, err := loadUsers()
+	if err != nil {
+		return User{}, false, err
 	}
 	
-	fmt.Println("Recent chats updated successfully")
+	for _, user := range usersData.Users {
+		if user.UserId == userId {
+			return user, true, nil
+		}
+	}
+	return User{}, false, nil
+}
+
+// Check whether a user with the given ID is registered
+func userExists(userId string) (bool, error) {
+	_, exists, err := findUser(userId)
+	return exists, err
 }
 
 // Helper function to update a single user's recent chats
@@ -468,11 +531,218 @@ func updateSingleRecentChat(data *RecentChatsData, userId, contactId, message st
 	}
 }
 
+// Read all messages from chats.json plus those still in chats.log,
+// returning an empty list if neither exists. The caller must hold storeMu.
+func loadChats() (ChatsData, error) {
+	chatsData := ChatsData{Messages: []Message{}}
+	
+	data, err := os.ReadFile("chats.json")
+	if err != nil && !os.IsNotExist(err) {
+		return chatsData, fmt.Errorf("reading chats.json: %w", err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &chatsData); err != nil {
+			return chatsData, fmt.Errorf("parsing chats.json: %w", err)
+		}
+	}
+	
+	logged, err := replayMessageLog(chatsData.Checkpoint)
+	if err != nil {
+		return chatsData, err
+	}
+	chatsData.Messages = append(chatsData.Messages, logged...)
+	if err := openMessages(chatsData.Messages); err != nil {
+		return chatsData, fmt.Errorf("reading chats: %w", err)
+	}
+	return chatsData, nil
+}
+
+// Write all messages to chats.json as a checkpoint and empty chats.log.
+// chatsData must hold every logged message, as loadChats returns them.
+// The caller must hold storeMu.
+func saveChats(chatsData ChatsData) error {
+	if err := openMessageLog(); err != nil {
+		return err
+	}
+	sealed, err := sealMessages(chatsData.Messages)
+	if err != nil {
+		return fmt.Errorf("encrypting chats data: %w", err)
+	}
+	newData, err := json.MarshalIndent(ChatsData{Messages: sealed, Checkpoint: logSeq}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encoding chats data: %w", err)
+	}
+	
+	if err := writeFileAtomic("chats.json", newData, 0644); err != nil {
+		return fmt.Errorf("writing to chats.json: %w", err)
+	}
+	return resetMessageLog()
+}
+
+// Read recent chats from recentChats.json, returning an empty list if the file doesn't exist
+func loadRecentChats() (RecentChatsData, error) {
+	recentChatsData := RecentChatsData{Chats: []RecentChat{}}
+	
+	data, err := os.ReadFile("recentChats.json")
+	if os.IsNotExist(err) {
+		return recentChatsData, nil
+	}
+	if err != nil {
+		return recentChatsData, fmt.Errorf("reading recentChats.json: %w", err)
+	}
+	
+	if err := json.Unmarshal(data, &recentChatsData); err != nil {
+		return recentChatsData, fmt.Errorf("parsing recentChats.json: %w", err)
+	}
+	for i, chat := range recentChatsData.Chats {
+		if recentChatsData.Chats[i].LastMessage, err = openText(chat.LastMessage, envelope.RecentChatContext(chat.UserId, chat.ContactId)); err != nil {
+			return recentChatsData, fmt.Errorf("decrypting recentChats.json: %w", err)
+		}
+	}
+	return recentChatsData, nil
+}
+
+// Write recent chats to recentChats.json
+func saveRecentChats(recentChatsData RecentChatsData) error {
+	sealed := RecentChatsData{Chats: make([]RecentChat, len(recentChatsData.Chats))}
+	for i, chat := range recentChatsData.Chats {
+		lastMessage, err := sealText(chat.LastMessage, envelope.RecentChatContext(chat.UserId, chat.ContactId))
+		if err != nil {
+			return fmt.Errorf("encrypting recent chats data: %w", err)
+		}
+		chat.LastMessage = lastMessage
+		sealed.Chats[i] = chat
+	}
+	newData, err := json.MarshalIndent(sealed, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encoding recent chats data: %w", err)
+	}
+	
+	if err := writeFileAtomic("recentChats.json", newData, 0644); err != nil {
+		return fmt.Errorf("writing to recentChats.json: %w", err)
+	}
+	return nil
+}
+
+// Replace a file through a temporary file so readers never see it half
+// written. The data is synced before the rename, so after a crash the file
+// holds either the old or the new content.
+func writeFileAtomic(name string, data []byte, perm os.FileMode) error {
+	file, err := os.OpenFile(name+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(name+".tmp", name)
+}
+
+// Recompute the recent chats of the affected conversations from their
+// latest message, adding or dropping entries as needed. Used when
+// messages are removed from or bulk-loaded into chats.json.
+func refreshRecentChats(affected map[[2]string]bool, messages []Message) error {
+	recentChatsData, err := currentRecentChats()
+	if err != nil {
+		return err
+	}
+	
+	// Latest message of each affected conversation
+	latest := store.LatestMessages(messages)
+	
+	chats := recentChatsData.Chats[:0]
+	for _, chat := range recentChatsData.Chats {
+		if !affected[store.ConversationKey(chat.UserId, chat.ContactId)] {
+			chats = append(chats, chat)
+		}
+	}
+	recentChatsData.Chats = chats
+	for key, message := range latest {
+		if !affected[key] {
+			continue
+		}
+		updateSingleRecentChat(&recentChatsData, message.Sender, message.Receiver, store.Preview(message), message.Timestamp, true)
+		updateSingleRecentChat(&recentChatsData, message.Receiver, message.Sender, store.Preview(message), message.Timestamp, message.IsRead)
+	}
+	return saveRecentChats(recentChatsData)
+}
+
+// Guards read-modify-write cycles on chats.json, chats.log and recentChats.json
+var storeMu sync.Mutex
+
+// Append a message to chats.log, update recent chats, record it for
+// device sync and notify webhooks.
+// Both files are written under storeMu; if only the recent chats write
+// fails, the message still counts as stored and the index is rebuilt on
+// its next use.
+func storeMessage(message Message) error {
+	if message.Id == "" {
+		message.Id = store.NewMessageId()
+	}
+
+	// Stamp an expiry if the conversation has a disappearing-message timer
+	if !message.IsSystem && message.ExpiresAt == nil {
+		ttl, err := conversationTTL(message.Sender, message.Receiver)
+		if err != nil {
+			return err
+		}
+		if ttl > 0 {
+			expiresAt := message.Timestamp.Add(ttl)
+			message.ExpiresAt = &expiresAt
+		}
+	}
+	
+	storeMu.Lock()
+	
+	recentChatsData, err := currentRecentChats()
+	if err != nil {
+		storeMu.Unlock()
+		return err
+	}
+	
+	// Add the new message
+	if err := appendMessageLog(message); err != nil {
+		storeMu.Unlock()
+		return err
+	}
+	scheduleExpiry(message)
+	if logPending >= checkpointRecords {
+		if err := checkpointMessageLog(); err != nil {
+			fmt.Println("Error checkpointing the message log:", err)
+		}
+	}
+	if err := recordChange(Change{Type: changeMessage, Users: []string{message.Sender, message.Receiver}, Message: &message, Time: message.Timestamp}); err != nil {
+		fmt.Println("Error recording change for sync:", err)
+	}
+	
+	// Update recent chats: the sender has read their own message
+	updateSingleRecentChat(&recentChatsData, message.Sender, message.Receiver, store.Preview(message), message.Timestamp, true)
+	updateSingleRecentChat(&recentChatsData, message.Receiver, message.Sender, store.Preview(message), message.Timestamp, message.IsRead)
+	if err := saveRecentChats(recentChatsData); err != nil {
+		recentChatsStale = true
+		fmt.Println("Error updating recent chats, will rebuild:", err)
+	} else {
+		fmt.Println("Recent chats updated successfully")
+	}
+	storeMu.Unlock()
+	
+	// Notify any webhooks watching this conversation
+	dispatchMessageEvent(message)
+	return nil
+}
+
 // Handler for sending a message
 func sendMessage(w http.ResponseWriter, r *http.Request) {
 	// Only accept POST requests
 	if r.Method != http.MethodPost {
-		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Invalid request method", "")
 		return
 	}
 	
@@ -481,7 +751,19 @@ func sendMessage(w http.ResponseWriter, r *http.Request) {
 	// Get sender from request (in a real app, this would come from authentication)
 	sender := r.URL.Query().Get("sender")
 	if sender == "" {
-		http.Error(w, "Sender is required", http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, "missing_parameter", "Sender is required", "sender")
+		return
+	}
+	
+	// Bots can only post through the token-authenticated bot endpoint
+	if senderUser, exists, err := findUser(sender); err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error reading users.json: "+err.Error(), "")
+		return
+	} else if exists && senderUser.IsBot {
+		writeError(w, http.StatusForbidden, "bot_sender", "Bots must post through /api/v1/bot/send-message", "sender")
+		return
+	} else if exists && senderUser.Disabled {
+		writeError(w, http.StatusForbidden, "account_disabled", "This account has been disabled", "sender")
 		return
 	}
 	
@@ -489,77 +771,93 @@ func sendMessage(w http.ResponseWriter, r *http.Request) {
 	var msgReq MessageRequest
 	err := json.NewDecoder(r.Body).Decode(&msgReq)
 	if err != nil {
-		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, "invalid_json", "Invalid JSON: "+err.Error(), "")
 		return
 	}
 	
-	// Create message
-	now := time.Now()
-	message := Message{
-		Sender:    sender,
-		Receiver:  msgReq.Receiver,
-		Content:   msgReq.Content,
-		Timestamp: now,
-		IsRead:    false, // New messages are unread by default
+	// Validate the receiver and message content
+	errs, err := validateMessage(&msgReq)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error reading users.json: "+err.Error(), "")
+		return
+	}
+	if len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return
 	}
 	
-	fmt.Printf("Storing message: %s -> %s: %s\n", sender, msgReq.Receiver, msgReq.Content)
-	
-	// Read existing chats from file
-	chatsData := ChatsData{Messages: []Message{}}
+	// Blocked senders, and non-contacts of users who accept messages only
+	// from contacts, can't send anything to the receiver, commands included
+	if !requireMessagingAllowed(w, sender, msgReq.Receiver) {
+		return
+	}
 	
-	// Check if the file exists
-	if _, err := os.Stat("chats.json"); err == nil {
-		// File exists, read it
-		data, err := os.ReadFile("chats.json")
-		if err != nil {
-			http.Error(w, "Error reading chats.json: "+err.Error(), http.StatusInternalServerError)
+	// Run slash commands before anything is stored
+	response := map[string]interface{}{"success": true}
+	if msgReq.Type == "" && strings.HasPrefix(msgReq.Content, "/") {
+		result := runSlashCommand(sender, msgReq.Receiver, msgReq.Content)
+		if result.Reply != "" {
+			response["reply"] = result.Reply // Private to the sender
+		}
+		response["stored"] = result.Store
+		if !result.Store {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(response)
 			return
 		}
+		msgReq.Content = result.Content
 		
-		// Unmarshal existing chat data
-		err = json.Unmarshal(data, &chatsData)
-		if err != nil {
-			http.Error(w, "Error parsing chats.json: "+err.Error(), http.StatusInternalServerError)
+		// What the command made of the message must fit the same limits,
+		// e.g. /me adds the sender's name
+		var errs ValidationErrors
+		validateContent(msgReq.Content, &errs)
+		if len(errs) > 0 {
+			writeValidationErrors(w, errs)
 			return
 		}
-		
-		fmt.Printf("Current number of messages: %d\n", len(chatsData.Messages))
-	} else {
-		fmt.Println("chats.json does not exist yet, creating new file")
 	}
 	
-	// Add the new message
-	chatsData.Messages = append(chatsData.Messages, message)
-	
-	// Write updated chats to file
-	newData, err := json.MarshalIndent(chatsData, "", "  ")
-	if err != nil {
-		http.Error(w, "Error encoding chats data: "+err.Error(), http.StatusInternalServerError)
+	// Messages with a send time are handed to the scheduler
+	if msgReq.SendAt != nil {
+		scheduled, err := scheduleMessage(sender, msgReq.Receiver, msgReq.Content, *msgReq.SendAt)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "internal_error", "Error scheduling message: "+err.Error(), "")
+			return
+		}
+		response["scheduled"] = scheduled
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
 		return
 	}
 	
-	err = os.WriteFile("chats.json", newData, 0644)
-	if err != nil {
-		http.Error(w, "Error writing to chats.json: "+err.Error(), http.StatusInternalServerError)
-		return
+	// Create message
+	now := time.Now()
+	message := Message{
+		Sender:    sender,
+		Receiver:  msgReq.Receiver,
+		Content:   msgReq.Content,
+		Timestamp: now,
+		IsRead:    false, // New messages are unread by default
+		Type:      msgReq.Type,
 	}
 	
-	// Update recent chats
-	updateRecentChats(sender, msgReq.Receiver, msgReq.Content, now, false) // New messages are unread by default
+	if err := storeMessage(message); err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error storing message: "+err.Error(), "")
+		return
+	}
 	
 	fmt.Println("Message stored successfully")
 	
 	// Return success response
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]bool{"success": true})
+	json.NewEncoder(w).Encode(response)
 }
 
 // Handler for retrieving chat messages
 func getMessages(w http.ResponseWriter, r *http.Request) {
 	// Only accept GET requests
 	if r.Method != http.MethodGet {
-		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Invalid request method", "")
 		return
 	}
 	
@@ -568,43 +866,37 @@ func getMessages(w http.ResponseWriter, r *http.Request) {
 	user2 := r.URL.Query().Get("user2")
 	
 	if user1 == "" || user2 == "" {
-		http.Error(w, "Both user IDs are required", http.StatusBadRequest)
+		field := "user1"
+		if user1 != "" {
+			field = "user2"
+		}
+		writeError(w, http.StatusBadRequest, "missing_parameter", "Both user IDs are required", field)
 		return
 	}
 	
-	fmt.Printf("Retrieving chat between %s and %s\n", user1, user2)
-	
-	// Read chats from file
-	chatsData := ChatsData{Messages: []Message{}}
-	
-	// Check if the file exists
-	if _, err := os.Stat("chats.json"); err != nil {
-		// File doesn't exist, no chats yet
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success":  true,
-			"messages": []Message{},
-		})
+	if !requireUser(w, user1, "user1") || !requireUser(w, user2, "user2") {
 		return
 	}
 	
-	// Read the file
-	data, err := os.ReadFile("chats.json")
-	if err != nil {
-		http.Error(w, "Error reading chats.json: "+err.Error(), http.StatusInternalServerError)
-		return
-	}
+	fmt.Printf("Retrieving chat between %s and %s\n", user1, user2)
 	
-	// Unmarshal the chat data
-	err = json.Unmarshal(data, &chatsData)
+	// Read chats, including those not yet checkpointed
+	storeMu.Lock()
+	chatsData, err := loadChats()
+	storeMu.Unlock()
 	if err != nil {
-		http.Error(w, "Error parsing chats.json: "+err.Error(), http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error reading chats: "+err.Error(), "")
 		return
 	}
 	
-	// Filter messages between the two users
+	// Filter messages between the two users, skipping any that expired
+	// since the last sweep
+	now := time.Now()
 	filteredMessages := []Message{}
 	for _, msg := range chatsData.Messages {
+		if msg.Expired(now) {
+			continue
+		}
 		if (msg.Sender == user1 && msg.Receiver == user2) || (msg.Sender == user2 && msg.Receiver == user1) {
 			filteredMessages = append(filteredMessages, msg)
 		}
@@ -624,7 +916,7 @@ func getMessages(w http.ResponseWriter, r *http.Request) {
 func getAllMessages(w http.ResponseWriter, r *http.Request) {
 	// Only accept GET requests
 	if r.Method != http.MethodGet {
-		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Invalid request method", "")
 		return
 	}
 	
@@ -632,97 +924,40 @@ func getAllMessages(w http.ResponseWriter, r *http.Request) {
 	user := r.URL.Query().Get("user")
 	
 	if user == "" {
-		http.Error(w, "User ID is required", http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, "missing_parameter", "User ID is required", "user")
 		return
 	}
 	
-	fmt.Printf("Retrieving all messages for user: %s\n", user)
-	
-	// Read chats from file
-	chatsData := ChatsData{Messages: []Message{}}
-	
-	// Check if the file exists
-	if _, err := os.Stat("chats.json"); err != nil {
-		// File doesn't exist, no chats yet
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": true,
-			"messages": []Message{},
-			"recentChats": []interface{}{},
-		})
+	if !requireUser(w, user, "user") {
 		return
 	}
 	
-	// Read the file
-	data, err := os.ReadFile("chats.json")
-	if err != nil {
-		http.Error(w, "Error reading chats.json: "+err.Error(), http.StatusInternalServerError)
-		return
-	}
+	fmt.Printf("Retrieving all messages for user: %s\n", user)
 	
-	// Unmarshal the chat data
-	err = json.Unmarshal(data, &chatsData)
+	// Read chats, including those not yet checkpointed
+	storeMu.Lock()
+	chatsData, err := loadChats()
+	storeMu.Unlock()
 	if err != nil {
-		http.Error(w, "Error parsing chats.json: "+err.Error(), http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error reading chats: "+err.Error(), "")
 		return
 	}
 	
-	// Filter messages where the user is sender or receiver
+	// Filter messages where the user is sender or receiver, skipping any
+	// that expired since the last sweep
+	now := time.Now()
 	filteredMessages := []Message{}
 	for _, msg := range chatsData.Messages {
+		if msg.Expired(now) {
+			continue
+		}
 		if msg.Sender == user || msg.Receiver == user {
 			filteredMessages = append(filteredMessages, msg)
 		}
 	}
 	
-	// Create a map to aggregate recent chats
-	contactsMap := make(map[string]struct {
-		LastMessage string    `json:"lastMessage"`
-		Timestamp   time.Time `json:"timestamp"`
-	})
-	
-	// Get the most recent message for each contact
-	for _, msg := range filteredMessages {
-		var contactId string
-		
-		if msg.Sender == user {
-			contactId = msg.Receiver
-		} else {
-			contactId = msg.Sender
-		}
-		
-		// If this contact doesn't exist yet, or we have a more recent message
-		if contact, exists := contactsMap[contactId]; !exists || msg.Timestamp.After(contact.Timestamp) {
-			contactsMap[contactId] = struct {
-				LastMessage string    `json:"lastMessage"`
-				Timestamp   time.Time `json:"timestamp"`
-			}{
-				LastMessage: msg.Content,
-				Timestamp:   msg.Timestamp,
-			}
-		}
-	}
-	
-	// Convert map to array and sort by timestamp (newest first)
-	type ContactInfo struct {
-		UserId      string    `json:"userId"`
-		LastMessage string    `json:"lastMessage"`
-		Timestamp   time.Time `json:"timestamp"`
-	}
-	
-	recentChats := []ContactInfo{}
-	for userId, contact := range contactsMap {
-		recentChats = append(recentChats, ContactInfo{
-			UserId:      userId,
-			LastMessage: contact.LastMessage,
-			Timestamp:   contact.Timestamp,
-		})
-	}
-	
-	// Sort by timestamp (newest first)
-	sort.Slice(recentChats, func(i, j int) bool {
-		return recentChats[i].Timestamp.After(recentChats[j].Timestamp)
-	})
+	// Summarize each conversation from its latest message, newest first
+	recentChats := contactSummaries(user, filteredMessages)
 	
 	fmt.Printf("Found %d recent chats for user %s\n", len(recentChats), user)
 	
@@ -739,7 +974,7 @@ func getAllMessages(w http.ResponseWriter, r *http.Request) {
 func getRecentChats(w http.ResponseWriter, r *http.Request) {
 	// Only accept GET requests
 	if r.Method != http.MethodGet {
-		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Invalid request method", "")
 		return
 	}
 	
@@ -747,37 +982,22 @@ func getRecentChats(w http.ResponseWriter, r *http.Request) {
 	userId := r.URL.Query().Get("userId")
 	
 	if userId == "" {
-		http.Error(w, "User ID is required", http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, "missing_parameter", "User ID is required", "userId")
 		return
 	}
 	
-	fmt.Printf("Retrieving recent chats for user: %s\n", userId)
-	
-	// Read recent chats from file
-	recentChatsData := RecentChatsData{Chats: []RecentChat{}}
-	
-	// Check if the file exists
-	if _, err := os.Stat("recentChats.json"); err != nil {
-		// File doesn't exist, no recent chats yet
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": true,
-			"recentChats": []RecentChat{},
-		})
+	if !requireUser(w, userId, "userId") {
 		return
 	}
 	
-	// Read the file
-	data, err := os.ReadFile("recentChats.json")
-	if err != nil {
-		http.Error(w, "Error reading recentChats.json: "+err.Error(), http.StatusInternalServerError)
-		return
-	}
+	fmt.Printf("Retrieving recent chats for user: %s\n", userId)
 	
-	// Unmarshal the recent chats data
-	err = json.Unmarshal(data, &recentChatsData)
+	// Read the index, rebuilding it if it is damaged
+	storeMu.Lock()
+	recentChatsData, err := currentRecentChats()
+	storeMu.Unlock()
 	if err != nil {
-		http.Error(w, "Error parsing recentChats.json: "+err.Error(), http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error reading recent chats: "+err.Error(), "")
 		return
 	}
 	
@@ -796,11 +1016,23 @@ func getRecentChats(w http.ResponseWriter, r *http.Request) {
 	
 	fmt.Printf("Found %d recent chats for user %s\n", len(userRecentChats), userId)
 	
+	// Names and avatars for the sidebar
+	contactIds := make([]string, 0, len(userRecentChats))
+	for _, chat := range userRecentChats {
+		contactIds = append(contactIds, chat.ContactId)
+	}
+	profiles, err := profileSummaries(contactIds)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error reading users.json: "+err.Error(), "")
+		return
+	}
+	
 	// Return recent chats
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"success": true,
 		"recentChats": userRecentChats,
+		"profiles": profiles,
 	})
 }
 
@@ -808,7 +1040,7 @@ func getRecentChats(w http.ResponseWriter, r *http.Request) {
 func markMessagesAsRead(w http.ResponseWriter, r *http.Request) {
 	// Only accept POST requests
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Invalid request method", "")
 		return
 	}
 
@@ -817,34 +1049,27 @@ func markMessagesAsRead(w http.ResponseWriter, r *http.Request) {
 	contactId := r.URL.Query().Get("contact")
 
 	if userId == "" || contactId == "" {
-		http.Error(w, "Missing user or contact ID", http.StatusBadRequest)
+		field := "user"
+		if userId != "" {
+			field = "contact"
+		}
+		writeError(w, http.StatusBadRequest, "missing_parameter", "Missing user or contact ID", field)
 		return
 	}
 
-	fmt.Printf("Marking messages from %s to %s as read\n", contactId, userId)
-	
-	// Read chats from file
-	chatsData := ChatsData{Messages: []Message{}}
-	
-	// Check if the file exists
-	if _, err := os.Stat("chats.json"); err != nil {
-		// File doesn't exist, no messages to mark as read
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]bool{"success": true})
+	if !requireUser(w, userId, "user") || !requireUser(w, contactId, "contact") {
 		return
 	}
+
+	fmt.Printf("Marking messages from %s to %s as read\n", contactId, userId)
 	
-	// Read the file
-	data, err := os.ReadFile("chats.json")
-	if err != nil {
-		http.Error(w, "Error reading chats.json: "+err.Error(), http.StatusInternalServerError)
-		return
-	}
+	storeMu.Lock()
+	defer storeMu.Unlock()
 	
-	// Unmarshal the chat data
-	err = json.Unmarshal(data, &chatsData)
+	// Read chats, including those not yet checkpointed
+	chatsData, err := loadChats()
 	if err != nil {
-		http.Error(w, "Error parsing chats.json: "+err.Error(), http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error reading chats: "+err.Error(), "")
 		return
 	}
 	
@@ -859,60 +1084,37 @@ func markMessagesAsRead(w http.ResponseWriter, r *http.Request) {
 	}
 	
 	if messagesMarked {
-		// Write updated chats to file
-		newData, err := json.MarshalIndent(chatsData, "", "  ")
-		if err != nil {
-			http.Error(w, "Error encoding chats data: "+err.Error(), http.StatusInternalServerError)
+		// Write updated chats to file, which also checkpoints the log
+		if err := saveChats(chatsData); err != nil {
+			writeError(w, http.StatusInternalServerError, "internal_error", "Error saving chats: "+err.Error(), "")
 			return
 		}
 		
-		err = os.WriteFile("chats.json", newData, 0644)
+		// Now update the recent chats to reflect read status
+		recentChatsData, err := currentRecentChats()
 		if err != nil {
-			http.Error(w, "Error writing to chats.json: "+err.Error(), http.StatusInternalServerError)
+			writeError(w, http.StatusInternalServerError, "internal_error", "Error reading recent chats: "+err.Error(), "")
 			return
 		}
 		
-		// Now update the recent chats to reflect read status
-		recentChatsData := RecentChatsData{Chats: []RecentChat{}}
-		
-		// Check if the recent chats file exists
-		if _, err := os.Stat("recentChats.json"); err == nil {
-			// File exists, read it
-			data, err := os.ReadFile("recentChats.json")
-			if err != nil {
-				http.Error(w, "Error reading recentChats.json: "+err.Error(), http.StatusInternalServerError)
-				return
-			}
-			
-			// Unmarshal existing recent chats data
-			err = json.Unmarshal(data, &recentChatsData)
-			if err != nil {
-				http.Error(w, "Error parsing recentChats.json: "+err.Error(), http.StatusInternalServerError)
-				return
-			}
-			
-			// Update the read status for the user's chat with the contact
-			for i, chat := range recentChatsData.Chats {
-				if chat.UserId == userId && chat.ContactId == contactId {
-					recentChatsData.Chats[i].IsRead = true
-					break
-				}
-			}
-			
-			// Write updated recent chats to file
-			newData, err := json.MarshalIndent(recentChatsData, "", "  ")
-			if err != nil {
-				http.Error(w, "Error encoding recent chats data: "+err.Error(), http.StatusInternalServerError)
-				return
-			}
-			
-			err = os.WriteFile("recentChats.json", newData, 0644)
-			if err != nil {
-				http.Error(w, "Error writing to recentChats.json: "+err.Error(), http.StatusInternalServerError)
-				return
+		// Update the read status for the user's chat with the contact
+		for i, chat := range recentChatsData.Chats {
+			if chat.UserId == userId && chat.ContactId == contactId {
+				recentChatsData.Chats[i].IsRead = true
+				break
 			}
 		}
 		
+		if err := saveRecentChats(recentChatsData); err != nil {
+			recentChatsStale = true
+			fmt.Println("Error updating recent chats, will rebuild:", err)
+		}
+		
+		// Let the user's other devices and the sender's devices catch up
+		if err := recordChange(Change{Type: changeRead, Users: []string{userId, contactId}, UserId: userId, ContactId: contactId}); err != nil {
+			fmt.Println("Error recording change for sync:", err)
+		}
+		
 		fmt.Println("Messages marked as read successfully")
 	}
 	
@@ -922,25 +1124,77 @@ func markMessagesAsRead(w http.ResponseWriter, r *http.Request) {
 }
 
 func main() {
-	// Setup route handlers
+	flag.DurationVar(&snapshotInterval, "snapshot-interval", snapshotInterval, "How often to snapshot the data files while running (0 disables)")
+	flag.IntVar(&snapshotKeep, "snapshot-keep", snapshotKeep, "Number of snapshots to keep")
+	flag.DurationVar(&checkpointInterval, "checkpoint-interval", checkpointInterval, "How often to fold chats.log into chats.json (0 leaves it to -checkpoint-records)")
+	flag.IntVar(&checkpointRecords, "checkpoint-records", checkpointRecords, "Fold chats.log into chats.json once it holds this many messages")
+	keyFile := flag.String("encryption-keys", "", "Key ring `file` for encrypting messages at rest (default $"+encryptionKeysEnv+")")
+	flag.DurationVar(&syncHistory, "sync-history", syncHistory, "How long to keep changes for devices to sync")
+	smtpAddr := flag.String("smtp", "", "SMTP server `host:port` for outgoing mail; credentials come from $"+smtpUserEnv+" and $"+smtpPasswordEnv+" (default: mail is only logged)")
+	mailFile := flag.String("mail-file", "", "Append outgoing mail to this mbox `file` instead of sending it")
+	mailFrom := flag.String("mail-from", "goChat <noreply@localhost>", "Sender `address` of outgoing mail")
+	flag.StringVar(&publicURL, "public-url", publicURL, "Base URL of the server, used in links sent by email")
+	flag.Parse()
+	
+	if err := loadEncryptionKeys(*keyFile); err != nil {
+		fmt.Println("Error loading encryption keys:", err)
+		os.Exit(1)
+	}
+	if err := configureMailer(*smtpAddr, *mailFile, *mailFrom); err != nil {
+		fmt.Println("Error configuring mail:", err)
+		os.Exit(1)
+	}
+	if id := activeKeyID(); id != "" {
+		fmt.Printf("Encrypting messages at rest with key %s (%d keys loaded)\n", id, len(encryptionKeys))
+	}
+	
+	// Messages logged before a crash go back into chats.json before anything reads it
+	if err := recoverMessageLog(); err != nil {
+		fmt.Println("Error recovering the message log:", err)
+		os.Exit(1)
+	}
+	
+	// Setup route handlers. The JSON endpoints below are legacy aliases of /api/v1.
 	http.HandleFunc("/", serveIndex)
 	http.HandleFunc("/dashboard", serveDashboard)
 	http.HandleFunc("/redirect", serveRedirect)
 	http.HandleFunc("/test", serveTestPage)
 	http.HandleFunc("/goto-dashboard", dashboardRedirect) // New direct redirect endpoint
+	http.HandleFunc("/admin", adminOnly(serveAdmin))
 	http.Handle("/register", enableCORS(http.HandlerFunc(registerUser)))
 	http.Handle("/login", enableCORS(http.HandlerFunc(loginUser)))
+	http.Handle("/login/totp", enableCORS(http.HandlerFunc(loginTOTP)))
 	http.Handle("/search-users", enableCORS(http.HandlerFunc(searchUsers)))
 	http.Handle("/send-message", enableCORS(http.HandlerFunc(sendMessage)))
 	http.Handle("/get-messages", enableCORS(http.HandlerFunc(getMessages)))
 	http.Handle("/get-all-messages", enableCORS(http.HandlerFunc(getAllMessages)))
 	http.Handle("/get-recent-chats", enableCORS(http.HandlerFunc(getRecentChats)))
 	http.Handle("/mark-messages-read", enableCORS(http.HandlerFunc(markMessagesAsRead)))
+	http.Handle("/api/v1/", enableCORS(setupAPIv1()))
+	http.Handle("/openapi.json", enableCORS(http.HandlerFunc(serveOpenAPI)))
 	
 	// Setup static file serving
 	setupStaticFiles()
 	
+	// recentChats.json is derived from the messages; repair it before serving
+	if err := ensureRecentChats(); err != nil {
+		fmt.Println("Error checking recent chats:", err)
+		os.Exit(1)
+	}
+	if err := trimChangeLog(time.Now()); err != nil {
+		fmt.Println("Error trimming the change log:", err)
+		os.Exit(1)
+	}
+	
+	// Deliver scheduled messages, remove expired ones, apply retention, take snapshots, checkpoint the message log and trim the change log in the background
+	startScheduler()
+	startSweeper()
+	startCompactor()
+	startSnapshotter()
+	startCheckpointer()
+	startChangeLogTrimmer()
+	
 	// Start the server
 	fmt.Println("Server running on http://localhost:8080")
-	http.ListenAndServe(":8080", nil)
+	http.ListenAndServe(":8080", enforceSessions(http.DefaultServeMux))
 }
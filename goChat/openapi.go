@@ -0,0 +1,1032 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The OpenAPI document is generated from the same structs the handlers
+// encode and decode, so renaming a JSON field changes the spec with it.
+// TestOpenAPIResponses exercises the real handlers and validates their
+// responses against the document.
+
+// schemaObject is a JSON schema fragment
+type schemaObject map[string]interface{}
+
+// Types published under components/schemas
+var openAPIComponents = map[string]reflect.Type{
+	"User":                  reflect.TypeOf(User{}),
+	"SearchRequest":         reflect.TypeOf(SearchRequest{}),
+	"Message":               reflect.TypeOf(Message{}),
+	"MessageRequest":        reflect.TypeOf(MessageRequest{}),
+	"RecentChat":            reflect.TypeOf(RecentChat{}),
+	"ContactInfo":           reflect.TypeOf(ContactInfo{}),
+	"APIError":              reflect.TypeOf(APIError{}),
+	"ScheduledMessage":      reflect.TypeOf(ScheduledMessage{}),
+	"DisappearingRequest":   reflect.TypeOf(DisappearingRequest{}),
+	"RetentionRule":         reflect.TypeOf(RetentionRule{}),
+	"ConversationExport":    reflect.TypeOf(ConversationExport{}),
+	"AdminUser":             reflect.TypeOf(AdminUser{}),
+	"StorageStats":          reflect.TypeOf(StorageStats{}),
+	"ChangePasswordRequest": reflect.TypeOf(ChangePasswordRequest{}),
+	"SnapshotManifest":      reflect.TypeOf(SnapshotManifest{}),
+	"SignedPrekey":          reflect.TypeOf(SignedPrekey{}),
+	"OneTimePrekey":         reflect.TypeOf(OneTimePrekey{}),
+	"DeviceKeys":            reflect.TypeOf(DeviceKeys{}),
+	"DeviceInfo":            reflect.TypeOf(DeviceInfo{}),
+	"PrekeyBundle":          reflect.TypeOf(PrekeyBundle{}),
+	"PrekeysRequest":        reflect.TypeOf(PrekeysRequest{}),
+	"LoginRequest":          reflect.TypeOf(LoginRequest{}),
+	"SessionInfo":           reflect.TypeOf(SessionInfo{}),
+	"SyncChange":            reflect.TypeOf(SyncChange{}),
+	"ContactList":           reflect.TypeOf(ContactList{}),
+	"ContactPrivacyRequest": reflect.TypeOf(ContactPrivacyRequest{}),
+	"Profile":               reflect.TypeOf(Profile{}),
+	"ProfileSummary":        reflect.TypeOf(ProfileSummary{}),
+	"ProfileUpdate":         reflect.TypeOf(ProfileUpdate{}),
+	"TOTPStatus":            reflect.TypeOf(TOTPStatus{}),
+}
+
+// Build a JSON schema for a Go type using its json struct tags
+func schemaFor(t reflect.Type) schemaObject {
+	// Reference named component types instead of inlining them
+	for name, component := range openAPIComponents {
+		if component == t {
+			return schemaObject{"$ref": "#/components/schemas/" + name}
+		}
+	}
+	return inlineSchemaFor(t)
+}
+
+// Build a schema for a type without substituting a component reference
+func inlineSchemaFor(t reflect.Type) schemaObject {
+	if t == reflect.TypeOf(time.Time{}) {
+		return schemaObject{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return schemaFor(t.Elem())
+	case reflect.String:
+		return schemaObject{"type": "string"}
+	case reflect.Bool:
+		return schemaObject{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return schemaObject{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return schemaObject{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return schemaObject{"type": "array", "items": schemaFor(t.Elem())}
+	case reflect.Map:
+		return schemaObject{"type": "object", "additionalProperties": schemaFor(t.Elem())}
+	case reflect.Struct:
+		properties := schemaObject{}
+		required := []string{}
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			name, opts, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if name == "-" {
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+			properties[name] = schemaFor(field.Type)
+			if !strings.Contains(opts, "omitempty") {
+				required = append(required, name)
+			}
+		}
+		schema := schemaObject{"type": "object", "properties": properties}
+		if len(required) > 0 {
+			schema["required"] = required
+		}
+		return schema
+	}
+	return schemaObject{}
+}
+
+// Build an object schema for a {"success": true, ...} response envelope
+func envelopeSchema(fields map[string]schemaObject) schemaObject {
+	properties := schemaObject{"success": schemaObject{"type": "boolean"}}
+	required := []string{"success"}
+	for name, schema := range fields {
+		properties[name] = schema
+		required = append(required, name)
+	}
+	sort.Strings(required)
+	return schemaObject{"type": "object", "properties": properties, "required": required}
+}
+
+// Schema shared by every error response
+func errorSchema() schemaObject {
+	return schemaObject{
+		"type": "object",
+		"properties": schemaObject{
+			"success": schemaObject{"type": "boolean"},
+			"error":   schemaFor(reflect.TypeOf(APIError{})),
+			"errors":  schemaFor(reflect.TypeOf([]APIError{})),
+		},
+		"required": []string{"error", "success"},
+	}
+}
+
+// Wrap a schema as an application/json media type
+func jsonContent(schema schemaObject) schemaObject {
+	return schemaObject{"application/json": schemaObject{"schema": schema}}
+}
+
+// Describe an operation's responses. Every operation can fail with the
+// uniform error object, using the listed error statuses.
+func responses(success schemaObject, errorStatuses ...int) schemaObject {
+	result := schemaObject{
+		"200": schemaObject{"description": "Success", "content": jsonContent(success)},
+	}
+	for _, status := range errorStatuses {
+		result[fmt.Sprint(status)] = errorResponse(status)
+	}
+	return result
+}
+
+// Describe an error response with the uniform error object
+func errorResponse(status int) schemaObject {
+	return schemaObject{
+		"description": http.StatusText(status),
+		"content":     jsonContent(schemaObject{"$ref": "#/components/schemas/ErrorResponse"}),
+	}
+}
+
+// Describe a required query parameter
+func queryParam(name, description string) schemaObject {
+	return schemaObject{
+		"name":        name,
+		"in":          "query",
+		"required":    true,
+		"description": description,
+		"schema":      schemaObject{"type": "string"},
+	}
+}
+
+// Describe an optional query parameter
+func optionalQueryParam(name, description string) schemaObject {
+	param := queryParam(name, description)
+	param["required"] = false
+	return param
+}
+
+// Build the OpenAPI 3 document for the JSON endpoints
+func buildOpenAPISpec() schemaObject {
+	components := schemaObject{"ErrorResponse": errorSchema()}
+	for name, t := range openAPIComponents {
+		components[name] = inlineSchemaFor(t)
+	}
+
+	userForm := schemaObject{
+		"type": "object",
+		"properties": schemaObject{
+			"username": schemaObject{"type": "string"},
+			"password": schemaObject{"type": "string"},
+			"email":    schemaObject{"type": "string"},
+		},
+	}
+	userBody := schemaObject{
+		"required": true,
+		"content": schemaObject{
+			"application/json":                  schemaObject{"schema": schemaFor(reflect.TypeOf(User{}))},
+			"application/x-www-form-urlencoded": schemaObject{"schema": userForm},
+		},
+	}
+	loginForm := schemaObject{
+		"type": "object",
+		"properties": schemaObject{
+			"username": schemaObject{"type": "string"},
+			"password": schemaObject{"type": "string"},
+			"device":   schemaObject{"type": "string"},
+		},
+	}
+	loginBody := schemaObject{
+		"required": true,
+		"content": schemaObject{
+			"application/json":                  schemaObject{"schema": schemaFor(reflect.TypeOf(LoginRequest{}))},
+			"application/x-www-form-urlencoded": schemaObject{"schema": loginForm},
+		},
+	}
+	successOnly := envelopeSchema(nil)
+
+	// With two-factor authentication on, /login answers 401 totp_required
+	// with a challenge for /login/totp, which creates the session
+	loginResponse := envelopeSchema(map[string]schemaObject{
+		"redirectTo": {"type": "string"},
+		"userId":     {"type": "string"},
+		"email":      {"type": "string"},
+		"token":      {"type": "string"},
+		"sessionId":  {"type": "string"},
+		"syncToken":  {"type": "string"},
+	})
+	loginResponses := responses(loginResponse, 400, 401, 403, 500)
+	challengeSchema := errorSchema()
+	challengeSchema["properties"].(schemaObject)["challenge"] = schemaObject{"type": "string"}
+	loginResponses["401"] = schemaObject{"description": "Wrong credentials, or totp_required with a challenge", "content": jsonContent(challengeSchema)}
+	totpLoginForm := schemaObject{
+		"type": "object",
+		"properties": schemaObject{
+			"challenge": schemaObject{"type": "string"},
+			"code":      schemaObject{"type": "string"},
+		},
+	}
+	totpLoginBody := schemaObject{
+		"required": true,
+		"content": schemaObject{
+			"application/json":                  schemaObject{"schema": schemaFor(reflect.TypeOf(TOTPLoginRequest{}))},
+			"application/x-www-form-urlencoded": schemaObject{"schema": totpLoginForm},
+		},
+	}
+	recoveryCodesResponse := envelopeSchema(map[string]schemaObject{
+		"recoveryCodes": schemaFor(reflect.TypeOf([]string{})),
+	})
+
+	// Slash commands add a private reply and report whether anything was stored
+	sendMessageResponse := envelopeSchema(nil)
+	sendMessageResponse["properties"].(schemaObject)["reply"] = schemaObject{"type": "string"}
+	sendMessageResponse["properties"].(schemaObject)["stored"] = schemaObject{"type": "boolean"}
+	sendMessageResponse["properties"].(schemaObject)["scheduled"] = schemaFor(reflect.TypeOf(ScheduledMessage{}))
+
+	retentionResponse := envelopeSchema(map[string]schemaObject{"retention": schemaFor(reflect.TypeOf(RetentionRule{}))})
+	messagesResponse := envelopeSchema(map[string]schemaObject{"messages": schemaFor(reflect.TypeOf([]Message{}))})
+	exportResponses := responses(schemaFor(reflect.TypeOf(ConversationExport{})), 400, 404, 500)
+	exportContent := exportResponses["200"].(schemaObject)["content"].(schemaObject)
+	exportContent["text/html"] = schemaObject{"schema": schemaObject{"type": "string"}}
+	exportContent["text/plain"] = schemaObject{"schema": schemaObject{"type": "string"}}
+	exportContent["application/zip"] = schemaObject{"schema": schemaObject{"type": "string", "format": "binary"}}
+	ttlResponse := envelopeSchema(map[string]schemaObject{"ttlSeconds": {"type": "integer"}})
+
+	// Admin operations authenticate with an admin's username and password,
+	// plus a session from a two-factor login for admins who have 2FA on
+	adminSecurity := []schemaObject{{"adminBasic": []string{}}}
+	adminTarget := []schemaObject{queryParam("user", "ID of the account to act on")}
+
+	// Session operations authenticate with the token returned by /login
+	sessionSecurity := []schemaObject{{"session": []string{}}, {"sessionCookie": []string{}}}
+	syncResponse := envelopeSchema(map[string]schemaObject{
+		"syncToken": {"type": "string"},
+		"changes":   schemaFor(reflect.TypeOf([]SyncChange{})),
+		"more":      {"type": "boolean"},
+		"reset":     {"type": "boolean"},
+	})
+	syncResponse["properties"].(schemaObject)["recentChats"] = schemaFor(reflect.TypeOf([]RecentChat{}))
+
+	// Profile summaries keyed by user ID, and the avatar image
+	profilesSchema := schemaFor(reflect.TypeOf(map[string]ProfileSummary{}))
+	profileResponse := envelopeSchema(map[string]schemaObject{"profile": schemaFor(reflect.TypeOf(Profile{}))})
+	imageSchema := schemaObject{"schema": schemaObject{"type": "string", "format": "binary"}}
+	avatarResponses := responses(successOnly, 400, 404, 500)
+	avatarResponses["200"] = schemaObject{"description": "Success", "content": schemaObject{"image/png": imageSchema}}
+
+	contactTarget := []schemaObject{queryParam("user", "User ID"), queryParam("contact", "Other user's ID")}
+
+	paths := schemaObject{
+		"/register": schemaObject{
+			"post": schemaObject{
+				"operationId": "registerUser",
+				"summary":     "Register a new user and email a link to verify the address. Form posts are redirected instead of receiving JSON.",
+				"requestBody": userBody,
+				"responses":   responses(successOnly, 400, 409, 500),
+			},
+		},
+		"/login": schemaObject{
+			"post": schemaObject{
+				"operationId": "loginUser",
+				"summary":     "Check a user's credentials and register the device as a session, or ask for a second factor if the user has two-factor authentication on. Form posts are redirected instead of receiving JSON.",
+				"requestBody": loginBody,
+				"responses":   loginResponses,
+			},
+		},
+		"/login/totp": schemaObject{
+			"post": schemaObject{
+				"operationId": "loginTOTP",
+				"summary":     "Answer the challenge from /login with an authenticator or recovery code and register the device as a session. Challenges expire after five minutes or five wrong codes.",
+				"requestBody": totpLoginBody,
+				"responses":   responses(loginResponse, 400, 401, 403, 500),
+			},
+		},
+		"/search-users": schemaObject{
+			"post": schemaObject{
+				"operationId": "searchUsers",
+				"summary":     "Find users whose ID or display name contains the search term, leaving out users the searcher has blocked",
+				"parameters":  []schemaObject{optionalQueryParam("user", "ID of the searching user")},
+				"requestBody": schemaObject{"required": true, "content": jsonContent(schemaFor(reflect.TypeOf(SearchRequest{})))},
+				"responses": responses(envelopeSchema(map[string]schemaObject{
+					"users":    schemaFor(reflect.TypeOf([]User{})),
+					"profiles": profilesSchema,
+				}), 400, 500),
+			},
+		},
+		"/send-message": schemaObject{
+			"post": schemaObject{
+				"operationId": "sendMessage",
+				"summary":     "Send a message from the sender to a receiver, or schedule it when sendAt is set",
+				"parameters":  []schemaObject{queryParam("sender", "ID of the sending user")},
+				"requestBody": schemaObject{"required": true, "content": jsonContent(schemaFor(reflect.TypeOf(MessageRequest{})))},
+				"responses":   responses(sendMessageResponse, 400, 403, 404, 500),
+			},
+		},
+		"/get-messages": schemaObject{
+			"get": schemaObject{
+				"operationId": "getMessages",
+				"summary":     "List the messages exchanged between two users",
+				"parameters":  []schemaObject{queryParam("user1", "First user ID"), queryParam("user2", "Second user ID")},
+				"responses": responses(envelopeSchema(map[string]schemaObject{
+					"messages": schemaFor(reflect.TypeOf([]Message{})),
+				}), 400, 404, 500),
+			},
+		},
+		"/get-all-messages": schemaObject{
+			"get": schemaObject{
+				"operationId": "getAllMessages",
+				"summary":     "List every message sent or received by a user, with a per-contact summary",
+				"parameters":  []schemaObject{queryParam("user", "User ID")},
+				"responses": responses(envelopeSchema(map[string]schemaObject{
+					"messages":    schemaFor(reflect.TypeOf([]Message{})),
+					"recentChats": schemaFor(reflect.TypeOf([]ContactInfo{})),
+				}), 400, 404, 500),
+			},
+		},
+		"/get-recent-chats": schemaObject{
+			"get": schemaObject{
+				"operationId": "getRecentChats",
+				"summary":     "List a user's conversations, newest first, with the contacts' profile summaries",
+				"parameters":  []schemaObject{queryParam("userId", "User ID")},
+				"responses": responses(envelopeSchema(map[string]schemaObject{
+					"recentChats": schemaFor(reflect.TypeOf([]RecentChat{})),
+					"profiles":    profilesSchema,
+				}), 400, 404, 500),
+			},
+		},
+		"/mark-messages-read": schemaObject{
+			"post": schemaObject{
+				"operationId": "markMessagesAsRead",
+				"summary":     "Mark every message from the contact to the user as read",
+				"parameters":  []schemaObject{queryParam("user", "Reading user ID"), queryParam("contact", "Contact whose messages were read")},
+				"responses":   responses(successOnly, 400, 404, 500),
+			},
+		},
+		"/list-scheduled": schemaObject{
+			"get": schemaObject{
+				"operationId": "listScheduled",
+				"summary":     "List the user's pending scheduled messages, soonest first",
+				"parameters":  []schemaObject{queryParam("user", "Sending user ID")},
+				"responses": responses(envelopeSchema(map[string]schemaObject{
+					"scheduled": schemaFor(reflect.TypeOf([]ScheduledMessage{})),
+				}), 400, 500),
+			},
+		},
+		"/cancel-scheduled": schemaObject{
+			"post": schemaObject{
+				"operationId": "cancelScheduled",
+				"summary":     "Cancel one of the user's pending scheduled messages",
+				"parameters":  []schemaObject{queryParam("user", "Sending user ID"), queryParam("id", "Scheduled message ID")},
+				"responses":   responses(successOnly, 400, 404, 500),
+			},
+		},
+		"/get-disappearing": schemaObject{
+			"get": schemaObject{
+				"operationId": "getDisappearing",
+				"summary":     "Read the conversation's disappearing-message timer in seconds (0 means off)",
+				"parameters":  []schemaObject{queryParam("user", "User ID"), queryParam("contact", "Other participant's user ID")},
+				"responses":   responses(ttlResponse, 400, 404, 500),
+			},
+		},
+		"/set-disappearing": schemaObject{
+			"post": schemaObject{
+				"operationId": "setDisappearing",
+				"summary":     "Change the conversation's disappearing-message timer. Either participant may change it.",
+				"parameters":  []schemaObject{queryParam("user", "User changing the timer"), queryParam("contact", "Other participant's user ID")},
+				"requestBody": schemaObject{"required": true, "content": jsonContent(schemaFor(reflect.TypeOf(DisappearingRequest{})))},
+				"responses":   responses(ttlResponse, 400, 404, 500),
+			},
+		},
+		"/get-retention": schemaObject{
+			"get": schemaObject{
+				"operationId": "getRetention",
+				"summary":     "Read the retention rule that applies to the user",
+				"parameters":  []schemaObject{queryParam("user", "User ID")},
+				"responses":   responses(retentionResponse, 400, 404, 500),
+			},
+		},
+		"/set-retention": schemaObject{
+			"post": schemaObject{
+				"operationId": "setRetention",
+				"summary":     "Set how long the user's messages are kept and whether they're archived or deleted afterwards",
+				"parameters":  []schemaObject{queryParam("user", "User ID")},
+				"requestBody": schemaObject{"required": true, "content": jsonContent(schemaFor(reflect.TypeOf(RetentionRule{})))},
+				"responses":   responses(retentionResponse, 400, 404, 500),
+			},
+		},
+		"/get-archived-messages": schemaObject{
+			"get": schemaObject{
+				"operationId": "getArchivedMessages",
+				"summary":     "List the user's archived messages, optionally for one contact, oldest first",
+				"parameters": []schemaObject{
+					queryParam("user", "User ID"),
+					optionalQueryParam("contact", "Only messages exchanged with this contact"),
+				},
+				"responses": responses(messagesResponse, 400, 404, 500),
+			},
+		},
+		"/search-messages": schemaObject{
+			"get": schemaObject{
+				"operationId": "searchMessages",
+				"summary":     "Search the user's messages, including archived ones, newest first",
+				"parameters": []schemaObject{
+					queryParam("user", "User ID"),
+					queryParam("q", "Text to look for, case insensitive"),
+					optionalQueryParam("contact", "Only messages exchanged with this contact"),
+					optionalQueryParam("limit", "Maximum number of results (at most 200)"),
+					optionalQueryParam("archive", `Set to "false" to skip archived messages`),
+				},
+				"responses": responses(messagesResponse, 400, 404, 500),
+			},
+		},
+		"/export-conversation": schemaObject{
+			"get": schemaObject{
+				"operationId": "exportConversation",
+				"summary":     "Download the conversation between the user and a contact, including archived messages",
+				"parameters": []schemaObject{
+					queryParam("user", "User ID"),
+					queryParam("contact", "Contact's user ID"),
+					optionalQueryParam("format", "json (default), html or text"),
+					optionalQueryParam("tz", "IANA time zone for timestamps, e.g. Europe/Berlin (default UTC)"),
+					optionalQueryParam("attachments", `Set to "true" to receive a zip archive`),
+				},
+				"responses": exportResponses,
+			},
+		},
+		"/keys/publish-device": schemaObject{
+			"post": schemaObject{
+				"operationId": "publishDeviceKeys",
+				"summary":     "Publish or replace the public keys of one of the user's devices for end-to-end encryption",
+				"parameters":  []schemaObject{queryParam("user", "User ID")},
+				"requestBody": schemaObject{"required": true, "content": jsonContent(schemaFor(reflect.TypeOf(DeviceKeys{})))},
+				"responses": responses(envelopeSchema(map[string]schemaObject{
+					"device": schemaFor(reflect.TypeOf(DeviceInfo{})),
+				}), 400, 404, 409, 500),
+			},
+		},
+		"/keys/add-prekeys": schemaObject{
+			"post": schemaObject{
+				"operationId": "addPrekeys",
+				"summary":     "Upload more one-time prekeys for a device",
+				"parameters": []schemaObject{
+					queryParam("user", "User ID"),
+					queryParam("device", "Device ID"),
+				},
+				"requestBody": schemaObject{"required": true, "content": jsonContent(schemaFor(reflect.TypeOf(PrekeysRequest{})))},
+				"responses": responses(envelopeSchema(map[string]schemaObject{
+					"prekeysLeft": {"type": "integer"},
+				}), 400, 404, 500),
+			},
+		},
+		"/keys/list-devices": schemaObject{
+			"get": schemaObject{
+				"operationId": "listDevices",
+				"summary":     "List a user's devices and their public keys",
+				"parameters":  []schemaObject{queryParam("user", "User ID")},
+				"responses": responses(envelopeSchema(map[string]schemaObject{
+					"devices": schemaFor(reflect.TypeOf([]DeviceInfo{})),
+				}), 400, 404, 500),
+			},
+		},
+		"/keys/claim-bundles": schemaObject{
+			"post": schemaObject{
+				"operationId": "claimPrekeyBundles",
+				"summary":     "Claim a prekey bundle for each of a user's devices, using up one one-time prekey per device",
+				"parameters": []schemaObject{
+					queryParam("user", "User whose devices to encrypt for"),
+					optionalQueryParam("except", "Device to leave out, usually the caller's own"),
+				},
+				"responses": responses(envelopeSchema(map[string]schemaObject{
+					"bundles": schemaFor(reflect.TypeOf([]PrekeyBundle{})),
+				}), 400, 404, 500),
+			},
+		},
+		"/keys/remove-device": schemaObject{
+			"post": schemaObject{
+				"operationId": "removeDevice",
+				"summary":     "Remove one of the user's devices from the key directory",
+				"parameters": []schemaObject{
+					queryParam("user", "User ID"),
+					queryParam("device", "Device ID"),
+				},
+				"responses": responses(successOnly, 400, 404, 500),
+			},
+		},
+		"/sessions/list": schemaObject{
+			"get": schemaObject{
+				"operationId": "listSessions",
+				"summary":     "List the devices the user is logged in on",
+				"security":    sessionSecurity,
+				"responses": responses(envelopeSchema(map[string]schemaObject{
+					"sessions": schemaFor(reflect.TypeOf([]SessionInfo{})),
+				}), 401, 500),
+			},
+		},
+		"/sessions/revoke": schemaObject{
+			"post": schemaObject{
+				"operationId": "revokeSession",
+				"summary":     "Log out one of the user's devices",
+				"security":    sessionSecurity,
+				"parameters":  []schemaObject{queryParam("id", "Session ID")},
+				"responses":   responses(successOnly, 400, 401, 404, 500),
+			},
+		},
+		"/sessions/revoke-others": schemaObject{
+			"post": schemaObject{
+				"operationId": "revokeOtherSessions",
+				"summary":     "Log out every device of the user except the one making the request",
+				"security":    sessionSecurity,
+				"responses": responses(envelopeSchema(map[string]schemaObject{
+					"revoked": {"type": "integer"},
+				}), 401, 500),
+			},
+		},
+		"/logout": schemaObject{
+			"post": schemaObject{
+				"operationId": "logoutSession",
+				"summary":     "Log out the device making the request",
+				"security":    sessionSecurity,
+				"responses":   responses(successOnly, 401, 500),
+			},
+		},
+		"/sync": schemaObject{
+			"get": schemaObject{
+				"operationId": "syncChanges",
+				"summary":     "Return the new messages and reads since a sync token, with recent chats when anything changed. Reset means the device must reload.",
+				"security":    sessionSecurity,
+				"parameters":  []schemaObject{optionalQueryParam("since", "Sync token from the last sync or login; defaults to where this session left off")},
+				"responses":   responses(syncResponse, 400, 401, 500),
+			},
+		},
+		"/contacts/list": schemaObject{
+			"get": schemaObject{
+				"operationId": "listContacts",
+				"summary":     "List the user's contacts, pending requests, blocked users and whether only contacts may message them",
+				"parameters":  []schemaObject{queryParam("user", "User ID")},
+				"responses": responses(envelopeSchema(map[string]schemaObject{
+					"contacts": schemaFor(reflect.TypeOf(ContactList{})),
+				}), 400, 404, 500),
+			},
+		},
+		"/contacts/request": schemaObject{
+			"post": schemaObject{
+				"operationId": "requestContact",
+				"summary":     "Send a contact request, or accept the contact's pending request to the user",
+				"parameters":  contactTarget,
+				"responses": responses(envelopeSchema(map[string]schemaObject{
+					"status": {"type": "string"},
+				}), 400, 404, 409, 500),
+			},
+		},
+		"/contacts/accept": schemaObject{
+			"post": schemaObject{
+				"operationId": "acceptContact",
+				"summary":     "Accept a contact request sent to the user",
+				"parameters":  contactTarget,
+				"responses":   responses(successOnly, 400, 404, 500),
+			},
+		},
+		"/contacts/remove": schemaObject{
+			"post": schemaObject{
+				"operationId": "removeContact",
+				"summary":     "Remove a contact, decline a request or withdraw one the user sent",
+				"parameters":  contactTarget,
+				"responses":   responses(successOnly, 400, 404, 500),
+			},
+		},
+		"/contacts/block": schemaObject{
+			"post": schemaObject{
+				"operationId": "blockContact",
+				"summary":     "Block a user, ending any contact or request between the two",
+				"parameters":  contactTarget,
+				"responses":   responses(successOnly, 400, 404, 500),
+			},
+		},
+		"/contacts/unblock": schemaObject{
+			"post": schemaObject{
+				"operationId": "unblockContact",
+				"summary":     "Unblock a user",
+				"parameters":  contactTarget,
+				"responses":   responses(successOnly, 400, 404, 500),
+			},
+		},
+		"/contacts/set-privacy": schemaObject{
+			"post": schemaObject{
+				"operationId": "setContactPrivacy",
+				"summary":     "Choose whether the user accepts messages only from contacts",
+				"parameters":  []schemaObject{queryParam("user", "User ID")},
+				"requestBody": schemaObject{"required": true, "content": jsonContent(schemaFor(reflect.TypeOf(ContactPrivacyRequest{})))},
+				"responses": responses(envelopeSchema(map[string]schemaObject{
+					"contactsOnly": {"type": "boolean"},
+				}), 400, 404, 500),
+			},
+		},
+		"/profile/get": schemaObject{
+			"get": schemaObject{
+				"operationId": "getProfile",
+				"summary":     "Read a user's profile",
+				"parameters":  []schemaObject{queryParam("user", "User ID")},
+				"responses":   responses(profileResponse, 400, 404, 500),
+			},
+		},
+		"/profile/update": schemaObject{
+			"post": schemaObject{
+				"operationId": "updateProfile",
+				"summary":     "Change the user's display name, bio, status or time zone. Fields left out are unchanged.",
+				"parameters":  []schemaObject{queryParam("user", "User ID")},
+				"requestBody": schemaObject{"required": true, "content": jsonContent(schemaFor(reflect.TypeOf(ProfileUpdate{})))},
+				"responses":   responses(profileResponse, 400, 404, 500),
+			},
+		},
+		"/profile/upload-avatar": schemaObject{
+			"post": schemaObject{
+				"operationId": "uploadAvatar",
+				"summary":     "Replace the user's avatar. The body is a PNG, JPEG or GIF image of up to 5 MiB, cropped to a square and scaled to 256 pixels.",
+				"parameters":  []schemaObject{queryParam("user", "User ID")},
+				"requestBody": schemaObject{
+					"required": true,
+					"content":  schemaObject{"image/png": imageSchema, "image/jpeg": imageSchema, "image/gif": imageSchema},
+				},
+				"responses": responses(profileResponse, 400, 404, 413, 500),
+			},
+		},
+		"/profile/remove-avatar": schemaObject{
+			"post": schemaObject{
+				"operationId": "removeAvatar",
+				"summary":     "Remove the user's avatar",
+				"parameters":  []schemaObject{queryParam("user", "User ID")},
+				"responses":   responses(profileResponse, 400, 404, 500),
+			},
+		},
+		"/profile/avatar": schemaObject{
+			"get": schemaObject{
+				"operationId": "serveAvatar",
+				"summary":     "Download the user's avatar as PNG",
+				"parameters":  []schemaObject{queryParam("user", "User ID"), optionalQueryParam("v", "Avatar version from avatarUrl; makes the response cacheable")},
+				"responses":   avatarResponses,
+			},
+		},
+		"/change-password": schemaObject{
+			"post": schemaObject{
+				"operationId": "changePassword",
+				"summary":     "Change the user's password, also used to finish an admin-forced reset",
+				"requestBody": schemaObject{"required": true, "content": jsonContent(schemaFor(reflect.TypeOf(ChangePasswordRequest{})))},
+				"responses":   responses(successOnly, 400, 401, 500),
+			},
+		},
+		"/email/verify": schemaObject{
+			"post": schemaObject{
+				"operationId": "verifyEmail",
+				"summary":     "Verify the user's email address with the token from the link mailed at registration. Tokens work once.",
+				"requestBody": schemaObject{"required": true, "content": jsonContent(schemaFor(reflect.TypeOf(VerifyEmailRequest{})))},
+				"responses": responses(envelopeSchema(map[string]schemaObject{
+					"userId": {"type": "string"},
+				}), 400, 500),
+			},
+		},
+		"/email/resend-verification": schemaObject{
+			"post": schemaObject{
+				"operationId": "resendVerification",
+				"summary":     "Email a new verification link, replacing the previous one. One link per minute.",
+				"parameters":  []schemaObject{queryParam("user", "User ID")},
+				"responses":   responses(successOnly, 400, 404, 409, 429, 500),
+			},
+		},
+		"/password/forgot": schemaObject{
+			"post": schemaObject{
+				"operationId": "forgotPassword",
+				"summary":     "Email a password reset link to the account with this user ID or email address, if its address is verified. The reply doesn't say whether an account matched.",
+				"requestBody": schemaObject{"required": true, "content": jsonContent(schemaFor(reflect.TypeOf(ForgotPasswordRequest{})))},
+				"responses":   responses(successOnly, 400, 500),
+			},
+		},
+		"/password/reset": schemaObject{
+			"post": schemaObject{
+				"operationId": "resetPassword",
+				"summary":     "Choose a new password with the token from a reset link and log out every device. Tokens work once and expire after an hour.",
+				"requestBody": schemaObject{"required": true, "content": jsonContent(schemaFor(reflect.TypeOf(ResetPasswordRequest{})))},
+				"responses": responses(envelopeSchema(map[string]schemaObject{
+					"userId": {"type": "string"},
+				}), 400, 500),
+			},
+		},
+		"/2fa/status": schemaObject{
+			"get": schemaObject{
+				"operationId": "getTOTPStatus",
+				"summary":     "Report whether the user has two-factor authentication on and how many recovery codes are left",
+				"parameters":  []schemaObject{queryParam("user", "User ID")},
+				"responses": responses(envelopeSchema(map[string]schemaObject{
+					"totp": schemaFor(reflect.TypeOf(TOTPStatus{})),
+				}), 400, 404, 500),
+			},
+		},
+		"/2fa/setup": schemaObject{
+			"post": schemaObject{
+				"operationId": "setupTOTP",
+				"summary":     "Start two-factor enrollment: create an authenticator secret and return it as an otpauth:// URI and QR code. It takes effect once /2fa/enable confirms a code.",
+				"requestBody": schemaObject{"required": true, "content": jsonContent(schemaFor(reflect.TypeOf(TOTPSetupRequest{})))},
+				"responses": responses(envelopeSchema(map[string]schemaObject{
+					"secret":     {"type": "string"},
+					"otpauthUri": {"type": "string"},
+					"qrCode":     {"type": "string"},
+					"qrText":     {"type": "string"},
+				}), 400, 401, 409, 500),
+			},
+		},
+		"/2fa/enable": schemaObject{
+			"post": schemaObject{
+				"operationId": "enableTOTP",
+				"summary":     "Finish enrollment with a code from the authenticator. Returns recovery codes, shown only this once.",
+				"requestBody": schemaObject{"required": true, "content": jsonContent(schemaFor(reflect.TypeOf(TOTPEnableRequest{})))},
+				"responses":   responses(recoveryCodesResponse, 400, 404, 409, 500),
+			},
+		},
+		"/2fa/disable": schemaObject{
+			"post": schemaObject{
+				"operationId": "disableTOTP",
+				"summary":     "Turn two-factor authentication off with the password and an authenticator or recovery code",
+				"requestBody": schemaObject{"required": true, "content": jsonContent(schemaFor(reflect.TypeOf(TOTPSetupRequest{})))},
+				"responses":   responses(successOnly, 400, 401, 409, 500),
+			},
+		},
+		"/2fa/recovery-codes": schemaObject{
+			"post": schemaObject{
+				"operationId": "regenerateRecoveryCodes",
+				"summary":     "Replace the recovery codes, given the password and an authenticator or recovery code. The old codes stop working.",
+				"requestBody": schemaObject{"required": true, "content": jsonContent(schemaFor(reflect.TypeOf(TOTPSetupRequest{})))},
+				"responses":   responses(recoveryCodesResponse, 400, 401, 409, 500),
+			},
+		},
+		"/admin/list-users": schemaObject{
+			"get": schemaObject{
+				"operationId": "adminListUsers",
+				"summary":     "List every account, bots included",
+				"security":    adminSecurity,
+				"responses": responses(envelopeSchema(map[string]schemaObject{
+					"users": schemaFor(reflect.TypeOf([]AdminUser{})),
+				}), 401, 500),
+			},
+		},
+		"/admin/disable-user": schemaObject{
+			"post": schemaObject{
+				"operationId": "adminDisableUser",
+				"summary":     "Disable an account so it can't log in or send messages",
+				"security":    adminSecurity,
+				"parameters":  adminTarget,
+				"responses":   responses(successOnly, 400, 401, 404, 500),
+			},
+		},
+		"/admin/enable-user": schemaObject{
+			"post": schemaObject{
+				"operationId": "adminEnableUser",
+				"summary":     "Enable a disabled account",
+				"security":    adminSecurity,
+				"parameters":  adminTarget,
+				"responses":   responses(successOnly, 400, 401, 404, 500),
+			},
+		},
+		"/admin/reset-password": schemaObject{
+			"post": schemaObject{
+				"operationId": "adminResetPassword",
+				"summary":     "Replace the account's password with a temporary one that must be changed at the next login",
+				"security":    adminSecurity,
+				"parameters":  adminTarget,
+				"responses": responses(envelopeSchema(map[string]schemaObject{
+					"temporaryPassword": {"type": "string"},
+				}), 400, 401, 404, 500),
+			},
+		},
+		"/admin/reset-2fa": schemaObject{
+			"post": schemaObject{
+				"operationId": "adminResetTOTP",
+				"summary":     "Turn off two-factor authentication for a user who lost their authenticator and recovery codes",
+				"security":    adminSecurity,
+				"parameters":  adminTarget,
+				"responses":   responses(successOnly, 400, 401, 404, 500),
+			},
+		},
+		"/admin/delete-user": schemaObject{
+			"post": schemaObject{
+				"operationId": "adminDeleteUser",
+				"summary":     "Delete an account, the bots it owns and all of their messages, archived ones included",
+				"security":    adminSecurity,
+				"parameters":  adminTarget,
+				"responses": responses(envelopeSchema(map[string]schemaObject{
+					"deletedUsers":    {"type": "integer"},
+					"deletedMessages": {"type": "integer"},
+				}), 400, 401, 404, 500),
+			},
+		},
+		"/admin/stats": schemaObject{
+			"get": schemaObject{
+				"operationId": "adminStats",
+				"summary":     "Account and message counts and the size of the data files",
+				"security":    adminSecurity,
+				"responses": responses(envelopeSchema(map[string]schemaObject{
+					"stats": schemaFor(reflect.TypeOf(StorageStats{})),
+				}), 401, 500),
+			},
+		},
+		"/admin/create-snapshot": schemaObject{
+			"post": schemaObject{
+				"operationId": "adminCreateSnapshot",
+				"summary":     "Take a consistent snapshot of the data files now and rotate old ones",
+				"security":    adminSecurity,
+				"responses": responses(envelopeSchema(map[string]schemaObject{
+					"snapshot": schemaFor(reflect.TypeOf(SnapshotManifest{})),
+				}), 401, 500),
+			},
+		},
+		"/admin/list-snapshots": schemaObject{
+			"get": schemaObject{
+				"operationId": "adminListSnapshots",
+				"summary":     "List the snapshots, newest first",
+				"security":    adminSecurity,
+				"responses": responses(envelopeSchema(map[string]schemaObject{
+					"snapshots": schemaFor(reflect.TypeOf([]SnapshotManifest{})),
+				}), 401, 500),
+			},
+		},
+	}
+
+	// Every other operation acts for the logged-in user: it needs a session,
+	// and answers 403 when the request names a different user
+	for path, item := range paths {
+		for _, operation := range item.(schemaObject) {
+			operation := operation.(schemaObject)
+			if _, ok := operation["security"]; ok || sessionExempt("/api/v1"+path) {
+				continue
+			}
+			operation["security"] = sessionSecurity
+			operationResponses := operation["responses"].(schemaObject)
+			for _, status := range []int{http.StatusUnauthorized, http.StatusForbidden} {
+				if _, ok := operationResponses[fmt.Sprint(status)]; !ok {
+					operationResponses[fmt.Sprint(status)] = errorResponse(status)
+				}
+			}
+		}
+	}
+
+	return schemaObject{
+		"openapi": "3.0.3",
+		"info": schemaObject{
+			"title":   "goChat API",
+			"version": "1.0.0",
+		},
+		// The same paths are served at the root (legacy) and below /api/v1
+		"servers": []schemaObject{
+			{"url": "/api/v1"},
+			{"url": "/"},
+		},
+		"paths": paths,
+		"components": schemaObject{
+			"schemas": components,
+			"securitySchemes": schemaObject{
+				"adminBasic":    schemaObject{"type": "http", "scheme": "basic", "description": "An admin's username and password. Admins with two-factor authentication must also send the session of a login that passed it."},
+				"session":       schemaObject{"type": "apiKey", "in": "header", "name": sessionHeader},
+				"sessionCookie": schemaObject{"type": "apiKey", "in": "cookie", "name": sessionCookie},
+			},
+		},
+	}
+}
+
+// Serve the OpenAPI document
+func serveOpenAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Invalid request method", "")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(buildOpenAPISpec())
+}
+
+// Resolve a local "#/components/schemas/X" reference
+func resolveSchema(spec, schema schemaObject) schemaObject {
+	ref, ok := schema["$ref"].(string)
+	if !ok {
+		return schema
+	}
+	name := strings.TrimPrefix(ref, "#/components/schemas/")
+	components := spec["components"].(schemaObject)["schemas"].(schemaObject)
+	resolved, _ := components[name].(schemaObject)
+	return resolved
+}
+
+// Validate a decoded JSON value against a schema, returning one problem per mismatch
+func validateSchema(spec, schema schemaObject, value interface{}, path string) []string {
+	schema = resolveSchema(spec, schema)
+	if schema == nil {
+		return []string{path + ": unresolvable schema reference"}
+	}
+
+	var problems []string
+	switch schema["type"] {
+	case "object":
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return []string{path + ": expected object"}
+		}
+		required, _ := schema["required"].([]string)
+		for _, name := range required {
+			if _, present := object[name]; !present {
+				problems = append(problems, path+"."+name+": required property missing")
+			}
+		}
+		properties, _ := schema["properties"].(schemaObject)
+		for name, propValue := range object {
+			propSchema, known := properties[name].(schemaObject)
+			if !known {
+				if additional, ok := schema["additionalProperties"].(schemaObject); ok {
+					problems = append(problems, validateSchema(spec, additional, propValue, path+"."+name)...)
+					continue
+				}
+				problems = append(problems, path+"."+name+": property not described by the schema")
+				continue
+			}
+			problems = append(problems, validateSchema(spec, propSchema, propValue, path+"."+name)...)
+		}
+	case "array":
+		array, ok := value.([]interface{})
+		if !ok {
+			return []string{path + ": expected array"}
+		}
+		items, _ := schema["items"].(schemaObject)
+		for i, item := range array {
+			problems = append(problems, validateSchema(spec, items, item, fmt.Sprintf("%s[%d]", path, i))...)
+		}
+	case "string":
+		str, ok := value.(string)
+		if !ok {
+			return []string{path + ": expected string"}
+		}
+		if schema["format"] == "date-time" {
+			if _, err := time.Parse(time.RFC3339Nano, str); err != nil {
+				problems = append(problems, path+": expected RFC 3339 date-time")
+			}
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return []string{path + ": expected boolean"}
+		}
+	case "integer", "number":
+		number, ok := value.(float64)
+		if !ok {
+			return []string{path + ": expected number"}
+		}
+		if schema["type"] == "integer" && number != float64(int64(number)) {
+			problems = append(problems, path+": expected integer")
+		}
+	}
+	return problems
+}
+
+// Validate a recorded response against the document for the given operation
+func validateResponse(spec schemaObject, method, path string, status int, contentType string, body []byte) []string {
+	pathItem, ok := spec["paths"].(schemaObject)[path].(schemaObject)
+	if !ok {
+		return []string{path + ": path is not documented"}
+	}
+	operation, ok := pathItem[strings.ToLower(method)].(schemaObject)
+	if !ok {
+		return []string{method + " " + path + ": method is not documented"}
+	}
+	response, ok := operation["responses"].(schemaObject)[fmt.Sprint(status)].(schemaObject)
+	if !ok {
+		return []string{fmt.Sprintf("%s %s: status %d is not documented", method, path, status)}
+	}
+	// Only JSON bodies are validated; other media types just have to be documented
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	media, ok := response["content"].(schemaObject)[strings.TrimSpace(mediaType)].(schemaObject)
+	if !ok {
+		return []string{fmt.Sprintf("%s %s: content type %q is not documented for status %d", method, path, contentType, status)}
+	}
+	if mediaType != "application/json" {
+		return nil
+	}
+	schema := media["schema"].(schemaObject)
+
+	var value interface{}
+	if err := json.Unmarshal(body, &value); err != nil {
+		return []string{fmt.Sprintf("%s %s: response is not JSON: %v", method, path, err)}
+	}
+	return validateSchema(spec, schema, value, fmt.Sprintf("%s %s (%d)", method, path, status))
+}
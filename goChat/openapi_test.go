@@ -0,0 +1,386 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// openAPICase is one request replayed against the /api/v1 handlers
+type openAPICase struct {
+	method      string
+	path        string // Documented path, without the query string
+	query       string
+	contentType string
+	body        string
+	status      int // Expected status code
+}
+
+// Device keys with a valid signed prekey, and the same keys with the
+// signature over a different prekey
+const (
+	testDeviceKeys   = `{"deviceId":"laptop","identityKey":"aJ9qYnOEx9yy3MFIflQCI+d7353NDYvooybtplsM6aQ=","signingKey":"4/Ur4Kc7d0r99gK+1pTcACAajnQAq12lAM8mGCuyEwQ=","signedPrekey":{"id":1,"publicKey":"oEdmMRlmXzGjRX/F8EFKPlCRiI6xsr2m7gZvydCveMg=","signature":"C0FwAoIpj10R1d66Si3e/WFT/k3OEQ32wNAGZjaOvjZu61bN7ZfThNWHkKwAmKZq/4jqRoinNPaCXIvPHkENAg=="},"oneTimePrekeys":[{"id":1,"publicKey":"g5IkSvzfz2o0rrtLNVRK5oby3GWdMI3X7sh6EEgAqEE="}]}`
+	testForgedPrekey = `{"deviceId":"laptop","identityKey":"aJ9qYnOEx9yy3MFIflQCI+d7353NDYvooybtplsM6aQ=","signingKey":"4/Ur4Kc7d0r99gK+1pTcACAajnQAq12lAM8mGCuyEwQ=","signedPrekey":{"id":1,"publicKey":"g5IkSvzfz2o0rrtLNVRK5oby3GWdMI3X7sh6EEgAqEE=","signature":"C0FwAoIpj10R1d66Si3e/WFT/k3OEQ32wNAGZjaOvjZu61bN7ZfThNWHkKwAmKZq/4jqRoinNPaCXIvPHkENAg=="}}`
+)
+
+// A 3x2 PNG for the avatar upload
+const testAvatarPNG = "\x89\x50\x4e\x47\x0d\x0a\x1a\x0a\x00\x00\x00\x0d\x49\x48\x44\x52\x00\x00\x00\x03\x00\x00\x00\x02\x08\x02\x00\x00\x00\x12\x16\xf1\x4d\x00\x00\x00\x10\x49\x44\x41\x54\x78\x9c\x63\xf8\xcf\xc0\xc0\x00\xc1\x70\x16\x00\x3b\xd8\x05\xfb\xde\x10\x37\x65\x00\x00\x00\x00\x49\x45\x4e\x44\xae\x42\x60\x82"
+
+// Independent scenarios covering every documented operation and its main
+// failure modes. Each starts from the seeded users in its own data
+// directory; the cases within a scenario run in order.
+var openAPIScenarios = []struct {
+	name  string
+	cases []openAPICase
+}{
+	// Registration, login and user search
+	{"accounts", []openAPICase{
+		{http.MethodPost, "/register", "", "application/json", `{"userId":"carol","email":"carol@example.com","password":"carol1234"}`, http.StatusOK},
+		{http.MethodPost, "/register", "", "application/json", `{"userId":"alice","email":"alice@example.com","password":"alice1234"}`, http.StatusConflict},
+		{http.MethodPost, "/register", "", "application/json", `{"userId":"","email":"nope","password":"x"}`, http.StatusBadRequest},
+		{http.MethodPost, "/login", "", "application/json", `{"userId":"alice","password":"alice1234"}`, http.StatusOK},
+		{http.MethodPost, "/login", "", "application/json", `{"userId":"alice","password":"wrong"}`, http.StatusUnauthorized},
+		{http.MethodPost, "/search-users", "", "application/json", `{"searchTerm":"a"}`, http.StatusOK},
+		{http.MethodPost, "/search-users", "", "application/json", `not json`, http.StatusBadRequest},
+	}},
+	// Sending, reading and listing messages
+	{"messages", []openAPICase{
+		{http.MethodPost, "/send-message", "sender=alice", "application/json", `{"receiver":"bob","content":"hello"}`, http.StatusOK},
+		{http.MethodPost, "/send-message", "sender=alice", "application/json", `{"receiver":"ghost","content":"hello"}`, http.StatusNotFound},
+		{http.MethodPost, "/send-message", "sender=alice", "application/json", `{"receiver":"bob","content":"   "}`, http.StatusBadRequest},
+		{http.MethodPost, "/send-message", "sender=alice", "application/json", `{"receiver":"bob","content":"/help"}`, http.StatusOK},
+		{http.MethodPost, "/send-message", "sender=alice", "application/json", `{"receiver":"bob","content":"later","sendAt":"2001-01-01T00:00:00Z"}`, http.StatusBadRequest},
+		{http.MethodPost, "/send-message", "sender=alice", "application/json", `{"receiver":"bob","content":"/remind 1h stretch"}`, http.StatusOK},
+		{http.MethodGet, "/get-messages", "user1=alice&user2=bob", "", "", http.StatusOK},
+		{http.MethodGet, "/get-messages", "user1=alice", "", "", http.StatusBadRequest},
+		{http.MethodGet, "/get-messages", "user1=alice&user2=ghost", "", "", http.StatusNotFound},
+		{http.MethodGet, "/get-all-messages", "user=alice", "", "", http.StatusOK},
+		{http.MethodGet, "/get-all-messages", "user=ghost", "", "", http.StatusNotFound},
+		{http.MethodGet, "/get-recent-chats", "userId=bob", "", "", http.StatusOK},
+		{http.MethodGet, "/get-recent-chats", "", "", "", http.StatusBadRequest},
+		{http.MethodPost, "/mark-messages-read", "user=bob&contact=alice", "", "", http.StatusOK},
+		{http.MethodPost, "/mark-messages-read", "user=bob&contact=ghost", "", "", http.StatusNotFound},
+	}},
+	// Scheduled messages
+	{"scheduled", []openAPICase{
+		{http.MethodGet, "/list-scheduled", "user=alice", "", "", http.StatusOK},
+		{http.MethodGet, "/list-scheduled", "", "", "", http.StatusBadRequest},
+		{http.MethodPost, "/cancel-scheduled", "user=alice&id=missing", "", "", http.StatusNotFound},
+		{http.MethodPost, "/cancel-scheduled", "user=alice", "", "", http.StatusBadRequest},
+	}},
+	// Disappearing messages
+	{"disappearing", []openAPICase{
+		{http.MethodPost, "/set-disappearing", "user=alice&contact=bob", "application/json", `{"ttlSeconds":3600}`, http.StatusOK},
+		{http.MethodPost, "/set-disappearing", "user=alice&contact=bob", "application/json", `{"ttlSeconds":5}`, http.StatusBadRequest},
+		{http.MethodPost, "/set-disappearing", "user=alice&contact=ghost", "application/json", `{"ttlSeconds":0}`, http.StatusNotFound},
+		{http.MethodGet, "/get-disappearing", "user=bob&contact=alice", "", "", http.StatusOK},
+		{http.MethodGet, "/get-disappearing", "user=bob", "", "", http.StatusBadRequest},
+	}},
+	// Retention, the archive, search and export
+	{"retention", []openAPICase{
+		{http.MethodPost, "/send-message", "sender=alice", "application/json", `{"receiver":"bob","content":"hello"}`, http.StatusOK},
+		{http.MethodPost, "/set-retention", "user=alice", "application/json", `{"days":30,"action":"archive"}`, http.StatusOK},
+		{http.MethodPost, "/set-retention", "user=alice", "application/json", `{"days":30,"action":"shred"}`, http.StatusBadRequest},
+		{http.MethodGet, "/get-retention", "user=alice", "", "", http.StatusOK},
+		{http.MethodGet, "/get-retention", "user=ghost", "", "", http.StatusNotFound},
+		{http.MethodGet, "/get-archived-messages", "user=alice&contact=bob", "", "", http.StatusOK},
+		{http.MethodGet, "/get-archived-messages", "", "", "", http.StatusBadRequest},
+		{http.MethodGet, "/search-messages", "user=alice&q=HELLO", "", "", http.StatusOK},
+		{http.MethodGet, "/search-messages", "user=alice", "", "", http.StatusBadRequest},
+		{http.MethodGet, "/export-conversation", "user=alice&contact=bob", "", "", http.StatusOK},
+		{http.MethodGet, "/export-conversation", "user=alice&contact=bob&format=html&tz=Asia/Kolkata", "", "", http.StatusOK},
+		{http.MethodGet, "/export-conversation", "user=alice&contact=bob&format=text&attachments=true", "", "", http.StatusOK},
+		{http.MethodGet, "/export-conversation", "user=alice&contact=bob&tz=Mars/Olympus", "", "", http.StatusBadRequest},
+		{http.MethodGet, "/export-conversation", "user=alice&contact=ghost", "", "", http.StatusNotFound},
+	}},
+	// End-to-end encryption keys and encrypted messages
+	{"keys", []openAPICase{
+		{http.MethodPost, "/keys/publish-device", "user=bob", "application/json", testDeviceKeys, http.StatusOK},
+		{http.MethodPost, "/keys/publish-device", "user=alice", "application/json", testForgedPrekey, http.StatusBadRequest},
+		{http.MethodPost, "/keys/publish-device", "user=ghost", "application/json", testDeviceKeys, http.StatusNotFound},
+		{http.MethodPost, "/keys/add-prekeys", "user=bob&device=laptop", "application/json", `{"oneTimePrekeys":[{"id":2,"publicKey":"g5IkSvzfz2o0rrtLNVRK5oby3GWdMI3X7sh6EEgAqEE="}]}`, http.StatusOK},
+		{http.MethodPost, "/keys/add-prekeys", "user=bob&device=laptop", "application/json", `{"oneTimePrekeys":[{"id":1,"publicKey":"g5IkSvzfz2o0rrtLNVRK5oby3GWdMI3X7sh6EEgAqEE="}]}`, http.StatusBadRequest},
+		{http.MethodPost, "/keys/add-prekeys", "user=bob&device=phone", "application/json", `{"oneTimePrekeys":[]}`, http.StatusNotFound},
+		{http.MethodGet, "/keys/list-devices", "user=bob", "", "", http.StatusOK},
+		{http.MethodGet, "/keys/list-devices", "", "", "", http.StatusBadRequest},
+		{http.MethodGet, "/keys/list-devices", "user=ghost", "", "", http.StatusNotFound},
+		{http.MethodPost, "/keys/claim-bundles", "user=bob", "", "", http.StatusOK},
+		{http.MethodPost, "/keys/claim-bundles", "user=bob&except=laptop", "", "", http.StatusOK},
+		{http.MethodPost, "/keys/claim-bundles", "user=ghost", "", "", http.StatusNotFound},
+		{http.MethodPost, "/send-message", "sender=alice", "application/json", `{"receiver":"bob","content":"eyJ2IjoxfQ==","type":"e2e"}`, http.StatusOK},
+		{http.MethodPost, "/send-message", "sender=alice", "application/json", `{"receiver":"bob","content":"not base64!","type":"e2e"}`, http.StatusBadRequest},
+		{http.MethodPost, "/send-message", "sender=alice", "application/json", `{"receiver":"bob","content":"hello","type":"pgp"}`, http.StatusBadRequest},
+		{http.MethodPost, "/keys/remove-device", "user=bob&device=laptop", "", "", http.StatusOK},
+		{http.MethodPost, "/keys/remove-device", "user=bob&device=laptop", "", "", http.StatusNotFound},
+	}},
+	// Sessions and sync, starting from a fresh login
+	{"sessions", []openAPICase{
+		{http.MethodPost, "/login", "", "application/json", `{"userId":"alice","password":"alice1234"}`, http.StatusOK},
+		{http.MethodGet, "/sync", "", "", "", http.StatusOK},
+		{http.MethodGet, "/sync", "since=abc", "", "", http.StatusBadRequest},
+		{http.MethodGet, "/sync", "since=999999", "", "", http.StatusOK},
+		{http.MethodGet, "/sessions/list", "", "", "", http.StatusOK},
+		{http.MethodPost, "/sessions/revoke", "id=missing", "", "", http.StatusNotFound},
+		{http.MethodPost, "/sessions/revoke", "", "", "", http.StatusBadRequest},
+		{http.MethodPost, "/login", "", "application/json", `{"userId":"alice","password":"alice1234","deviceName":"Laptop"}`, http.StatusOK},
+		{http.MethodPost, "/sessions/revoke-others", "", "", "", http.StatusOK},
+		{http.MethodPost, "/logout", "", "", "", http.StatusOK},
+		{http.MethodPost, "/logout", "", "", "", http.StatusUnauthorized},
+		{http.MethodGet, "/sync", "", "", "", http.StatusUnauthorized},
+	}},
+	// Contacts and privacy; carol is a stranger to bob
+	{"contacts", []openAPICase{
+		{http.MethodPost, "/register", "", "application/json", `{"userId":"carol","email":"carol@example.com","password":"carol1234"}`, http.StatusOK},
+		{http.MethodPost, "/contacts/request", "user=alice&contact=bob", "", "", http.StatusOK},
+		{http.MethodPost, "/contacts/request", "user=alice&contact=alice", "", "", http.StatusBadRequest},
+		{http.MethodPost, "/contacts/request", "user=alice&contact=ghost", "", "", http.StatusNotFound},
+		{http.MethodPost, "/contacts/accept", "user=bob&contact=alice", "", "", http.StatusOK},
+		{http.MethodPost, "/contacts/accept", "user=bob&contact=alice", "", "", http.StatusNotFound},
+		{http.MethodPost, "/contacts/set-privacy", "user=bob", "application/json", `{"contactsOnly":true}`, http.StatusOK},
+		{http.MethodPost, "/contacts/set-privacy", "user=bob", "application/json", `{`, http.StatusBadRequest},
+		{http.MethodPost, "/send-message", "sender=carol", "application/json", `{"receiver":"bob","content":"hi"}`, http.StatusForbidden},
+		{http.MethodPost, "/send-message", "sender=alice", "application/json", `{"receiver":"bob","content":"hi"}`, http.StatusOK},
+		{http.MethodPost, "/contacts/block", "user=bob&contact=carol", "", "", http.StatusOK},
+		{http.MethodPost, "/contacts/block", "user=bob", "", "", http.StatusBadRequest},
+		{http.MethodPost, "/contacts/request", "user=carol&contact=bob", "", "", http.StatusOK},
+		{http.MethodPost, "/contacts/request", "user=bob&contact=carol", "", "", http.StatusConflict},
+		{http.MethodPost, "/search-users", "user=bob", "application/json", `{"searchTerm":"carol"}`, http.StatusOK},
+		{http.MethodGet, "/contacts/list", "user=bob", "", "", http.StatusOK},
+		{http.MethodGet, "/contacts/list", "", "", "", http.StatusBadRequest},
+		{http.MethodGet, "/contacts/list", "user=ghost", "", "", http.StatusNotFound},
+		{http.MethodPost, "/contacts/unblock", "user=bob&contact=carol", "", "", http.StatusOK},
+		{http.MethodPost, "/contacts/unblock", "user=bob&contact=carol", "", "", http.StatusNotFound},
+		{http.MethodPost, "/contacts/remove", "user=bob&contact=alice", "", "", http.StatusOK},
+		{http.MethodPost, "/contacts/remove", "user=bob&contact=alice", "", "", http.StatusNotFound},
+		{http.MethodPost, "/contacts/set-privacy", "user=bob", "application/json", `{"contactsOnly":false}`, http.StatusOK},
+	}},
+	// Profiles and avatars
+	{"profiles", []openAPICase{
+		{http.MethodPost, "/profile/update", "user=alice", "application/json", `{"displayName":"Alice Liddell","bio":"Curiouser and curiouser","timezone":"Europe/London"}`, http.StatusOK},
+		{http.MethodPost, "/profile/update", "user=alice", "application/json", `{"timezone":"Mars/Olympus"}`, http.StatusBadRequest},
+		{http.MethodPost, "/profile/update", "user=ghost", "application/json", `{}`, http.StatusNotFound},
+		{http.MethodGet, "/profile/get", "user=alice", "", "", http.StatusOK},
+		{http.MethodGet, "/profile/get", "", "", "", http.StatusBadRequest},
+		{http.MethodGet, "/profile/avatar", "user=alice", "", "", http.StatusNotFound},
+		{http.MethodPost, "/profile/upload-avatar", "user=alice", "image/png", testAvatarPNG, http.StatusOK},
+		{http.MethodPost, "/profile/upload-avatar", "user=alice", "image/png", "not an image", http.StatusBadRequest},
+		{http.MethodGet, "/profile/avatar", "user=alice", "", "", http.StatusOK},
+		{http.MethodPost, "/search-users", "", "application/json", `{"searchTerm":"liddell"}`, http.StatusOK},
+		{http.MethodGet, "/get-recent-chats", "userId=bob", "", "", http.StatusOK},
+		{http.MethodPost, "/profile/remove-avatar", "user=alice", "", "", http.StatusOK},
+		{http.MethodPost, "/profile/remove-avatar", "", "", "", http.StatusBadRequest},
+	}},
+	// Email verification and password reset for a new account
+	{"email", []openAPICase{
+		{http.MethodPost, "/register", "", "application/json", `{"userId":"carol","email":"carol@example.com","password":"carol1234"}`, http.StatusOK},
+		{http.MethodPost, "/email/verify", "", "application/json", `{"token":"{verify-token}"}`, http.StatusOK},
+		{http.MethodPost, "/email/verify", "", "application/json", `{"token":"{verify-token}"}`, http.StatusBadRequest},
+		{http.MethodPost, "/email/resend-verification", "user=carol", "", "", http.StatusConflict},
+		{http.MethodPost, "/email/resend-verification", "user=alice", "", "", http.StatusOK},
+		{http.MethodPost, "/email/resend-verification", "user=alice", "", "", http.StatusTooManyRequests},
+		{http.MethodPost, "/email/resend-verification", "user=ghost", "", "", http.StatusNotFound},
+		{http.MethodPost, "/password/forgot", "", "application/json", `{"login":"carol@example.com"}`, http.StatusOK},
+		{http.MethodPost, "/password/forgot", "", "application/json", `{"login":"ghost"}`, http.StatusOK},
+		{http.MethodPost, "/password/forgot", "", "application/json", `{"login":""}`, http.StatusBadRequest},
+		{http.MethodPost, "/password/reset", "", "application/json", `{"token":"{reset-token}","newPassword":"short"}`, http.StatusBadRequest},
+		{http.MethodPost, "/password/reset", "", "application/json", `{"token":"{reset-token}","newPassword":"carol5678"}`, http.StatusOK},
+		{http.MethodPost, "/password/reset", "", "application/json", `{"token":"{reset-token}","newPassword":"carol9012"}`, http.StatusBadRequest},
+	}},
+	// Two-factor setup, login and recovery codes
+	{"two-factor", []openAPICase{
+		{http.MethodPost, "/register", "", "application/json", `{"userId":"carol","email":"carol@example.com","password":"carol5678"}`, http.StatusOK},
+		{http.MethodGet, "/2fa/status", "user=carol", "", "", http.StatusOK},
+		{http.MethodGet, "/2fa/status", "user=ghost", "", "", http.StatusNotFound},
+		{http.MethodPost, "/2fa/enable", "", "application/json", `{"userId":"carol","code":"123456"}`, http.StatusBadRequest},
+		{http.MethodPost, "/2fa/setup", "", "application/json", `{"userId":"carol","password":"wrong"}`, http.StatusUnauthorized},
+		{http.MethodPost, "/2fa/setup", "", "application/json", `{"userId":"carol","password":"carol5678"}`, http.StatusOK},
+		{http.MethodPost, "/2fa/enable", "", "application/json", `{"userId":"carol","code":"abcdef"}`, http.StatusBadRequest},
+		{http.MethodPost, "/2fa/enable", "", "application/json", `{"userId":"carol","code":"{totp-code}"}`, http.StatusOK},
+		{http.MethodPost, "/2fa/enable", "", "application/json", `{"userId":"ghost","code":"{totp-code}"}`, http.StatusNotFound},
+		{http.MethodPost, "/2fa/setup", "", "application/json", `{"userId":"carol","password":"carol5678"}`, http.StatusConflict},
+		{http.MethodPost, "/login", "", "application/json", `{"userId":"carol","password":"carol5678"}`, http.StatusUnauthorized},
+		{http.MethodPost, "/login/totp", "", "application/json", `{"challenge":"{challenge}","code":"abcdef"}`, http.StatusUnauthorized},
+		{http.MethodPost, "/login/totp", "", "application/json", `{"challenge":"{challenge}","code":"{next-totp-code}"}`, http.StatusOK},
+		{http.MethodPost, "/login/totp", "", "application/json", `{"challenge":"{challenge}","code":"{next-totp-code}"}`, http.StatusUnauthorized},
+		{http.MethodPost, "/login/totp", "", "application/json", `{`, http.StatusBadRequest},
+		{http.MethodPost, "/login", "", "application/json", `{"userId":"carol","password":"carol5678"}`, http.StatusUnauthorized},
+		{http.MethodPost, "/login/totp", "", "application/json", `{"challenge":"{challenge}","code":"{recovery-code}"}`, http.StatusOK},
+		{http.MethodPost, "/2fa/recovery-codes", "", "application/json", `{"userId":"carol","password":"carol5678","code":"abcdef"}`, http.StatusBadRequest},
+		{http.MethodPost, "/2fa/recovery-codes", "", "application/json", `{"userId":"carol","password":"wrong","code":"abcdef"}`, http.StatusUnauthorized},
+		{http.MethodPost, "/2fa/recovery-codes", "", "application/json", `{"userId":"carol","password":"carol5678","code":"{recovery-code}"}`, http.StatusOK},
+		{http.MethodPost, "/2fa/disable", "", "application/json", `{"userId":"carol","password":"carol5678","code":"abcdef"}`, http.StatusBadRequest},
+		{http.MethodPost, "/2fa/disable", "", "application/json", `{"userId":"carol","password":"carol5678","code":"{recovery-code}"}`, http.StatusOK},
+		{http.MethodPost, "/2fa/disable", "", "application/json", `{"userId":"carol","password":"carol5678","code":"{recovery-code}"}`, http.StatusConflict},
+		{http.MethodPost, "/2fa/recovery-codes", "", "application/json", `{"userId":"carol","password":"carol5678","code":"{recovery-code}"}`, http.StatusConflict},
+		{http.MethodPost, "/2fa/disable", "", "application/json", `{"userId":"carol","password":"wrong"}`, http.StatusUnauthorized},
+		{http.MethodPost, "/2fa/setup", "", "application/json", `not json`, http.StatusBadRequest},
+	}},
+	// Admin operations and password changes
+	{"admin", []openAPICase{
+		{http.MethodGet, "/admin/list-users", "", "", "", http.StatusOK},
+		{http.MethodGet, "/admin/list-users", "", "", "", http.StatusUnauthorized},
+		{http.MethodGet, "/admin/stats", "", "", "", http.StatusOK},
+		{http.MethodGet, "/admin/stats", "", "", "", http.StatusUnauthorized},
+		{http.MethodPost, "/admin/create-snapshot", "", "", "", http.StatusOK},
+		{http.MethodPost, "/admin/create-snapshot", "", "", "", http.StatusUnauthorized},
+		{http.MethodGet, "/admin/list-snapshots", "", "", "", http.StatusOK},
+		{http.MethodPost, "/admin/disable-user", "user=bob", "", "", http.StatusOK},
+		{http.MethodPost, "/admin/disable-user", "user=root", "", "", http.StatusBadRequest},
+		{http.MethodPost, "/admin/disable-user", "user=ghost", "", "", http.StatusNotFound},
+		{http.MethodPost, "/login", "", "application/json", `{"userId":"bob","password":"bob12345"}`, http.StatusForbidden},
+		{http.MethodPost, "/send-message", "sender=bob", "application/json", `{"receiver":"alice","content":"hi"}`, http.StatusForbidden},
+		{http.MethodPost, "/admin/enable-user", "user=bob", "", "", http.StatusOK},
+		{http.MethodPost, "/admin/enable-user", "", "", "", http.StatusBadRequest},
+		{http.MethodPost, "/admin/reset-password", "user=bob", "", "", http.StatusOK},
+		{http.MethodPost, "/admin/reset-password", "user=ghost", "", "", http.StatusNotFound},
+		{http.MethodPost, "/change-password", "", "application/json", `{"userId":"alice","password":"wrong","newPassword":"alice5678"}`, http.StatusUnauthorized},
+		{http.MethodPost, "/change-password", "", "application/json", `{"userId":"alice","password":"alice1234","newPassword":"short"}`, http.StatusBadRequest},
+		{http.MethodPost, "/change-password", "", "application/json", `{"userId":"alice","password":"alice1234","newPassword":"alice5678"}`, http.StatusOK},
+		{http.MethodPost, "/admin/reset-2fa", "user=alice", "", "", http.StatusOK},
+		{http.MethodPost, "/admin/reset-2fa", "user=ghost", "", "", http.StatusNotFound},
+		{http.MethodPost, "/admin/delete-user", "user=bob", "", "", http.StatusOK},
+		{http.MethodPost, "/admin/delete-user", "user=bob", "", "", http.StatusNotFound},
+	}},
+}
+
+// Users every scenario starts with
+var openAPIUsers = []User{
+	{UserId: "alice", Password: "alice1234", Email: "alice@example.com"},
+	{UserId: "bob", Password: "bob12345", Email: "bob@example.com"},
+	{UserId: "root", Password: "root1234", IsAdmin: true},
+}
+
+// Replay each scenario against the /api/v1 handlers and validate every
+// response against the OpenAPI document
+func TestOpenAPIResponses(t *testing.T) {
+	spec := buildOpenAPISpec()
+	for _, scenario := range openAPIScenarios {
+		scenario := scenario
+		t.Run(scenario.name, func(t *testing.T) {
+			useDataDir(t, openAPIUsers...)
+			replayOpenAPICases(t, spec, enforceSessions(setupAPIv1()), scenario.cases)
+		})
+	}
+}
+
+// Every documented operation must be exercised by some scenario
+func TestOpenAPICoverage(t *testing.T) {
+	covered := map[string]bool{}
+	for _, scenario := range openAPIScenarios {
+		for _, c := range scenario.cases {
+			covered[strings.ToLower(c.method)+" "+c.path] = true
+		}
+	}
+	for path, item := range buildOpenAPISpec()["paths"].(schemaObject) {
+		for method := range item.(schemaObject) {
+			if !covered[method+" "+path] {
+				t.Errorf("%s %s: documented but not checked", strings.ToUpper(method), path)
+			}
+		}
+	}
+}
+
+func replayOpenAPICases(t *testing.T, spec schemaObject, router http.Handler, cases []openAPICase) {
+	token := ""                     // Session of the last successful login
+	sessions := map[string]string{} // Tokens of the users cases act for
+
+	// Two-factor state picked up from earlier responses: the secret from
+	// the last setup, the last login challenge and the unused recovery codes
+	var totpSecret, challenge string
+	var recoveryCodes []string
+
+	for _, c := range cases {
+		target := "/api/v1" + c.path
+		if c.query != "" {
+			target += "?" + c.query
+		}
+		totpNow, _ := totpCode(totpSecret, time.Now())
+		totpNext, _ := totpCode(totpSecret, time.Now().Add(totpPeriod*time.Second))
+		recoveryCode := ""
+		if strings.Contains(c.body, "{recovery-code}") && len(recoveryCodes) > 0 {
+			recoveryCode, recoveryCodes = recoveryCodes[0], recoveryCodes[1:]
+		}
+		body := strings.NewReplacer(
+			"{verify-token}", lastMailedToken("verify"),
+			"{reset-token}", lastMailedToken("reset"),
+			"{totp-code}", totpNow,
+			"{next-totp-code}", totpNext,
+			"{challenge}", challenge,
+			"{recovery-code}", recoveryCode,
+		).Replace(c.body)
+		req := httptest.NewRequest(c.method, target, strings.NewReader(body))
+		if c.contentType != "" {
+			req.Header.Set("Content-Type", c.contentType)
+		}
+		// Admin cases authenticate as the seeded admin unless they expect a 401
+		if strings.HasPrefix(c.path, "/admin/") && c.status != http.StatusUnauthorized {
+			req.SetBasicAuth("root", "root1234")
+		}
+		// Session cases use the last login's token unless they expect a 401;
+		// the others act for the user they name
+		if strings.HasPrefix(c.path, "/sessions/") || c.path == "/sync" || c.path == "/logout" {
+			if c.status != http.StatusUnauthorized {
+				req.Header.Set(sessionHeader, token)
+			}
+		} else if !sessionExempt(req.URL.Path) && !ownAuthentication(req.URL.Path) {
+			actor := openAPIActor(c)
+			if sessions[actor] == "" {
+				_, sessions[actor], _ = createSession(actor, "test", false)
+			}
+			req.Header.Set(sessionHeader, sessions[actor])
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+
+		if rec.Code != c.status {
+			t.Errorf("%s %s: expected status %d, got %d: %s", c.method, target, c.status, rec.Code, strings.TrimSpace(rec.Body.String()))
+			continue
+		}
+		for _, problem := range validateResponse(spec, c.method, c.path, rec.Code, rec.Header().Get("Content-Type"), rec.Body.Bytes()) {
+			t.Error(problem)
+		}
+		var reply struct {
+			Token         string   `json:"token"`
+			Challenge     string   `json:"challenge"`
+			Secret        string   `json:"secret"`
+			RecoveryCodes []string `json:"recoveryCodes"`
+		}
+		json.Unmarshal(rec.Body.Bytes(), &reply)
+		if (c.path == "/login" || c.path == "/login/totp") && rec.Code == http.StatusOK {
+			token = reply.Token
+		}
+		if reply.Challenge != "" {
+			challenge = reply.Challenge
+		}
+		if reply.Secret != "" {
+			totpSecret = reply.Secret
+		}
+		if reply.RecoveryCodes != nil {
+			recoveryCodes = reply.RecoveryCodes
+		}
+	}
+}
+
+// User a case acts for: the one named in its query or body, or alice when
+// it names nobody or only someone to look up
+func openAPIActor(c openAPICase) string {
+	query, _ := url.ParseQuery(c.query)
+	if !lookupPaths["/api/v1"+c.path] {
+		for _, param := range append(actorParams, "user1") {
+			if value := query.Get(param); value != "" {
+				return value
+			}
+		}
+	}
+	var body struct {
+		UserId string `json:"userId"`
+	}
+	if json.Unmarshal([]byte(c.body), &body) == nil && body.UserId != "" {
+		return body.UserId
+	}
+	return "alice"
+}
@@ -0,0 +1,467 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif" // Decoders for uploaded avatars
+	_ "image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"gochat/internal/store"
+)
+
+// Profiles are kept in users.json next to the account. Avatars are
+// uploaded as PNG, JPEG or GIF, cropped to a square and scaled to
+// avatarSize, and stored as PNG under avatars/ named by their checksum.
+// A file is never rewritten, so the avatar URL carries the checksum and
+// browsers may cache it; files no user refers to any more are removed.
+
+// Directory holding avatar images
+const avatarDir = store.AvatarDir
+
+// Profile limits
+const (
+	avatarSize           = 256              // Width and height of stored avatars in pixels
+	maxAvatarUpload      = 5 << 20          // Largest accepted upload in bytes
+	maxAvatarPixels      = 40 * 1000 * 1000 // Largest accepted image before scaling
+	maxDisplayNameLength = 64
+	maxBioLength         = 500
+	maxStatusLength      = 100
+)
+
+// Profile is what other users see of an account
+type Profile struct {
+	UserId      string `json:"userId"`
+	DisplayName string `json:"displayName"` // Falls back to the user ID
+	AvatarURL   string `json:"avatarUrl,omitempty"`
+	Bio         string `json:"bio,omitempty"`
+	Status      string `json:"status,omitempty"`
+	Timezone    string `json:"timezone,omitempty"`
+	IsBot       bool   `json:"isBot,omitempty"`
+}
+
+// ProfileSummary is the part of a profile shown in lists such as the sidebar
+type ProfileSummary struct {
+	DisplayName string `json:"displayName"`
+	AvatarURL   string `json:"avatarUrl,omitempty"`
+	Status      string `json:"status,omitempty"`
+}
+
+// ProfileUpdate request struct. Fields left out are not changed; an empty
+// string clears the field.
+type ProfileUpdate struct {
+	DisplayName *string `json:"displayName,omitempty"`
+	Bio         *string `json:"bio,omitempty"`
+	Status      *string `json:"status,omitempty"`
+	Timezone    *string `json:"timezone,omitempty"`
+}
+
+// Guards the avatars directory against removing a file that is being added
+var avatarsMu sync.Mutex
+
+// Upload problems reported to the client
+var (
+	errUnsupportedImage = errors.New("unsupported image format")
+	errImageTooLarge    = errors.New("image too large")
+)
+
+// URL of a user's avatar, or "" if they have none
+func avatarURL(user User) string {
+	if user.Avatar == "" {
+		return ""
+	}
+	return "/api/v1/profile/avatar?user=" + url.QueryEscape(user.UserId) + "&v=" + user.Avatar[:12]
+}
+
+// The public profile of a user
+func profileOf(user User) Profile {
+	displayName := user.DisplayName
+	if displayName == "" {
+		displayName = user.UserId
+	}
+	return Profile{
+		UserId:      user.UserId,
+		DisplayName: displayName,
+		AvatarURL:   avatarURL(user),
+		Bio:         user.Bio,
+		Status:      user.Status,
+		Timezone:    user.Timezone,
+		IsBot:       user.IsBot,
+	}
+}
+
+// The profile summaries of the given users, keyed by user ID. Unknown
+// users are left out.
+func profileSummaries(userIds []string) (map[string]ProfileSummary, error) {
+	usersData, err := loadUsers()
+	if err != nil {
+		return nil, err
+	}
+	wanted := map[string]bool{}
+	for _, userId := range userIds {
+		wanted[userId] = true
+	}
+	summaries := map[string]ProfileSummary{}
+	for _, user := range usersData.Users {
+		if wanted[user.UserId] {
+			profile := profileOf(user)
+			summaries[user.UserId] = ProfileSummary{
+				DisplayName: profile.DisplayName,
+				AvatarURL:   profile.AvatarURL,
+				Status:      profile.Status,
+			}
+		}
+	}
+	return summaries, nil
+}
+
+// Check a single-line profile text such as the display name or status
+func validateProfileLine(field, value string, maxLength int, errs *ValidationErrors) {
+	if utf8.RuneCountInString(value) > maxLength {
+		errs.add(field, fmt.Sprintf("Must be at most %d characters", maxLength))
+		return
+	}
+	for _, r := range value {
+		if unicode.IsControl(r) {
+			errs.add(field, "Must not contain control characters")
+			return
+		}
+	}
+}
+
+// Normalize a profile update in place and validate every field
+func validateProfileUpdate(update *ProfileUpdate) ValidationErrors {
+	var errs ValidationErrors
+	if update.DisplayName != nil {
+		*update.DisplayName = normalizeText(*update.DisplayName)
+		validateProfileLine("displayName", *update.DisplayName, maxDisplayNameLength, &errs)
+	}
+	if update.Status != nil {
+		*update.Status = normalizeText(*update.Status)
+		validateProfileLine("status", *update.Status, maxStatusLength, &errs)
+	}
+	if update.Bio != nil {
+		*update.Bio = normalizeText(*update.Bio)
+		if utf8.RuneCountInString(*update.Bio) > maxBioLength {
+			errs.add("bio", fmt.Sprintf("Must be at most %d characters", maxBioLength))
+		} else {
+			for _, r := range *update.Bio {
+				if unicode.IsControl(r) && r != '\n' {
+					errs.add("bio", "Must not contain control characters")
+					break
+				}
+			}
+		}
+	}
+	if update.Timezone != nil {
+		*update.Timezone = strings.TrimSpace(*update.Timezone)
+		// time.LoadLocation treats "" as UTC and "Local" as the server's zone
+		if *update.Timezone != "" {
+			if _, err := time.LoadLocation(*update.Timezone); err != nil || *update.Timezone == "Local" {
+				errs.add("timezone", "Must be an IANA time zone such as Europe/Berlin")
+			}
+		}
+	}
+	return errs
+}
+
+// Crop an image to a centered square and scale it to size x size. Each
+// output pixel averages the source pixels it covers, so large photos shrink
+// without aliasing; small images are scaled up by repeating pixels.
+func resizeAvatar(src image.Image, size int) *image.NRGBA {
+	bounds := src.Bounds()
+	side := bounds.Dx()
+	if bounds.Dy() < side {
+		side = bounds.Dy()
+	}
+	x0 := bounds.Min.X + (bounds.Dx()-side)/2
+	y0 := bounds.Min.Y + (bounds.Dy()-side)/2
+
+	dst := image.NewNRGBA(image.Rect(0, 0, size, size))
+	for dy := 0; dy < size; dy++ {
+		sy0, sy1 := y0+dy*side/size, y0+(dy+1)*side/size
+		if sy1 == sy0 {
+			sy1 = sy0 + 1
+		}
+		for dx := 0; dx < size; dx++ {
+			sx0, sx1 := x0+dx*side/size, x0+(dx+1)*side/size
+			if sx1 == sx0 {
+				sx1 = sx0 + 1
+			}
+			// Sum premultiplied colors so transparent pixels don't darken edges
+			var r, g, b, a, n uint64
+			for sy := sy0; sy < sy1; sy++ {
+				for sx := sx0; sx < sx1; sx++ {
+					pr, pg, pb, pa := src.At(sx, sy).RGBA()
+					r, g, b, a = r+uint64(pr), g+uint64(pg), b+uint64(pb), a+uint64(pa)
+					n++
+				}
+			}
+			i := dst.PixOffset(dx, dy)
+			if a == 0 {
+				continue // Fully transparent; Pix is already zero
+			}
+			dst.Pix[i+0] = uint8(r * 0xff / a)
+			dst.Pix[i+1] = uint8(g * 0xff / a)
+			dst.Pix[i+2] = uint8(b * 0xff / a)
+			dst.Pix[i+3] = uint8(a / n >> 8)
+		}
+	}
+	return dst
+}
+
+// Decode an uploaded image and turn it into a stored avatar. Returns the
+// avatar's checksum.
+func storeAvatar(data []byte) (string, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return "", errUnsupportedImage
+	}
+	if config.Width <= 0 || config.Height <= 0 || config.Width*config.Height > maxAvatarPixels {
+		return "", errImageTooLarge
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return "", errUnsupportedImage
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, resizeAvatar(img, avatarSize)); err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(buf.Bytes())
+	hash := hex.EncodeToString(sum[:])
+
+	if err := os.MkdirAll(avatarDir, 0755); err != nil {
+		return "", err
+	}
+	path := filepath.Join(avatarDir, hash+".png")
+	if _, err := os.Stat(path); err == nil {
+		return hash, nil // Same image as an existing avatar
+	}
+	return hash, writeFileAtomic(path, buf.Bytes(), 0644)
+}
+
+// Remove avatar files that no user refers to. The caller must hold avatarsMu.
+func pruneAvatars() error {
+	entries, err := os.ReadDir(avatarDir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	usersData, err := loadUsers()
+	if err != nil {
+		return err
+	}
+	used := map[string]bool{}
+	for _, user := range usersData.Users {
+		if user.Avatar != "" {
+			used[user.Avatar+".png"] = true
+		}
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() && !used[entry.Name()] {
+			if err := os.Remove(filepath.Join(avatarDir, entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Read the user parameter shared by the profile handlers. Returns false if
+// a response was written and the handler should stop.
+func profileUser(w http.ResponseWriter, r *http.Request) (User, bool) {
+	userId := r.URL.Query().Get("user")
+	if userId == "" {
+		writeError(w, http.StatusBadRequest, "missing_parameter", "User ID is required", "user")
+		return User{}, false
+	}
+	user, exists, err := findUser(userId)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error reading users.json: "+err.Error(), "")
+		return User{}, false
+	}
+	if !exists {
+		writeError(w, http.StatusNotFound, "user_not_found", "User "+userId+" does not exist", "user")
+		return User{}, false
+	}
+	return user, true
+}
+
+// Write a profile as the response
+func writeProfile(w http.ResponseWriter, user User) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"profile": profileOf(user),
+	})
+}
+
+// Handler for reading a user's profile
+func getProfile(w http.ResponseWriter, r *http.Request) {
+	user, ok := profileUser(w, r)
+	if !ok {
+		return
+	}
+	writeProfile(w, user)
+}
+
+// Handler for changing the user's display name, bio, status or time zone
+func updateProfile(w http.ResponseWriter, r *http.Request) {
+	user, ok := profileUser(w, r)
+	if !ok {
+		return
+	}
+
+	var update ProfileUpdate
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_json", "Invalid JSON: "+err.Error(), "")
+		return
+	}
+	if errs := validateProfileUpdate(&update); len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return
+	}
+
+	err := updateUser(user.UserId, func(user *User) {
+		if update.DisplayName != nil {
+			user.DisplayName = *update.DisplayName
+		}
+		if update.Bio != nil {
+			user.Bio = *update.Bio
+		}
+		if update.Status != nil {
+			user.Status = *update.Status
+		}
+		if update.Timezone != nil {
+			user.Timezone = *update.Timezone
+		}
+	})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error updating users.json: "+err.Error(), "")
+		return
+	}
+	user, _, err = findUser(user.UserId)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error reading users.json: "+err.Error(), "")
+		return
+	}
+
+	fmt.Println("Profile updated for:", user.UserId)
+	writeProfile(w, user)
+}
+
+// Handler for uploading a new avatar. The request body is the image itself.
+func uploadAvatar(w http.ResponseWriter, r *http.Request) {
+	user, ok := profileUser(w, r)
+	if !ok {
+		return
+	}
+
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxAvatarUpload))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeError(w, http.StatusRequestEntityTooLarge, "image_too_large", fmt.Sprintf("The image can be at most %d MiB", maxAvatarUpload>>20), "")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_image", "Error reading the image: "+err.Error(), "")
+		return
+	}
+	if len(data) == 0 {
+		writeError(w, http.StatusBadRequest, "invalid_image", "The request body must be the image", "")
+		return
+	}
+
+	avatarsMu.Lock()
+	defer avatarsMu.Unlock()
+
+	hash, err := storeAvatar(data)
+	switch {
+	case err == errUnsupportedImage:
+		writeError(w, http.StatusBadRequest, "invalid_image", "The image must be a PNG, JPEG or GIF", "")
+		return
+	case err == errImageTooLarge:
+		writeError(w, http.StatusBadRequest, "invalid_image", fmt.Sprintf("The image can be at most %d megapixels", maxAvatarPixels/1000000), "")
+		return
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error storing avatar: "+err.Error(), "")
+		return
+	}
+	if err := updateUser(user.UserId, func(user *User) { user.Avatar = hash }); err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error updating users.json: "+err.Error(), "")
+		return
+	}
+	if err := pruneAvatars(); err != nil {
+		fmt.Println("Error removing unused avatars:", err)
+	}
+
+	user.Avatar = hash
+	fmt.Println("Avatar updated for:", user.UserId)
+	writeProfile(w, user)
+}
+
+// Handler for removing the user's avatar
+func removeAvatar(w http.ResponseWriter, r *http.Request) {
+	user, ok := profileUser(w, r)
+	if !ok {
+		return
+	}
+
+	avatarsMu.Lock()
+	defer avatarsMu.Unlock()
+
+	if err := updateUser(user.UserId, func(user *User) { user.Avatar = "" }); err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error updating users.json: "+err.Error(), "")
+		return
+	}
+	if err := pruneAvatars(); err != nil {
+		fmt.Println("Error removing unused avatars:", err)
+	}
+
+	user.Avatar = ""
+	fmt.Println("Avatar removed for:", user.UserId)
+	writeProfile(w, user)
+}
+
+// Handler for serving a user's avatar image
+func serveAvatar(w http.ResponseWriter, r *http.Request) {
+	user, ok := profileUser(w, r)
+	if !ok {
+		return
+	}
+	if user.Avatar == "" {
+		writeError(w, http.StatusNotFound, "avatar_not_found", user.UserId+" has no avatar", "user")
+		return
+	}
+
+	data, err := os.ReadFile(filepath.Join(avatarDir, user.Avatar+".png"))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error reading avatar: "+err.Error(), "")
+		return
+	}
+	// The URL names the avatar's version, so it can be cached for long
+	if r.URL.Query().Get("v") != "" {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(data)
+}
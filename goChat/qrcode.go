@@ -0,0 +1,513 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"strings"
+)
+
+// A minimal QR code encoder for the otpauth:// URIs shown when enrolling
+// in two-factor authentication: byte mode, error correction level M,
+// versions 1 to 10 (up to 213 bytes). It follows ISO/IEC 18004; modules
+// are addressed as [y][x] with x the column.
+
+// qrBlocks describes the error correction blocks of one version at level M
+type qrBlocks struct {
+	ecPerBlock int // Error correction codewords in every block
+	count1     int // Blocks in the first group
+	data1      int // Data codewords in each block of the first group
+	count2     int // Blocks in the second group, one data codeword longer
+}
+
+// Level M block structure by version, from table 9 of the standard
+var qrLevelM = [...]qrBlocks{
+	1:  {10, 1, 16, 0},
+	2:  {16, 1, 28, 0},
+	3:  {26, 1, 44, 0},
+	4:  {18, 2, 32, 0},
+	5:  {24, 2, 43, 0},
+	6:  {16, 4, 27, 0},
+	7:  {18, 4, 31, 0},
+	8:  {22, 2, 38, 2},
+	9:  {22, 3, 36, 2},
+	10: {26, 4, 43, 1},
+}
+
+// Centers of the alignment patterns by version
+var qrAlignment = [...][]int{
+	1: nil, 2: {6, 18}, 3: {6, 22}, 4: {6, 26}, 5: {6, 30},
+	6: {6, 34}, 7: {6, 22, 38}, 8: {6, 24, 42}, 9: {6, 26, 46}, 10: {6, 28, 50},
+}
+
+// Returned by encodeQR for text longer than version 10 holds
+var errQRTooLong = errors.New("text is too long for a QR code")
+
+// qrCode is an encoded symbol; true modules are dark
+type qrCode struct {
+	size     int
+	modules  [][]bool
+	function [][]bool // Finder, timing, alignment and format modules, which masks skip
+}
+
+// Data codewords of a version at level M
+func (b qrBlocks) dataCodewords() int {
+	return b.count1*b.data1 + b.count2*(b.data1+1)
+}
+
+// Encode text in the smallest version that fits
+func encodeQR(text string) (*qrCode, error) {
+	data := []byte(text)
+	version := 0
+	for v := 1; v < len(qrLevelM); v++ {
+		countBits := 8
+		if v >= 10 {
+			countBits = 16
+		}
+		if 4+countBits+8*len(data) <= 8*qrLevelM[v].dataCodewords() {
+			version = v
+			break
+		}
+	}
+	if version == 0 {
+		return nil, errQRTooLong
+	}
+
+	size := 17 + 4*version
+	qr := &qrCode{size: size, modules: make([][]bool, size), function: make([][]bool, size)}
+	for y := range qr.modules {
+		qr.modules[y] = make([]bool, size)
+		qr.function[y] = make([]bool, size)
+	}
+	qr.drawFunctionPatterns(version)
+	qr.drawCodewords(qrCodewords(data, version))
+
+	// Keep the mask with the lowest penalty
+	best, bestPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		qr.applyMask(mask)
+		qr.drawFormatBits(mask)
+		if penalty := qr.penalty(); bestPenalty < 0 || penalty < bestPenalty {
+			best, bestPenalty = mask, penalty
+		}
+		qr.applyMask(mask) // Masks are their own inverse
+	}
+	qr.applyMask(best)
+	qr.drawFormatBits(best)
+	return qr, nil
+}
+
+// Set a module that masks must leave alone
+func (qr *qrCode) setFunction(x, y int, dark bool) {
+	qr.modules[y][x] = dark
+	qr.function[y][x] = true
+}
+
+// Draw the finder, timing and alignment patterns and reserve the format
+// and version areas
+func (qr *qrCode) drawFunctionPatterns(version int) {
+	for i := 0; i < qr.size; i++ {
+		qr.setFunction(6, i, i%2 == 0)
+		qr.setFunction(i, 6, i%2 == 0)
+	}
+
+	// Finder patterns with their separators
+	for _, center := range [][2]int{{3, 3}, {qr.size - 4, 3}, {3, qr.size - 4}} {
+		for dy := -4; dy <= 4; dy++ {
+			for dx := -4; dx <= 4; dx++ {
+				x, y := center[0]+dx, center[1]+dy
+				if x >= 0 && x < qr.size && y >= 0 && y < qr.size {
+					dist := chebyshev(dx, dy)
+					qr.setFunction(x, y, dist != 2 && dist != 4)
+				}
+			}
+		}
+	}
+
+	// Alignment patterns, except where they would overlap a finder
+	positions := qrAlignment[version]
+	last := len(positions) - 1
+	for i, cy := range positions {
+		for j, cx := range positions {
+			if (i == 0 && j == 0) || (i == 0 && j == last) || (i == last && j == 0) {
+				continue
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					qr.setFunction(cx+dx, cy+dy, chebyshev(dx, dy) != 1)
+				}
+			}
+		}
+	}
+
+	qr.drawFormatBits(0) // Overwritten once the mask is chosen
+
+	// Version information from version 7 on, a BCH(18,6) code
+	if version >= 7 {
+		rem := version
+		for i := 0; i < 12; i++ {
+			rem = (rem << 1) ^ ((rem >> 11) * 0x1F25)
+		}
+		bits := version<<12 | rem
+		for i := 0; i < 18; i++ {
+			dark := (bits>>i)&1 != 0
+			a, b := qr.size-11+i%3, i/3
+			qr.setFunction(a, b, dark)
+			qr.setFunction(b, a, dark)
+		}
+	}
+}
+
+// Draw both copies of the format information: level M and the mask, as a
+// BCH(15,5) code
+func (qr *qrCode) drawFormatBits(mask int) {
+	data := 0<<3 | mask // Level M is 00
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = (rem << 1) ^ ((rem >> 9) * 0x537)
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+	bit := func(i int) bool { return (bits>>i)&1 != 0 }
+
+	for i := 0; i <= 5; i++ {
+		qr.setFunction(8, i, bit(i))
+	}
+	qr.setFunction(8, 7, bit(6))
+	qr.setFunction(8, 8, bit(7))
+	qr.setFunction(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		qr.setFunction(14-i, 8, bit(i))
+	}
+
+	for i := 0; i < 8; i++ {
+		qr.setFunction(qr.size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		qr.setFunction(8, qr.size-15+i, bit(i))
+	}
+	qr.setFunction(8, qr.size-8, true) // Always dark
+}
+
+// Build the final codeword sequence: the byte-mode segment padded to the
+// version's capacity, split into blocks, with error correction, interleaved
+func qrCodewords(data []byte, version int) []byte {
+	blocks := qrLevelM[version]
+	capacity := blocks.dataCodewords()
+
+	var bits []bool
+	appendBits := func(value, n int) {
+		for i := n - 1; i >= 0; i-- {
+			bits = append(bits, (value>>i)&1 != 0)
+		}
+	}
+	appendBits(0x4, 4) // Byte mode
+	if version >= 10 {
+		appendBits(len(data), 16)
+	} else {
+		appendBits(len(data), 8)
+	}
+	for _, b := range data {
+		appendBits(int(b), 8)
+	}
+	terminator := 8*capacity - len(bits)
+	if terminator > 4 {
+		terminator = 4
+	}
+	appendBits(0, terminator)
+	for len(bits)%8 != 0 {
+		bits = append(bits, false)
+	}
+
+	codewords := make([]byte, 0, capacity)
+	for i := 0; i < len(bits); i += 8 {
+		var b byte
+		for _, bit := range bits[i : i+8] {
+			b <<= 1
+			if bit {
+				b |= 1
+			}
+		}
+		codewords = append(codewords, b)
+	}
+	for pad := byte(0xEC); len(codewords) < capacity; pad ^= 0xEC ^ 0x11 {
+		codewords = append(codewords, pad)
+	}
+
+	// Split into blocks and add error correction to each
+	var dataBlocks, ecBlocks [][]byte
+	offset := 0
+	for i := 0; i < blocks.count1+blocks.count2; i++ {
+		n := blocks.data1
+		if i >= blocks.count1 {
+			n++
+		}
+		block := codewords[offset : offset+n]
+		offset += n
+		dataBlocks = append(dataBlocks, block)
+		ecBlocks = append(ecBlocks, reedSolomon(block, blocks.ecPerBlock))
+	}
+
+	// Interleave: the i-th codeword of every block in turn
+	result := make([]byte, 0, capacity+len(ecBlocks)*blocks.ecPerBlock)
+	for i := 0; i <= blocks.data1; i++ {
+		for _, block := range dataBlocks {
+			if i < len(block) {
+				result = append(result, block[i])
+			}
+		}
+	}
+	for i := 0; i < blocks.ecPerBlock; i++ {
+		for _, block := range ecBlocks {
+			result = append(result, block[i])
+		}
+	}
+	return result
+}
+
+// Multiply in GF(256) with the QR code polynomial x^8+x^4+x^3+x^2+1
+func gfMultiply(a, b byte) byte {
+	var product byte
+	for ; b != 0; b >>= 1 {
+		if b&1 != 0 {
+			product ^= a
+		}
+		carry := a & 0x80
+		a <<= 1
+		if carry != 0 {
+			a ^= 0x1D
+		}
+	}
+	return product
+}
+
+// Reed-Solomon error correction codewords for a block
+func reedSolomon(data []byte, degree int) []byte {
+	// Generator polynomial (x - 2^0)(x - 2^1)...(x - 2^(degree-1)),
+	// highest coefficient (always 1) left out
+	generator := make([]byte, degree)
+	generator[degree-1] = 1
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := 0; j < degree; j++ {
+			generator[j] = gfMultiply(generator[j], root)
+			if j+1 < degree {
+				generator[j] ^= generator[j+1]
+			}
+		}
+		root = gfMultiply(root, 2)
+	}
+
+	// Remainder of data * x^degree divided by the generator
+	remainder := make([]byte, degree)
+	for _, b := range data {
+		factor := b ^ remainder[0]
+		copy(remainder, remainder[1:])
+		remainder[degree-1] = 0
+		for i := range remainder {
+			remainder[i] ^= gfMultiply(generator[i], factor)
+		}
+	}
+	return remainder
+}
+
+// Place the codewords in the zigzag order of the standard, two columns at
+// a time from the bottom right, skipping the vertical timing pattern
+func (qr *qrCode) drawCodewords(codewords []byte) {
+	i := 0
+	for right := qr.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		for vert := 0; vert < qr.size; vert++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				y := vert
+				if (right+1)&2 == 0 {
+					y = qr.size - 1 - vert // Upward
+				}
+				if !qr.function[y][x] && i < len(codewords)*8 {
+					qr.modules[y][x] = (codewords[i>>3]>>(7-i&7))&1 != 0
+					i++
+				}
+			}
+		}
+	}
+}
+
+// Invert the data modules selected by the mask pattern
+func (qr *qrCode) applyMask(mask int) {
+	for y := 0; y < qr.size; y++ {
+		for x := 0; x < qr.size; x++ {
+			var invert bool
+			switch mask {
+			case 0:
+				invert = (x+y)%2 == 0
+			case 1:
+				invert = y%2 == 0
+			case 2:
+				invert = x%3 == 0
+			case 3:
+				invert = (x+y)%3 == 0
+			case 4:
+				invert = (x/3+y/2)%2 == 0
+			case 5:
+				invert = x*y%2+x*y%3 == 0
+			case 6:
+				invert = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				invert = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if invert && !qr.function[y][x] {
+				qr.modules[y][x] = !qr.modules[y][x]
+			}
+		}
+	}
+}
+
+// Score the symbol with the four penalty rules; lower is easier to scan
+func (qr *qrCode) penalty() int {
+	penalty := 0
+	at := func(x, y int, transposed bool) bool {
+		if transposed {
+			return qr.modules[x][y]
+		}
+		return qr.modules[y][x]
+	}
+
+	for _, transposed := range []bool{false, true} {
+		for y := 0; y < qr.size; y++ {
+			// Runs of five or more modules of one color
+			run := 1
+			for x := 1; x < qr.size; x++ {
+				if at(x, y, transposed) == at(x-1, y, transposed) {
+					run++
+					continue
+				}
+				if run >= 5 {
+					penalty += run - 2
+				}
+				run = 1
+			}
+			if run >= 5 {
+				penalty += run - 2
+			}
+
+			// Patterns that look like a finder: dark-light-dark-dark-dark-light-dark
+			// with four light modules on one side
+			for x := 0; x+11 <= qr.size; x++ {
+				var pattern strings.Builder
+				for k := 0; k < 11; k++ {
+					if at(x+k, y, transposed) {
+						pattern.WriteByte('1')
+					} else {
+						pattern.WriteByte('0')
+					}
+				}
+				if p := pattern.String(); p == "10111010000" || p == "00001011101" {
+					penalty += 40
+				}
+			}
+		}
+	}
+
+	// 2x2 blocks of one color
+	dark := 0
+	for y := 0; y < qr.size; y++ {
+		for x := 0; x < qr.size; x++ {
+			if qr.modules[y][x] {
+				dark++
+			}
+			if x > 0 && y > 0 {
+				c := qr.modules[y][x]
+				if qr.modules[y-1][x] == c && qr.modules[y][x-1] == c && qr.modules[y-1][x-1] == c {
+					penalty += 3
+				}
+			}
+		}
+	}
+
+	// Balance of dark and light modules, in steps of 5% away from half
+	total := qr.size * qr.size
+	penalty += abs(dark*100/total-50) / 5 * 10
+	return penalty
+}
+
+// Render the symbol as a PNG with a four-module quiet zone
+func (qr *qrCode) png(scale int) ([]byte, error) {
+	const quiet = 4
+	side := (qr.size + 2*quiet) * scale
+	img := image.NewGray(image.Rect(0, 0, side, side))
+	for py := 0; py < side; py++ {
+		for px := 0; px < side; px++ {
+			x, y := px/scale-quiet, py/scale-quiet
+			shade := color.Gray{Y: 255}
+			if x >= 0 && x < qr.size && y >= 0 && y < qr.size && qr.modules[y][x] {
+				shade = color.Gray{Y: 0}
+			}
+			img.SetGray(px, py, shade)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Render the symbol as a PNG data: URI for an <img> tag
+func (qr *qrCode) dataURI(scale int) (string, error) {
+	data, err := qr.png(scale)
+	if err != nil {
+		return "", err
+	}
+	return "data:image/png;base64," + base64.StdEncoding.EncodeToString(data), nil
+}
+
+// Render the symbol for a terminal with half-block characters, two rows
+// of modules per line, dark on light with a quiet zone
+func (qr *qrCode) text() string {
+	const quiet = 2
+	dark := func(x, y int) bool {
+		x, y = x-quiet, y-quiet
+		return x >= 0 && x < qr.size && y >= 0 && y < qr.size && qr.modules[y][x]
+	}
+
+	var out strings.Builder
+	side := qr.size + 2*quiet
+	for y := 0; y < side; y += 2 {
+		for x := 0; x < side; x++ {
+			top, bottom := dark(x, y), y+1 < side && dark(x, y+1)
+			switch {
+			case top && bottom:
+				out.WriteRune(' ')
+			case top:
+				out.WriteRune('▄')
+			case bottom:
+				out.WriteRune('▀')
+			default:
+				out.WriteRune('█')
+			}
+		}
+		out.WriteByte('\n')
+	}
+	return out.String()
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// Distance from a pattern's center, counted in rings
+func chebyshev(dx, dy int) int {
+	if abs(dx) > abs(dy) {
+		return abs(dx)
+	}
+	return abs(dy)
+}
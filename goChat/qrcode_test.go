@@ -0,0 +1,459 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+// The decoder below reads symbols back from the PNG the server shows,
+// using its own copy of the tables in ISO/IEC 18004 rather than the
+// encoder's, so a mistake in one is not repeated in the other.
+
+// Level M blocks by version: error correction codewords per block, then
+// the count and data codewords of each group
+var testQRBlocks = [...][5]int{
+	1:  {10, 1, 16, 0, 0},
+	2:  {16, 1, 28, 0, 0},
+	3:  {26, 1, 44, 0, 0},
+	4:  {18, 2, 32, 0, 0},
+	5:  {24, 2, 43, 0, 0},
+	6:  {16, 4, 27, 0, 0},
+	7:  {18, 4, 31, 0, 0},
+	8:  {22, 2, 38, 2, 39},
+	9:  {22, 3, 36, 2, 37},
+	10: {26, 4, 43, 1, 44},
+}
+
+// Alignment pattern centers by version
+var testQRAlignment = [...][]int{
+	2: {6, 18}, 3: {6, 22}, 4: {6, 26}, 5: {6, 30}, 6: {6, 34},
+	7: {6, 22, 38}, 8: {6, 24, 42}, 9: {6, 26, 46}, 10: {6, 28, 50},
+}
+
+// GF(256) with the QR polynomial x^8+x^4+x^3+x^2+1
+var gfExp, gfLog = func() (exp [512]byte, log [256]int) {
+	x := 1
+	for i := 0; i < 255; i++ {
+		exp[i] = byte(x)
+		log[x] = i
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11D
+		}
+	}
+	for i := 255; i < 512; i++ {
+		exp[i] = exp[i-255]
+	}
+	return exp, log
+}()
+
+// testQRSymbol is a decoded module grid, [row][column], true for dark
+type testQRSymbol [][]bool
+
+// Sample the modules of a PNG rendered with a four-module quiet zone. The
+// scale is found from the width of the top left finder pattern.
+func readQRImage(data []byte) (testQRSymbol, error) {
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	bounds := img.Bounds()
+	dark := func(x, y int) bool {
+		r, g, b, _ := img.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+		return r+g+b < 3*0x8000
+	}
+
+	// The first dark pixel on the diagonal is the finder's corner
+	start := -1
+	for i := 0; i < bounds.Dx() && i < bounds.Dy(); i++ {
+		if dark(i, i) {
+			start = i
+			break
+		}
+	}
+	if start < 0 {
+		return nil, errors.New("no finder pattern")
+	}
+	run := 0
+	for x := start; x < bounds.Dx() && dark(x, start); x++ {
+		run++
+	}
+	if run%7 != 0 || start != 4*run/7 {
+		return nil, fmt.Errorf("finder of %d pixels at %d", run, start)
+	}
+	scale := run / 7
+	size := bounds.Dx()/scale - 8
+	if bounds.Dx() != bounds.Dy() || (size-17)%4 != 0 {
+		return nil, fmt.Errorf("%dx%d image does not hold a symbol", bounds.Dx(), bounds.Dy())
+	}
+
+	symbol := make(testQRSymbol, size)
+	for row := range symbol {
+		symbol[row] = make([]bool, size)
+		for col := range symbol[row] {
+			symbol[row][col] = dark((col+4)*scale+scale/2, (row+4)*scale+scale/2)
+		}
+	}
+	return symbol, nil
+}
+
+// Remainder of a BCH code: data shifted left by the degree of the
+// generator, reduced modulo it
+func bchRemainder(data, generator, degree int) int {
+	rem := data << degree
+	for bit := 30; bit >= degree; bit-- {
+		if rem>>bit&1 != 0 {
+			rem ^= generator << (bit - degree)
+		}
+	}
+	return rem
+}
+
+// Read both copies of the format information and return the error
+// correction level bits and the mask
+func (s testQRSymbol) format() (level, mask int, err error) {
+	n := len(s)
+	bit := func(dark bool) int {
+		if dark {
+			return 1
+		}
+		return 0
+	}
+	var first, second int
+	// Around the top left finder, most significant bit first
+	for _, c := range [][2]int{{8, 0}, {8, 1}, {8, 2}, {8, 3}, {8, 4}, {8, 5}, {8, 7}, {8, 8}, {7, 8}, {5, 8}, {4, 8}, {3, 8}, {2, 8}, {1, 8}, {0, 8}} {
+		first = first<<1 | bit(s[c[0]][c[1]])
+	}
+	// Below the top right finder, then right of the bottom left one,
+	// least significant bit first
+	for i := 0; i < 8; i++ {
+		second |= bit(s[8][n-1-i]) << i
+	}
+	for i := 8; i < 15; i++ {
+		second |= bit(s[n-15+i][8]) << i
+	}
+	if !s[n-8][8] {
+		return 0, 0, errors.New("dark module is light")
+	}
+	if first != second {
+		return 0, 0, fmt.Errorf("format copies differ: %015b and %015b", first, second)
+	}
+	word := first ^ 0x5412
+	if bchRemainder(word>>10, 0x537, 10) != word&0x3FF {
+		return 0, 0, fmt.Errorf("format %015b is not a BCH codeword", first)
+	}
+	return word >> 13, word >> 10 & 7, nil
+}
+
+// Check both copies of the version information of versions 7 and up
+func (s testQRSymbol) checkVersion(version int) error {
+	if version < 7 {
+		return nil
+	}
+	n := len(s)
+	want := version<<12 | bchRemainder(version, 0x1F25, 12)
+	var below, beside int
+	for i := 17; i >= 0; i-- {
+		row, col := i/3, n-11+i%3
+		if s[row][col] {
+			below |= 1 << i
+		}
+		if s[col][row] {
+			beside |= 1 << i
+		}
+	}
+	if below != want || beside != want {
+		return fmt.Errorf("version information %018b and %018b, want %018b", below, beside, want)
+	}
+	return nil
+}
+
+// Modules that hold no codeword bits
+func testQRFunctionModules(version int) [][]bool {
+	n := 17 + 4*version
+	reserved := make([][]bool, n)
+	for row := range reserved {
+		reserved[row] = make([]bool, n)
+	}
+	fill := func(row0, col0, rows, cols int) {
+		for row := row0; row < row0+rows; row++ {
+			for col := col0; col < col0+cols; col++ {
+				reserved[row][col] = true
+			}
+		}
+	}
+	// Finders with separators and format information
+	fill(0, 0, 9, 9)
+	fill(0, n-8, 9, 8)
+	fill(n-8, 0, 8, 9)
+	// Timing patterns
+	fill(6, 0, 1, n)
+	fill(0, 6, n, 1)
+	// Alignment patterns clear of the finders
+	centers := testQRAlignment[version]
+	for _, row := range centers {
+		for _, col := range centers {
+			if (row < 9 && col < 9) || (row < 9 && col > n-9) || (row > n-9 && col < 9) {
+				continue
+			}
+			fill(row-2, col-2, 5, 5)
+		}
+	}
+	// Version information
+	if version >= 7 {
+		fill(0, n-11, 6, 3)
+		fill(n-11, 0, 3, 6)
+	}
+	return reserved
+}
+
+// Whether a mask pattern inverts the module at row i, column j
+func testQRMasked(mask, i, j int) bool {
+	switch mask {
+	case 0:
+		return (i+j)%2 == 0
+	case 1:
+		return i%2 == 0
+	case 2:
+		return j%3 == 0
+	case 3:
+		return (i+j)%3 == 0
+	case 4:
+		return (i/2+j/3)%2 == 0
+	case 5:
+		return (i*j)%2+(i*j)%3 == 0
+	case 6:
+		return ((i*j)%2+(i*j)%3)%2 == 0
+	default:
+		return ((i+j)%2+(i*j)%3)%2 == 0
+	}
+}
+
+// Decode a level M, byte mode symbol back to its text
+func decodeQR(s testQRSymbol) (string, int, error) {
+	n := len(s)
+	version := (n - 17) / 4
+	if version < 1 || version >= len(testQRBlocks) {
+		return "", 0, fmt.Errorf("unexpected size %d", n)
+	}
+	if err := s.checkVersion(version); err != nil {
+		return "", version, err
+	}
+	level, mask, err := s.format()
+	if err != nil {
+		return "", version, err
+	}
+	if level != 0 {
+		return "", version, fmt.Errorf("error correction level bits %02b, want M (00)", level)
+	}
+
+	// Read the unmasked codeword bits in zigzag order
+	reserved := testQRFunctionModules(version)
+	var stream []byte
+	var current byte
+	bits := 0
+	upward := true
+	for col := n - 1; col > 0; col -= 2 {
+		if col == 6 {
+			col--
+		}
+		for k := 0; k < n; k++ {
+			row := k
+			if upward {
+				row = n - 1 - k
+			}
+			for _, c := range []int{col, col - 1} {
+				if reserved[row][c] {
+					continue
+				}
+				dark := s[row][c] != testQRMasked(mask, row, c)
+				current <<= 1
+				if dark {
+					current |= 1
+				}
+				if bits++; bits%8 == 0 {
+					stream = append(stream, current)
+				}
+			}
+		}
+		upward = !upward
+	}
+
+	// Deinterleave the data and error correction codewords into blocks
+	b := testQRBlocks[version]
+	ecLen := b[0]
+	var blocks [][]byte
+	var dataLens []int
+	for i := 0; i < b[1]; i++ {
+		dataLens = append(dataLens, b[2])
+	}
+	for i := 0; i < b[3]; i++ {
+		dataLens = append(dataLens, b[4])
+	}
+	total := 0
+	for _, l := range dataLens {
+		blocks = append(blocks, make([]byte, 0, l+ecLen))
+		total += l + ecLen
+	}
+	if len(stream) < total {
+		return "", version, fmt.Errorf("%d codewords, want %d", len(stream), total)
+	}
+	pos := 0
+	for i := 0; i < b[4] || i < b[2]; i++ {
+		for k := range blocks {
+			if i < dataLens[k] {
+				blocks[k] = append(blocks[k], stream[pos])
+				pos++
+			}
+		}
+	}
+	for i := 0; i < ecLen; i++ {
+		for k := range blocks {
+			blocks[k] = append(blocks[k], stream[pos])
+			pos++
+		}
+	}
+
+	// Every block is a codeword of the Reed-Solomon code whose generator
+	// has the roots a^0 to a^(ecLen-1), so all syndromes are zero
+	var data []byte
+	for k, block := range blocks {
+		for root := 0; root < ecLen; root++ {
+			var syndrome byte
+			for _, c := range block {
+				if syndrome != 0 {
+					syndrome = gfExp[gfLog[syndrome]+root]
+				}
+				syndrome ^= c
+			}
+			if syndrome != 0 {
+				return "", version, fmt.Errorf("block %d has a nonzero syndrome at a^%d", k, root)
+			}
+		}
+		data = append(data, block[:dataLens[k]]...)
+	}
+
+	// A single byte mode segment with an 8 or 16 bit count
+	bit := func(i int) int { return int(data[i/8]>>(7-i%8)) & 1 }
+	read := func(at, width int) int {
+		v := 0
+		for i := 0; i < width; i++ {
+			v = v<<1 | bit(at+i)
+		}
+		return v
+	}
+	if m := read(0, 4); m != 4 {
+		return "", version, fmt.Errorf("mode %04b, want byte mode", m)
+	}
+	countBits := 8
+	if version >= 10 {
+		countBits = 16
+	}
+	count := read(4, countBits)
+	at := 4 + countBits
+	if at+8*count > 8*len(data) {
+		return "", version, fmt.Errorf("count %d overruns %d data codewords", count, len(data))
+	}
+	text := make([]byte, count)
+	for i := range text {
+		text[i] = byte(read(at+8*i, 8))
+	}
+	return string(text), version, nil
+}
+
+// Bytes level M holds in a version
+func testQRCapacity(version int) int {
+	b := testQRBlocks[version]
+	countBits := 8
+	if version >= 10 {
+		countBits = 16
+	}
+	return (8*(b[1]*b[2]+b[3]*b[4]) - 4 - countBits) / 8
+}
+
+func TestQRCodeDecodes(t *testing.T) {
+	texts := []string{
+		"",
+		"a",
+		totpURI("alice", "JBSWY3DPEHPK3PXP"),
+		totpURI("a-rather-long-user-name@example.com", "JBSWY3DPEHPK3PXPJBSWY3DPEHPK3PXP"),
+		"café ✓ \x00\xff",
+	}
+	// Both sides of every version boundary
+	for version := 1; version < len(testQRBlocks); version++ {
+		capacity := testQRCapacity(version)
+		texts = append(texts, strings.Repeat("x", capacity-1), strings.Repeat("y", capacity))
+	}
+
+	for _, text := range texts {
+		qr, err := encodeQR(text)
+		if err != nil {
+			t.Errorf("encoding %d bytes: %v", len(text), err)
+			continue
+		}
+		for _, scale := range []int{1, 3} {
+			data, err := qr.png(scale)
+			if err != nil {
+				t.Fatal(err)
+			}
+			symbol, err := readQRImage(data)
+			if err != nil {
+				t.Errorf("reading the image of %d bytes at scale %d: %v", len(text), scale, err)
+				continue
+			}
+			decoded, version, err := decodeQR(symbol)
+			if err != nil {
+				t.Errorf("decoding %d bytes: %v", len(text), err)
+				continue
+			}
+			if decoded != text {
+				t.Errorf("decoded %q, want %q", decoded, text)
+			}
+			// The smallest version that fits
+			if len(text) > testQRCapacity(version) || (version > 1 && len(text) <= testQRCapacity(version-1)) {
+				t.Errorf("%d bytes encoded in version %d", len(text), version)
+			}
+		}
+	}
+}
+
+func TestQRCodeTooLong(t *testing.T) {
+	if _, err := encodeQR(strings.Repeat("z", testQRCapacity(10)+1)); err != errQRTooLong {
+		t.Errorf("got %v, want errQRTooLong", err)
+	}
+}
+
+// Every mask the encoder can pick must decode
+func TestQRCodeMasks(t *testing.T) {
+	seen := map[int]bool{}
+	for i := 0; i < 400 && len(seen) < 8; i++ {
+		text := fmt.Sprintf("otpauth://totp/goChat:user%d?secret=%d", i, i*7919)
+		qr, err := encodeQR(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := qr.png(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		symbol, err := readQRImage(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, mask, err := symbol.format()
+		if err != nil {
+			t.Fatalf("%q: %v", text, err)
+		}
+		seen[mask] = true
+		if decoded, _, err := decodeQR(symbol); err != nil || decoded != text {
+			t.Errorf("mask %d: decoded %q, %v", mask, decoded, err)
+		}
+	}
+	if len(seen) < 8 {
+		t.Logf("only masks %v were chosen", seen)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+
+	"gochat/internal/store"
+)
+
+// recentChats.json is an index derived from the message history: for every
+// conversation, each participant has one entry describing its latest
+// message. The message history (chats.json plus chats.log) is the source
+// of truth. The index is written in the same locked step as each message,
+// and when it can't be trusted (missing, unreadable, inconsistent or after
+// a failed write) it is rebuilt from the history plus the archive, so
+// recent chats of fully archived conversations survive a rebuild.
+
+// Set when a write of recentChats.json failed after chats.json was saved.
+// The next reader rebuilds the index. Guarded by storeMu.
+var recentChatsStale bool
+
+// Derive the whole index from the hot messages and, for conversations
+// that only exist in the archive, the latest archived message
+func buildRecentChats(messages []Message) (RecentChatsData, error) {
+	latest := store.LatestMessages(messages)
+
+	archiveMu.Lock()
+	defer archiveMu.Unlock()
+	index, err := loadArchiveIndex()
+	if err != nil {
+		return RecentChatsData{}, err
+	}
+	if err := store.AddArchivedLatest(latest, index, readArchiveSegment); err != nil {
+		return RecentChatsData{}, err
+	}
+	return store.RecentChatsFromLatest(latest), nil
+}
+
+// Rebuild recentChats.json from chats.json and the archive. The caller
+// must hold storeMu.
+func rebuildRecentChats() (RecentChatsData, error) {
+	chatsData, err := loadChats()
+	if err != nil {
+		return RecentChatsData{}, err
+	}
+	recentChatsData, err := buildRecentChats(chatsData.Messages)
+	if err != nil {
+		return recentChatsData, err
+	}
+	if err := saveRecentChats(recentChatsData); err != nil {
+		return recentChatsData, err
+	}
+	recentChatsStale = false
+	return recentChatsData, nil
+}
+
+// Read the index, rebuilding it first if the last write failed or the
+// file can't be parsed. The caller must hold storeMu.
+func currentRecentChats() (RecentChatsData, error) {
+	if !recentChatsStale {
+		recentChatsData, err := loadRecentChats()
+		if err == nil {
+			return recentChatsData, nil
+		}
+		fmt.Println("Rebuilding recent chats:", err)
+	}
+	return rebuildRecentChats()
+}
+
+// Check recentChats.json against chats.json and the archive index
+func verifyRecentChats() ([]string, error) {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+
+	chatsData, err := loadChats()
+	if err != nil {
+		return nil, err
+	}
+	archiveMu.Lock()
+	index, err := loadArchiveIndex()
+	archiveMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	recentChatsData, err := loadRecentChats()
+	if err != nil {
+		return []string{err.Error()}, nil
+	}
+	return store.CheckRecentChats(recentChatsData, chatsData.Messages, index), nil
+}
+
+// Run at startup: rebuild the index if it is missing or doesn't match the
+// message history
+func ensureRecentChats() error {
+	problems, err := verifyRecentChats()
+	if err != nil {
+		return err
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+
+	fmt.Printf("Recent chats index has %d problems, rebuilding:\n", len(problems))
+	for _, problem := range problems {
+		fmt.Println("  " + problem)
+	}
+	storeMu.Lock()
+	defer storeMu.Unlock()
+	recentChatsData, err := rebuildRecentChats()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Rebuilt recent chats with %d entries\n", len(recentChatsData.Chats))
+	return nil
+}
+
+// Summarize a user's conversations from their messages, newest first
+func contactSummaries(userId string, messages []Message) []ContactInfo {
+	summaries := []ContactInfo{}
+	for _, chat := range store.RecentChatsFromLatest(store.LatestMessages(messages)).Chats {
+		if chat.UserId == userId {
+			summaries = append(summaries, ContactInfo{
+				UserId:      chat.ContactId,
+				LastMessage: chat.LastMessage,
+				Timestamp:   chat.Timestamp,
+			})
+		}
+	}
+	return summaries
+}
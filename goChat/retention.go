@@ -0,0 +1,507 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gochat/internal/store"
+)
+
+// Old messages are moved out of chats.json by the compaction job. Each
+// message falls under the policy of whichever participant keeps history
+// for the shorter time; when both keep it equally long, archiving wins
+// over deleting. Archived messages are written to gzip-compressed JSON
+// Lines segments under archive/, listed in archive/index.json, and can
+// still be searched and fetched through the API. Disappearing messages are
+// left for the sweeper and never archived.
+
+// The settings and archive formats are shared with gochat-admin through
+// internal/store
+type (
+	RetentionRule   = store.RetentionRule
+	UserRetention   = store.UserRetention
+	RetentionConfig = store.RetentionConfig
+	ArchiveSegment  = store.ArchiveSegment
+	ArchiveIndex    = store.ArchiveIndex
+)
+
+// Retention settings
+const (
+	archiveDir         = store.ArchiveDir
+	archiveSegmentSize = store.ArchiveSegmentSize
+	compactionInterval = time.Hour
+	maxRetentionDays   = 3650
+	maxSearchResults   = 200
+)
+
+// Guards retention.json
+var retentionMu sync.Mutex
+
+// Guards the archive directory and its index
+var archiveMu sync.Mutex
+
+// Read retention settings, defaulting to keeping everything
+func loadRetention() (RetentionConfig, error) {
+	return store.LoadRetention(".")
+}
+
+// Write retention settings to retention.json
+func saveRetention(config RetentionConfig) error {
+	newData, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic("retention.json", newData, 0644)
+}
+
+// Check a rule supplied by a user or the config file
+func validateRetentionRule(rule RetentionRule) error {
+	if rule.Days < 0 || rule.Days > maxRetentionDays {
+		return fmt.Errorf("days must be between 0 and %d", maxRetentionDays)
+	}
+	if rule.Action != "archive" && rule.Action != "delete" {
+		return errors.New(`action must be "archive" or "delete"`)
+	}
+	return nil
+}
+
+// Read the archive index
+func loadArchiveIndex() (ArchiveIndex, error) {
+	return store.LoadArchiveIndex(".")
+}
+
+// Write the archive index through a temporary file so it's never half-written
+func saveArchiveIndex(index ArchiveIndex) error {
+	return store.SaveArchiveIndex(".", index)
+}
+
+// Write messages to a new compressed segment and describe it
+func writeArchiveSegment(messages []Message) (ArchiveSegment, error) {
+	segment := store.NewSegment(messages)
+	sealed, err := sealMessages(messages)
+	if err != nil {
+		return segment, err
+	}
+	return segment, store.WriteSegment(".", segment.File, sealed)
+}
+
+// Read every message in one segment
+func readArchiveSegment(segment ArchiveSegment) ([]Message, error) {
+	messages, err := store.ReadSegment(".", segment)
+	if err != nil {
+		return nil, err
+	}
+	if err := openMessages(messages); err != nil {
+		return nil, fmt.Errorf("%s: %w", segment.File, err)
+	}
+	return messages, nil
+}
+
+// Collect archived messages involving userId, optionally limited to one
+// contact, that match keep. Segments without the user are skipped, and so
+// are disappearing messages archived before compaction left them alone.
+func loadArchivedMessages(userId, contactId string, keep func(Message) bool) ([]Message, error) {
+	archiveMu.Lock()
+	defer archiveMu.Unlock()
+
+	index, err := loadArchiveIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	results := []Message{}
+	for _, segment := range index.Segments {
+		i := sort.SearchStrings(segment.Users, userId)
+		if i == len(segment.Users) || segment.Users[i] != userId {
+			continue
+		}
+
+		messages, err := readArchiveSegment(segment)
+		if err != nil {
+			return nil, err
+		}
+		for _, message := range messages {
+			if message.Sender != userId && message.Receiver != userId {
+				continue
+			}
+			if contactId != "" && message.Sender != contactId && message.Receiver != contactId {
+				continue
+			}
+			if message.Expired(now) {
+				continue
+			}
+			if keep == nil || keep(message) {
+				results = append(results, message)
+			}
+		}
+	}
+	return results, nil
+}
+
+// Apply the retention policies: move messages past their retention period
+// into archive segments or delete them. Expired disappearing messages are
+// deleted too, and ones still waiting to expire stay in chats.json for the
+// sweeper. The segments are written before chats.json, so a crash in
+// between can duplicate messages in the archive but never lose them.
+func compactMessages(now time.Time) (archived, deleted int, err error) {
+	retentionMu.Lock()
+	config, err := loadRetention()
+	retentionMu.Unlock()
+	if err != nil {
+		return 0, 0, fmt.Errorf("reading retention.json: %w", err)
+	}
+
+	storeMu.Lock()
+	defer storeMu.Unlock()
+
+	chatsData, err := loadChats()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	kept, toArchive, dropped := config.Compact(chatsData.Messages, now)
+	if len(toArchive) == 0 && len(dropped) == 0 {
+		return 0, 0, nil
+	}
+	deletedFrom := map[[2]string]bool{}
+	for _, message := range dropped {
+		deletedFrom[store.ConversationKey(message.Sender, message.Receiver)] = true
+	}
+	deleted = len(dropped)
+
+	if len(toArchive) > 0 {
+		archiveMu.Lock()
+		index, err := loadArchiveIndex()
+		for start := 0; err == nil && start < len(toArchive); start += archiveSegmentSize {
+			end := start + archiveSegmentSize
+			if end > len(toArchive) {
+				end = len(toArchive)
+			}
+			var segment ArchiveSegment
+			segment, err = writeArchiveSegment(toArchive[start:end])
+			if err == nil {
+				index.Segments = append(index.Segments, segment)
+			}
+		}
+		if err == nil {
+			err = saveArchiveIndex(index)
+		}
+		archiveMu.Unlock()
+		if err != nil {
+			return 0, 0, fmt.Errorf("writing archive: %w", err)
+		}
+	}
+
+	chatsData.Messages = kept
+	if err := saveChats(chatsData); err != nil {
+		return 0, 0, err
+	}
+
+	// Deleted messages may have been the last message of a conversation.
+	// Archived ones still count as history there.
+	if len(deletedFrom) > 0 {
+		if err := refreshRecentChats(deletedFrom, append(kept, toArchive...)); err != nil {
+			return len(toArchive), deleted, err
+		}
+		if err := purgeDeletedMessages(func(message Message) bool { return config.Deletes(message, now) }); err != nil {
+			return len(toArchive), deleted, fmt.Errorf("purging %s: %w", changeLogFile, err)
+		}
+	}
+	return len(toArchive), deleted, nil
+}
+
+// Run compaction once and log the outcome
+func runCompaction() {
+	archived, deleted, err := compactMessages(time.Now())
+	if err != nil {
+		fmt.Println("Error compacting messages:", err)
+		return
+	}
+	if archived > 0 || deleted > 0 {
+		fmt.Printf("Compaction archived %d and deleted %d messages\n", archived, deleted)
+	}
+}
+
+// Run compaction in the background
+func startCompactor() {
+	go func() {
+		runCompaction()
+		ticker := time.NewTicker(compactionInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			runCompaction()
+		}
+	}()
+}
+
+// Handler for reading the retention rule that applies to a user
+func getRetention(w http.ResponseWriter, r *http.Request) {
+	userId := r.URL.Query().Get("user")
+	if userId == "" {
+		writeError(w, http.StatusBadRequest, "missing_parameter", "User ID is required", "user")
+		return
+	}
+	if !requireUser(w, userId, "user") {
+		return
+	}
+
+	retentionMu.Lock()
+	config, err := loadRetention()
+	retentionMu.Unlock()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error reading retention.json: "+err.Error(), "")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":   true,
+		"retention": config.RuleFor(userId),
+	})
+}
+
+// Handler for setting a user's own retention rule
+func setRetention(w http.ResponseWriter, r *http.Request) {
+	userId := r.URL.Query().Get("user")
+	if userId == "" {
+		writeError(w, http.StatusBadRequest, "missing_parameter", "User ID is required", "user")
+		return
+	}
+	if !requireUser(w, userId, "user") {
+		return
+	}
+
+	var rule RetentionRule
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_json", "Invalid JSON: "+err.Error(), "")
+		return
+	}
+	if err := validateRetentionRule(rule); err != nil {
+		field := "days"
+		if strings.HasPrefix(err.Error(), "action") {
+			field = "action"
+		}
+		writeError(w, http.StatusBadRequest, "invalid_field", err.Error(), field)
+		return
+	}
+
+	retentionMu.Lock()
+	defer retentionMu.Unlock()
+
+	config, err := loadRetention()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error reading retention.json: "+err.Error(), "")
+		return
+	}
+	found := false
+	for i, override := range config.Users {
+		if override.UserId == userId {
+			config.Users[i].RetentionRule = rule
+			found = true
+			break
+		}
+	}
+	if !found {
+		config.Users = append(config.Users, UserRetention{UserId: userId, RetentionRule: rule})
+	}
+	if err := saveRetention(config); err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error writing to retention.json: "+err.Error(), "")
+		return
+	}
+
+	fmt.Printf("Retention for %s set to %d days (%s)\n", userId, rule.Days, rule.Action)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":   true,
+		"retention": rule,
+	})
+}
+
+// Handler for fetching archived messages, for one conversation or all of
+// a user's conversations
+func getArchivedMessages(w http.ResponseWriter, r *http.Request) {
+	userId := r.URL.Query().Get("user")
+	contactId := r.URL.Query().Get("contact")
+	if userId == "" {
+		writeError(w, http.StatusBadRequest, "missing_parameter", "User ID is required", "user")
+		return
+	}
+	if !requireUser(w, userId, "user") {
+		return
+	}
+
+	messages, err := loadArchivedMessages(userId, contactId, nil)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error reading archive: "+err.Error(), "")
+		return
+	}
+	sort.SliceStable(messages, func(i, j int) bool {
+		return messages[i].Timestamp.Before(messages[j].Timestamp)
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":  true,
+		"messages": messages,
+	})
+}
+
+// Handler for searching a user's messages, including archived history.
+// Results are newest first.
+func searchMessages(w http.ResponseWriter, r *http.Request) {
+	userId := r.URL.Query().Get("user")
+	contactId := r.URL.Query().Get("contact")
+	term := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("q")))
+	if userId == "" || term == "" {
+		field := "user"
+		if userId != "" {
+			field = "q"
+		}
+		writeError(w, http.StatusBadRequest, "missing_parameter", "Missing user or search term", field)
+		return
+	}
+	if !requireUser(w, userId, "user") {
+		return
+	}
+
+	limit := maxSearchResults
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 {
+			writeError(w, http.StatusBadRequest, "invalid_field", "Limit must be a positive number", "limit")
+			return
+		}
+		if parsed < limit {
+			limit = parsed
+		}
+	}
+
+	now := time.Now()
+	matches := func(message Message) bool {
+		if message.Sender != userId && message.Receiver != userId {
+			return false
+		}
+		if message.Expired(now) {
+			return false
+		}
+		if contactId != "" && message.Sender != contactId && message.Receiver != contactId {
+			return false
+		}
+		if message.Type == messageTypeE2E {
+			return false // The server can't read encrypted messages
+		}
+		return strings.Contains(strings.ToLower(message.Content), term)
+	}
+
+	storeMu.Lock()
+	chatsData, err := loadChats()
+	storeMu.Unlock()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error reading chats.json: "+err.Error(), "")
+		return
+	}
+	results := []Message{}
+	for _, message := range chatsData.Messages {
+		if matches(message) {
+			results = append(results, message)
+		}
+	}
+
+	if r.URL.Query().Get("archive") != "false" {
+		archived, err := loadArchivedMessages(userId, contactId, matches)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "internal_error", "Error reading archive: "+err.Error(), "")
+			return
+		}
+		results = append(results, archived...)
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Timestamp.After(results[j].Timestamp)
+	})
+	if len(results) > limit {
+		results = results[:limit]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":  true,
+		"messages": results,
+	})
+}
+
+// Remove every archived message sent or received by the given users,
+// rewriting the segments they appear in. Returns the number removed.
+func purgeArchivedMessages(users map[string]bool) (int, error) {
+	archiveMu.Lock()
+	defer archiveMu.Unlock()
+
+	index, err := loadArchiveIndex()
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	segments := []ArchiveSegment{}
+	var obsolete []string
+	for _, segment := range index.Segments {
+		involved := false
+		for _, user := range segment.Users {
+			if users[user] {
+				involved = true
+				break
+			}
+		}
+		if !involved {
+			segments = append(segments, segment)
+			continue
+		}
+
+		messages, err := readArchiveSegment(segment)
+		if err != nil {
+			return removed, err
+		}
+		kept := messages[:0]
+		for _, message := range messages {
+			if users[message.Sender] || users[message.Receiver] {
+				continue
+			}
+			kept = append(kept, message)
+		}
+		removed += len(messages) - len(kept)
+
+		// Replace the segment with a rewritten one, or drop it if it's empty
+		if len(kept) > 0 {
+			replacement, err := writeArchiveSegment(kept)
+			if err != nil {
+				return removed, err
+			}
+			segments = append(segments, replacement)
+		}
+		obsolete = append(obsolete, segment.File)
+	}
+
+	if len(obsolete) == 0 {
+		return 0, nil
+	}
+
+	// Old segments are only deleted once the index no longer lists them
+	index.Segments = segments
+	if err := saveArchiveIndex(index); err != nil {
+		return removed, err
+	}
+	for _, file := range obsolete {
+		os.Remove(filepath.Join(archiveDir, file))
+	}
+	return removed, nil
+}
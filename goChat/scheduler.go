@@ -0,0 +1,290 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"gochat/internal/envelope"
+	"gochat/internal/store"
+)
+
+// scheduled.json holds messages waiting for delivery
+type (
+	ScheduledMessage = store.ScheduledMessage
+	ScheduledData    = store.ScheduledData
+)
+
+// How often the scheduler looks for due messages
+const schedulerInterval = 5 * time.Second
+
+// Guards scheduled.json
+var scheduledMu sync.Mutex
+
+// Read pending messages from scheduled.json
+func loadScheduled() (ScheduledData, error) {
+	scheduledData := ScheduledData{Messages: []ScheduledMessage{}}
+
+	data, err := os.ReadFile("scheduled.json")
+	if os.IsNotExist(err) {
+		return scheduledData, nil
+	}
+	if err != nil {
+		return scheduledData, err
+	}
+
+	if err := json.Unmarshal(data, &scheduledData); err != nil {
+		return scheduledData, err
+	}
+	for i, scheduled := range scheduledData.Messages {
+		if scheduledData.Messages[i].Content, err = openText(scheduled.Content, envelope.ScheduledContext(scheduled.Id)); err != nil {
+			return scheduledData, fmt.Errorf("decrypting scheduled.json: %w", err)
+		}
+	}
+	return scheduledData, nil
+}
+
+// Write pending messages to scheduled.json
+func saveScheduled(scheduledData ScheduledData) error {
+	sealed := ScheduledData{Messages: make([]ScheduledMessage, len(scheduledData.Messages))}
+	for i, scheduled := range scheduledData.Messages {
+		content, err := sealText(scheduled.Content, envelope.ScheduledContext(scheduled.Id))
+		if err != nil {
+			return err
+		}
+		scheduled.Content = content
+		sealed.Messages[i] = scheduled
+	}
+	newData, err := json.MarshalIndent(sealed, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic("scheduled.json", newData, 0644)
+}
+
+// Persist a message for later delivery by the scheduler
+func scheduleMessage(sender, receiver, content string, sendAt time.Time) (ScheduledMessage, error) {
+	scheduled := ScheduledMessage{
+		Id:        randomHex(8),
+		Sender:    sender,
+		Receiver:  receiver,
+		Content:   content,
+		SendAt:    sendAt,
+		CreatedAt: time.Now(),
+	}
+
+	scheduledMu.Lock()
+	defer scheduledMu.Unlock()
+
+	scheduledData, err := loadScheduled()
+	if err != nil {
+		return scheduled, err
+	}
+	scheduledData.Messages = append(scheduledData.Messages, scheduled)
+	if err := saveScheduled(scheduledData); err != nil {
+		return scheduled, err
+	}
+
+	fmt.Printf("Scheduled message %s: %s -> %s at %s\n", scheduled.Id, sender, receiver, sendAt.Format(time.RFC3339))
+	return scheduled, nil
+}
+
+// IDs of the messages in chats.json and chats.log
+func storedMessageIds() (map[string]bool, error) {
+	storeMu.Lock()
+	chatsData, err := loadChats()
+	storeMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	ids := make(map[string]bool, len(chatsData.Messages))
+	for _, message := range chatsData.Messages {
+		ids[message.Id] = true
+	}
+	return ids, nil
+}
+
+// Deliver every pending message that is due. Messages stay in
+// scheduled.json until they've been stored, so a crash mid-delivery
+// retries them on the next run instead of losing them. A message keeps
+// its scheduled ID, so one stored just before the crash isn't stored again.
+func deliverDueMessages(now time.Time) {
+	scheduledMu.Lock()
+	defer scheduledMu.Unlock()
+
+	scheduledData, err := loadScheduled()
+	if err != nil {
+		fmt.Println("Error reading scheduled.json:", err)
+		return
+	}
+
+	pending := []ScheduledMessage{}
+	delivered, dropped := 0, 0
+	var stored map[string]bool
+	for _, scheduled := range scheduledData.Messages {
+		if scheduled.SendAt.After(now) {
+			pending = append(pending, scheduled)
+			continue
+		}
+
+		if stored == nil {
+			if stored, err = storedMessageIds(); err != nil {
+				fmt.Println("Error reading chats:", err)
+				return
+			}
+		}
+		if stored[scheduled.Id] {
+			delivered++
+			continue
+		}
+
+		// Disabled senders can't send messages, scheduled or not
+		if sender, exists, err := findUser(scheduled.Sender); err != nil {
+			fmt.Printf("Error delivering scheduled message %s: %v\n", scheduled.Id, err)
+			pending = append(pending, scheduled)
+			continue
+		} else if !exists || sender.Disabled {
+			fmt.Printf("Dropped scheduled message %s: %s is disabled or deleted\n", scheduled.Id, scheduled.Sender)
+			dropped++
+			continue
+		}
+
+		// The receiver may have blocked the sender since it was scheduled
+		if allowed, err := checkMessagingAllowed(scheduled.Sender, scheduled.Receiver, ""); err != nil {
+			fmt.Printf("Error delivering scheduled message %s: %v\n", scheduled.Id, err)
+			pending = append(pending, scheduled)
+			continue
+		} else if !allowed {
+			fmt.Printf("Dropped scheduled message %s: %s no longer accepts messages from %s\n", scheduled.Id, scheduled.Receiver, scheduled.Sender)
+			dropped++
+			continue
+		}
+
+		// The delivery time becomes the message timestamp so it sorts
+		// where it appears in the conversation
+		message := Message{
+			Id:        scheduled.Id,
+			Sender:    scheduled.Sender,
+			Receiver:  scheduled.Receiver,
+			Content:   scheduled.Content,
+			Timestamp: time.Now(),
+			IsRead:    false,
+		}
+		if err := storeMessage(message); err != nil {
+			fmt.Printf("Error delivering scheduled message %s: %v\n", scheduled.Id, err)
+			pending = append(pending, scheduled)
+			continue
+		}
+		delivered++
+	}
+
+	if delivered == 0 && dropped == 0 {
+		return
+	}
+	scheduledData.Messages = pending
+	if err := saveScheduled(scheduledData); err != nil {
+		fmt.Println("Error writing to scheduled.json:", err)
+		return
+	}
+	fmt.Printf("Delivered %d scheduled messages\n", delivered)
+}
+
+// Run the scheduler loop. Overdue messages, e.g. ones that came due while
+// the server was stopped, are delivered on the first pass.
+func startScheduler() {
+	go func() {
+		deliverDueMessages(time.Now())
+		ticker := time.NewTicker(schedulerInterval)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			deliverDueMessages(now)
+		}
+	}()
+}
+
+// Handler for listing the user's pending scheduled messages
+func listScheduled(w http.ResponseWriter, r *http.Request) {
+	userId := r.URL.Query().Get("user")
+	if userId == "" {
+		writeError(w, http.StatusBadRequest, "missing_parameter", "User ID is required", "user")
+		return
+	}
+
+	scheduledMu.Lock()
+	scheduledData, err := loadScheduled()
+	scheduledMu.Unlock()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error reading scheduled.json: "+err.Error(), "")
+		return
+	}
+
+	userScheduled := []ScheduledMessage{}
+	for _, scheduled := range scheduledData.Messages {
+		if scheduled.Sender == userId {
+			userScheduled = append(userScheduled, scheduled)
+		}
+	}
+
+	// Soonest first
+	sort.Slice(userScheduled, func(i, j int) bool {
+		return userScheduled[i].SendAt.Before(userScheduled[j].SendAt)
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":   true,
+		"scheduled": userScheduled,
+	})
+}
+
+// Handler for cancelling one of the user's scheduled messages
+func cancelScheduled(w http.ResponseWriter, r *http.Request) {
+	userId := r.URL.Query().Get("user")
+	scheduledId := r.URL.Query().Get("id")
+	if userId == "" || scheduledId == "" {
+		field := "user"
+		if userId != "" {
+			field = "id"
+		}
+		writeError(w, http.StatusBadRequest, "missing_parameter", "Missing user or scheduled message ID", field)
+		return
+	}
+
+	scheduledMu.Lock()
+	defer scheduledMu.Unlock()
+
+	scheduledData, err := loadScheduled()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error reading scheduled.json: "+err.Error(), "")
+		return
+	}
+
+	remaining := []ScheduledMessage{}
+	found := false
+	for _, scheduled := range scheduledData.Messages {
+		if scheduled.Id == scheduledId && scheduled.Sender == userId {
+			found = true
+			continue
+		}
+		remaining = append(remaining, scheduled)
+	}
+	if !found {
+		// Already delivered, cancelled, or someone else's
+		writeError(w, http.StatusNotFound, "scheduled_not_found", "No such pending message", "id")
+		return
+	}
+
+	scheduledData.Messages = remaining
+	if err := saveScheduled(scheduledData); err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error writing to scheduled.json: "+err.Error(), "")
+		return
+	}
+
+	fmt.Printf("Scheduled message %s cancelled by %s\n", scheduledId, userId)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{"success": true})
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// A message stored just before a crash isn't delivered again, and
+// messages of senders disabled since scheduling are dropped
+func TestScheduledDelivery(t *testing.T) {
+	useDataDir(t, User{UserId: "alice", Password: "alice1234"}, User{UserId: "bob", Password: "bob12345"})
+
+	sendAt := time.Now().Add(time.Minute)
+	stored, err := scheduleMessage("alice", "bob", "stored before the crash", sendAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := scheduleMessage("alice", "bob", "due", sendAt); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := scheduleMessage("bob", "alice", "from a disabled sender", sendAt); err != nil {
+		t.Fatal(err)
+	}
+	if err := storeMessage(Message{Id: stored.Id, Sender: "alice", Receiver: "bob", Content: stored.Content, Timestamp: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := updateUser("bob", func(user *User) { user.Disabled = true }); err != nil {
+		t.Fatal(err)
+	}
+
+	deliverDueMessages(sendAt)
+
+	storeMu.Lock()
+	chatsData, err := loadChats()
+	storeMu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chatsData.Messages) != 2 || chatsData.Messages[0].Id != stored.Id || chatsData.Messages[1].Content != "due" {
+		t.Errorf("stored %+v", chatsData.Messages)
+	}
+	scheduledData, err := loadScheduled()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(scheduledData.Messages) != 0 {
+		t.Errorf("still scheduled: %+v", scheduledData.Messages)
+	}
+}
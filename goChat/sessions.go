@@ -0,0 +1,529 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Every login registers the device as a session with its own token. The
+// token is returned once and set as the gochat_session cookie; clients
+// that don't use cookies send it in the X-GoChat-Session header. Sessions
+// are what the sync endpoint and "log out my other devices" work with.
+// Every request that acts for a user needs a live session of that user;
+// a token that has been revoked is refused everywhere.
+
+// Cookie and header carrying the session token
+const (
+	sessionCookie = "gochat_session"
+	sessionHeader = "X-GoChat-Session"
+)
+
+// Longest device name kept for a session
+const maxDeviceNameLength = 64
+
+// Session struct to store a logged-in device in sessions.json
+type Session struct {
+	Id         string    `json:"id"`
+	UserId     string    `json:"userId"`
+	DeviceName string    `json:"deviceName"`
+	TokenHash  string    `json:"tokenHash"` // SHA-256 of the token, which itself is never stored
+	CreatedAt  time.Time `json:"createdAt"`
+	LastSeenAt time.Time `json:"lastSeenAt"`
+	SyncSeq    uint64    `json:"syncSeq"` // Position in the change log this device has synced up to
+
+	SecondFactor bool `json:"secondFactor,omitempty"` // The login passed two-factor authentication
+}
+
+// SessionsData struct to match our JSON structure
+type SessionsData struct {
+	Sessions []Session `json:"sessions"`
+}
+
+// SessionInfo is a session as shown to its user
+type SessionInfo struct {
+	Id         string    `json:"id"`
+	DeviceName string    `json:"deviceName"`
+	CreatedAt  time.Time `json:"createdAt"`
+	LastSeenAt time.Time `json:"lastSeenAt"`
+	Current    bool      `json:"current"` // The session making the request
+}
+
+// LoginRequest struct for logging in. DeviceName labels the new session;
+// it defaults to a description of the client.
+type LoginRequest struct {
+	UserId     string `json:"userId"`
+	Password   string `json:"password"`
+	DeviceName string `json:"deviceName,omitempty"`
+}
+
+// Guards sessions.json
+var sessionsMu sync.Mutex
+
+// Read all sessions from sessions.json
+func loadSessions() (SessionsData, error) {
+	sessionsData := SessionsData{Sessions: []Session{}}
+
+	data, err := os.ReadFile("sessions.json")
+	if os.IsNotExist(err) {
+		return sessionsData, nil
+	}
+	if err != nil {
+		return sessionsData, err
+	}
+
+	err = json.Unmarshal(data, &sessionsData)
+	return sessionsData, err
+}
+
+// Write all sessions to sessions.json. Token hashes are as good as
+// passwords for guessing, so the file is only readable by the server.
+func saveSessions(sessionsData SessionsData) error {
+	newData, err := json.MarshalIndent(sessionsData, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic("sessions.json", newData, 0600)
+}
+
+// Hash a session token for storage and lookup
+func hashSessionToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Session token sent with a request, if any
+func sessionToken(r *http.Request) string {
+	if token := r.Header.Get(sessionHeader); token != "" {
+		return token
+	}
+	if cookie, err := r.Cookie(sessionCookie); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
+
+// Guess a device name from the User-Agent header, e.g. "Firefox on Linux"
+func describeDevice(userAgent string) string {
+	platform := ""
+	for _, p := range []struct{ marker, name string }{
+		{"iPhone", "iPhone"}, {"iPad", "iPad"}, {"Android", "Android"},
+		{"Windows", "Windows"}, {"Macintosh", "macOS"}, {"Linux", "Linux"},
+	} {
+		if strings.Contains(userAgent, p.marker) {
+			platform = p.name
+			break
+		}
+	}
+	client := ""
+	for _, b := range []struct{ marker, name string }{
+		{"Firefox/", "Firefox"}, {"Edg/", "Edge"}, {"Chrome/", "Chrome"}, {"Safari/", "Safari"},
+		{"curl/", "curl"}, {"Go-http-client/", "Go client"},
+	} {
+		if strings.Contains(userAgent, b.marker) {
+			client = b.name
+			break
+		}
+	}
+	switch {
+	case client != "" && platform != "":
+		return client + " on " + platform
+	case client != "":
+		return client
+	case platform != "":
+		return platform
+	}
+	return "Unknown device"
+}
+
+// Register a new session for a user who just logged in. Returns the
+// session and its token.
+func createSession(userId, deviceName string, secondFactor bool) (Session, string, error) {
+	deviceName = normalizeText(deviceName)
+	if len([]rune(deviceName)) > maxDeviceNameLength {
+		deviceName = string([]rune(deviceName)[:maxDeviceNameLength])
+	}
+
+	// New devices start at the head of the change log; what came before
+	// is loaded in full at login
+	storeMu.Lock()
+	head, err := changeLogHead()
+	storeMu.Unlock()
+	if err != nil {
+		return Session{}, "", err
+	}
+
+	token := randomHex(32)
+	now := time.Now()
+	session := Session{
+		Id:         randomHex(8),
+		UserId:     userId,
+		DeviceName: deviceName,
+		TokenHash:  hashSessionToken(token),
+		CreatedAt:  now,
+		LastSeenAt: now,
+		SyncSeq:    head,
+
+		SecondFactor: secondFactor,
+	}
+
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	sessionsData, err := loadSessions()
+	if err != nil {
+		return Session{}, "", err
+	}
+	sessionsData.Sessions = append(sessionsData.Sessions, session)
+	if err := saveSessions(sessionsData); err != nil {
+		return Session{}, "", err
+	}
+	return session, token, nil
+}
+
+// Look up the session a token belongs to
+func findSession(token string) (Session, bool, error) {
+	sessionsMu.Lock()
+	sessionsData, err := loadSessions()
+	sessionsMu.Unlock()
+	if err != nil {
+		return Session{}, false, err
+	}
+	hash := hashSessionToken(token)
+	for _, session := range sessionsData.Sessions {
+		if session.TokenHash == hash {
+			return session, true, nil
+		}
+	}
+	return Session{}, false, nil
+}
+
+// Change a stored session
+func updateSession(id string, update func(*Session)) error {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	sessionsData, err := loadSessions()
+	if err != nil {
+		return err
+	}
+	for i := range sessionsData.Sessions {
+		if sessionsData.Sessions[i].Id == id {
+			update(&sessionsData.Sessions[i])
+			return saveSessions(sessionsData)
+		}
+	}
+	return nil
+}
+
+// Delete the sessions matching a filter, returning how many were removed
+func revokeSessions(match func(Session) bool) (int, error) {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	sessionsData, err := loadSessions()
+	if err != nil {
+		return 0, err
+	}
+	kept := []Session{}
+	for _, session := range sessionsData.Sessions {
+		if !match(session) {
+			kept = append(kept, session)
+		}
+	}
+	revoked := len(sessionsData.Sessions) - len(kept)
+	if revoked == 0 {
+		return 0, nil
+	}
+	sessionsData.Sessions = kept
+	return revoked, saveSessions(sessionsData)
+}
+
+// Log a user out everywhere, e.g. after an admin disables the account
+func revokeUserSessions(users map[string]bool) (int, error) {
+	return revokeSessions(func(session Session) bool { return users[session.UserId] })
+}
+
+// Set the session cookie after a login
+func setSessionCookie(w http.ResponseWriter, token string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// Remove the session cookie
+func clearSessionCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: "", Path: "/", MaxAge: -1, HttpOnly: true})
+}
+
+// Find the session making the request. Writes a 401 and returns false if
+// there is none or it was revoked.
+func authenticateSession(w http.ResponseWriter, r *http.Request) (Session, bool) {
+	token := sessionToken(r)
+	if token == "" {
+		writeError(w, http.StatusUnauthorized, "missing_session", "Log in to get a session token", "")
+		return Session{}, false
+	}
+	session, exists, err := findSession(token)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error reading sessions.json: "+err.Error(), "")
+		return Session{}, false
+	}
+	if !exists {
+		writeError(w, http.StatusUnauthorized, "session_revoked", "This device has been logged out", "")
+		return Session{}, false
+	}
+	return session, true
+}
+
+// Paths that work without a valid session: the login page and the pages
+// that only redirect to the dashboard, logging in, registering, the links
+// mailed to users, static files and the API description. Changing the
+// password takes the old one; it is done from the login page after an
+// admin reset.
+func sessionExempt(path string) bool {
+	switch path {
+	case "/", "/login", "/register", "/api/v1/login", "/api/v1/register", "/openapi.json",
+		"/redirect", "/goto-dashboard", "/test",
+		"/login/totp", "/api/v1/login/totp", "/api/v1/change-password",
+		"/api/v1/email/verify", "/api/v1/password/forgot", "/api/v1/password/reset":
+		return true
+	}
+	return strings.HasPrefix(path, "/static/")
+}
+
+// Paths with their own authentication: the admin pages and API take an
+// admin's credentials and bots send with a bot token. A session is
+// optional there.
+func ownAuthentication(path string) bool {
+	return path == "/admin" || strings.HasPrefix(path, "/api/v1/admin/") || strings.HasPrefix(path, "/api/v1/bot/")
+}
+
+// Query parameters naming the user a request acts for
+var actorParams = []string{"user", "sender", "userId"}
+
+// Paths whose "user" parameter names someone else: the profile or keys
+// being looked up
+var lookupPaths = map[string]bool{
+	"/api/v1/profile/get":        true,
+	"/api/v1/profile/avatar":     true,
+	"/api/v1/keys/list-devices":  true,
+	"/api/v1/keys/claim-bundles": true,
+}
+
+// Find a query parameter naming a user other than the session's, if any.
+// A conversation is named by user1 and user2, one of which must be the
+// session's user.
+func foreignUserParam(r *http.Request, session Session) string {
+	query := r.URL.Query()
+	if !lookupPaths[r.URL.Path] {
+		for _, param := range actorParams {
+			if value, ok := query[param]; ok && (len(value) != 1 || value[0] != session.UserId) {
+				return param
+			}
+		}
+	}
+	if user1, user2 := query.Get("user1"), query.Get("user2"); (user1 != "" || user2 != "") && user1 != session.UserId && user2 != session.UserId {
+		return "user1"
+	}
+	return ""
+}
+
+type sessionContextKey struct{}
+
+// Session of the request, attached by enforceSessions
+func requestSession(r *http.Request) (Session, bool) {
+	session, ok := r.Context().Value(sessionContextKey{}).(Session)
+	return session, ok
+}
+
+// Check that the request's session belongs to userId, for endpoints that
+// name the user in the body where enforceSessions can't see it. Writes a
+// 401 or 403 and returns false if not.
+func requireSessionUser(w http.ResponseWriter, r *http.Request, userId, field string) bool {
+	session, ok := requestSession(r)
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "missing_session", "Log in to get a session token", "")
+		return false
+	}
+	if session.UserId != userId {
+		writeError(w, http.StatusForbidden, "wrong_user", "This session belongs to another user", field)
+		return false
+	}
+	return true
+}
+
+// Require a live session on every path that acts for a user, and refuse
+// requests that name a different user than the session's. A revoked token
+// is refused even where a session is optional, so logging a device out
+// takes effect on its next request. The dashboard is sent back to the
+// login page instead. The cookie is left alone until the next login
+// replaces it.
+func enforceSessions(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if sessionExempt(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		token := sessionToken(r)
+		if token == "" && ownAuthentication(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var session Session
+		exists := false
+		if token != "" {
+			var err error
+			session, exists, err = findSession(token)
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, "internal_error", "Error reading sessions.json: "+err.Error(), "")
+				return
+			}
+		}
+		if !exists {
+			code, message := "missing_session", "Log in to get a session token"
+			if token != "" {
+				code, message = "session_revoked", "This device has been logged out"
+			}
+			if r.Method == http.MethodGet && r.URL.Path == "/dashboard" {
+				target := "/"
+				if token != "" {
+					target = "/?error=session_revoked"
+				}
+				http.Redirect(w, r, target, http.StatusFound)
+				return
+			}
+			writeError(w, http.StatusUnauthorized, code, message, "")
+			return
+		}
+
+		if !ownAuthentication(r.URL.Path) {
+			if param := foreignUserParam(r, session); param != "" {
+				writeError(w, http.StatusForbidden, "wrong_user", "This session belongs to another user", param)
+				return
+			}
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), sessionContextKey{}, session)))
+	})
+}
+
+// Handler for listing the devices the user is logged in on
+func listSessions(w http.ResponseWriter, r *http.Request) {
+	current, ok := authenticateSession(w, r)
+	if !ok {
+		return
+	}
+
+	sessionsMu.Lock()
+	sessionsData, err := loadSessions()
+	sessionsMu.Unlock()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error reading sessions.json: "+err.Error(), "")
+		return
+	}
+
+	sessions := []SessionInfo{}
+	for _, session := range sessionsData.Sessions {
+		if session.UserId == current.UserId {
+			sessions = append(sessions, SessionInfo{
+				Id:         session.Id,
+				DeviceName: session.DeviceName,
+				CreatedAt:  session.CreatedAt,
+				LastSeenAt: session.LastSeenAt,
+				Current:    session.Id == current.Id,
+			})
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastSeenAt.After(sessions[j].LastSeenAt)
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":  true,
+		"sessions": sessions,
+	})
+}
+
+// Handler for logging out one of the user's devices
+func revokeSession(w http.ResponseWriter, r *http.Request) {
+	current, ok := authenticateSession(w, r)
+	if !ok {
+		return
+	}
+	sessionId := r.URL.Query().Get("id")
+	if sessionId == "" {
+		writeError(w, http.StatusBadRequest, "missing_parameter", "Session ID is required", "id")
+		return
+	}
+
+	revoked, err := revokeSessions(func(session Session) bool {
+		return session.Id == sessionId && session.UserId == current.UserId
+	})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error writing to sessions.json: "+err.Error(), "")
+		return
+	}
+	if revoked == 0 {
+		writeError(w, http.StatusNotFound, "session_not_found", "No such session", "id")
+		return
+	}
+	if sessionId == current.Id {
+		clearSessionCookie(w)
+	}
+
+	fmt.Printf("Session %s of %s revoked\n", sessionId, current.UserId)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{"success": true})
+}
+
+// Handler for logging out every device except the one making the request
+func revokeOtherSessions(w http.ResponseWriter, r *http.Request) {
+	current, ok := authenticateSession(w, r)
+	if !ok {
+		return
+	}
+
+	revoked, err := revokeSessions(func(session Session) bool {
+		return session.UserId == current.UserId && session.Id != current.Id
+	})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error writing to sessions.json: "+err.Error(), "")
+		return
+	}
+
+	fmt.Printf("Logged out %d other devices of %s\n", revoked, current.UserId)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"revoked": revoked,
+	})
+}
+
+// Handler for logging out the device making the request
+func logoutSession(w http.ResponseWriter, r *http.Request) {
+	current, ok := authenticateSession(w, r)
+	if !ok {
+		return
+	}
+
+	if _, err := revokeSessions(func(session Session) bool { return session.Id == current.Id }); err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error writing to sessions.json: "+err.Error(), "")
+		return
+	}
+	clearSessionCookie(w)
+
+	fmt.Printf("Session %s of %s logged out\n", current.Id, current.UserId)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{"success": true})
+}
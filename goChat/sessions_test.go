@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestEnforceSessions(t *testing.T) {
+	useDataDir(t,
+		User{UserId: "alice", Password: "alice1234"},
+		User{UserId: "bob", Password: "bob12345"},
+		User{UserId: "root", Password: "root1234", IsAdmin: true},
+	)
+	mux := http.NewServeMux()
+	mux.Handle("/api/v1/", setupAPIv1())
+	mux.HandleFunc("/dashboard", func(w http.ResponseWriter, r *http.Request) {})
+	handler := enforceSessions(mux)
+
+	_, alice, err := createSession("alice", "laptop", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	revoked, revokedToken, err := createSession("alice", "phone", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := revokeSessions(func(s Session) bool { return s.Id == revoked.Id }); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name     string
+		method   string
+		target   string
+		token    string
+		body     string
+		status   int
+		code     string // Error code, for failures
+		location string // Redirect target
+	}{
+		{"no session", "GET", "/api/v1/get-all-messages?user=alice", "", "", http.StatusUnauthorized, "missing_session", ""},
+		{"own messages", "GET", "/api/v1/get-all-messages?user=alice", alice, "", http.StatusOK, "", ""},
+		{"someone else's messages", "GET", "/api/v1/get-all-messages?user=bob", alice, "", http.StatusForbidden, "wrong_user", ""},
+		{"repeated parameter", "GET", "/api/v1/get-all-messages?user=alice&user=bob", alice, "", http.StatusForbidden, "wrong_user", ""},
+		{"sending as someone else", "POST", "/api/v1/send-message?sender=bob", alice, `{"receiver":"alice","content":"hi"}`, http.StatusForbidden, "wrong_user", ""},
+		{"recent chats of someone else", "GET", "/api/v1/get-recent-chats?userId=bob", alice, "", http.StatusForbidden, "wrong_user", ""},
+		{"own conversation, either side", "GET", "/api/v1/get-messages?user1=bob&user2=alice", alice, "", http.StatusOK, "", ""},
+		{"others' conversation", "GET", "/api/v1/get-messages?user1=bob&user2=root", alice, "", http.StatusForbidden, "wrong_user", ""},
+		{"looking up a profile", "GET", "/api/v1/profile/get?user=bob", alice, "", http.StatusOK, "", ""},
+		{"updating someone else's profile", "POST", "/api/v1/profile/update?user=bob", alice, `{}`, http.StatusForbidden, "wrong_user", ""},
+		{"2FA settings in the body", "POST", "/api/v1/2fa/setup", alice, `{"userId":"bob","password":"bob12345"}`, http.StatusForbidden, "wrong_user", ""},
+		{"revoked session", "GET", "/api/v1/get-all-messages?user=alice", revokedToken, "", http.StatusUnauthorized, "session_revoked", ""},
+		{"search without a session", "POST", "/api/v1/search-users", "", `{"searchTerm":"a"}`, http.StatusUnauthorized, "missing_session", ""},
+		{"login needs no session", "POST", "/api/v1/login", "", `{"userId":"alice","password":"alice1234"}`, http.StatusOK, "", ""},
+		{"admin API uses its own credentials", "GET", "/api/v1/admin/list-users", "", "", http.StatusUnauthorized, "admin_required", ""},
+		{"revoked session on the admin API", "GET", "/api/v1/admin/list-users", revokedToken, "", http.StatusUnauthorized, "session_revoked", ""},
+		{"dashboard without a session", "GET", "/dashboard", "", "", http.StatusFound, "", "/"},
+		{"dashboard after logout", "GET", "/dashboard", revokedToken, "", http.StatusFound, "", "/?error=session_revoked"},
+		{"dashboard", "GET", "/dashboard", alice, "", http.StatusOK, "", ""},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(c.method, c.target, strings.NewReader(c.body))
+		req.Header.Set("Content-Type", "application/json")
+		if c.token != "" {
+			req.AddCookie(&http.Cookie{Name: sessionCookie, Value: c.token})
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		if rec.Code != c.status {
+			t.Errorf("%s: status %d, want %d: %s", c.name, rec.Code, c.status, strings.TrimSpace(rec.Body.String()))
+			continue
+		}
+		if c.location != "" && rec.Header().Get("Location") != c.location {
+			t.Errorf("%s: redirected to %q, want %q", c.name, rec.Header().Get("Location"), c.location)
+		}
+		if c.code != "" {
+			var reply struct {
+				Error APIError `json:"error"`
+			}
+			json.Unmarshal(rec.Body.Bytes(), &reply)
+			if reply.Error.Code != c.code {
+				t.Errorf("%s: error %q, want %q", c.name, reply.Error.Code, c.code)
+			}
+		}
+	}
+}
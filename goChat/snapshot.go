@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"gochat/internal/store"
+)
+
+// Snapshots are consistent copies of the data files taken while the server
+// runs. Every store lock is held while the files are copied, so no write
+// lands halfway through a snapshot. Each snapshot is a directory under
+// snapshots/ with a manifest of checksums, which `gochat-admin restore`
+// verifies before rolling back; the format is in internal/store, which
+// gochat-admin shares.
+
+// Snapshot manifests are shared with gochat-admin through internal/store
+type (
+	SnapshotFile     = store.SnapshotFile
+	SnapshotManifest = store.SnapshotManifest
+)
+
+// Directory holding one subdirectory per snapshot
+const snapshotDir = store.SnapshotDir
+
+// Serializes snapshot creation and rotation
+var snapshotMu sync.Mutex
+
+// Take a snapshot of every data file
+func createSnapshot(reason string) (SnapshotManifest, error) {
+	snapshotMu.Lock()
+	defer snapshotMu.Unlock()
+
+	// Hold every store lock, in the order the handlers nest them
+	for _, mu := range []*sync.Mutex{&usersMu, &scheduledMu, &contactsMu, &conversationsMu, &retentionMu, &webhooksMu, &botTokensMu, &e2eKeysMu, &sessionsMu, &accountTokensMu, &storeMu, &archiveMu, &avatarsMu} {
+		mu.Lock()
+		defer mu.Unlock()
+	}
+	return store.CreateSnapshot(".", reason)
+}
+
+// Read every snapshot manifest, newest first
+func listSnapshots() ([]SnapshotManifest, error) {
+	return store.ListSnapshots(".")
+}
+
+// Delete all but the newest keep snapshots
+func rotateSnapshots(keep int) (int, error) {
+	snapshotMu.Lock()
+	defer snapshotMu.Unlock()
+	return store.RotateSnapshots(".", keep)
+}
+
+// Take a snapshot and apply rotation, logging the outcome
+func runSnapshot(reason string, keep int) (SnapshotManifest, error) {
+	manifest, err := createSnapshot(reason)
+	if err != nil {
+		fmt.Println("Error creating snapshot:", err)
+		return manifest, err
+	}
+	fmt.Printf("Created snapshot %s with %d files\n", manifest.Name, len(manifest.Files))
+
+	removed, err := rotateSnapshots(keep)
+	if err != nil {
+		fmt.Println("Error rotating snapshots:", err)
+		return manifest, nil
+	}
+	if removed > 0 {
+		fmt.Printf("Removed %d old snapshots\n", removed)
+	}
+	return manifest, nil
+}
+
+// Snapshot schedule, set from the command line. The defaults keep a
+// week of snapshots.
+var (
+	snapshotInterval = 6 * time.Hour
+	snapshotKeep     = store.DefaultSnapshotKeep
+)
+
+// Run the snapshot loop in the background. An interval of 0 disables it.
+func startSnapshotter() {
+	if snapshotInterval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(snapshotInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			runSnapshot("scheduled", snapshotKeep)
+		}
+	}()
+}
+
+// Handler for taking a snapshot on demand
+func adminCreateSnapshot(w http.ResponseWriter, r *http.Request) {
+	manifest, err := runSnapshot("admin", snapshotKeep)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error creating snapshot: "+err.Error(), "")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":  true,
+		"snapshot": manifest,
+	})
+}
+
+// Handler for listing the snapshots, newest first
+func adminListSnapshots(w http.ResponseWriter, r *http.Request) {
+	snapshotMu.Lock()
+	snapshots, err := listSnapshots()
+	snapshotMu.Unlock()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error reading snapshots: "+err.Error(), "")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":   true,
+		"snapshots": snapshots,
+	})
+}
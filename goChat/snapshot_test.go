@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// A snapshot taken while users.json is being written holds a complete copy
+func TestSnapshotUsersDuringWrites(t *testing.T) {
+	useDataDir(t, User{UserId: "alice", Password: "alice1234"})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := addUser(User{UserId: fmt.Sprintf("user%d", i), Password: "password"}); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	var manifests []SnapshotManifest
+	for i := 0; i < 3; i++ {
+		manifest, err := createSnapshot("test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		manifests = append(manifests, manifest)
+	}
+	wg.Wait()
+
+	for _, manifest := range manifests {
+		data, err := os.ReadFile(filepath.Join(snapshotDir, manifest.Name, "users.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var usersData UsersData
+		if err := json.Unmarshal(data, &usersData); err != nil {
+			t.Errorf("%s: %v", manifest.Name, err)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+// DOM elements
+const statsContainer = document.getElementById('stats');
+const usersBody = document.getElementById('users-body');
+const filterInput = document.getElementById('filter-input');
+const refreshBtn = document.getElementById('refresh-btn');
+
+// Global variables
+let users = [];
+
+// The browser already holds the admin's Basic credentials from loading this
+// page, and sends them with these same-origin requests
+async function adminRequest(method, path) {
+    const response = await fetch('/api/v1/admin/' + path, { method, credentials: 'same-origin' });
+    const data = await response.json();
+    if (!data.success) {
+        throw new Error(data.error.message);
+    }
+    return data;
+}
+
+// Initialize the page
+document.addEventListener('DOMContentLoaded', function() {
+    refreshBtn.addEventListener('click', loadAll);
+    filterInput.addEventListener('input', renderUsers);
+    loadAll();
+});
+
+// Load the stats and the account list
+function loadAll() {
+    loadStats();
+    loadUsers();
+}
+
+// Human-readable file size
+function formatBytes(bytes) {
+    const units = ['B', 'KB', 'MB', 'GB'];
+    let unit = 0;
+    while (bytes >= 1024 && unit < units.length - 1) {
+        bytes /= 1024;
+        unit++;
+    }
+    return (unit === 0 ? bytes : bytes.toFixed(1)) + ' ' + units[unit];
+}
+
+// Show the storage stats as cards
+async function loadStats() {
+    try {
+        const { stats } = await adminRequest('GET', 'stats');
+        const cards = [
+            ['Accounts', stats.users],
+            ['Admins', stats.admins],
+            ['Bots', stats.bots],
+            ['Disabled', stats.disabledUsers],
+            ['Messages', stats.messages],
+            ['Archived', stats.archivedMessages],
+            ['Scheduled', stats.scheduledPending],
+            ['Storage', formatBytes(stats.totalBytes)],
+            ['Encryption', stats.encryptionKey ? 'key ' + stats.encryptionKey : 'off']
+        ];
+        statsContainer.innerHTML = '';
+        cards.forEach(([label, value]) => {
+            const card = document.createElement('div');
+            card.className = 'stat';
+            card.innerHTML = '<div class="value"></div><div class="label"></div>';
+            card.querySelector('.value').textContent = value;
+            card.querySelector('.label').textContent = label;
+            statsContainer.appendChild(card);
+        });
+    } catch (error) {
+        console.error('Error loading stats:', error);
+        statsContainer.textContent = 'Could not load stats: ' + error.message;
+    }
+}
+
+// Fetch the account list
+async function loadUsers() {
+    try {
+        const data = await adminRequest('GET', 'list-users');
+        users = data.users;
+        renderUsers();
+    } catch (error) {
+        console.error('Error loading users:', error);
+        alert('Could not load accounts: ' + error.message);
+    }
+}
+
+// Small helpers for building table rows
+function cell(row, text) {
+    const td = document.createElement('td');
+    td.textContent = text;
+    row.appendChild(td);
+    return td;
+}
+
+function badge(td, text, className) {
+    const span = document.createElement('span');
+    span.className = 'badge ' + (className || '');
+    span.textContent = text;
+    td.appendChild(span);
+}
+
+function actionButton(td, label, className, handler) {
+    const button = document.createElement('button');
+    button.className = 'btn ' + (className || '');
+    button.textContent = label;
+    button.addEventListener('click', handler);
+    td.appendChild(button);
+}
+
+// Render the accounts matching the filter
+function renderUsers() {
+    const filter = filterInput.value.trim().toLowerCase();
+    usersBody.innerHTML = '';
+
+    users
+        .filter(user => !filter || user.userId.toLowerCase().includes(filter) || (user.email || '').toLowerCase().includes(filter))
+        .forEach(user => {
+            const row = document.createElement('tr');
+            cell(row, user.userId);
+            const email = cell(row, user.email || '');
+            if (user.email && !user.emailVerified) {
+                badge(email, 'unverified');
+            }
+
+            const role = cell(row, '');
+            if (user.isAdmin) {
+                badge(role, 'admin', 'admin');
+            } else if (user.isBot) {
+                badge(role, 'bot of ' + user.botOwner);
+            } else {
+                badge(role, 'user');
+            }
+            if (user.totpEnabled) {
+                badge(role, '2FA');
+            }
+
+            cell(row, user.messages);
+
+            const status = cell(row, '');
+            if (user.disabled) {
+                badge(status, 'disabled', 'disabled');
+            } else if (user.mustResetPassword) {
+                badge(status, 'password reset');
+            } else {
+                badge(status, 'active');
+            }
+
+            const actions = cell(row, '');
+            if (user.disabled) {
+                actionButton(actions, 'Enable', '', () => userAction('enable-user', user.userId));
+            } else {
+                actionButton(actions, 'Disable', 'muted', () => userAction('disable-user', user.userId));
+            }
+            if (!user.isBot) {
+                actionButton(actions, 'Reset password', 'muted', () => resetPassword(user.userId));
+            }
+            if (user.totpEnabled) {
+                actionButton(actions, 'Reset 2FA', 'muted', () => resetTOTP(user.userId));
+            }
+            actionButton(actions, 'Delete', 'danger', () => deleteUser(user.userId));
+
+            usersBody.appendChild(row);
+        });
+}
+
+// Disable or enable an account
+async function userAction(action, userId) {
+    try {
+        await adminRequest('POST', action + '?user=' + encodeURIComponent(userId));
+        loadAll();
+    } catch (error) {
+        alert(error.message);
+    }
+}
+
+// Force a password reset and show the temporary password once
+async function resetPassword(userId) {
+    if (!confirm('Reset the password of ' + userId + '? They will have to choose a new one at their next login.')) {
+        return;
+    }
+    try {
+        const data = await adminRequest('POST', 'reset-password?user=' + encodeURIComponent(userId));
+        prompt('Temporary password for ' + userId + ' (shown only once):', data.temporaryPassword);
+        loadAll();
+    } catch (error) {
+        alert(error.message);
+    }
+}
+
+// Turn off two-factor authentication for a user who lost their authenticator
+async function resetTOTP(userId) {
+    if (!confirm('Turn off two-factor authentication for ' + userId + '? They can log in with their password alone until they set it up again.')) {
+        return;
+    }
+    userAction('reset-2fa', userId);
+}
+
+// Delete an account with all of its messages
+async function deleteUser(userId) {
+    if (!confirm('Delete ' + userId + ', the bots they own and all of their messages? This cannot be undone.')) {
+        return;
+    }
+    try {
+        const data = await adminRequest('POST', 'delete-user?user=' + encodeURIComponent(userId));
+        alert('Deleted ' + data.deletedUsers + ' account(s) and ' + data.deletedMessages + ' message(s).');
+        loadAll();
+    } catch (error) {
+        alert(error.message);
+    }
+}
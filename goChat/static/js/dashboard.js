@@ -17,6 +17,9 @@ let recentChats = [];
 let lastMessageTimestamp = null;
 let pollingInterval = null;
 let messageCheckInterval = 8000; // 8 seconds between checks
+let syncToken = null; // Position in the server's change log, see syncChanges
+let syncAvailable = true;
+let profiles = {}; // Display names and avatars by user ID, see rememberProfiles
 
 // Initialize the dashboard
 document.addEventListener('DOMContentLoaded', function() {
@@ -81,8 +84,18 @@ function setupEventListeners() {
     actionsMenu.addEventListener('click', function() {
         if (confirm('Do you want to logout?')) {
             stopMessagePolling();
-            localStorage.removeItem('currentUser');
-            window.location.href = '/';
+            const logoutOthers = confirm('Also log out your other devices?');
+            // End this device's session, and the others' first if asked
+            const revokeOthers = logoutOthers
+                ? fetch('/api/v1/sessions/revoke-others', { method: 'POST' })
+                : Promise.resolve();
+            revokeOthers
+                .then(() => fetch('/api/v1/logout', { method: 'POST' }))
+                .catch(error => console.error("Error logging out:", error))
+                .finally(() => {
+                    localStorage.removeItem('currentUser');
+                    window.location.href = '/';
+                });
         }
     });
     
@@ -166,6 +179,9 @@ function checkForNewMessages() {
     window.isCheckingMessages = true;
     console.log("Checking for new messages");
     
+    // Pick up reads and messages from the user's other devices
+    syncChanges();
+    
     // Check for messages with current chat user
     if (currentChatUser) {
         fetch(`/get-messages?user1=${currentUser}&user2=${currentChatUser}`)
@@ -188,6 +204,46 @@ function checkForNewMessages() {
     }
 }
 
+// Catch up on changes made on other devices. The session cookie set at
+// login identifies this device; a revoked session goes back to the login page.
+function syncChanges() {
+    if (!syncAvailable) return;
+    
+    const query = syncToken ? '?since=' + encodeURIComponent(syncToken) : '';
+    fetch('/api/v1/sync' + query)
+        .then(response => response.json().then(data => ({ status: response.status, data })))
+        .then(({ status, data }) => {
+            if (status === 401) {
+                if (data.error && data.error.code === 'session_revoked') {
+                    stopMessagePolling();
+                    window.location.href = '/?error=session_revoked';
+                } else {
+                    // Logged in before sessions existed; keep polling without sync
+                    syncAvailable = false;
+                }
+                return;
+            }
+            if (!data.success) return;
+            
+            syncToken = data.syncToken;
+            if (data.recentChats) {
+                handleRecentChatsUpdate(data.recentChats);
+            }
+            
+            // Reload the open conversation if it changed elsewhere
+            const openChatChanged = currentChatUser && (data.reset || data.changes.some(change =>
+                (change.type === 'read' && change.contactId === currentChatUser) ||
+                (change.type === 'message' && change.message.sender === currentUser && change.message.receiver === currentChatUser)
+            ));
+            if (openChatChanged) {
+                loadMessages(currentUser, currentChatUser);
+            }
+        })
+        .catch(error => {
+            console.error("Error syncing changes:", error);
+        });
+}
+
 // Process new messages
 function processNewMessages(messages) {
     // If this is first check, just set timestamp
@@ -235,6 +291,7 @@ function updateRecentChats() {
         })
         .then(data => {
             if (data.success && data.recentChats) {
+                rememberProfiles(data.profiles);
                 handleRecentChatsUpdate(data.recentChats);
             }
         })
@@ -332,6 +389,7 @@ function loadRecentChats() {
         })
         .then(data => {
             if (data.success && data.recentChats) {
+                rememberProfiles(data.profiles);
                 const formattedChats = data.recentChats.map(chat => ({
                     userId: chat.contactId,
                     lastMessage: chat.lastMessage,
@@ -404,7 +462,7 @@ function fetchRecentChatsManually(users) {
                     
                     return {
                         userId: user.userId,
-                        lastMessage: messages[0].content,
+                        lastMessage: messageText(messages[0]),
                         timestamp: messages[0].timestamp,
                         hasMessages: true
                     };
@@ -463,9 +521,6 @@ function displayRecentChats(chats) {
         contactDiv.className = 'contact';
         contactDiv.dataset.userId = chat.userId;
         
-        // First letter for avatar
-        const firstLetter = chat.userId.charAt(0).toUpperCase();
-        
         // Format time
         let timeDisplay = formatChatTime(chat.timestamp);
         
@@ -474,10 +529,7 @@ function displayRecentChats(chats) {
         contactImgDiv.className = 'contact-img';
         
         // Avatar
-        const avatarDiv = document.createElement('div');
-        avatarDiv.className = 'avatar';
-        avatarDiv.textContent = firstLetter;
-        contactImgDiv.appendChild(avatarDiv);
+        contactImgDiv.appendChild(createAvatar(chat.userId));
         
         // Contact info
         const contactInfoDiv = document.createElement('div');
@@ -485,7 +537,7 @@ function displayRecentChats(chats) {
         
         const nameDiv = document.createElement('div');
         nameDiv.className = 'name';
-        nameDiv.textContent = chat.userId;
+        nameDiv.textContent = displayName(chat.userId);
         
         const messageDiv = document.createElement('div');
         messageDiv.className = 'message';
@@ -563,8 +615,8 @@ function searchUsers(searchTerm) {
     searchResults.innerHTML = '<p class="loading">Searching for users...</p>';
     searchResults.style.display = 'block';
     
-    // Make search request
-    fetch('/search-users', {
+    // Make search request; users we've blocked are left out
+    fetch(`/search-users?user=${encodeURIComponent(currentUser)}`, {
         method: 'POST',
         headers: { 'Content-Type': 'application/json' },
         body: JSON.stringify({ searchTerm })
@@ -574,6 +626,7 @@ function searchUsers(searchTerm) {
         searchResults.innerHTML = '';
         
         if (data.success && data.users.length > 0) {
+            rememberProfiles(data.profiles);
             displaySearchResults(data.users);
         } else {
             searchResults.innerHTML = '<p>No users found matching your search.</p>';
@@ -596,33 +649,109 @@ function displaySearchResults(users) {
         userItem.className = 'user-item';
         userItem.dataset.userId = user.userId;
         
-        // First letter for avatar
-        const firstLetter = user.userId.charAt(0).toUpperCase();
-        
         userItem.innerHTML = `
-            <div class="avatar">${firstLetter}</div>
             <div class="user-details">
-                <h4>${user.userId}</h4>
-                <p>${user.email || 'No email provided'}</p>
+                <h4></h4>
+                <p></p>
+            </div>
+            <div class="user-actions">
+                <button class="add-contact" title="Send a contact request">Add</button>
+                <button class="block-contact" title="Block this user">Block</button>
             </div>
         `;
         
+        // Names are user-supplied, so set them as text
+        userItem.prepend(createAvatar(user.userId));
+        userItem.querySelector('h4').textContent = displayName(user.userId);
+        userItem.querySelector('p').textContent = profileLine(user);
+        
         // Add click event
         userItem.addEventListener('click', function() {
             startChatWith(user);
         });
         
+        userItem.querySelector('.add-contact').addEventListener('click', function(event) {
+            event.stopPropagation();
+            updateContact('request', user.userId);
+        });
+        userItem.querySelector('.block-contact').addEventListener('click', function(event) {
+            event.stopPropagation();
+            if (confirm(`Block ${user.userId}? They won't be able to message you.`)) {
+                updateContact('block', user.userId);
+                userItem.remove();
+            }
+        });
+        
         searchResults.appendChild(userItem);
     });
 }
 
+// Send a contact request to, or block, another user
+function updateContact(action, contactId) {
+    fetch(`/api/v1/contacts/${action}?user=${encodeURIComponent(currentUser)}&contact=${encodeURIComponent(contactId)}`, {
+        method: 'POST'
+    })
+    .then(response => response.json())
+    .then(data => {
+        if (!data.success) {
+            alert(data.error ? data.error.message : 'Could not update contacts. Please try again.');
+            return;
+        }
+        if (action === 'request') {
+            alert(data.status === 'accepted' ? `${contactId} is now a contact.` : `Contact request sent to ${contactId}.`);
+        }
+    })
+    .catch(error => {
+        console.error('Error updating contacts:', error);
+    });
+}
+
+// Keep the profile summaries that come with search results and recent chats
+function rememberProfiles(summaries) {
+    if (summaries) {
+        Object.assign(profiles, summaries);
+    }
+}
+
+// The name to show for a user: their display name if they've set one
+function displayName(userId) {
+    const profile = profiles[userId];
+    return profile && profile.displayName ? profile.displayName : userId;
+}
+
+// The second line of a search result: the user ID when a display name is
+// shown, then their status
+function profileLine(user) {
+    const profile = profiles[user.userId] || {};
+    const parts = [];
+    if (profile.displayName && profile.displayName !== user.userId) parts.push('@' + user.userId);
+    if (profile.status) parts.push(profile.status);
+    return parts.join(' · ') || user.email || 'No email provided';
+}
+
+// Avatar image, or the first letter of the name when there isn't one
+function createAvatar(userId) {
+    const avatarDiv = document.createElement('div');
+    avatarDiv.className = 'avatar';
+    const profile = profiles[userId];
+    if (profile && profile.avatarUrl) {
+        const img = document.createElement('img');
+        img.src = profile.avatarUrl;
+        img.alt = '';
+        avatarDiv.appendChild(img);
+    } else {
+        avatarDiv.textContent = displayName(userId).charAt(0).toUpperCase();
+    }
+    return avatarDiv;
+}
+
 // Start chat with a user
 function startChatWith(user) {
     // Set current chat user
     currentChatUser = user.userId;
     
     // Update chat header
-    chatWithDisplay.textContent = user.userId;
+    chatWithDisplay.textContent = displayName(user.userId);
     
     // Enable chat input
     chatInput.disabled = false;
@@ -631,7 +760,7 @@ function startChatWith(user) {
     chatMessages.innerHTML = `
         <div class="message system">
             <div class="content">
-                <p>Loading messages with ${user.userId}...</p>
+                <p>Loading messages...</p>
             </div>
         </div>
     `;
@@ -722,8 +851,20 @@ function loadMessages(user1, user2) {
         });
 }
 
+// End-to-end encrypted messages can't be read in the browser, so they
+// are shown as a placeholder
+function messageText(message) {
+    return message.type === 'e2e' ? '🔒 Encrypted message' : message.content;
+}
+
 // Display a message
 function displayMessage(message) {
+    // Announcements such as disappearing-message timer changes are shown centred
+    if (message.isSystem) {
+        displaySystemNote(message.content);
+        return;
+    }
+    
     const messageEl = document.createElement('div');
     const isSent = message.sender === currentUser;
     
@@ -732,9 +873,12 @@ function displayMessage(message) {
     // Format timestamp
     let timeStr = formatMessageTime(message.timestamp);
     
+    // Messages posted through the bot API carry a small label
+    const botLabel = message.isBot ? '<span class="bot-label">BOT</span> ' : '';
+    
     messageEl.innerHTML = `
         <div class="content">
-            <p>${message.content}</p>
+            <p>${botLabel}${messageText(message)}</p>
             <div class="time">${timeStr}</div>
         </div>
     `;
@@ -742,6 +886,24 @@ function displayMessage(message) {
     chatMessages.appendChild(messageEl);
 }
 
+// Display a note that only the current user can see, such as a command reply
+function displaySystemNote(text) {
+    const noteEl = document.createElement('div');
+    noteEl.className = 'message system';
+    
+    const content = document.createElement('div');
+    content.className = 'content';
+    text.split('\n').forEach(line => {
+        const p = document.createElement('p');
+        p.textContent = line;
+        content.appendChild(p);
+    });
+    
+    noteEl.appendChild(content);
+    chatMessages.appendChild(noteEl);
+    chatMessages.scrollTop = chatMessages.scrollHeight;
+}
+
 // Format message timestamp
 function formatMessageTime(timestamp) {
     let timeStr = "Just now";
@@ -775,14 +937,20 @@ function sendMessage() {
         content: message
     };
     
+    // Slash commands are handled by the server, so wait for its answer
+    // instead of showing the raw command in the conversation
+    const isCommand = message.startsWith('/') && !message.startsWith('//');
+    
     // Create and display message locally
     const now = new Date();
-    displayMessage({
-        sender: currentUser,
-        receiver: currentChatUser,
-        content: message,
-        timestamp: now
-    });
+    if (!isCommand) {
+        displayMessage({
+            sender: currentUser,
+            receiver: currentChatUser,
+            content: message,
+            timestamp: now
+        });
+    }
     
     // Clear input
     chatInput.value = '';
@@ -801,8 +969,23 @@ function sendMessage() {
     })
     .then(response => response.json())
     .then(data => {
+        if (data.success && isCommand) {
+            if (data.reply) {
+                displaySystemNote(data.reply);
+            }
+            if (data.stored) {
+                loadMessages(currentUser, currentChatUser);
+            }
+            return;
+        }
         if (!data.success) {
-            alert('Failed to send message. Please try again.');
+            if (data.errors && data.errors.length > 0) {
+                alert(data.errors.map(e => e.message).join('\n'));
+            } else if (data.error) {
+                alert(data.error.message);
+            } else {
+                alert('Failed to send message. Please try again.');
+            }
         }
     })
     .catch(error => {
@@ -7,6 +7,7 @@ const leftPanelContent = document.querySelector(".left-panel .content");
 const rightPanelContent = document.querySelector(".right-panel .content");
 const leftPanel = document.querySelector(".left-panel");
 const rightPanel = document.querySelector(".right-panel");
+const forgotPasswordLink = document.querySelector("#forgot-password");
 
 // Disable forms during transition
 function disableFormsDuringTransition() {
@@ -59,22 +60,180 @@ document.addEventListener("DOMContentLoaded", () => {
     if (signUpBtn) {
         signUpBtn.addEventListener("click", disableFormsDuringTransition);
     }
+    
+    if (forgotPasswordLink) {
+        forgotPasswordLink.addEventListener("click", event => {
+            event.preventDefault();
+            requestPasswordReset();
+        });
+    }
 
-    // Check if there's an error parameter in the URL
+    // Links mailed for verifying the address and resetting the password
     const urlParams = new URLSearchParams(window.location.search);
+    if (urlParams.get('verify')) {
+        verifyEmail(urlParams.get('verify'));
+    } else if (urlParams.get('reset')) {
+        chooseNewPassword(urlParams.get('reset'));
+    }
+    
+    // Check if there's an error parameter in the URL
     const error = urlParams.get('error');
     if (error) {
         if (error === 'invalid_credentials') {
             alert('Invalid username or password. Please try again.');
+        } else if (error === 'account_disabled') {
+            alert('This account has been disabled. Please contact an administrator.');
+        } else if (error === 'session_revoked') {
+            alert('You have been logged out on this device. Please log in again.');
+        } else if (error === 'password_reset_required') {
+            changeTemporaryPassword(urlParams.get('user'));
+        } else if (error === 'totp_required' || error === 'invalid_code') {
+            enterSecondFactor(urlParams.get('challenge'), error === 'invalid_code');
+        } else if (error === 'challenge_expired') {
+            alert('The sign-in took too long or too many codes were wrong. Please sign in again.');
         } else if (error === 'user_exists') {
             alert('Username already exists. Please choose another username.');
             if (signUpBtn) {
                 signUpBtn.click(); // Switch to signup form
             }
+        } else if (error === 'invalid_input') {
+            // Each rejected field is passed back as its own query parameter
+            const messages = ['username', 'email', 'password']
+                .filter(field => urlParams.get(field))
+                .map(field => urlParams.get(field));
+            alert('Please fix the following:\n' + messages.join('\n'));
+            if (signUpBtn) {
+                signUpBtn.click(); // Switch to signup form
+            }
         }
     }
 });
 
+// An admin reset the password; the temporary one must be replaced before logging in
+async function changeTemporaryPassword(userId) {
+    const password = prompt('Your password was reset by an administrator.\nEnter the temporary password you were given:');
+    if (!password) {
+        return;
+    }
+    const newPassword = prompt('Choose a new password (at least 8 characters, with a letter and a digit):');
+    if (!newPassword) {
+        return;
+    }
+
+    try {
+        const response = await fetch('/api/v1/change-password', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ userId, password, newPassword })
+        });
+        const data = await response.json();
+        if (data.success) {
+            alert('Password changed. Please sign in with your new password.');
+        } else {
+            alert(data.error.message);
+        }
+    } catch (err) {
+        console.error('Error changing password:', err);
+        alert('Could not change the password. Please try again.');
+    }
+}
+
+// The password was right but two-factor authentication is on: ask for a
+// code and post it with the challenge, like the sign-in form does
+function enterSecondFactor(challenge, retry) {
+    history.replaceState(null, '', '/');
+    const code = prompt((retry ? 'That code is not valid.\n' : '') +
+        'Enter the 6-digit code from your authenticator app, or one of your recovery codes:');
+    if (!code) {
+        return;
+    }
+
+    const form = document.createElement('form');
+    form.method = 'POST';
+    form.action = '/login/totp';
+    for (const [name, value] of Object.entries({ challenge, code: code.trim() })) {
+        const input = document.createElement('input');
+        input.type = 'hidden';
+        input.name = name;
+        input.value = value;
+        form.appendChild(input);
+    }
+    document.body.appendChild(form);
+    form.submit();
+}
+
+// Send the token from a verification link
+async function verifyEmail(token) {
+    history.replaceState(null, '', '/');
+    try {
+        const response = await fetch('/api/v1/email/verify', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ token })
+        });
+        const data = await response.json();
+        alert(data.success ? 'Your email address is verified.' : data.error.message);
+    } catch (err) {
+        console.error('Error verifying email:', err);
+        alert('Could not verify the email address. Please try again.');
+    }
+}
+
+// Ask for a link to reset the password. The server answers the same way
+// whether or not the account exists.
+async function requestPasswordReset() {
+    const login = prompt('Enter your username or email address.\nIf the account has a verified email address, we will send it a link to choose a new password.');
+    if (!login) {
+        return;
+    }
+
+    try {
+        const response = await fetch('/api/v1/password/forgot', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ login })
+        });
+        const data = await response.json();
+        alert(data.success ? 'If the account exists, a reset link is on its way. Check your email.' : data.error.message);
+    } catch (err) {
+        console.error('Error requesting a password reset:', err);
+        alert('Could not request a password reset. Please try again.');
+    }
+}
+
+// Choose a new password with the token from a reset link. A rejected
+// password can be retried; the link stays valid until it is used.
+async function chooseNewPassword(token) {
+    history.replaceState(null, '', '/');
+    for (;;) {
+        const newPassword = prompt('Choose a new password (at least 8 characters, with a letter and a digit):');
+        if (!newPassword) {
+            return;
+        }
+
+        try {
+            const response = await fetch('/api/v1/password/reset', {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/json' },
+                body: JSON.stringify({ token, newPassword })
+            });
+            const data = await response.json();
+            if (data.success) {
+                alert('Password changed. Please sign in with your new password.');
+                return;
+            }
+            alert(data.error.message);
+            if (data.error.field !== 'newPassword') {
+                return;
+            }
+        } catch (err) {
+            console.error('Error resetting the password:', err);
+            alert('Could not reset the password. Please try again.');
+            return;
+        }
+    }
+}
+
 // Switch to Sign Up mode if the button exists
 if (signUpBtn) {
     signUpBtn.addEventListener("click", () => {
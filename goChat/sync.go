@@ -0,0 +1,437 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gochat/internal/envelope"
+	"gochat/internal/store"
+)
+
+// Devices catch up through /api/v1/sync. Every new message and every
+// "mark as read" is appended to changes.jsonl with an increasing sequence
+// number, and a sync returns the caller's changes after the position in
+// its sync token. The token is opaque to clients; it is the sequence
+// number of the last change they have seen, and the server also remembers
+// it per session so a device can sync without one. Messages can't be
+// edited in goChat yet; an edit would become one more change type.
+// Deletions by expiry, retention or an admin are not replayed; devices
+// see them the next time they load a conversation in full. The deleted
+// messages are blanked out of the log, though, so it never keeps a copy of
+// them. Changes older than -sync-history are dropped at startup and every
+// hour after, and a device that falls behind them is told to reset and
+// reload. The server
+// keeps the byte offset of every change so a sync reads only what's new.
+
+// Change log file, next to chats.log
+const changeLogFile = "changes.jsonl"
+
+// Change types
+const (
+	changeMessage = "message"
+	changeRead    = "read"
+)
+
+// Most changes returned by one sync; the rest follow on the next call
+const maxSyncChanges = 500
+
+// How often changes older than the sync history are dropped
+const changeLogTrimInterval = time.Hour
+
+// How long changes are kept for devices to catch up, set from the command line
+var syncHistory = 30 * 24 * time.Hour
+
+// Change is one record of the change log
+type Change = store.Change
+
+// SyncChange is a change as returned to a device
+type SyncChange struct {
+	Type      string    `json:"type"`
+	Message   *Message  `json:"message,omitempty"`
+	UserId    string    `json:"userId,omitempty"`
+	ContactId string    `json:"contactId,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+// Where one change starts in the log file
+type changeOffset struct {
+	seq    uint64
+	offset int64
+}
+
+// State of the change log, guarded by storeMu
+var (
+	changeLogOpen bool
+	changeSeq     uint64         // Sequence number of the last change written
+	changeFloor   uint64         // Changes up to this number have been dropped
+	changeIndex   []changeOffset // Every change in the log, in sequence order
+	changeLogSize int64
+)
+
+// Read the changes in the log from a byte offset on, passing each one and
+// where it starts to fn until fn returns false. Message bodies are left as
+// stored. Returns the offset reading stopped at.
+func scanChangeLog(offset int64, fn func(change Change, start int64) bool) (int64, error) {
+	file, err := os.Open(changeLogFile)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	reader := bufio.NewReaderSize(file, 64*1024)
+	for {
+		line, err := reader.ReadBytes('\n')
+		start := offset
+		offset += int64(len(line))
+		if len(bytes.TrimSpace(line)) > 0 {
+			var change Change
+			if err := json.Unmarshal(line, &change); err != nil {
+				// A crash can leave a partial last line; skip it
+				fmt.Printf("Skipping damaged record in %s: %v\n", changeLogFile, err)
+			} else if !fn(change, start) {
+				return offset, nil
+			}
+		}
+		if err == io.EOF {
+			return offset, nil
+		}
+		if err != nil {
+			return offset, fmt.Errorf("reading %s: %w", changeLogFile, err)
+		}
+	}
+}
+
+// Read every change in the log. Message bodies are left as stored.
+func readChangeLog() ([]Change, error) {
+	var changes []Change
+	_, err := scanChangeLog(0, func(change Change, start int64) bool {
+		changes = append(changes, change)
+		return true
+	})
+	return changes, err
+}
+
+// Pick up the sequence numbers where the log left off and index where
+// each change starts. The caller must hold storeMu.
+func openChangeLog() error {
+	if changeLogOpen {
+		return nil
+	}
+	var index []changeOffset
+	size, err := scanChangeLog(0, func(change Change, start int64) bool {
+		index = append(index, changeOffset{change.Seq, start})
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	changeSeq, changeFloor = 0, 0
+	if len(index) > 0 {
+		changeFloor = index[0].seq - 1
+		changeSeq = index[len(index)-1].seq
+	}
+	changeIndex, changeLogSize = index, size
+	changeLogOpen = true
+	return nil
+}
+
+// Read up to limit changes after seq that match keep, starting at the
+// first one's indexed offset. The caller must hold storeMu and have
+// opened the log.
+func readChangesAfter(seq uint64, keep func(Change) bool, limit int) ([]Change, error) {
+	i := sort.Search(len(changeIndex), func(i int) bool { return changeIndex[i].seq > seq })
+	if i == len(changeIndex) {
+		return nil, nil
+	}
+	var changes []Change
+	_, err := scanChangeLog(changeIndex[i].offset, func(change Change, start int64) bool {
+		if keep(change) {
+			changes = append(changes, change)
+		}
+		return len(changes) < limit
+	})
+	return changes, err
+}
+
+// Sequence number of the last change. The caller must hold storeMu.
+func changeLogHead() (uint64, error) {
+	if err := openChangeLog(); err != nil {
+		return 0, err
+	}
+	return changeSeq, nil
+}
+
+// Append a change to the log. The caller must hold storeMu. A change that
+// can't be recorded only delays other devices until they reload, so
+// callers report the error and carry on.
+func recordChange(change Change) error {
+	if err := openChangeLog(); err != nil {
+		return err
+	}
+	change.Seq = changeSeq + 1
+	if change.Time.IsZero() {
+		change.Time = time.Now()
+	}
+	if change.Message != nil {
+		message := *change.Message
+		content, err := sealText(message.Content, envelope.MessageContext(message.Id))
+		if err != nil {
+			return fmt.Errorf("encrypting change: %w", err)
+		}
+		message.Content = content
+		change.Message = &message
+	}
+	line, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(changeLogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	changeSeq = change.Seq
+	changeIndex = append(changeIndex, changeOffset{change.Seq, changeLogSize})
+	changeLogSize += int64(len(line)) + 1
+	return nil
+}
+
+// Drop changes older than the sync history, always keeping the last one
+// so the sequence numbers carry on after a restart
+func trimChangeLog(now time.Time) error {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+
+	changes, err := readChangeLog()
+	if err != nil {
+		return err
+	}
+	cutoff := now.Add(-syncHistory)
+	keep := 0
+	for keep < len(changes)-1 && changes[keep].Time.Before(cutoff) {
+		keep++
+	}
+	changeLogOpen = false
+	if keep == 0 {
+		return openChangeLog()
+	}
+
+	var buf strings.Builder
+	for _, change := range changes[keep:] {
+		line, err := json.Marshal(change)
+		if err != nil {
+			return err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	if err := writeFileAtomic(changeLogFile, []byte(buf.String()), 0644); err != nil {
+		return err
+	}
+	fmt.Printf("Dropped %d changes older than %s from %s\n", keep, syncHistory, changeLogFile)
+	return openChangeLog()
+}
+
+// Trim the change log in the background. The first trim runs at startup,
+// before the server accepts requests.
+func startChangeLogTrimmer() {
+	go func() {
+		ticker := time.NewTicker(changeLogTrimInterval)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			if err := trimChangeLog(now); err != nil {
+				fmt.Println("Error trimming the change log:", err)
+			}
+		}
+	}()
+}
+
+// Parse a sync token
+func parseSyncToken(token string) (uint64, bool) {
+	seq, err := strconv.ParseUint(token, 10, 64)
+	return seq, err == nil
+}
+
+// Handler for catching a device up on what it missed
+func syncChanges(w http.ResponseWriter, r *http.Request) {
+	session, ok := authenticateSession(w, r)
+	if !ok {
+		return
+	}
+
+	since := session.SyncSeq
+	if token := r.URL.Query().Get("since"); token != "" {
+		seq, valid := parseSyncToken(token)
+		if !valid {
+			writeError(w, http.StatusBadRequest, "invalid_parameter", "Invalid sync token", "since")
+			return
+		}
+		since = seq
+	}
+
+	// One more than a page is read to tell whether there are more
+	now := time.Now()
+	forSession := func(change Change) bool {
+		return containsString(change.Users, session.UserId) && (change.Message == nil || !change.Message.Expired(now))
+	}
+
+	storeMu.Lock()
+	if err := openChangeLog(); err != nil {
+		storeMu.Unlock()
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error reading "+changeLogFile+": "+err.Error(), "")
+		return
+	}
+	head, floor := changeSeq, changeFloor
+	var changes []Change
+	var err error
+	if since >= floor && since < head {
+		changes, err = readChangesAfter(since, forSession, maxSyncChanges+1)
+	}
+	var recentChatsData RecentChatsData
+	if err == nil {
+		recentChatsData, err = currentRecentChats()
+	}
+	storeMu.Unlock()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error reading changes: "+err.Error(), "")
+		return
+	}
+
+	// A token from before the oldest kept change, or from another server,
+	// can't be caught up; the device reloads instead
+	reset := since < floor || since > head
+	position := head
+	more := len(changes) > maxSyncChanges
+	if more {
+		changes = changes[:maxSyncChanges]
+		position = changes[len(changes)-1].Seq
+	}
+
+	result := []SyncChange{}
+	for _, change := range changes {
+		if change.Message != nil {
+			content, err := openText(change.Message.Content, envelope.MessageContext(change.Message.Id))
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, "internal_error", "Error decrypting change: "+err.Error(), "")
+				return
+			}
+			change.Message.Content = content
+		}
+		result = append(result, SyncChange{
+			Type:      change.Type,
+			Message:   change.Message,
+			UserId:    change.UserId,
+			ContactId: change.ContactId,
+			Time:      change.Time,
+		})
+	}
+
+	if err := updateSession(session.Id, func(s *Session) {
+		s.SyncSeq = position
+		s.LastSeenAt = now
+	}); err != nil {
+		fmt.Println("Error updating session:", err)
+	}
+
+	response := map[string]interface{}{
+		"success":   true,
+		"syncToken": strconv.FormatUint(position, 10),
+		"changes":   result,
+		"more":      more,
+		"reset":     reset,
+	}
+	// Recent chats come along whenever they may have changed
+	if reset || len(result) > 0 {
+		userRecentChats := []RecentChat{}
+		for _, chat := range recentChatsData.Chats {
+			if chat.UserId == session.UserId {
+				userRecentChats = append(userRecentChats, chat)
+			}
+		}
+		sort.Slice(userRecentChats, func(i, j int) bool {
+			return userRecentChats[i].Timestamp.After(userRecentChats[j].Timestamp)
+		})
+		response["recentChats"] = userRecentChats
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// Whether a list holds a string
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Blank out the changes matching drop. The records stay so the sequence
+// numbers don't move. The caller must hold storeMu.
+func purgeChanges(drop func(Change) bool) error {
+	changes, err := readChangeLog()
+	if err != nil {
+		return err
+	}
+	purged := false
+	var buf strings.Builder
+	for _, change := range changes {
+		if drop(change) {
+			change = Change{Seq: change.Seq, Type: change.Type, Users: []string{}, Time: change.Time}
+			purged = true
+		}
+		line, err := json.Marshal(change)
+		if err != nil {
+			return err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	if !purged {
+		return nil
+	}
+	changeLogOpen = false // The offsets have moved
+	return writeFileAtomic(changeLogFile, []byte(buf.String()), 0644)
+}
+
+// Blank out the changes involving deleted users. The caller must hold
+// storeMu.
+func purgeChangeLog(users map[string]bool) error {
+	return purgeChanges(func(change Change) bool {
+		for _, userId := range change.Users {
+			if users[userId] {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// Blank out the new-message changes of deleted messages, so the log
+// doesn't keep a copy of them. The caller must hold storeMu.
+func purgeDeletedMessages(deleted func(Message) bool) error {
+	return purgeChanges(func(change Change) bool {
+		return change.Message != nil && deleted(*change.Message)
+	})
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+type syncReply struct {
+	SyncToken string       `json:"syncToken"`
+	Changes   []SyncChange `json:"changes"`
+	More      bool         `json:"more"`
+	Reset     bool         `json:"reset"`
+}
+
+func syncAs(t *testing.T, userId, since string) syncReply {
+	t.Helper()
+	rec := apiRequest(t, http.MethodGet, "/api/v1/sync?since="+since, userId, "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("sync: status %d: %s", rec.Code, rec.Body.String())
+	}
+	var reply syncReply
+	if err := json.Unmarshal(rec.Body.Bytes(), &reply); err != nil {
+		t.Fatal(err)
+	}
+	return reply
+}
+
+// Pages follow on from each other, skipping other users' changes
+func TestSyncPaging(t *testing.T) {
+	useDataDir(t,
+		User{UserId: "alice", Password: "alice1234"},
+		User{UserId: "bob", Password: "bob12345"},
+		User{UserId: "carol", Password: "carol5678"},
+	)
+	const sent = maxSyncChanges + 20
+	for i := 0; i < sent; i++ {
+		if err := storeMessage(Message{Sender: "alice", Receiver: "bob", Content: fmt.Sprint(i), Timestamp: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+		if err := storeMessage(Message{Sender: "bob", Receiver: "carol", Content: "not for alice", Timestamp: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	first := syncAs(t, "alice", "0")
+	if len(first.Changes) != maxSyncChanges || !first.More {
+		t.Fatalf("first page: %d changes, more %v", len(first.Changes), first.More)
+	}
+	second := syncAs(t, "alice", first.SyncToken)
+	if len(second.Changes) != sent-maxSyncChanges || second.More {
+		t.Fatalf("second page: %d changes, more %v", len(second.Changes), second.More)
+	}
+	for i, change := range append(first.Changes, second.Changes...) {
+		if change.Message == nil || change.Message.Content != fmt.Sprint(i) {
+			t.Fatalf("change %d: %+v", i, change)
+		}
+	}
+	if last := syncAs(t, "alice", second.SyncToken); len(last.Changes) != 0 || last.SyncToken != second.SyncToken {
+		t.Errorf("caught-up sync returned %d changes and token %s", len(last.Changes), last.SyncToken)
+	}
+}
+
+// The change log must not keep copies of messages that have been deleted
+func TestChangeLogForgetsDeletedMessages(t *testing.T) {
+	useDataDir(t, User{UserId: "alice", Password: "alice1234"}, User{UserId: "bob", Password: "bob12345"})
+	if err := saveRetention(RetentionConfig{Users: []UserRetention{{UserId: "bob", RetentionRule: RetentionRule{Days: 1, Action: "delete"}}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	expiresAt := now.Add(time.Minute)
+	messages := []Message{
+		{Sender: "alice", Receiver: "bob", Content: "disappearing", Timestamp: now, ExpiresAt: &expiresAt},
+		{Sender: "bob", Receiver: "alice", Content: "old", Timestamp: now.Add(-48 * time.Hour)},
+		{Sender: "alice", Receiver: "bob", Content: "kept", Timestamp: now},
+	}
+	for _, message := range messages {
+		if err := storeMessage(message); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sweepExpiredMessages(now.Add(2 * time.Minute))
+	if _, _, err := compactMessages(now); err != nil {
+		t.Fatal(err)
+	}
+	log, err := os.ReadFile(changeLogFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, content := range []string{"disappearing", "old"} {
+		if strings.Contains(string(log), content) {
+			t.Errorf("change log still holds %q", content)
+		}
+	}
+
+	// The log was rewritten; changes after it must still be found
+	if err := storeMessage(Message{Sender: "bob", Receiver: "alice", Content: "after", Timestamp: now}); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, change := range syncAs(t, "alice", "0").Changes {
+		got = append(got, change.Message.Content)
+	}
+	if strings.Join(got, ", ") != "kept, after" {
+		t.Errorf("synced %v, want kept and after", got)
+	}
+}
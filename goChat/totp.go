@@ -0,0 +1,606 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Two-factor authentication with time-based one-time passwords (RFC 6238)
+// as shown by authenticator apps: HMAC-SHA1, six digits, 30-second steps.
+// Enrolling creates a secret that only takes effect once a code from it
+// has been entered, and hands out recovery codes, which are stored as
+// hashes and work once each. With 2FA on, a correct password at /login
+// only earns a short-lived challenge; the session is created at
+// /login/totp once the challenge is answered with a code.
+
+// TOTPSetupRequest struct for starting enrollment, and for the actions
+// that need the password
+type TOTPSetupRequest struct {
+	UserId   string `json:"userId"`
+	Password string `json:"password"`
+	Code     string `json:"code,omitempty"` // Authenticator or recovery code, where required
+}
+
+// TOTPEnableRequest struct for finishing enrollment with a first code
+type TOTPEnableRequest struct {
+	UserId string `json:"userId"`
+	Code   string `json:"code"`
+}
+
+// TOTPLoginRequest struct for the second login step
+type TOTPLoginRequest struct {
+	Challenge string `json:"challenge"`
+	Code      string `json:"code"` // Authenticator or recovery code
+}
+
+// TOTPStatus describes a user's two-factor settings
+type TOTPStatus struct {
+	Enabled           bool `json:"enabled"`
+	Pending           bool `json:"pending"` // Enrollment started but not confirmed
+	RecoveryCodesLeft int  `json:"recoveryCodesLeft"`
+}
+
+// TOTP parameters, fixed to what authenticator apps support
+const (
+	totpIssuer = "goChat"
+	totpDigits = 6
+	totpPeriod = 30 // Seconds
+	totpSkew   = 1  // Steps of clock drift accepted either way
+)
+
+// Recovery codes handed out at a time
+const recoveryCodeCount = 10
+
+// How long a login challenge stays valid and how many codes it accepts
+const (
+	loginChallengeTTL      = 5 * time.Minute
+	loginChallengeAttempts = 5
+)
+
+// loginChallenge is a password check waiting for its second factor
+type loginChallenge struct {
+	userId     string
+	deviceName string
+	expiresAt  time.Time
+	attempts   int
+}
+
+// Outstanding challenges by token hash. They only live for minutes, so a
+// restart simply asks for the password again.
+var (
+	loginChallengesMu sync.Mutex
+	loginChallenges   = map[string]*loginChallenge{}
+)
+
+// HOTP value (RFC 4226) for a counter: HMAC of the big-endian counter,
+// dynamically truncated to the given number of decimal digits
+func hotp(newHash func() hash.Hash, key []byte, counter uint64, digits int) string {
+	var message [8]byte
+	binary.BigEndian.PutUint64(message[:], counter)
+	mac := hmac.New(newHash, key)
+	mac.Write(message[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	modulus := uint32(1)
+	for i := 0; i < digits; i++ {
+		modulus *= 10
+	}
+	return fmt.Sprintf("%0*d", digits, value%modulus)
+}
+
+// Time step of a moment
+func totpCounter(t time.Time) uint64 {
+	return uint64(t.Unix()) / totpPeriod
+}
+
+// Current code for a base32 secret
+func totpCode(secret string, t time.Time) (string, error) {
+	key, err := decodeTOTPSecret(secret)
+	if err != nil {
+		return "", err
+	}
+	return hotp(sha1.New, key, totpCounter(t), totpDigits), nil
+}
+
+// Secrets are base32 without padding, as in otpauth:// URIs
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Decode a secret, tolerating the spaces and lower case people type
+func decodeTOTPSecret(secret string) ([]byte, error) {
+	return totpEncoding.DecodeString(strings.ToUpper(strings.ReplaceAll(secret, " ", "")))
+}
+
+// New random secret of 160 bits, the HMAC-SHA1 key size RFC 4226 recommends
+func newTOTPSecret() string {
+	key, _ := hex.DecodeString(randomHex(20))
+	return totpEncoding.EncodeToString(key)
+}
+
+// Key URI understood by authenticator apps, see
+// https://github.com/google/google-authenticator/wiki/Key-Uri-Format
+func totpURI(userId, secret string) string {
+	query := url.Values{
+		"secret":    {secret},
+		"issuer":    {totpIssuer},
+		"algorithm": {"SHA1"},
+		"digits":    {fmt.Sprint(totpDigits)},
+		"period":    {fmt.Sprint(totpPeriod)},
+	}
+	label := url.PathEscape(totpIssuer + ":" + userId)
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+// Check a code against the secret, allowing for clock drift. Returns the
+// matching time step, which must be later than the last one used so a
+// code can't be replayed.
+func verifyTOTP(secret, code string, lastCounter uint64, now time.Time) (uint64, bool) {
+	code = strings.ReplaceAll(code, " ", "")
+	if len(code) != totpDigits {
+		return 0, false
+	}
+	key, err := decodeTOTPSecret(secret)
+	if err != nil {
+		return 0, false
+	}
+	current := totpCounter(now)
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= lastCounter {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(hotp(sha1.New, key, step, totpDigits)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// Normalize a recovery code for hashing: "ABCD-1234" and "abcd1234" match
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+// Hash a recovery code for storage
+func hashRecoveryCode(code string) string {
+	sum := sha256.Sum256([]byte(normalizeRecoveryCode(code)))
+	return hex.EncodeToString(sum[:])
+}
+
+// New recovery codes, returned in the clear, and their hashes
+func newRecoveryCodes() ([]string, []string) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		raw := randomHex(5)
+		codes[i] = raw[:5] + "-" + raw[5:]
+		hashes[i] = hashRecoveryCode(codes[i])
+	}
+	return codes, hashes
+}
+
+// Check a second factor for an enrolled user: an authenticator code or an
+// unused recovery code. The used code is recorded on the user, who must
+// then be saved.
+func checkSecondFactor(user *User, code string, now time.Time) bool {
+	if step, ok := verifyTOTP(user.TOTPSecret, code, user.TOTPLastCounter, now); ok {
+		user.TOTPLastCounter = step
+		return true
+	}
+	hash := hashRecoveryCode(code)
+	for i, stored := range user.RecoveryCodes {
+		if subtle.ConstantTimeCompare([]byte(stored), []byte(hash)) == 1 {
+			user.RecoveryCodes = append(user.RecoveryCodes[:i:i], user.RecoveryCodes[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Check a code for the user and save what it used up. Returns false for a
+// wrong code or a user without 2FA. The check and the save happen under
+// usersMu, so racing requests can't both use the same code.
+func useSecondFactor(userId, code string) (bool, error) {
+	return useSecondFactorThen(userId, code, func(user *User) {})
+}
+
+// Like useSecondFactor, also applying then to the user when the code is
+// good, in the same update
+func useSecondFactorThen(userId, code string, then func(user *User)) (bool, error) {
+	ok := false
+	err := updateUser(userId, func(user *User) {
+		if ok = user.TOTPEnabled && checkSecondFactor(user, code, time.Now()); ok {
+			then(user)
+		}
+	})
+	return ok, err
+}
+
+// Start the second login step for a user whose password was correct.
+// Returns the challenge token.
+func newLoginChallenge(userId, deviceName string) string {
+	token := randomHex(32)
+	now := time.Now()
+
+	loginChallengesMu.Lock()
+	defer loginChallengesMu.Unlock()
+	for key, challenge := range loginChallenges {
+		if now.After(challenge.expiresAt) {
+			delete(loginChallenges, key)
+		}
+	}
+	loginChallenges[hashSessionToken(token)] = &loginChallenge{
+		userId:     userId,
+		deviceName: deviceName,
+		expiresAt:  now.Add(loginChallengeTTL),
+	}
+	return token
+}
+
+// Look up a challenge and count an attempt against it. Challenges that
+// are used up or expired are forgotten.
+func takeLoginChallenge(token string) (loginChallenge, bool) {
+	loginChallengesMu.Lock()
+	defer loginChallengesMu.Unlock()
+
+	key := hashSessionToken(token)
+	challenge, exists := loginChallenges[key]
+	if !exists {
+		return loginChallenge{}, false
+	}
+	challenge.attempts++
+	if time.Now().After(challenge.expiresAt) || challenge.attempts > loginChallengeAttempts {
+		delete(loginChallenges, key)
+		return loginChallenge{}, false
+	}
+	return *challenge, true
+}
+
+// Forget a challenge once it has been answered
+func dropLoginChallenge(token string) {
+	loginChallengesMu.Lock()
+	delete(loginChallenges, hashSessionToken(token))
+	loginChallengesMu.Unlock()
+}
+
+// Write the reply asking for the second factor. JSON clients get a 401
+// with the challenge; form posts go back to the login page, which asks
+// for the code and posts it to /login/totp.
+func writeTOTPRequired(w http.ResponseWriter, r *http.Request, isAjaxRequest bool, challenge string) {
+	if !isAjaxRequest {
+		http.Redirect(w, r, "/?error=totp_required&challenge="+url.QueryEscape(challenge), http.StatusFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnauthorized)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":   false,
+		"error":     APIError{Code: "totp_required", Message: "Enter the code from your authenticator app", Field: "code"},
+		"challenge": challenge,
+	})
+}
+
+// Handler for the second login step, for JSON and form posts like /login
+func loginTOTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Invalid request method", "")
+		return
+	}
+	isAjaxRequest := r.Header.Get("Content-Type") == "application/json"
+
+	var req TOTPLoginRequest
+	if isAjaxRequest {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_json", "Invalid JSON: "+err.Error(), "")
+			return
+		}
+	} else {
+		if err := r.ParseForm(); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_form", "Error parsing form data: "+err.Error(), "")
+			return
+		}
+		req.Challenge = r.FormValue("challenge")
+		req.Code = r.FormValue("code")
+	}
+
+	challenge, ok := takeLoginChallenge(req.Challenge)
+	if !ok {
+		fmt.Println("Expired or unknown login challenge")
+		if isAjaxRequest {
+			writeError(w, http.StatusUnauthorized, "challenge_expired", "Log in again with your password", "challenge")
+		} else {
+			http.Redirect(w, r, "/?error=challenge_expired", http.StatusFound)
+		}
+		return
+	}
+
+	ok, err := useSecondFactor(challenge.userId, req.Code)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error updating users.json: "+err.Error(), "")
+		return
+	}
+	if !ok {
+		fmt.Println("Wrong second factor for:", challenge.userId)
+		if isAjaxRequest {
+			writeError(w, http.StatusUnauthorized, "invalid_code", "The code is not valid", "code")
+		} else {
+			http.Redirect(w, r, "/?error=invalid_code&challenge="+url.QueryEscape(req.Challenge), http.StatusFound)
+		}
+		return
+	}
+	dropLoginChallenge(req.Challenge)
+
+	// The account may have been disabled since the password was checked
+	user, exists, err := findUser(challenge.userId)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error reading users.json: "+err.Error(), "")
+		return
+	}
+	if !exists || user.Disabled {
+		if isAjaxRequest {
+			writeError(w, http.StatusForbidden, "account_disabled", "This account has been disabled", "")
+		} else {
+			http.Redirect(w, r, "/?error=account_disabled", http.StatusFound)
+		}
+		return
+	}
+	completeLogin(w, r, user, challenge.deviceName, true, isAjaxRequest)
+}
+
+// Check the session and credentials of a 2FA settings request. Writes a
+// 401 or 403 and returns false if they are wrong.
+func authenticateTOTPRequest(w http.ResponseWriter, r *http.Request, userId, password string) (User, bool) {
+	if !requireSessionUser(w, r, userId, "userId") {
+		return User{}, false
+	}
+	user, exists, err := findUser(userId)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error reading users.json: "+err.Error(), "")
+		return User{}, false
+	}
+	if !exists || user.IsBot || user.Disabled || subtle.ConstantTimeCompare([]byte(user.Password), []byte(password)) != 1 {
+		writeError(w, http.StatusUnauthorized, "invalid_credentials", "Invalid username or password", "")
+		return User{}, false
+	}
+	return user, true
+}
+
+// Handler for starting enrollment. Returns the secret with its otpauth://
+// URI and QR code; 2FA is enabled once a code from it is entered. Starting
+// again replaces a pending secret.
+func setupTOTP(w http.ResponseWriter, r *http.Request) {
+	var req TOTPSetupRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_json", "Invalid JSON: "+err.Error(), "")
+		return
+	}
+	user, ok := authenticateTOTPRequest(w, r, req.UserId, req.Password)
+	if !ok {
+		return
+	}
+	if user.TOTPEnabled {
+		writeError(w, http.StatusConflict, "totp_enabled", "Two-factor authentication is already on", "")
+		return
+	}
+
+	secret := newTOTPSecret()
+	uri := totpURI(user.UserId, secret)
+	qr, err := encodeQR(uri)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error encoding QR code: "+err.Error(), "")
+		return
+	}
+	qrImage, err := qr.dataURI(6)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error encoding QR code: "+err.Error(), "")
+		return
+	}
+
+	err = updateUser(user.UserId, func(user *User) {
+		user.TOTPSecret = secret
+		user.TOTPLastCounter = 0
+	})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error updating users.json: "+err.Error(), "")
+		return
+	}
+
+	fmt.Println("Two-factor enrollment started for:", user.UserId)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":    true,
+		"secret":     secret,
+		"otpauthUri": uri,
+		"qrCode":     qrImage,   // PNG data: URI
+		"qrText":     qr.text(), // For terminals
+	})
+}
+
+// Handler for finishing enrollment with a code from the new secret.
+// Returns the recovery codes, which are shown only this once.
+func enableTOTP(w http.ResponseWriter, r *http.Request) {
+	var req TOTPEnableRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_json", "Invalid JSON: "+err.Error(), "")
+		return
+	}
+	if !requireSessionUser(w, r, req.UserId, "userId") || !requireUser(w, req.UserId, "userId") {
+		return
+	}
+
+	codes, hashes := newRecoveryCodes()
+	var problem string
+	err := updateUser(req.UserId, func(user *User) {
+		switch {
+		case user.TOTPEnabled:
+			problem = "totp_enabled"
+		case user.TOTPSecret == "":
+			problem = "totp_not_set_up"
+		default:
+			step, ok := verifyTOTP(user.TOTPSecret, req.Code, user.TOTPLastCounter, time.Now())
+			if !ok {
+				problem = "invalid_code"
+				return
+			}
+			user.TOTPEnabled = true
+			user.TOTPLastCounter = step
+			user.RecoveryCodes = hashes
+		}
+	})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error updating users.json: "+err.Error(), "")
+		return
+	}
+	switch problem {
+	case "totp_enabled":
+		writeError(w, http.StatusConflict, problem, "Two-factor authentication is already on", "")
+		return
+	case "totp_not_set_up":
+		writeError(w, http.StatusBadRequest, problem, "Start the setup first", "")
+		return
+	case "invalid_code":
+		writeError(w, http.StatusBadRequest, problem, "The code is not valid", "code")
+		return
+	}
+
+	fmt.Println("Two-factor authentication enabled for:", req.UserId)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":       true,
+		"recoveryCodes": codes,
+	})
+}
+
+// Handler for turning 2FA off, which takes the password and a code
+func disableTOTP(w http.ResponseWriter, r *http.Request) {
+	var req TOTPSetupRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_json", "Invalid JSON: "+err.Error(), "")
+		return
+	}
+	user, ok := authenticateTOTPRequest(w, r, req.UserId, req.Password)
+	if !ok {
+		return
+	}
+	if !user.TOTPEnabled {
+		writeError(w, http.StatusConflict, "totp_disabled", "Two-factor authentication is off", "")
+		return
+	}
+
+	ok, err := useSecondFactorThen(user.UserId, req.Code, clearTOTP)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error updating users.json: "+err.Error(), "")
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusBadRequest, "invalid_code", "The code is not valid", "code")
+		return
+	}
+
+	fmt.Println("Two-factor authentication disabled for:", user.UserId)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{"success": true})
+}
+
+// Handler for replacing the recovery codes, which takes the password and
+// a code. The old codes stop working.
+func regenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	var req TOTPSetupRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_json", "Invalid JSON: "+err.Error(), "")
+		return
+	}
+	user, ok := authenticateTOTPRequest(w, r, req.UserId, req.Password)
+	if !ok {
+		return
+	}
+	if !user.TOTPEnabled {
+		writeError(w, http.StatusConflict, "totp_disabled", "Two-factor authentication is off", "")
+		return
+	}
+
+	codes, hashes := newRecoveryCodes()
+	ok, err := useSecondFactorThen(user.UserId, req.Code, func(user *User) { user.RecoveryCodes = hashes })
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error updating users.json: "+err.Error(), "")
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusBadRequest, "invalid_code", "The code is not valid", "code")
+		return
+	}
+
+	fmt.Println("Recovery codes replaced for:", user.UserId)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":       true,
+		"recoveryCodes": codes,
+	})
+}
+
+// Handler for reading a user's 2FA settings
+func getTOTPStatus(w http.ResponseWriter, r *http.Request) {
+	userId := r.URL.Query().Get("user")
+	if userId == "" {
+		writeError(w, http.StatusBadRequest, "missing_parameter", "User ID is required", "user")
+		return
+	}
+	user, exists, err := findUser(userId)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error reading users.json: "+err.Error(), "")
+		return
+	}
+	if !exists {
+		writeError(w, http.StatusNotFound, "user_not_found", "User "+userId+" does not exist", "user")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"totp": TOTPStatus{
+			Enabled:           user.TOTPEnabled,
+			Pending:           !user.TOTPEnabled && user.TOTPSecret != "",
+			RecoveryCodesLeft: len(user.RecoveryCodes),
+		},
+	})
+}
+
+// Turn 2FA off for a user, forgetting the secret and recovery codes
+func clearTOTP(user *User) {
+	user.TOTPEnabled = false
+	user.TOTPSecret = ""
+	user.TOTPLastCounter = 0
+	user.RecoveryCodes = nil
+}
+
+// Handler for an admin turning off 2FA for a user who lost their
+// authenticator and recovery codes. They can enroll again after logging in.
+func adminResetTOTP(w http.ResponseWriter, r *http.Request) {
+	userId, ok := adminTargetUser(w, r)
+	if !ok {
+		return
+	}
+
+	if err := updateUser(userId, clearTOTP); err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error updating users.json: "+err.Error(), "")
+		return
+	}
+
+	fmt.Println("Two-factor authentication reset for:", userId)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{"success": true})
+}
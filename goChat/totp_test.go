@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"hash"
+	"sync"
+	"testing"
+	"time"
+)
+
+// RFC 6238 appendix B: the eight-digit codes for the test seeds at
+// several times, with each of the three hash functions
+var totpTestVectors = []struct {
+	unix   int64
+	sha1   string
+	sha256 string
+	sha512 string
+}{
+	{59, "94287082", "46119246", "90693936"},
+	{1111111109, "07081804", "68084774", "25091201"},
+	{1111111111, "14050471", "67062674", "99943326"},
+	{1234567890, "89005924", "91819424", "93441116"},
+	{2000000000, "69279037", "90698825", "38618901"},
+	{20000000000, "65353130", "77737706", "47863826"},
+}
+
+func TestTOTPVectors(t *testing.T) {
+	seeds := []struct {
+		name    string
+		newHash func() hash.Hash
+		key     string
+	}{
+		{"SHA1", sha1.New, "12345678901234567890"},
+		{"SHA256", sha256.New, "12345678901234567890123456789012"},
+		{"SHA512", sha512.New, "1234567890123456789012345678901234567890123456789012345678901234"},
+	}
+
+	for _, vector := range totpTestVectors {
+		counter := totpCounter(time.Unix(vector.unix, 0))
+		for i, expected := range []string{vector.sha1, vector.sha256, vector.sha512} {
+			seed := seeds[i]
+			if code := hotp(seed.newHash, []byte(seed.key), counter, 8); code != expected {
+				t.Errorf("%s at %d: expected %s, got %s", seed.name, vector.unix, expected, code)
+			}
+		}
+	}
+}
+
+func TestVerifyTOTP(t *testing.T) {
+	secret := newTOTPSecret()
+	now := time.Unix(1700000000, 0)
+	code := func(offset time.Duration) string {
+		c, err := totpCode(secret, now.Add(offset))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	step, ok := verifyTOTP(secret, code(0), 0, now)
+	if !ok || step != totpCounter(now) {
+		t.Fatalf("current code rejected")
+	}
+	if _, ok := verifyTOTP(secret, code(0), step, now); ok {
+		t.Errorf("replayed code accepted")
+	}
+	if _, ok := verifyTOTP(secret, code(-totpPeriod*time.Second), 0, now); !ok {
+		t.Errorf("code from the previous step rejected")
+	}
+	if _, ok := verifyTOTP(secret, code(-3*totpPeriod*time.Second), 0, now); ok {
+		t.Errorf("code from three steps ago accepted")
+	}
+	if _, ok := verifyTOTP(secret, "12345", 0, now); ok {
+		t.Errorf("short code accepted")
+	}
+}
+
+func TestRecoveryCodesAreSingleUse(t *testing.T) {
+	codes, hashes := newRecoveryCodes()
+	user := User{UserId: "alice", TOTPEnabled: true, TOTPSecret: newTOTPSecret(), RecoveryCodes: hashes}
+	now := time.Now()
+
+	// Recovery codes match regardless of case and separators
+	if !checkSecondFactor(&user, " "+codes[0][:5]+codes[0][6:]+" ", now) {
+		t.Fatalf("recovery code rejected")
+	}
+	if checkSecondFactor(&user, codes[0], now) {
+		t.Errorf("recovery code accepted twice")
+	}
+	if len(user.RecoveryCodes) != len(codes)-1 {
+		t.Errorf("%d recovery codes left, want %d", len(user.RecoveryCodes), len(codes)-1)
+	}
+}
+
+// Racing requests with the same code must not both get in
+func TestUseSecondFactorOnce(t *testing.T) {
+	secret := newTOTPSecret()
+	codes, hashes := newRecoveryCodes()
+	useDataDir(t, User{UserId: "alice", Password: "alice1234", TOTPEnabled: true, TOTPSecret: secret, RecoveryCodes: hashes})
+	current, err := totpCode(secret, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, code := range []string{current, codes[0]} {
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		accepted := 0
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				ok, err := useSecondFactor("alice", code)
+				if err != nil {
+					t.Error(err)
+				}
+				if ok {
+					mu.Lock()
+					accepted++
+					mu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+		if accepted != 1 {
+			t.Errorf("code %s accepted %d times", code, accepted)
+		}
+	}
+}
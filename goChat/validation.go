@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"gochat/internal/validate"
+)
+
+// Validation limits. The account limits are in internal/validate, shared
+// with gochat-admin.
+const (
+	maxMessageLength = 4000 // Measured in characters, not bytes
+
+	maxScheduleDistance = 365 * 24 * time.Hour // How far ahead a message can be scheduled
+)
+
+// ValidationErrors collects every field error found in a request
+type ValidationErrors []APIError
+
+// Error joins the field errors so ValidationErrors can be used as an error
+func (v ValidationErrors) Error() string {
+	parts := make([]string, 0, len(v))
+	for _, fe := range v {
+		parts = append(parts, fe.Field+": "+fe.Message)
+	}
+	return strings.Join(parts, "; ")
+}
+
+// add records a new error for the given field
+func (v *ValidationErrors) add(field, message string) {
+	*v = append(*v, APIError{Code: "invalid_field", Message: message, Field: field})
+}
+
+// status picks the HTTP status for the response: 404 when the only problem
+// is a reference to an unknown user, 400 otherwise
+func (v ValidationErrors) status() int {
+	for _, fe := range v {
+		if fe.Code != "user_not_found" {
+			return http.StatusBadRequest
+		}
+	}
+	return http.StatusNotFound
+}
+
+// redirectQuery encodes the errors for the form-post flow, e.g.
+// /?error=invalid_input&username=...&email=...
+func (v ValidationErrors) redirectQuery() string {
+	values := url.Values{}
+	values.Set("error", "invalid_input")
+	for _, fe := range v {
+		if values.Get(fe.Field) == "" {
+			values.Set(fe.Field, fe.Message)
+		}
+	}
+	return values.Encode()
+}
+
+// normalizeText converts input to Unicode NFC and trims surrounding whitespace
+func normalizeText(s string) string {
+	return validate.NormalizeText(s)
+}
+
+// validateUsername checks username length and allowed characters
+func validateUsername(username string, errs *ValidationErrors) {
+	if err := validate.Username(username); err != nil {
+		errs.add("username", err.Error())
+	}
+}
+
+// validateEmail parses the address according to RFC 5322
+func validateEmail(email string, errs *ValidationErrors) {
+	if err := validate.Email(email); err != nil {
+		errs.add("email", err.Error())
+	}
+}
+
+// validatePassword enforces the password policy
+func validatePassword(password, username string, errs *ValidationErrors) {
+	if err := validate.Password(password, username); err != nil {
+		errs.add("password", err.Error())
+	}
+}
+
+// validateRegistration normalizes a new user in place and validates every field
+func validateRegistration(user *User) ValidationErrors {
+	user.UserId = normalizeText(user.UserId)
+	user.Email = strings.ToLower(normalizeText(user.Email))
+	user.Password = validate.NormalizePassword(user.Password)
+
+	var errs ValidationErrors
+	validateUsername(user.UserId, &errs)
+	validateEmail(user.Email, &errs)
+	validatePassword(user.Password, user.UserId, &errs)
+	return errs
+}
+
+// validateMessage normalizes a message request in place and validates it,
+// including checking that the receiver is a registered user
+func validateMessage(msgReq *MessageRequest) (ValidationErrors, error) {
+	msgReq.Receiver = normalizeText(msgReq.Receiver)
+
+	var errs ValidationErrors
+	switch msgReq.Type {
+	case "":
+		msgReq.Content = normalizeText(msgReq.Content)
+		validateContent(msgReq.Content, &errs)
+	case messageTypeE2E:
+		// The envelope is opaque; only its encoding and size are checked
+		if msgReq.Content == "" {
+			errs.add("content", "Message cannot be empty")
+		} else if len(msgReq.Content) > maxEnvelopeLength {
+			errs.add("content", fmt.Sprintf("Encrypted message cannot be larger than %d KiB", maxEnvelopeLength>>10))
+		} else if _, err := base64.StdEncoding.DecodeString(msgReq.Content); err != nil {
+			errs.add("content", "Encrypted message must be base64")
+		}
+		if msgReq.SendAt != nil {
+			errs.add("sendAt", "Encrypted messages can't be scheduled")
+		}
+	default:
+		errs.add("type", `Type must be "e2e" or left out`)
+	}
+
+	if msgReq.SendAt != nil && msgReq.Type == "" {
+		now := time.Now()
+		if !msgReq.SendAt.After(now) {
+			errs.add("sendAt", "Scheduled time must be in the future")
+		} else if msgReq.SendAt.Sub(now) > maxScheduleDistance {
+			errs.add("sendAt", "Scheduled time can be at most a year away")
+		}
+	}
+
+	if msgReq.Receiver == "" {
+		errs.add("receiver", "Receiver is required")
+		return errs, nil
+	}
+
+	exists, err := userExists(msgReq.Receiver)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		errs = append(errs, APIError{Code: "user_not_found", Message: "Receiver does not exist", Field: "receiver"})
+	}
+	return errs, nil
+}
+
+// validateContent checks the text of a plaintext message
+func validateContent(content string, errs *ValidationErrors) {
+	if !utf8.ValidString(content) {
+		errs.add("content", "Message must be valid UTF-8")
+	} else if content == "" {
+		errs.add("content", "Message cannot be empty")
+	} else if utf8.RuneCountInString(content) > maxMessageLength {
+		errs.add("content", fmt.Sprintf("Message cannot be longer than %d characters", maxMessageLength))
+	} else {
+		for _, r := range content {
+			if unicode.IsControl(r) && r != '\n' && r != '\t' {
+				errs.add("content", "Message contains invalid control characters")
+				break
+			}
+		}
+	}
+}
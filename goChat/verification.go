@@ -0,0 +1,447 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"gochat/internal/validate"
+)
+
+// Registering sends a link that verifies the email address, and a
+// forgotten password is replaced through a link sent to a verified
+// address. The links carry a random token that is stored only as a hash
+// in account_tokens.json, works once, and expires. Only the newest token
+// of each kind is valid for an account.
+
+// AccountToken struct to store an outstanding verification or reset token
+type AccountToken struct {
+	Purpose   string    `json:"purpose"` // tokenVerifyEmail or tokenResetPassword
+	UserId    string    `json:"userId"`
+	Email     string    `json:"email"`     // Address the link was sent to
+	TokenHash string    `json:"tokenHash"` // SHA-256 of the token, which itself is never stored
+	CreatedAt time.Time `json:"createdAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// AccountTokensData struct to match our JSON structure
+type AccountTokensData struct {
+	Tokens []AccountToken `json:"tokens"`
+}
+
+// VerifyEmailRequest struct for redeeming a verification link
+type VerifyEmailRequest struct {
+	Token string `json:"token"`
+}
+
+// ForgotPasswordRequest struct for asking for a reset link. Login is the
+// user ID or the email address.
+type ForgotPasswordRequest struct {
+	Login string `json:"login"`
+}
+
+// ResetPasswordRequest struct for choosing a new password with a reset link
+type ResetPasswordRequest struct {
+	Token       string `json:"token"`
+	NewPassword string `json:"newPassword"`
+}
+
+// Token purposes
+const (
+	tokenVerifyEmail   = "verify-email"
+	tokenResetPassword = "reset-password"
+)
+
+// How long links stay valid, and how soon another one can be sent
+const (
+	verifyTokenTTL   = 48 * time.Hour
+	resetTokenTTL    = time.Hour
+	tokenResendDelay = time.Minute
+)
+
+// Base URL of the links in outgoing mail, set with -public-url
+var publicURL = "http://localhost:8080"
+
+// Guards account_tokens.json
+var accountTokensMu sync.Mutex
+
+// Returned by issueAccountToken when the last link went out too recently
+var errTokenTooSoon = errors.New("a link was sent less than a minute ago")
+
+// Read outstanding tokens from account_tokens.json
+func loadAccountTokens() (AccountTokensData, error) {
+	tokensData := AccountTokensData{Tokens: []AccountToken{}}
+
+	data, err := os.ReadFile("account_tokens.json")
+	if os.IsNotExist(err) {
+		return tokensData, nil
+	}
+	if err != nil {
+		return tokensData, err
+	}
+
+	err = json.Unmarshal(data, &tokensData)
+	return tokensData, err
+}
+
+// Write the tokens that haven't expired to account_tokens.json. Like
+// sessions.json, the file is only readable by the server.
+func saveAccountTokens(tokensData AccountTokensData, now time.Time) error {
+	live := []AccountToken{}
+	for _, token := range tokensData.Tokens {
+		if now.Before(token.ExpiresAt) {
+			live = append(live, token)
+		}
+	}
+	tokensData.Tokens = live
+
+	newData, err := json.MarshalIndent(tokensData, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic("account_tokens.json", newData, 0600)
+}
+
+// Create a token for the user, replacing any earlier one with the same
+// purpose. Returns errTokenTooSoon if the earlier one is very recent.
+func issueAccountToken(purpose, userId, email string, ttl time.Duration) (string, error) {
+	accountTokensMu.Lock()
+	defer accountTokensMu.Unlock()
+
+	tokensData, err := loadAccountTokens()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	others := []AccountToken{}
+	for _, token := range tokensData.Tokens {
+		if token.Purpose == purpose && token.UserId == userId {
+			if now.Sub(token.CreatedAt) < tokenResendDelay {
+				return "", errTokenTooSoon
+			}
+			continue
+		}
+		others = append(others, token)
+	}
+
+	secret := randomHex(32)
+	tokensData.Tokens = append(others, AccountToken{
+		Purpose:   purpose,
+		UserId:    userId,
+		Email:     email,
+		TokenHash: hashSessionToken(secret),
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	})
+	if err := saveAccountTokens(tokensData, now); err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+// Index of the token with the purpose and secret, or -1
+func indexAccountToken(tokensData AccountTokensData, purpose, secret string) int {
+	hash := hashSessionToken(secret)
+	for i, token := range tokensData.Tokens {
+		if token.Purpose == purpose && token.TokenHash == hash {
+			return i
+		}
+	}
+	return -1
+}
+
+// Look up a token without using it up. Returns false if it is unknown,
+// expired or already used.
+func findAccountToken(purpose, secret string) (AccountToken, bool, error) {
+	accountTokensMu.Lock()
+	tokensData, err := loadAccountTokens()
+	accountTokensMu.Unlock()
+	if err != nil {
+		return AccountToken{}, false, err
+	}
+	i := indexAccountToken(tokensData, purpose, secret)
+	if i < 0 || !time.Now().Before(tokensData.Tokens[i].ExpiresAt) {
+		return AccountToken{}, false, nil
+	}
+	return tokensData.Tokens[i], true, nil
+}
+
+// Use up a token. Returns false if it is unknown, expired or already used.
+func redeemAccountToken(purpose, secret string) (AccountToken, bool, error) {
+	accountTokensMu.Lock()
+	defer accountTokensMu.Unlock()
+
+	tokensData, err := loadAccountTokens()
+	if err != nil {
+		return AccountToken{}, false, err
+	}
+	i := indexAccountToken(tokensData, purpose, secret)
+	if i < 0 {
+		return AccountToken{}, false, nil
+	}
+
+	now := time.Now()
+	token := tokensData.Tokens[i]
+	tokensData.Tokens = append(tokensData.Tokens[:i], tokensData.Tokens[i+1:]...)
+	if err := saveAccountTokens(tokensData, now); err != nil {
+		return AccountToken{}, false, err
+	}
+	return token, now.Before(token.ExpiresAt), nil
+}
+
+// Remove the given users' tokens with the purpose, or all of them if
+// purpose is empty
+func revokeAccountTokens(users map[string]bool, purpose string) error {
+	accountTokensMu.Lock()
+	defer accountTokensMu.Unlock()
+
+	tokensData, err := loadAccountTokens()
+	if err != nil {
+		return err
+	}
+	remaining := []AccountToken{}
+	for _, token := range tokensData.Tokens {
+		if users[token.UserId] && (purpose == "" || token.Purpose == purpose) {
+			continue
+		}
+		remaining = append(remaining, token)
+	}
+	tokensData.Tokens = remaining
+	return saveAccountTokens(tokensData, time.Now())
+}
+
+// Link to the login page that redeems a token, e.g. /?verify=<token>
+func accountLink(param, secret string) string {
+	return strings.TrimRight(publicURL, "/") + "/?" + url.Values{param: {secret}}.Encode()
+}
+
+// Email the user a link to verify their address
+func sendVerificationMail(user User) error {
+	secret, err := issueAccountToken(tokenVerifyEmail, user.UserId, user.Email, verifyTokenTTL)
+	if err != nil {
+		return err
+	}
+	return mailer.Send(Mail{
+		To:      user.Email,
+		Subject: "Verify your goChat email address",
+		Body: fmt.Sprintf("Hi %s,\n\nPlease confirm that this is your email address by opening this link:\n\n%s\n\n"+
+			"The link works once and expires in %d hours. If you didn't sign up for goChat, you can ignore this message.\n",
+			user.UserId, accountLink("verify", secret), int(verifyTokenTTL.Hours())),
+	})
+}
+
+// Email the user a link to choose a new password
+func sendResetMail(user User) error {
+	secret, err := issueAccountToken(tokenResetPassword, user.UserId, user.Email, resetTokenTTL)
+	if err != nil {
+		return err
+	}
+	return mailer.Send(Mail{
+		To:      user.Email,
+		Subject: "Reset your goChat password",
+		Body: fmt.Sprintf("Hi %s,\n\nSomeone asked to reset the password of your goChat account. To choose a new one, open this link:\n\n%s\n\n"+
+			"The link works once and expires in %d minutes. If you didn't ask for this, you can ignore this message; your password stays the same.\n",
+			user.UserId, accountLink("reset", secret), int(resetTokenTTL.Minutes())),
+	})
+}
+
+// Handler for redeeming an email verification link
+func verifyEmail(w http.ResponseWriter, r *http.Request) {
+	var req VerifyEmailRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_json", "Invalid JSON: "+err.Error(), "")
+		return
+	}
+	if req.Token == "" {
+		writeError(w, http.StatusBadRequest, "missing_parameter", "Token is required", "token")
+		return
+	}
+
+	token, valid, err := redeemAccountToken(tokenVerifyEmail, req.Token)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error updating account_tokens.json: "+err.Error(), "")
+		return
+	}
+	if !valid {
+		writeError(w, http.StatusBadRequest, "invalid_token", "This link is invalid, expired or already used", "token")
+		return
+	}
+
+	// The link only verifies the address it was sent to
+	verified := false
+	err = updateUser(token.UserId, func(user *User) {
+		if user.Email == token.Email {
+			user.EmailVerified = true
+			verified = true
+		}
+	})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error updating users.json: "+err.Error(), "")
+		return
+	}
+	if !verified {
+		writeError(w, http.StatusBadRequest, "invalid_token", "This link is invalid, expired or already used", "token")
+		return
+	}
+
+	fmt.Println("Email verified for:", token.UserId)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"userId":  token.UserId,
+	})
+}
+
+// Handler for sending a new verification link, e.g. after the first expired
+func resendVerification(w http.ResponseWriter, r *http.Request) {
+	userId := r.URL.Query().Get("user")
+	if userId == "" {
+		writeError(w, http.StatusBadRequest, "missing_parameter", "User ID is required", "user")
+		return
+	}
+
+	user, exists, err := findUser(userId)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error reading users.json: "+err.Error(), "")
+		return
+	}
+	if !exists {
+		writeError(w, http.StatusNotFound, "user_not_found", "User "+userId+" does not exist", "user")
+		return
+	}
+	if user.Email == "" {
+		writeError(w, http.StatusBadRequest, "invalid_field", "This account has no email address", "user")
+		return
+	}
+	if user.EmailVerified {
+		writeError(w, http.StatusConflict, "already_verified", "The email address is already verified", "user")
+		return
+	}
+
+	if err := sendVerificationMail(user); err == errTokenTooSoon {
+		writeError(w, http.StatusTooManyRequests, "too_many_requests", "A link was sent less than a minute ago", "")
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error sending mail: "+err.Error(), "")
+		return
+	}
+
+	fmt.Println("Verification link sent again for:", userId)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{"success": true})
+}
+
+// Handler for asking for a password reset link. The reply is the same
+// whether or not an account matched, so it can't be used to find out who
+// is registered; mail only goes to verified addresses.
+func forgotPassword(w http.ResponseWriter, r *http.Request) {
+	var req ForgotPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_json", "Invalid JSON: "+err.Error(), "")
+		return
+	}
+	login := normalizeText(req.Login)
+	if login == "" {
+		writeError(w, http.StatusBadRequest, "missing_parameter", "User ID or email address is required", "login")
+		return
+	}
+
+	usersData, err := loadUsers()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error reading users.json: "+err.Error(), "")
+		return
+	}
+	for _, user := range usersData.Users {
+		if user.UserId != login && !strings.EqualFold(user.Email, login) {
+			continue
+		}
+		if user.IsBot || user.Disabled || !user.EmailVerified {
+			fmt.Println("No reset link for:", user.UserId)
+			continue
+		}
+		// Failures are logged but not reported, for the same reason
+		if err := sendResetMail(user); err != nil {
+			fmt.Printf("Error sending reset link to %s: %v\n", user.UserId, err)
+			continue
+		}
+		fmt.Println("Password reset link sent for:", user.UserId)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{"success": true})
+}
+
+// Handler for choosing a new password with a reset link. Every device of
+// the user is logged out.
+func resetPassword(w http.ResponseWriter, r *http.Request) {
+	var req ResetPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_json", "Invalid JSON: "+err.Error(), "")
+		return
+	}
+	if req.Token == "" {
+		writeError(w, http.StatusBadRequest, "missing_parameter", "Token is required", "token")
+		return
+	}
+
+	token, valid, err := findAccountToken(tokenResetPassword, req.Token)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error reading account_tokens.json: "+err.Error(), "")
+		return
+	}
+	if !valid {
+		writeError(w, http.StatusBadRequest, "invalid_token", "This link is invalid, expired or already used", "token")
+		return
+	}
+
+	// Check the password before using up the link, so a typo can be fixed
+	req.NewPassword = validate.NormalizePassword(req.NewPassword)
+	var errs ValidationErrors
+	validatePassword(req.NewPassword, token.UserId, &errs)
+	if len(errs) > 0 {
+		for i := range errs {
+			errs[i].Field = "newPassword"
+		}
+		writeValidationErrors(w, errs)
+		return
+	}
+
+	// Another request may have used it in the meantime
+	token, valid, err = redeemAccountToken(tokenResetPassword, req.Token)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error updating account_tokens.json: "+err.Error(), "")
+		return
+	}
+	if !valid {
+		writeError(w, http.StatusBadRequest, "invalid_token", "This link is invalid, expired or already used", "token")
+		return
+	}
+
+	err = updateUser(token.UserId, func(user *User) {
+		user.Password = req.NewPassword
+		user.MustResetPassword = false
+	})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error updating users.json: "+err.Error(), "")
+		return
+	}
+
+	if _, err := revokeUserSessions(map[string]bool{token.UserId: true}); err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error writing to sessions.json: "+err.Error(), "")
+		return
+	}
+
+	fmt.Println("Password reset with an emailed link for:", token.UserId)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"userId":  token.UserId,
+	})
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Verification and reset links go out through the mailer, work once and
+// expire
+func TestAccountLinks(t *testing.T) {
+	useDataDir(t)
+	post := func(target, body string) int {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, target, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		enforceSessions(setupAPIv1()).ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if status := post("/api/v1/register", `{"userId": "carol", "email": "Carol@Example.com", "password": "carol1234"}`); status != http.StatusOK {
+		t.Fatalf("register: %d", status)
+	}
+	mail, _ := os.ReadFile("mail.mbox")
+	if !strings.Contains(string(mail), "To: carol@example.com") {
+		t.Fatalf("no verification mail to carol:\n%s", mail)
+	}
+	verify := lastMailedToken("verify")
+	if verify == "" {
+		t.Fatal("verification mail has no link")
+	}
+
+	// Reset links only go to verified addresses
+	if status := post("/api/v1/password/forgot", `{"login": "carol"}`); status != http.StatusOK || lastMailedToken("reset") != "" {
+		t.Fatalf("forgot before verifying: %d, link %q", status, lastMailedToken("reset"))
+	}
+
+	if status := post("/api/v1/email/verify", `{"token": "`+verify+`"}`); status != http.StatusOK {
+		t.Fatalf("verify: %d", status)
+	}
+	if user, _, _ := findUser("carol"); !user.EmailVerified {
+		t.Error("email not verified")
+	}
+	if status := post("/api/v1/email/verify", `{"token": "`+verify+`"}`); status != http.StatusBadRequest {
+		t.Errorf("second use of the verification link: %d", status)
+	}
+
+	if status := post("/api/v1/password/forgot", `{"login": "carol@example.com"}`); status != http.StatusOK {
+		t.Fatalf("forgot: %d", status)
+	}
+	reset := lastMailedToken("reset")
+	if reset == "" {
+		t.Fatal("reset mail has no link")
+	}
+	// A rejected password leaves the link usable
+	if status := post("/api/v1/password/reset", `{"token": "`+reset+`", "newPassword": "short"}`); status != http.StatusBadRequest {
+		t.Errorf("weak password: %d", status)
+	}
+	if status := post("/api/v1/password/reset", `{"token": "`+reset+`", "newPassword": "carol5678"}`); status != http.StatusOK {
+		t.Fatalf("reset: %d", status)
+	}
+	if user, _, _ := findUser("carol"); user.Password != "carol5678" {
+		t.Error("password not changed")
+	}
+	if status := post("/api/v1/password/reset", `{"token": "`+reset+`", "newPassword": "carol9999"}`); status != http.StatusBadRequest {
+		t.Errorf("second use of the reset link: %d", status)
+	}
+
+	expired, err := issueAccountToken(tokenResetPassword, "carol", "carol@example.com", time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if status := post("/api/v1/password/reset", `{"token": "`+expired+`", "newPassword": "carol9999"}`); status != http.StatusBadRequest {
+		t.Errorf("expired reset link: %d", status)
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"gochat/internal/envelope"
+	"gochat/internal/store"
+)
+
+// New messages are appended to chats.log instead of rewriting chats.json;
+// the record format is in internal/store, which gochat-admin shares. Every
+// append is fsync'd before the message counts as stored. chats.json is the
+// compacted checkpoint: it records the sequence number of the last log
+// record folded into it, so records at or below that number are skipped
+// when the log is replayed. Any full write of chats.json through saveChats
+// is a checkpoint and empties the log. A crash during an append leaves a
+// torn final record, which is detected by its length or checksum and
+// truncated at startup.
+
+// Message log file, next to the checkpoint in chats.json
+const messageLogFile = store.LogFile
+
+// State of the open log, guarded by storeMu
+var (
+	messageLog *os.File
+	logSeq     uint64 // Sequence number of the last record written or checkpointed
+	logSize    int64  // Bytes of complete records in the log
+	logPending int    // Records appended since the last checkpoint
+)
+
+// Checkpoint schedule, set from the command line. A checkpoint is also
+// taken as soon as checkpointRecords messages are waiting in the log.
+var (
+	checkpointInterval = time.Minute
+	checkpointRecords  = 1000
+)
+
+// Read every complete record of the log. valid is the size of the intact
+// prefix; when it is smaller than the file, the rest is a torn or damaged
+// record. A missing log has no records.
+func readMessageLog() (records []store.LogRecord, valid int64, size int64, err error) {
+	return store.ReadLog(".")
+}
+
+// Open the log for appending, truncating a torn final record and picking
+// up the sequence numbers where they left off. The caller must hold
+// storeMu.
+func openMessageLog() error {
+	if messageLog != nil {
+		return nil
+	}
+
+	records, valid, size, err := readMessageLog()
+	if err != nil {
+		return err
+	}
+	if valid < size {
+		fmt.Printf("Truncating torn record at offset %d of %s (%d bytes)\n", valid, messageLogFile, size-valid)
+		if err := os.Truncate(messageLogFile, valid); err != nil {
+			return fmt.Errorf("truncating %s: %w", messageLogFile, err)
+		}
+	}
+
+	chatsData, err := loadChats()
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(messageLogFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("opening %s: %w", messageLogFile, err)
+	}
+	messageLog = file
+	logSize = valid
+	logSeq = chatsData.Checkpoint
+	logPending = 0
+	for _, record := range records {
+		if record.Seq > logSeq {
+			logSeq = record.Seq
+		}
+		if record.Seq > chatsData.Checkpoint {
+			logPending++
+		}
+	}
+	return nil
+}
+
+// Close the log; the next append or checkpoint reopens it. The caller
+// must hold storeMu.
+func closeMessageLog() {
+	if messageLog != nil {
+		messageLog.Close()
+		messageLog = nil
+	}
+}
+
+// Append a message to the log and wait for it to reach the disk. A failed
+// write is cut off again so later records don't end up behind a torn one.
+// The caller must hold storeMu.
+func appendMessageLog(message Message) error {
+	if err := openMessageLog(); err != nil {
+		return err
+	}
+
+	content, err := sealText(message.Content, envelope.MessageContext(message.Id))
+	if err != nil {
+		return fmt.Errorf("encrypting log record: %w", err)
+	}
+	message.Content = content
+	buf, err := store.EncodeLogRecord(store.LogRecord{Seq: logSeq + 1, Message: message})
+	if err != nil {
+		return fmt.Errorf("encoding log record: %w", err)
+	}
+	if _, err := messageLog.Write(buf); err != nil {
+		messageLog.Truncate(logSize)
+		return fmt.Errorf("writing to %s: %w", messageLogFile, err)
+	}
+	if err := messageLog.Sync(); err != nil {
+		messageLog.Truncate(logSize)
+		return fmt.Errorf("syncing %s: %w", messageLogFile, err)
+	}
+	logSeq++
+	logSize += int64(len(buf))
+	logPending++
+	return nil
+}
+
+// Messages in the log that are newer than the checkpoint, with their
+// bodies still as stored. The caller must hold storeMu.
+func replayMessageLog(checkpoint uint64) ([]Message, error) {
+	records, _, _, err := readMessageLog()
+	if err != nil {
+		return nil, err
+	}
+	var messages []Message
+	for _, record := range records {
+		if record.Seq > checkpoint {
+			messages = append(messages, record.Message)
+		}
+	}
+	return messages, nil
+}
+
+// Empty the log after a checkpoint has been written. The caller must hold
+// storeMu.
+func resetMessageLog() error {
+	if err := messageLog.Truncate(0); err != nil {
+		return fmt.Errorf("truncating %s: %w", messageLogFile, err)
+	}
+	logSize = 0
+	logPending = 0
+	return nil
+}
+
+// Fold the log into chats.json. The caller must hold storeMu.
+func checkpointMessageLog() error {
+	chatsData, err := loadChats()
+	if err != nil {
+		return err
+	}
+	return saveChats(chatsData)
+}
+
+// Run at startup: replay the log tail into chats.json
+func recoverMessageLog() error {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+
+	if err := openMessageLog(); err != nil {
+		return err
+	}
+	if logPending == 0 {
+		return nil
+	}
+	replayed := logPending
+	if err := checkpointMessageLog(); err != nil {
+		return err
+	}
+	fmt.Printf("Replayed %d messages from %s\n", replayed, messageLogFile)
+	return nil
+}
+
+// Checkpoint the log in the background whenever it holds messages. An
+// interval of 0 leaves checkpoints to the record limit.
+func startCheckpointer() {
+	if checkpointInterval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(checkpointInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			storeMu.Lock()
+			if logPending > 0 {
+				if err := checkpointMessageLog(); err != nil {
+					fmt.Println("Error checkpointing the message log:", err)
+				}
+			}
+			storeMu.Unlock()
+		}
+	}()
+}
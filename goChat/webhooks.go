@@ -0,0 +1,506 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"gochat/internal/envelope"
+	"gochat/internal/store"
+)
+
+// Webhook struct to store an outgoing webhook registration
+type Webhook struct {
+	Id        string    `json:"id"`
+	Owner     string    `json:"owner"`               // User who registered the webhook, or adminWebhookOwner of an admin
+	UserId    string    `json:"userId"`              // Messages sent to or by this user trigger the webhook
+	ContactId string    `json:"contactId,omitempty"` // If set, only the conversation between UserId and ContactId
+	URL       string    `json:"url"`
+	Secret    string    `json:"secret,omitempty"` // HMAC key, only returned when the webhook is created
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Admin webhooks are owned by adminWebhookPrefix and the admin's ID. User
+// IDs can't contain a colon, so the user endpoints never see them, not even
+// through the admin's own account.
+const adminWebhookPrefix = "admin:"
+
+func adminWebhookOwner(adminId string) string {
+	return adminWebhookPrefix + adminId
+}
+
+// WebhooksData struct to match our JSON structure
+type WebhooksData struct {
+	Webhooks []Webhook `json:"webhooks"`
+}
+
+// WebhookRequest struct for registering a webhook
+type WebhookRequest struct {
+	URL       string `json:"url"`
+	ContactId string `json:"contactId,omitempty"`
+}
+
+// WebhookEvent is the JSON body POSTed to webhook URLs; a DeadLetter
+// records a delivery that failed every attempt
+type (
+	WebhookEvent = store.WebhookEvent
+	DeadLetter   = store.DeadLetter
+)
+
+// Delivery settings. Attempt n waits webhookBaseBackoff * 2^(n-1) before retrying.
+// The client dials directly, without a proxy, so every address it connects
+// to goes through checkWebhookDial.
+var (
+	webhookMaxAttempts = 5
+	webhookBaseBackoff = 2 * time.Second
+	webhookClient      = &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			DialContext:         (&net.Dialer{Timeout: 5 * time.Second, Control: checkWebhookDial}).DialContext,
+			TLSHandshakeTimeout: 5 * time.Second,
+		},
+	}
+)
+
+// Address ranges that aren't on the public internet, besides those the
+// net.IP methods already recognise
+var nonPublicNets = []*net.IPNet{
+	mustParseCIDR("0.0.0.0/8"),     // "This network"
+	mustParseCIDR("100.64.0.0/10"), // Carrier-grade NAT
+	mustParseCIDR("240.0.0.0/4"),   // Reserved, and the broadcast address
+}
+
+func mustParseCIDR(cidr string) *net.IPNet {
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		panic(err)
+	}
+	return ipNet
+}
+
+// Whether webhooks may be delivered to an address. Only public addresses
+// are allowed, so a webhook can't be used to reach services on the
+// server's own network. Tests replace this to use a local receiver.
+var webhookAddressAllowed = func(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsMulticast() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() {
+		return false
+	}
+	for _, ipNet := range nonPublicNets {
+		if ipNet.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// Refuse to connect to a non-public address. This runs on every dial, so
+// it also catches names that resolved to a public address at registration
+// but don't any more, and redirects.
+func checkWebhookDial(network, address string, conn syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !webhookAddressAllowed(ip) {
+		return fmt.Errorf("webhook address %s is not public", host)
+	}
+	return nil
+}
+
+// Check that a webhook host resolves only to public addresses
+func checkWebhookHost(host string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return fmt.Errorf("can't resolve %s", host)
+	}
+	for _, addr := range addrs {
+		if !webhookAddressAllowed(addr.IP) {
+			return fmt.Errorf("%s is not a public address", host)
+		}
+	}
+	return nil
+}
+
+// Guards webhooks.json and the dead-letter log
+var (
+	webhooksMu   sync.Mutex
+	deadLetterMu sync.Mutex
+)
+
+// Generate a random hex identifier with n bytes of entropy
+func randomHex(n int) string {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		panic("crypto/rand failed: " + err.Error())
+	}
+	return hex.EncodeToString(buf)
+}
+
+// Read all webhooks from webhooks.json
+func loadWebhooks() (WebhooksData, error) {
+	webhooksData := WebhooksData{Webhooks: []Webhook{}}
+
+	data, err := os.ReadFile("webhooks.json")
+	if os.IsNotExist(err) {
+		return webhooksData, nil
+	}
+	if err != nil {
+		return webhooksData, err
+	}
+
+	err = json.Unmarshal(data, &webhooksData)
+	return webhooksData, err
+}
+
+// Write all webhooks to webhooks.json. The file holds signing secrets, so
+// it's only readable by the server's user.
+func saveWebhooks(webhooksData WebhooksData) error {
+	newData, err := json.MarshalIndent(webhooksData, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic("webhooks.json", newData, 0600)
+}
+
+// Check whether a message should trigger the webhook
+func (hook Webhook) matches(msg Message) bool {
+	switch hook.UserId {
+	case msg.Sender:
+		return hook.ContactId == "" || hook.ContactId == msg.Receiver
+	case msg.Receiver:
+		return hook.ContactId == "" || hook.ContactId == msg.Sender
+	}
+	return false
+}
+
+// Compute the signature header value for a delivery. The timestamp is
+// signed with the body so receivers can reject replayed deliveries.
+func signWebhookPayload(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Queue deliveries of a new-message event to every matching webhook.
+// Deliveries run in the background and never delay the sender.
+func dispatchMessageEvent(msg Message) {
+	webhooksMu.Lock()
+	webhooksData, err := loadWebhooks()
+	webhooksMu.Unlock()
+	if err != nil {
+		fmt.Println("Error reading webhooks.json:", err)
+		return
+	}
+
+	for _, hook := range webhooksData.Webhooks {
+		if !hook.matches(msg) {
+			continue
+		}
+		event := WebhookEvent{
+			Id:        randomHex(16),
+			Type:      "message.created",
+			CreatedAt: time.Now(),
+			Message:   msg,
+		}
+		go deliverWebhook(hook, event)
+	}
+}
+
+// Deliver one event, retrying with exponential backoff. After the last
+// failed attempt the event is written to the dead-letter log.
+func deliverWebhook(hook Webhook, event WebhookEvent) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		fmt.Println("Error encoding webhook event:", err)
+		return
+	}
+
+	var lastErr error
+	for attempt := 1; attempt <= webhookMaxAttempts; attempt++ {
+		lastErr = postWebhook(hook, event, body)
+		if lastErr == nil {
+			fmt.Printf("Webhook %s delivered event %s (attempt %d)\n", hook.Id, event.Id, attempt)
+			return
+		}
+
+		fmt.Printf("Webhook %s delivery attempt %d failed: %v\n", hook.Id, attempt, lastErr)
+		if attempt < webhookMaxAttempts {
+			time.Sleep(webhookBaseBackoff << (attempt - 1))
+		}
+	}
+
+	recordDeadLetter(DeadLetter{
+		WebhookId: hook.Id,
+		URL:       hook.URL,
+		Attempts:  webhookMaxAttempts,
+		LastError: lastErr.Error(),
+		FailedAt:  time.Now(),
+		Event:     event,
+	})
+}
+
+// Make a single signed POST to the webhook URL
+func postWebhook(hook Webhook, event WebhookEvent, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-GoChat-Event", event.Type)
+	req.Header.Set("X-GoChat-Delivery", event.Id)
+	req.Header.Set("X-GoChat-Timestamp", strconv.FormatInt(timestamp, 10))
+	req.Header.Set("X-GoChat-Signature", signWebhookPayload(hook.Secret, timestamp, body))
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("receiver returned %s", resp.Status)
+	}
+	return nil
+}
+
+// Append a failed delivery to webhook_deadletter.jsonl, one JSON object per line
+func recordDeadLetter(letter DeadLetter) {
+	deadLetterMu.Lock()
+	defer deadLetterMu.Unlock()
+
+	content, err := sealText(letter.Event.Message.Content, envelope.MessageContext(letter.Event.Message.Id))
+	if err != nil {
+		fmt.Println("Error encrypting dead letter:", err)
+		return
+	}
+	letter.Event.Message.Content = content
+	line, err := json.Marshal(letter)
+	if err != nil {
+		fmt.Println("Error encoding dead letter:", err)
+		return
+	}
+
+	file, err := os.OpenFile("webhook_deadletter.jsonl", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		fmt.Println("Error opening webhook_deadletter.jsonl:", err)
+		return
+	}
+	defer file.Close()
+
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		fmt.Println("Error writing to webhook_deadletter.jsonl:", err)
+		return
+	}
+	fmt.Printf("Webhook %s gave up on event %s; recorded in dead-letter log\n", letter.WebhookId, letter.Event.Id)
+}
+
+// Handler for registering a webhook for the user's messages
+func registerWebhook(w http.ResponseWriter, r *http.Request) {
+	userId := r.URL.Query().Get("user")
+	if userId == "" {
+		writeError(w, http.StatusBadRequest, "missing_parameter", "User ID is required", "user")
+		return
+	}
+	if !requireSessionUser(w, r, userId, "user") || !requireUser(w, userId, "user") {
+		return
+	}
+	addWebhook(w, r, userId, userId)
+}
+
+// Handler for an admin registering a webhook for any user's messages. The
+// webhook belongs to the admin, not the user, and is only managed through
+// the admin endpoints.
+func adminRegisterWebhook(w http.ResponseWriter, r *http.Request) {
+	adminId, _, _ := r.BasicAuth()
+	userId := r.URL.Query().Get("user")
+	if userId == "" {
+		writeError(w, http.StatusBadRequest, "missing_parameter", "User ID is required", "user")
+		return
+	}
+	if !requireUser(w, userId, "user") {
+		return
+	}
+	addWebhook(w, r, adminWebhookOwner(adminId), userId)
+}
+
+// Register a webhook on the messages of userId from the request body
+func addWebhook(w http.ResponseWriter, r *http.Request, owner, userId string) {
+	var hookReq WebhookRequest
+	if err := json.NewDecoder(r.Body).Decode(&hookReq); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_json", "Invalid JSON: "+err.Error(), "")
+		return
+	}
+
+	target, err := url.Parse(hookReq.URL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		writeError(w, http.StatusBadRequest, "invalid_field", "Webhook URL must be an absolute http or https URL", "url")
+		return
+	}
+	if err := checkWebhookHost(target.Hostname()); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_field", "Webhook URL must point at a public address: "+err.Error(), "url")
+		return
+	}
+	if hookReq.ContactId != "" && !requireUser(w, hookReq.ContactId, "contactId") {
+		return
+	}
+
+	hook := Webhook{
+		Id:        randomHex(8),
+		Owner:     owner,
+		UserId:    userId,
+		ContactId: hookReq.ContactId,
+		URL:       target.String(),
+		Secret:    randomHex(32),
+		CreatedAt: time.Now(),
+	}
+
+	webhooksMu.Lock()
+	webhooksData, err := loadWebhooks()
+	if err == nil {
+		webhooksData.Webhooks = append(webhooksData.Webhooks, hook)
+		err = saveWebhooks(webhooksData)
+	}
+	webhooksMu.Unlock()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error updating webhooks.json: "+err.Error(), "")
+		return
+	}
+
+	fmt.Printf("Webhook %s registered by %s for %s\n", hook.Id, owner, hook.URL)
+
+	// The secret is only ever shown in this response
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"webhook": hook,
+	})
+}
+
+// Handler for listing the webhooks a user registered
+func listWebhooks(w http.ResponseWriter, r *http.Request) {
+	userId := r.URL.Query().Get("user")
+	if userId == "" {
+		writeError(w, http.StatusBadRequest, "missing_parameter", "User ID is required", "user")
+		return
+	}
+	if !requireSessionUser(w, r, userId, "user") {
+		return
+	}
+	writeWebhooks(w, userId)
+}
+
+// Handler for listing the webhooks the admin registered
+func adminListWebhooks(w http.ResponseWriter, r *http.Request) {
+	adminId, _, _ := r.BasicAuth()
+	writeWebhooks(w, adminWebhookOwner(adminId))
+}
+
+// Respond with the webhooks belonging to owner
+func writeWebhooks(w http.ResponseWriter, owner string) {
+	webhooksMu.Lock()
+	webhooksData, err := loadWebhooks()
+	webhooksMu.Unlock()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error reading webhooks.json: "+err.Error(), "")
+		return
+	}
+
+	userWebhooks := []Webhook{}
+	for _, hook := range webhooksData.Webhooks {
+		if hook.Owner == owner {
+			hook.Secret = "" // Never reveal secrets after creation
+			userWebhooks = append(userWebhooks, hook)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":  true,
+		"webhooks": userWebhooks,
+	})
+}
+
+// Handler for deleting one of the user's webhooks
+func deleteWebhook(w http.ResponseWriter, r *http.Request) {
+	userId := r.URL.Query().Get("user")
+	hookId := r.URL.Query().Get("id")
+	if userId == "" || hookId == "" {
+		field := "user"
+		if userId != "" {
+			field = "id"
+		}
+		writeError(w, http.StatusBadRequest, "missing_parameter", "Missing user or webhook ID", field)
+		return
+	}
+	if !requireSessionUser(w, r, userId, "user") {
+		return
+	}
+	removeWebhook(w, userId, hookId)
+}
+
+// Handler for deleting one of the admin's webhooks
+func adminDeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	adminId, _, _ := r.BasicAuth()
+	hookId := r.URL.Query().Get("id")
+	if hookId == "" {
+		writeError(w, http.StatusBadRequest, "missing_parameter", "Webhook ID is required", "id")
+		return
+	}
+	removeWebhook(w, adminWebhookOwner(adminId), hookId)
+}
+
+// Delete a webhook if it belongs to owner
+func removeWebhook(w http.ResponseWriter, owner, hookId string) {
+	webhooksMu.Lock()
+	defer webhooksMu.Unlock()
+
+	webhooksData, err := loadWebhooks()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error reading webhooks.json: "+err.Error(), "")
+		return
+	}
+
+	remaining := []Webhook{}
+	found := false
+	for _, hook := range webhooksData.Webhooks {
+		if hook.Id == hookId && hook.Owner == owner {
+			found = true
+			continue
+		}
+		remaining = append(remaining, hook)
+	}
+	if !found {
+		writeError(w, http.StatusNotFound, "webhook_not_found", "No such webhook", "id")
+		return
+	}
+
+	webhooksData.Webhooks = remaining
+	if err := saveWebhooks(webhooksData); err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error writing to webhooks.json: "+err.Error(), "")
+		return
+	}
+
+	fmt.Printf("Webhook %s deleted by %s\n", hookId, owner)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{"success": true})
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Let webhooks reach the loopback receivers these tests start
+func allowLoopbackWebhooks(t *testing.T) {
+	previous := webhookAddressAllowed
+	webhookAddressAllowed = func(ip net.IP) bool { return ip.IsLoopback() }
+	t.Cleanup(func() { webhookAddressAllowed = previous })
+}
+
+// Register a webhook and return it, secret included
+func mustRegisterWebhook(t *testing.T, target, userId, url string) Webhook {
+	t.Helper()
+	rec := apiRequest(t, http.MethodPost, target, userId, `{"url":"`+url+`"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("registering %s: status %d: %s", url, rec.Code, rec.Body.String())
+	}
+	var reply struct {
+		Webhook Webhook `json:"webhook"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &reply); err != nil {
+		t.Fatal(err)
+	}
+	return reply.Webhook
+}
+
+var webhookUsers = []User{
+	{UserId: "alice", Password: "alice1234"},
+	{UserId: "bob", Password: "bob12345"},
+	{UserId: "root", Password: "root1234", IsAdmin: true},
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	useDataDir(t, webhookUsers...)
+	allowLoopbackWebhooks(t)
+	webhookBaseBackoff = time.Millisecond
+	t.Cleanup(func() { webhookBaseBackoff = 2 * time.Second })
+
+	// The receiver fails the first attempt so the retry is exercised
+	type delivery struct {
+		header http.Header
+		body   []byte
+	}
+	deliveries := make(chan delivery, 10)
+	attempts := 0
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		attempts++
+		if attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		deliveries <- delivery{r.Header, body}
+	}))
+	defer receiver.Close()
+
+	hook := mustRegisterWebhook(t, "/api/v1/register-webhook?user=alice", "alice", receiver.URL)
+	adminHook := mustRegisterWebhook(t, "/api/v1/admin/register-webhook?user=bob", "", receiver.URL+"/admin")
+	if hook.Secret == "" || adminHook.Owner != "admin:root" || adminHook.UserId != "bob" {
+		t.Fatalf("unexpected webhooks %+v and %+v", hook, adminHook)
+	}
+
+	dispatchMessageEvent(Message{Sender: "alice", Receiver: "carol", Content: "hello", Timestamp: time.Now()})
+	select {
+	case d := <-deliveries:
+		timestamp, _ := strconv.ParseInt(d.header.Get("X-GoChat-Timestamp"), 10, 64)
+		if signature := signWebhookPayload(hook.Secret, timestamp, d.body); d.header.Get("X-GoChat-Signature") != signature {
+			t.Errorf("signature %q, want %q", d.header.Get("X-GoChat-Signature"), signature)
+		}
+		var event WebhookEvent
+		if err := json.Unmarshal(d.body, &event); err != nil {
+			t.Fatal(err)
+		}
+		if event.Type != "message.created" || event.Message.Content != "hello" || d.header.Get("X-GoChat-Delivery") != event.Id {
+			t.Errorf("unexpected event %+v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no delivery")
+	}
+	if attempts != 2 {
+		t.Errorf("%d attempts, want 2", attempts)
+	}
+	select {
+	case <-deliveries:
+		t.Errorf("bob's webhook fired for a message bob wasn't part of")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestWebhookDeadLetter(t *testing.T) {
+	useDataDir(t, webhookUsers...)
+	allowLoopbackWebhooks(t)
+	webhookBaseBackoff = time.Millisecond
+	webhookMaxAttempts = 2
+	t.Cleanup(func() {
+		webhookBaseBackoff = 2 * time.Second
+		webhookMaxAttempts = 5
+	})
+
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer receiver.Close()
+	hook := mustRegisterWebhook(t, "/api/v1/register-webhook?user=alice", "alice", receiver.URL)
+
+	deliverWebhook(hook, WebhookEvent{Id: "event1", Type: "message.created", Message: Message{Sender: "alice", Receiver: "bob", Content: "hi"}})
+	file, err := os.Open("webhook_deadletter.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	if !scanner.Scan() {
+		t.Fatal("dead-letter log is empty")
+	}
+	var letter DeadLetter
+	if err := json.Unmarshal(scanner.Bytes(), &letter); err != nil {
+		t.Fatal(err)
+	}
+	if letter.WebhookId != hook.Id || letter.Attempts != 2 || letter.Event.Id != "event1" {
+		t.Errorf("unexpected dead letter %+v", letter)
+	}
+}
+
+func TestWebhookAccess(t *testing.T) {
+	useDataDir(t, webhookUsers...)
+	publicURL := "http://93.184.216.34/hook"
+	hook := mustRegisterWebhook(t, "/api/v1/register-webhook?user=alice", "alice", publicURL)
+	adminHook := mustRegisterWebhook(t, "/api/v1/admin/register-webhook?user=alice", "", publicURL)
+
+	// The admin's own account doesn't see the admin webhooks
+	rec := apiRequest(t, http.MethodGet, "/api/v1/list-webhooks?user=root", "root", "")
+	if rec.Code != http.StatusOK || strings.Contains(rec.Body.String(), adminHook.Id) {
+		t.Errorf("listing as the admin user: %d %s", rec.Code, rec.Body)
+	}
+
+	cases := []struct {
+		name   string
+		method string
+		target string
+		userId string
+		body   string
+		status int
+	}{
+		{"registering for someone else", http.MethodPost, "/api/v1/register-webhook?user=alice", "bob", `{"url":"` + publicURL + `"}`, http.StatusForbidden},
+		{"loopback", http.MethodPost, "/api/v1/register-webhook?user=alice", "alice", `{"url":"http://127.0.0.1:8080/"}`, http.StatusBadRequest},
+		{"IPv6 loopback", http.MethodPost, "/api/v1/register-webhook?user=alice", "alice", `{"url":"http://[::1]/"}`, http.StatusBadRequest},
+		{"private", http.MethodPost, "/api/v1/register-webhook?user=alice", "alice", `{"url":"https://10.1.2.3/"}`, http.StatusBadRequest},
+		{"link-local", http.MethodPost, "/api/v1/register-webhook?user=alice", "alice", `{"url":"http://169.254.169.254/latest/meta-data/"}`, http.StatusBadRequest},
+		{"localhost", http.MethodPost, "/api/v1/admin/register-webhook?user=alice", "", `{"url":"http://localhost/"}`, http.StatusBadRequest},
+		{"listing someone else's", http.MethodGet, "/api/v1/list-webhooks?user=alice", "bob", "", http.StatusForbidden},
+		{"deleting someone else's", http.MethodPost, "/api/v1/delete-webhook?user=alice&id=" + hook.Id, "bob", "", http.StatusForbidden},
+		{"deleting as the wrong owner", http.MethodPost, "/api/v1/delete-webhook?user=bob&id=" + hook.Id, "bob", "", http.StatusNotFound},
+		{"deleting the admin's", http.MethodPost, "/api/v1/delete-webhook?user=alice&id=" + adminHook.Id, "alice", "", http.StatusNotFound},
+		{"deleting the admin's as the admin user", http.MethodPost, "/api/v1/delete-webhook?user=root&id=" + adminHook.Id, "root", "", http.StatusNotFound},
+		{"deleting own", http.MethodPost, "/api/v1/delete-webhook?user=alice&id=" + hook.Id, "alice", "", http.StatusOK},
+		{"admin deleting own", http.MethodPost, "/api/v1/admin/delete-webhook?id=" + adminHook.Id, "", "", http.StatusOK},
+	}
+	for _, c := range cases {
+		if rec := apiRequest(t, c.method, c.target, c.userId, c.body); rec.Code != c.status {
+			t.Errorf("%s: status %d, want %d: %s", c.name, rec.Code, c.status, strings.TrimSpace(rec.Body.String()))
+		}
+	}
+
+	// Names that resolve to a public address at registration are still
+	// checked when delivering
+	err := postWebhook(Webhook{URL: "http://127.0.0.1:1/", Secret: "secret"}, WebhookEvent{}, []byte("{}"))
+	if err == nil || !strings.Contains(err.Error(), "not public") {
+		t.Errorf("delivery to loopback: got %v", err)
+	}
+}